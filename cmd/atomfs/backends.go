@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/urfave/cli"
+	"machinerun.io/atomfs/pkg/fs"
+)
+
+var backendsCmd = cli.Command{
+	Name:   "backends",
+	Usage:  "list the registered filesystem backends and which of their extractors can be used",
+	Action: doBackends,
+}
+
+func doBackends(ctx *cli.Context) error {
+	for _, b := range fs.Backends() {
+		reader := "no"
+		if b.NewReader != nil || b.Open != nil {
+			reader = "yes"
+		}
+		available, excuses := b.Availability()
+		fmt.Printf("%s\tpure-go reader: %s\textractors: %s\n", b.Name, reader, strings.Join(available, " "))
+
+		names := []string{}
+		for name := range excuses {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Printf("\t%s unavailable: %v\n", name, excuses[name])
+		}
+	}
+	return nil
+}
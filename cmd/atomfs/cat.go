@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/sys/unix"
+)
+
+var catCmd = cli.Command{
+	Name:      "cat",
+	Usage:     "print a file from an atomfs image without mounting it",
+	ArgsUsage: "ocidir:tag:path",
+	Action:    doCat,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "per-layer",
+			Usage: "Print the file from every atom that has it, not just the one that wins",
+		},
+	},
+}
+
+func catUsage(me string) error {
+	return fmt.Errorf("Usage: %s cat [--per-layer] ocidir:tag:path", me)
+}
+
+func catFile(fsys fs.FS, name string) error {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return fmt.Errorf("%s is a directory", name)
+	}
+	_, err = io.Copy(os.Stdout, f)
+	return err
+}
+
+func doCat(ctx *cli.Context) error {
+	if ctx.NArg() != 1 {
+		return catUsage(ctx.App.Name)
+	}
+
+	o, closeAll, name, err := openImage(ctx.Args()[0])
+	if err != nil {
+		return err
+	}
+	defer closeAll()
+
+	if name == "." {
+		return catUsage(ctx.App.Name)
+	}
+
+	if !ctx.Bool("per-layer") {
+		return catFile(o, name)
+	}
+
+	// each atom on its own, top most first, ignoring whatever the others
+	// would hide
+	found := false
+	for _, l := range o.Layers {
+		_, err := l.FS.Lstat(name)
+		if errors.Is(err, fs.ErrNotExist) || errors.Is(err, unix.ENOTDIR) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		found = true
+		fmt.Printf("==> %s <==\n", l.Name)
+		if err := catFile(l.FS, name); err != nil {
+			return err
+		}
+	}
+	if !found {
+		return &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"machinerun.io/atomfs/pkg/imagefs"
+)
+
+var diffImagesCmd = cli.Command{
+	Name:      "diff-images",
+	Usage:     "show what differs between two atomfs images without mounting them",
+	ArgsUsage: "ocidir:tag ocidir:tag",
+	Action:    doDiffImages,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "Print the changes as JSON",
+		},
+	},
+}
+
+func diffImagesUsage(me string) error {
+	return fmt.Errorf("Usage: %s diff-images [--json] ocidir:tag ocidir:tag", me)
+}
+
+func doDiffImages(ctx *cli.Context) error {
+	if ctx.NArg() != 2 {
+		return diffImagesUsage(ctx.App.Name)
+	}
+
+	overlays := []*imagefs.Overlay{}
+	for _, arg := range ctx.Args() {
+		o, closeAll, name, err := openImage(arg)
+		if err != nil {
+			return err
+		}
+		defer closeAll()
+		if name != "." {
+			return errors.Errorf("%q: only whole images can be compared", arg)
+		}
+		overlays = append(overlays, o)
+	}
+
+	changes, err := imagefs.Diff(overlays[0], overlays[1])
+	if err != nil {
+		return err
+	}
+
+	if ctx.Bool("json") {
+		if changes == nil {
+			changes = []imagefs.Change{}
+		}
+		out, err := json.MarshalIndent(changes, "", "  ")
+		if err != nil {
+			return errors.Wrapf(err, "couldn't marshal changes")
+		}
+		fmt.Println(string(out))
+		return nil
+	}
+
+	for _, c := range changes {
+		switch c.Kind {
+		case imagefs.Added:
+			fmt.Printf("A %s\n", c.Path)
+		case imagefs.Removed:
+			fmt.Printf("D %s\n", c.Path)
+		default:
+			fmt.Printf("M %s (%s)\n", c.Path, strings.Join(c.Differences, ","))
+		}
+	}
+	return nil
+}
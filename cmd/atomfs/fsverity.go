@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"machinerun.io/atomfs/pkg/common"
+	"machinerun.io/atomfs/pkg/fsverity"
+	"machinerun.io/atomfs/pkg/molecule"
+)
+
+var enableFsverityCmd = cli.Command{
+	Name:      "enable-fsverity",
+	Usage:     "enable fs-verity on the atoms of an image and record their digests in its manifest",
+	ArgsUsage: "ocidir:tag",
+	Action:    doEnableFsverity,
+}
+
+func enableFsverityUsage(me string) error {
+	return fmt.Errorf("Usage: %s enable-fsverity ocidir:tag", me)
+}
+
+func doEnableFsverity(ctx *cli.Context) error {
+	if ctx.NArg() != 1 {
+		return enableFsverityUsage(ctx.App.Name)
+	}
+	arg := ctx.Args()[0]
+
+	r := strings.SplitN(arg, ":", 2)
+	if len(r) != 2 {
+		return enableFsverityUsage(ctx.App.Name)
+	}
+	opts := molecule.MountOCIOpts{OCIDir: r[0], Tag: r[1]}
+	if !common.PathExists(opts.OCIDir) {
+		return errors.Errorf("oci directory %s does not exist", opts.OCIDir)
+	}
+
+	man, err := molecule.EnableFsverity(opts)
+	if err != nil {
+		return err
+	}
+	for _, layer := range man.Layers {
+		fmt.Printf("%s\t%s\n", layer.Digest, layer.Annotations[fsverity.DigestAnnotation])
+	}
+	return nil
+}
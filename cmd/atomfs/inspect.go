@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"machinerun.io/atomfs/pkg/common"
+	"machinerun.io/atomfs/pkg/composefs"
+	"machinerun.io/atomfs/pkg/erofs"
+	"machinerun.io/atomfs/pkg/fs"
+	"machinerun.io/atomfs/pkg/fsverity"
+	"machinerun.io/atomfs/pkg/molecule"
+	"machinerun.io/atomfs/pkg/squashfs"
+	types "machinerun.io/atomfs/pkg/types"
+	"machinerun.io/atomfs/pkg/verity"
+)
+
+var inspectCmd = cli.Command{
+	Name:      "inspect",
+	Usage:     "show superblock, verity and compression details of atoms",
+	ArgsUsage: "blob|ocidir:tag",
+	Action:    doInspect,
+}
+
+func inspectUsage(me string) error {
+	return fmt.Errorf("Usage: %s inspect blob|ocidir:tag", me)
+}
+
+func doInspect(ctx *cli.Context) error {
+	if ctx.NArg() != 1 {
+		return inspectUsage(ctx.App.Name)
+	}
+	arg := ctx.Args()[0]
+
+	if fi, err := os.Stat(arg); err == nil && fi.Mode().IsRegular() {
+		return inspectBlob(arg, nil)
+	}
+
+	r := strings.SplitN(arg, ":", 2)
+	if len(r) != 2 {
+		return errors.Errorf("%s is neither a blob nor of the form ocidir:tag", arg)
+	}
+	opts := molecule.MountOCIOpts{OCIDir: r[0], Tag: r[1]}
+	if !common.PathExists(opts.OCIDir) {
+		return errors.Errorf("oci directory %s does not exist", opts.OCIDir)
+	}
+	mol, err := molecule.BuildMoleculeFromOCI(opts)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't build molecule for %s", arg)
+	}
+
+	failed := false
+	for i, a := range mol.Atoms {
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Printf("atom %s (layer %d from the top)\n", a.Digest, i)
+		if err := inspectBlob(opts.AtomsPath(a.Digest.Encoded()), &a); err != nil {
+			fmt.Printf("  error: %v\n", err)
+			failed = true
+		}
+	}
+	if failed {
+		return errors.Errorf("some atoms of %s failed inspection", arg)
+	}
+	return nil
+}
+
+// inspectBlob prints what's known about the atom at path, checking it
+// against its descriptor if there is one.
+func inspectBlob(path string, desc *ispec.Descriptor) error {
+	fsType, err := fs.Detect(path)
+	if err != nil {
+		return err
+	}
+	// composefs images are erofs ones, told apart only by their media type
+	if fsType == fs.ErofsType && desc != nil && composefs.IsComposefsMediaType(desc.MediaType) {
+		fsType = fs.ComposefsType
+	}
+	info, err := fs.New(fsType).Inspect(path)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("  type:          %s\n", info.Type)
+	compression := strings.Join(info.Compression, ",")
+	if compression == "" {
+		compression = "none"
+	}
+	fmt.Printf("  compression:   %s\n", compression)
+	fmt.Printf("  block size:    %d\n", info.BlockSize)
+	fmt.Printf("  inodes:        %d\n", info.Inodes)
+	fmt.Printf("  features:      %s\n", strings.Join(info.Features, " "))
+	fmt.Printf("  build time:    %s\n", info.BuildTime.UTC())
+	fmt.Printf("  file size:     %d\n", info.Size)
+	fmt.Printf("  verity offset: %d\n", info.VerityOffset)
+
+	annotation := ""
+	if desc != nil {
+		annotation = desc.Annotations[verity.VerityRootHashAnnotation]
+		if annotation == "" {
+			annotation = desc.Annotations[verity.VerityRootHashAnnotation_Previous]
+		}
+	}
+
+	problems := []string{}
+	hasVerity := uint64(info.Size) > info.VerityOffset
+	if !hasVerity {
+		fmt.Printf("  verity:        none\n")
+		if annotation != "" {
+			problems = append(problems, "root hash annotation present but no verity data")
+		}
+	} else {
+		f, err := os.Open(path)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		defer f.Close()
+
+		sb, err := verity.ReadSuperblock(f, info.VerityOffset)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("  verity:\n")
+		fmt.Printf("    hash algorithm:  %s\n", sb.Algorithm)
+		fmt.Printf("    hash type:       %d\n", sb.HashType)
+		fmt.Printf("    salt:            %x\n", sb.Salt)
+		fmt.Printf("    data block size: %d\n", sb.DataBlockSize)
+		fmt.Printf("    hash block size: %d\n", sb.HashBlockSize)
+		fmt.Printf("    data blocks:     %d\n", sb.DataBlocks)
+
+		if sb.DataBlocks*uint64(sb.DataBlockSize) != info.VerityOffset {
+			problems = append(problems, fmt.Sprintf("verity covers %d bytes, not the whole filesystem's %d", sb.DataBlocks*uint64(sb.DataBlockSize), info.VerityOffset))
+		}
+		if end := sb.HashTreeEnd(); end > uint64(info.Size) {
+			problems = append(problems, fmt.Sprintf("hash tree is truncated, it needs %d bytes", end))
+		}
+
+		rootHash, err := sb.RootHash(f)
+		if err != nil {
+			return err
+		}
+		stored, err := sb.StoredRootHash(f)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("    root hash:       %s\n", rootHash)
+		if stored != rootHash {
+			problems = append(problems, fmt.Sprintf("stored hash tree has root hash %s, it doesn't match the data", stored))
+		}
+
+		switch {
+		case desc == nil:
+		case annotation == "":
+			problems = append(problems, "verity data present but no root hash annotation")
+		case annotation == rootHash:
+			fmt.Printf("    annotation:      matches\n")
+		default:
+			problems = append(problems, fmt.Sprintf("root hash annotation %s doesn't match", annotation))
+		}
+	}
+
+	if desc != nil {
+		if expected, ok := desc.Annotations[fsverity.DigestAnnotation]; ok {
+			measured, err := fsverity.Measure(path)
+			switch {
+			case errors.Is(err, fsverity.ErrNotEnabled):
+				fmt.Printf("  fs-verity:     not enabled\n")
+				problems = append(problems, "fs-verity digest annotation present but fs-verity isn't enabled")
+			case err != nil:
+				return err
+			case measured == expected:
+				fmt.Printf("  fs-verity:     %s (matches)\n", measured)
+			default:
+				fmt.Printf("  fs-verity:     %s\n", measured)
+				problems = append(problems, fmt.Sprintf("fs-verity digest annotation %s doesn't match", expected))
+			}
+		}
+		fmt.Printf("  media type:    %s\n", desc.MediaType)
+		problems = append(problems, mediaTypeProblems(desc.MediaType, compression, info.Type, hasVerity)...)
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	for _, p := range problems {
+		fmt.Printf("  problem: %s\n", p)
+	}
+	return errors.Errorf("%s is inconsistent", path)
+}
+
+// mediaTypeProblems checks that mediaType, e.g.
+// application/vnd.stacker.image.layer.squashfs+zstd+verity, describes the
+// atom.
+func mediaTypeProblems(mediaType, compression string, fsType types.FilesystemType, hasVerity bool) []string {
+	base := erofs.BaseMediaTypeLayerErofs
+	switch fsType {
+	case fs.SquashfsType:
+		base = squashfs.BaseMediaTypeLayerSquashfs
+	case fs.ComposefsType:
+		base = composefs.BaseMediaTypeLayerComposefs
+	}
+	if !strings.HasPrefix(mediaType, base) {
+		return []string{fmt.Sprintf("media type %s but the atom is %s", mediaType, base)}
+	}
+
+	problems := []string{}
+	suffixes := strings.Split(strings.TrimPrefix(mediaType, base), "+")[1:]
+	if len(suffixes) > 0 && suffixes[len(suffixes)-1] == verity.VeritySuffix {
+		suffixes = suffixes[:len(suffixes)-1]
+		if !hasVerity {
+			problems = append(problems, "media type says verity but there's no verity data")
+		}
+	}
+	// an uncompressed image doesn't contradict whichever compression it
+	// was built with
+	if len(suffixes) > 0 && compression != "none" {
+		comp := strings.TrimSuffix(suffixes[0], "hc")
+		if !strings.Contains(","+compression+",", ","+comp+",") {
+			problems = append(problems, fmt.Sprintf("media type says %s compression but the atom has %s", suffixes[0], compression))
+		}
+	}
+	return problems
+}
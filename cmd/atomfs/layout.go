@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"machinerun.io/atomfs/pkg/common"
+	"machinerun.io/atomfs/pkg/composefs"
+	"machinerun.io/atomfs/pkg/layout"
+	"machinerun.io/atomfs/pkg/molecule"
+)
+
+var layoutCmd = cli.Command{
+	Name:  "layout",
+	Usage: "maintain local OCI layouts",
+	Subcommands: []cli.Command{
+		layoutGCCmd,
+		layoutDedupeCmd,
+	},
+}
+
+var layoutGCCmd = cli.Command{
+	Name:      "gc",
+	Usage:     "remove the blobs of an OCI layout that no image in it refers to",
+	ArgsUsage: "ocidir",
+	Action:    doLayoutGC,
+	Flags: []cli.Flag{
+		cli.StringSliceFlag{
+			Name:  "keep-tag",
+			Usage: "Only keep the images with tags matching this glob, untagging the others (can be repeated)",
+		},
+		cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "Only say what would be removed",
+		},
+		cli.StringFlag{
+			Name:  "metadir",
+			Usage: "Directory to use for metadata. Use this if /run/atomfs is not writable for some reason.",
+		},
+	},
+}
+
+func doLayoutGC(ctx *cli.Context) error {
+	if ctx.NArg() != 1 {
+		return fmt.Errorf("Usage: %s layout gc [--keep-tag GLOB] [--dry-run] ocidir", ctx.App.Name)
+	}
+	ocidir := ctx.Args()[0]
+	if !common.PathExists(ocidir) {
+		return errors.Errorf("oci directory %s does not exist", ocidir)
+	}
+
+	inUse, err := molecule.BlobsInUse(ctx.String("metadir"))
+	if err != nil {
+		return errors.Wrapf(err, "couldn't find the blobs in use")
+	}
+	result, err := layout.GC(ocidir, layout.GCOptions{
+		KeepTags: ctx.StringSlice("keep-tag"),
+		DryRun:   ctx.Bool("dry-run"),
+		InUse:    inUse,
+		Objects:  composefs.AtomObjects,
+	})
+	if err != nil {
+		return err
+	}
+
+	untagged, removed, reclaimed := "untagged", "removed", "reclaimed"
+	if ctx.Bool("dry-run") {
+		untagged, removed, reclaimed = "would untag", "would remove", "would reclaim"
+	}
+	for _, t := range result.Untagged {
+		fmt.Printf("%s %s\n", untagged, t)
+	}
+	kept := []string{}
+	for f := range result.InUse {
+		kept = append(kept, f)
+	}
+	sort.Strings(kept)
+	for _, f := range kept {
+		fmt.Printf("kept %s: in use by %s\n", f, strings.Join(result.InUse[f], ", "))
+	}
+	for _, f := range result.Removed {
+		fmt.Printf("%s %s\n", removed, f)
+	}
+	fmt.Printf("%s %d bytes\n", reclaimed, result.Reclaimed)
+	return nil
+}
+
+var layoutDedupeCmd = cli.Command{
+	Name:      "dedupe",
+	Usage:     "link identical blobs of OCI layouts to one copy",
+	ArgsUsage: "ocidir...",
+	Action:    doLayoutDedupe,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "store",
+			Usage: "Link the blobs to the copies in this shared blob store, e.g. /var/lib/atomfs/blobs, adding those it doesn't have",
+		},
+		cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "Only say what would be linked",
+		},
+	},
+}
+
+func doLayoutDedupe(ctx *cli.Context) error {
+	if ctx.NArg() < 1 {
+		return fmt.Errorf("Usage: %s layout dedupe [--store DIR] [--dry-run] ocidir...", ctx.App.Name)
+	}
+	for _, ocidir := range ctx.Args() {
+		if !common.PathExists(ocidir) {
+			return errors.Errorf("oci directory %s does not exist", ocidir)
+		}
+	}
+
+	result, err := layout.Dedupe(ctx.Args(), layout.DedupeOptions{
+		Store:  ctx.String("store"),
+		DryRun: ctx.Bool("dry-run"),
+	})
+	if err != nil {
+		return err
+	}
+
+	stored, linked, saved := "stored", "linked", "saved"
+	if ctx.Bool("dry-run") {
+		stored, linked, saved = "would store", "would link", "would save"
+	}
+	for _, f := range result.Stored {
+		fmt.Printf("%s %s\n", stored, f)
+	}
+	for _, f := range result.Linked {
+		fmt.Printf("%s %s\n", linked, f)
+	}
+	fmt.Printf("%s %d bytes\n", saved, result.Saved)
+	return nil
+}
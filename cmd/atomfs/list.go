@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/urfave/cli"
+	"machinerun.io/atomfs/pkg/molecule"
+)
+
+var listCmd = cli.Command{
+	Name:   "list",
+	Usage:  "list mounted atomfs images and the state of their FUSE daemons",
+	Action: doList,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "metadir",
+			Usage: "Directory to use for metadata. Use this if /run/atomfs is not writable for some reason.",
+		},
+	},
+}
+
+func doList(ctx *cli.Context) error {
+	mols, err := molecule.ListMounted(ctx.String("metadir"))
+	if err != nil {
+		return err
+	}
+
+	for _, mol := range mols {
+		state := "ok"
+		if dead := mol.DeadDaemons(); len(dead) > 0 {
+			state = fmt.Sprintf("%d dead FUSE daemons", len(dead))
+		}
+		fmt.Printf("%s\t%s:%s\t%s\n", mol.Config.Target, mol.Config.OCIDir, mol.Config.Tag, state)
+		// each daemon is indented, with its pid first and its name, which
+		// may have spaces, last, so the lines can be split on tabs
+		for _, d := range mol.Daemons {
+			alive := "alive"
+			if !d.Alive() {
+				alive = "dead"
+			}
+			fmt.Printf("\t%d\t%s\t%s\t%s\n", d.Pid, alive, d.Mountpoint, d.Name())
+		}
+	}
+	return nil
+}
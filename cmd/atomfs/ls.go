@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"machinerun.io/atomfs/pkg/common"
+	"machinerun.io/atomfs/pkg/imagefs"
+	"machinerun.io/atomfs/pkg/molecule"
+)
+
+var lsCmd = cli.Command{
+	Name:      "ls",
+	Usage:     "list a directory of an atomfs image without mounting it",
+	ArgsUsage: "ocidir:tag[:path]",
+	Action:    doLs,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "per-layer",
+			Usage: "Show which atom provides each entry",
+		},
+	},
+}
+
+func lsUsage(me string) error {
+	return fmt.Errorf("Usage: %s ls [--per-layer] ocidir:tag[:path]", me)
+}
+
+// openImage opens the merged view of the image named by an
+// ocidir:tag[:path] argument, returning it and the path within it.
+func openImage(arg string) (*imagefs.Overlay, func(), string, error) {
+	r := strings.SplitN(arg, ":", 3)
+	if len(r) < 2 {
+		return nil, nil, "", errors.Errorf("%q is not of the form ocidir:tag[:path]", arg)
+	}
+	ocidir, tag := r[0], r[1]
+	if !common.PathExists(ocidir) {
+		return nil, nil, "", errors.Errorf("oci directory %s does not exist", ocidir)
+	}
+
+	// paths are given as they would be in a mounted image
+	name := "."
+	if len(r) == 3 {
+		name = strings.TrimPrefix(path.Clean("/"+r[2]), "/")
+		if name == "" {
+			name = "."
+		}
+	}
+
+	mol, err := molecule.BuildMoleculeFromOCI(molecule.MountOCIOpts{OCIDir: ocidir, Tag: tag})
+	if err != nil {
+		return nil, nil, "", errors.Wrapf(err, "couldn't build molecule for %s", arg)
+	}
+	overlay, closeAll, err := mol.Open()
+	if err != nil {
+		return nil, nil, "", err
+	}
+	return overlay, closeAll, name, nil
+}
+
+func formatEntry(o *imagefs.Overlay, name string, fi fs.FileInfo) string {
+	uid, gid := uint32(0), uint32(0)
+	if st := imagefs.StatOf(fi); st != nil {
+		uid, gid = st.Uid, st.Gid
+	}
+	line := fmt.Sprintf("%s %5d %5d %10d %s", fi.Mode(), uid, gid, fi.Size(), fi.Name())
+	if fi.Mode()&fs.ModeSymlink != 0 {
+		if target, err := o.ReadLink(name); err == nil {
+			line += " -> " + target
+		}
+	}
+	return line
+}
+
+func doLs(ctx *cli.Context) error {
+	if ctx.NArg() != 1 {
+		return lsUsage(ctx.App.Name)
+	}
+
+	o, closeAll, name, err := openImage(ctx.Args()[0])
+	if err != nil {
+		return err
+	}
+	defer closeAll()
+
+	perLayer := ctx.Bool("per-layer")
+	show := func(name string, fi fs.FileInfo) error {
+		line := formatEntry(o, name, fi)
+		if perLayer {
+			providers, err := o.Providers(name)
+			if err != nil {
+				return err
+			}
+			line = strings.Join(providers, ",") + " " + line
+		}
+		fmt.Println(line)
+		return nil
+	}
+
+	fi, err := o.Stat(name)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		fi, err = o.Lstat(name)
+		if err != nil {
+			return err
+		}
+		return show(name, fi)
+	}
+
+	ents, err := o.ReadDir(name)
+	if err != nil {
+		return err
+	}
+	for _, e := range ents {
+		p := path.Join(name, e.Name())
+		fi, err := e.Info()
+		if err != nil {
+			return errors.Wrapf(err, "couldn't stat %s", p)
+		}
+		if err := show(p, fi); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -6,11 +6,24 @@ import (
 
 	"github.com/apex/log"
 	"github.com/urfave/cli"
+	"machinerun.io/atomfs/pkg/userns"
+	"machinerun.io/atomfs/pkg/verityfuse"
 )
 
 var Version string
 
 func main() {
+	if err := userns.Enter(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %+v\n", err)
+		os.Exit(1)
+	}
+
+	// verified FUSE mounts are served by the verityfuse subcommand
+	if err := verityfuse.UseSelf(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %+v\n", err)
+		os.Exit(1)
+	}
+
 	app := cli.NewApp()
 	app.Name = "atomfs"
 	app.Usage = "mount and unmount atomfs filesystems"
@@ -19,6 +32,18 @@ func main() {
 		mountCmd,
 		umountCmd,
 		verifyCmd,
+		listCmd,
+		backendsCmd,
+		lsCmd,
+		catCmd,
+		diffImagesCmd,
+		inspectCmd,
+		enableFsverityCmd,
+		pullCmd,
+		pushCmd,
+		layoutCmd,
+		runCmd,
+		verityFuseCmd,
 	}
 
 	app.Flags = []cli.Flag{
@@ -3,7 +3,6 @@ package main
 import (
 	"fmt"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
 
@@ -11,35 +10,73 @@ import (
 	"github.com/urfave/cli"
 	"machinerun.io/atomfs/pkg/common"
 	"machinerun.io/atomfs/pkg/molecule"
+	"machinerun.io/atomfs/pkg/userns"
 )
 
+// mountFlags are shared by mount and run.
+var mountFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "persist",
+		Usage: "Specify a directory to use for the workdir and upperdir of a writeable overlay (implies --writeable)",
+	},
+	cli.BoolFlag{
+		Name:  "writeable, writable",
+		Usage: "Make the mount writeable using an overlay (ephemeral by default)",
+	},
+	cli.BoolFlag{
+		Name:  "allow-missing-verity",
+		Usage: "Mount even if the image has no verity data",
+	},
+	cli.StringFlag{
+		Name:  "verify-digests",
+		Usage: "Check atoms against their digests before mounting them: auto (those without verity data), always or never",
+		Value: "auto",
+	},
+	cli.StringFlag{
+		Name:  "metadir",
+		Usage: "Directory to use for metadata. Use this if /run/atomfs is not writable for some reason.",
+	},
+	cli.StringFlag{
+		Name:  "atoms-from",
+		Usage: "Fetch atoms missing from ocidir from this registry repository, e.g. registry.example.com/library/busybox, as they're read",
+	},
+	cli.StringFlag{
+		Name:  "store",
+		Usage: "Mount atoms from this shared blob store, e.g. /var/lib/atomfs/blobs, rather than ocidir when it has them",
+	},
+	cli.StringFlag{
+		Name:  "idmap-userns",
+		Usage: "Idmap the mount with the mappings of this user namespace, e.g. /proc/PID/ns/user",
+	},
+	cli.StringSliceFlag{
+		Name:  "uid-map",
+		Usage: "Idmap the mount's uids as container:host:size (repeatable)",
+	},
+	cli.StringSliceFlag{
+		Name:  "gid-map",
+		Usage: "Idmap the mount's gids as container:host:size (repeatable)",
+	},
+}
+
 var mountCmd = cli.Command{
 	Name:      "mount",
 	Usage:     "mount atomfs image",
 	ArgsUsage: "ocidir:tag target",
 	Action:    doMount,
-	Flags: []cli.Flag{
-		cli.StringFlag{
-			Name:  "persist",
-			Usage: "Specify a directory to use for the workdir and upperdir of a writeable overlay (implies --writeable)",
-		},
+	Flags: append([]cli.Flag{
 		cli.BoolFlag{
-			Name:  "writeable, writable",
-			Usage: "Make the mount writeable using an overlay (ephemeral by default)",
+			Name:  "userns",
+			Usage: "Mount in a new user namespace, kept alive in the background, so no privileges are needed",
 		},
 		cli.BoolFlag{
-			Name:  "allow-missing-verity",
-			Usage: "Mount even if the image has no verity data",
+			Name:   usernsHoldFlag,
+			Hidden: true,
 		},
-		cli.StringFlag{
-			Name:  "metadir",
-			Usage: "Directory to use for metadata. Use this if /run/atomfs is not writable for some reason.",
-		},
-	},
+	}, mountFlags...),
 }
 
 func mountUsage(_ string) error {
-	return errors.New("Usage: atomfs mount [--writeable] [--persist=/tmp/upperdir] ocidir:tag target")
+	return errors.New("Usage: atomfs mount [--userns] [--writeable] [--persist=/tmp/upperdir] ocidir:tag target")
 }
 
 func findImage(ctx *cli.Context) (string, string, error) {
@@ -58,7 +95,7 @@ func findImage(ctx *cli.Context) (string, string, error) {
 
 func doMount(ctx *cli.Context) error {
 
-	if len(ctx.Args()) == 0 {
+	if len(ctx.Args()) < 2 {
 		return mountUsage(ctx.App.Name)
 	}
 
@@ -66,21 +103,49 @@ func doMount(ctx *cli.Context) error {
 	if err != nil {
 		return err
 	}
+	target := ctx.Args()[1]
+	absTarget, err := filepath.Abs(target)
+	if err != nil {
+		return err
+	}
+
+	if ctx.Bool("userns") {
+		return mountInUserns(ctx, absTarget)
+	}
+
 	if !amPrivileged() {
 		fmt.Println("Please run as root, or in a user namespace")
 		fmt.Println(" You could try:")
+		fmt.Println("\tatomfs mount --userns ...")
+		fmt.Println(" or")
 		fmt.Println("\tlxc-usernsexec -s -- /bin/bash")
 		fmt.Println(" or")
 		fmt.Println("\tunshare -Umr -- /bin/bash")
 		fmt.Println("then run from that shell")
 		os.Exit(1)
 	}
-	target := ctx.Args()[1]
-	absTarget, err := filepath.Abs(target)
-	if err != nil {
+
+	var ready *os.File
+	if ctx.Bool(usernsHoldFlag) {
+		// before the fuse servers start, or they'd inherit it and
+		// mount --userns would never see it closed
+		if ready, err = usernsReady(); err != nil {
+			return err
+		}
+	}
+
+	if err := mountMolecule(ctx, ocidir, tag, absTarget); err != nil {
 		return err
 	}
 
+	if ready != nil {
+		return holdUserns(ready, absTarget, ctx.String("metadir"))
+	}
+	return nil
+}
+
+// mountMolecule mounts ocidir:tag at target as the mountFlags say.
+func mountMolecule(ctx *cli.Context, ocidir, tag, target string) error {
 	absOCIDir, err := filepath.Abs(ocidir)
 	if err != nil {
 		return err
@@ -96,11 +161,31 @@ func doMount(ctx *cli.Context) error {
 	opts := molecule.MountOCIOpts{
 		OCIDir:                 absOCIDir,
 		Tag:                    tag,
-		Target:                 absTarget,
+		Target:                 target,
 		AddWriteableOverlay:    ctx.Bool("writeable") || ctx.IsSet("persist"),
 		WriteableOverlayPath:   persistPath,
 		AllowMissingVerityData: ctx.Bool("allow-missing-verity"),
 		MetadataDir:            ctx.String("metadir"), // nil here means /run/atomfs
+		IDMapUserns:            ctx.String("idmap-userns"),
+		AtomsRepository:        ctx.String("atoms-from"),
+		AtomsStore:             ctx.String("store"),
+	}
+	if opts.UIDMappings, err = parseMappings(ctx.StringSlice("uid-map")); err != nil {
+		return err
+	}
+	if opts.GIDMappings, err = parseMappings(ctx.StringSlice("gid-map")); err != nil {
+		return err
+	}
+	if opts.DigestCheck, err = molecule.ParseDigestCheck(ctx.String("verify-digests")); err != nil {
+		return err
+	}
+	if opts.AtomsStore != "" {
+		if opts.AtomsStore, err = filepath.Abs(opts.AtomsStore); err != nil {
+			return err
+		}
+	}
+	if opts.IDMapUserns != "" && (opts.UIDMappings != nil || opts.GIDMappings != nil) {
+		return errors.Errorf("--idmap-userns can't be used with --uid-map or --gid-map")
 	}
 
 	mol, err := molecule.BuildMoleculeFromOCI(opts)
@@ -116,22 +201,18 @@ func doMount(ctx *cli.Context) error {
 	return nil
 }
 
-func RunCommand(args ...string) error {
-	cmd := exec.Command(args[0], args[1:]...)
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("%s: %s: %s", strings.Join(args, " "), err, string(output))
+func parseMappings(args []string) ([]userns.Mapping, error) {
+	var mappings []userns.Mapping
+	for _, arg := range args {
+		m, err := userns.ParseMapping(arg)
+		if err != nil {
+			return nil, err
+		}
+		mappings = append(mappings, m)
 	}
-	return nil
+	return mappings, nil
 }
 
 func amPrivileged() bool {
 	return os.Geteuid() == 0
 }
-
-func squashUmount(p string) error {
-	if amPrivileged() {
-		return common.Umount(p)
-	}
-	return RunCommand("fusermount", "-u", p)
-}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/urfave/cli"
+	"machinerun.io/atomfs/pkg/composefs"
+	"machinerun.io/atomfs/pkg/registry"
+)
+
+var pullCmd = cli.Command{
+	Name:      "pull",
+	Usage:     "fetch an image from an OCI registry into a local OCI layout",
+	ArgsUsage: "[scheme://]registry/repo[:tag|@digest] ocidir:tag",
+	Action:    doPull,
+	Flags: []cli.Flag{
+		cli.IntFlag{
+			Name:  "jobs",
+			Usage: "How many blobs to download at once",
+			Value: registry.DefaultJobs,
+		},
+		cli.BoolFlag{
+			Name:  "no-referrers",
+			Usage: "Don't fetch the signatures and other artifacts referring to the image",
+		},
+		cli.StringFlag{
+			Name:  "creds",
+			Usage: "Log in to the registry as username:password, rather than with the credentials docker login saved for it",
+		},
+	},
+}
+
+func pullUsage(me string) error {
+	return fmt.Errorf("Usage: %s pull [--jobs N] [--no-referrers] [--creds USER:PASS] registry/repo:tag ocidir:tag", me)
+}
+
+// setCredentials gives repo the credentials from --creds, or if there
+// aren't any, those docker login saved for its registry.
+func setCredentials(ctx *cli.Context, repo *registry.Repository) error {
+	var err error
+	if creds := ctx.String("creds"); creds != "" {
+		repo.Credentials, err = registry.ParseCredentials(creds)
+	} else {
+		repo.Credentials, err = registry.DockerCredentials(repo.Host())
+	}
+	return err
+}
+
+func doPull(ctx *cli.Context) error {
+	if ctx.NArg() != 2 {
+		return pullUsage(ctx.App.Name)
+	}
+	repo, ref, err := registry.ParseReference(ctx.Args()[0])
+	if err != nil {
+		return err
+	}
+	if err := setCredentials(ctx, repo); err != nil {
+		return err
+	}
+	r := strings.SplitN(ctx.Args()[1], ":", 2)
+	if len(r) != 2 {
+		return pullUsage(ctx.App.Name)
+	}
+
+	desc, err := registry.Pull(repo, ref, r[0], r[1], registry.PullOptions{
+		Jobs:        ctx.Int("jobs"),
+		NoReferrers: ctx.Bool("no-referrers"),
+		LocalOnly:   composefs.IsComposefsMediaType,
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Println(desc.Digest)
+	return nil
+}
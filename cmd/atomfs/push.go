@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/urfave/cli"
+	"machinerun.io/atomfs/pkg/composefs"
+	"machinerun.io/atomfs/pkg/registry"
+)
+
+var pushCmd = cli.Command{
+	Name:      "push",
+	Usage:     "upload an image from a local OCI layout to an OCI registry",
+	ArgsUsage: "ocidir:tag [scheme://]registry/repo[:tag]",
+	Action:    doPush,
+	Flags: []cli.Flag{
+		cli.IntFlag{
+			Name:  "jobs",
+			Usage: "How many blobs to upload at once",
+			Value: registry.DefaultJobs,
+		},
+		cli.Int64Flag{
+			Name:  "chunk-size",
+			Usage: "Upload blobs in chunks of this many bytes, rather than in one request",
+		},
+		cli.StringSliceFlag{
+			Name:  "mount-from",
+			Usage: "Mount blobs from this repository on the same registry rather than uploading them, if it has them (can be repeated)",
+		},
+		cli.BoolFlag{
+			Name:  "referrers",
+			Usage: "Push the signatures and other artifacts in the layout referring to the image too",
+		},
+		cli.IntFlag{
+			Name:  "retries",
+			Usage: "How many times to retry a failed upload (0 for none)",
+			Value: registry.DefaultRetries,
+		},
+		cli.StringFlag{
+			Name:  "creds",
+			Usage: "Log in to the registry as username:password, rather than with the credentials docker login saved for it",
+		},
+	},
+}
+
+func pushUsage(me string) error {
+	return fmt.Errorf("Usage: %s push [--jobs N] [--chunk-size BYTES] [--mount-from REPO] [--referrers] [--creds USER:PASS] ocidir:tag registry/repo:tag", me)
+}
+
+func doPush(ctx *cli.Context) error {
+	if ctx.NArg() != 2 {
+		return pushUsage(ctx.App.Name)
+	}
+	r := strings.SplitN(ctx.Args()[0], ":", 2)
+	if len(r) != 2 {
+		return pushUsage(ctx.App.Name)
+	}
+	repo, ref, err := registry.ParseReference(ctx.Args()[1])
+	if err != nil {
+		return err
+	}
+	if err := setCredentials(ctx, repo); err != nil {
+		return err
+	}
+
+	retries := ctx.Int("retries")
+	if retries == 0 {
+		retries = -1
+	}
+	desc, err := registry.Push(r[0], r[1], repo, ref, registry.PushOptions{
+		Jobs:      ctx.Int("jobs"),
+		ChunkSize: ctx.Int64("chunk-size"),
+		MountFrom: ctx.StringSlice("mount-from"),
+		Referrers: ctx.Bool("referrers"),
+		Retries:   retries,
+		LocalOnly: composefs.IsComposefsMediaType,
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Println(desc.Digest)
+	return nil
+}
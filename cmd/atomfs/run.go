@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"machinerun.io/atomfs/pkg/log"
+	"machinerun.io/atomfs/pkg/molecule"
+	"machinerun.io/atomfs/pkg/userns"
+)
+
+var runCmd = cli.Command{
+	Name:      "run",
+	Usage:     "mount an atomfs image and run a command with it mounted, in a new user namespace if not root",
+	ArgsUsage: "ocidir:tag target command [args...]",
+	Action:    doRun,
+	Flags:     mountFlags,
+}
+
+func runUsage(me string) error {
+	return fmt.Errorf("Usage: %s run [--writeable] [--persist=/tmp/upperdir] ocidir:tag target [--] command [args...]", me)
+}
+
+func doRun(ctx *cli.Context) error {
+	if ctx.NArg() < 3 {
+		return runUsage(ctx.App.Name)
+	}
+
+	if !amPrivileged() {
+		cmd, err := userns.Command(os.Args[1:]...)
+		if err != nil {
+			return err
+		}
+		return exitStatus(cmd.Run())
+	}
+
+	ocidir, tag, err := findImage(ctx)
+	if err != nil {
+		return err
+	}
+	target, err := filepath.Abs(ctx.Args()[1])
+	if err != nil {
+		return err
+	}
+	if err := mountMolecule(ctx, ocidir, tag, target); err != nil {
+		return err
+	}
+
+	args := ctx.Args()[2:]
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	runErr := cmd.Run()
+
+	if err := molecule.UmountWithMetadir(target, ctx.String("metadir")); err != nil {
+		if runErr == nil {
+			return err
+		}
+		log.Errorf("couldn't unmount %s: %v", target, err)
+	}
+	return exitStatus(runErr)
+}
+
+// exitStatus makes atomfs exit the way the command that returned err did.
+func exitStatus(err error) error {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return cli.NewExitError("", exitErr.ExitCode())
+	}
+	if err != nil {
+		return errors.Wrapf(err, "couldn't run command")
+	}
+	return nil
+}
@@ -40,5 +40,10 @@ func doUmount(ctx *cli.Context) error {
 		}
 	}
 
+	// mounts made with mount --userns aren't visible here
+	if found, err := umountUserns(mountpoint, ctx.String("metadir")); found {
+		return err
+	}
+
 	return molecule.UmountWithMetadir(mountpoint, ctx.String("metadir"))
 }
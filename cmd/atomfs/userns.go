@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/sys/unix"
+	"machinerun.io/atomfs/pkg/common"
+	"machinerun.io/atomfs/pkg/log"
+	"machinerun.io/atomfs/pkg/molecule"
+	"machinerun.io/atomfs/pkg/userns"
+)
+
+// usernsHoldFlag is what mount --userns re-executes atomfs mount with in
+// the new namespaces.
+const usernsHoldFlag = "userns-hold"
+
+// usernsPidFile holds the pid of the process keeping a --userns mount's
+// namespaces alive.
+const usernsPidFile = "userns.pid"
+
+// usernsReadyFd is where the holder says it has mounted.
+const usernsReadyFd = 4
+
+// usernsMetaDir is where the holder of a --userns mount at target is
+// recorded, in the mount namespace atomfs was run in.
+func usernsMetaDir(metadir, target string) (string, error) {
+	mountNSName, err := common.GetMountNSName()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(common.RuntimeDir(metadir), "meta", mountNSName, common.ReplacePathSeparators(target)), nil
+}
+
+// mountInUserns re-executes this mount in new user and mount namespaces.
+// The mount is only visible in those, which a process stays in to keep
+// alive: unprivileged users can't bind mount the namespaces' nsfs files to
+// pin them. Its pid and links to the namespaces go in the metadata dir.
+func mountInUserns(ctx *cli.Context, target string) error {
+	metadir, err := usernsMetaDir(ctx.String("metadir"), target)
+	if err != nil {
+		return err
+	}
+	if common.PathExists(filepath.Join(metadir, usernsPidFile)) {
+		return errors.Errorf("%s is already mounted in a user namespace", target)
+	}
+	if err := common.EnsureDir(metadir); err != nil {
+		return err
+	}
+
+	complete := false
+	defer func() {
+		if !complete {
+			os.RemoveAll(metadir)
+		}
+	}()
+
+	args := []string{}
+	for _, a := range os.Args[1:] {
+		if a == "--userns" || a == "-userns" {
+			a = "--" + usernsHoldFlag
+		}
+		args = append(args, a)
+	}
+	cmd, err := userns.Command(args...)
+	if err != nil {
+		return err
+	}
+
+	logf := filepath.Join(metadir, "userns.log")
+	out, err := os.OpenFile(logf, os.O_RDWR|os.O_TRUNC|os.O_CREATE, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't open %s", logf)
+	}
+	defer out.Close()
+	ready, readyW, err := os.Pipe()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer ready.Close()
+
+	cmd.Stdin = nil
+	cmd.Stdout = out
+	cmd.Stderr = out
+	cmd.ExtraFiles = append(cmd.ExtraFiles, readyW)
+	// the holder outlives us
+	cmd.SysProcAttr.Setsid = true
+	err = cmd.Start()
+	readyW.Close()
+	if err != nil {
+		return err
+	}
+
+	// the holder writes once mounted; exiting closes the pipe
+	msg, err := io.ReadAll(ready)
+	if err != nil || len(msg) == 0 {
+		_ = cmd.Wait()
+		content, _ := os.ReadFile(logf)
+		return errors.Errorf("mounting %s in a user namespace failed: %s", target, strings.TrimSpace(string(content)))
+	}
+
+	pid := cmd.Process.Pid
+	if err := os.WriteFile(filepath.Join(metadir, usernsPidFile), []byte(strconv.Itoa(pid)), 0644); err != nil {
+		_ = cmd.Process.Signal(syscall.SIGTERM)
+		return errors.Wrapf(err, "couldn't record user namespace holder")
+	}
+	for _, ns := range []string{"user", "mnt"} {
+		if err := os.Symlink(fmt.Sprintf("/proc/%d/ns/%s", pid, ns), filepath.Join(metadir, ns)); err != nil {
+			log.Warnf("couldn't link %s namespace: %v", ns, err)
+		}
+	}
+	if err := cmd.Process.Release(); err != nil {
+		return errors.WithStack(err)
+	}
+
+	complete = true
+	fmt.Printf("%s is mounted in the namespaces of pid %d, enter them with:\n", target, pid)
+	fmt.Printf("\tnsenter --user=%s/user --mount=%s/mnt --preserve-credentials\n", metadir, metadir)
+	return nil
+}
+
+// usernsReady returns where the holder tells mountInUserns it has mounted.
+// Anything but the pipe mountInUserns passes means someone else ran us with
+// --userns-hold.
+func usernsReady() (*os.File, error) {
+	var st unix.Stat_t
+	_, err := unix.FcntlInt(usernsReadyFd, unix.F_GETFD, 0)
+	if err == nil {
+		err = unix.Fstat(usernsReadyFd, &st)
+	}
+	if err != nil || st.Mode&unix.S_IFMT != unix.S_IFIFO {
+		return nil, errors.Errorf("--%s is only for mount --userns", usernsHoldFlag)
+	}
+	syscall.CloseOnExec(usernsReadyFd)
+	return os.NewFile(usernsReadyFd, "ready"), nil
+}
+
+// holdUserns runs in the namespaces mountInUserns made, once target is
+// mounted: it tells mountInUserns so, then keeps them alive until umount
+// asks it to stop.
+func holdUserns(ready *os.File, target, metadir string) error {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+
+	if _, err := ready.Write([]byte("ready\n")); err != nil {
+		return errors.Wrapf(err, "couldn't report mount")
+	}
+	ready.Close()
+
+	sig := <-stop
+	log.Infof("got %s, unmounting %s", sig, target)
+	return molecule.UmountWithMetadir(target, metadir)
+}
+
+// umountUserns stops the holder of a --userns mount at target, which
+// unmounts it. It says whether there was one.
+func umountUserns(target, metadir string) (bool, error) {
+	usernsMeta, err := usernsMetaDir(metadir, target)
+	if err != nil {
+		return false, err
+	}
+	content, err := os.ReadFile(filepath.Join(usernsMeta, usernsPidFile))
+	if err != nil {
+		return false, nil
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil {
+		return true, errors.Wrapf(err, "bad user namespace pid for %s", target)
+	}
+
+	if isUsernsHolder(pid) {
+		if err := syscall.Kill(pid, syscall.SIGTERM); err != nil && err != syscall.ESRCH {
+			return true, errors.Wrapf(err, "couldn't stop user namespace holder %d", pid)
+		}
+		stopped := false
+		for i := 0; i < 3000 && !stopped; i++ {
+			stopped = !isUsernsHolder(pid)
+			if !stopped {
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+		if !stopped {
+			return true, errors.Errorf("user namespace holder %d didn't exit, see %s", pid, filepath.Join(usernsMeta, "userns.log"))
+		}
+	} else {
+		log.Warnf("user namespace holder %d for %s is already gone", pid, target)
+	}
+
+	return true, errors.WithStack(os.RemoveAll(usernsMeta))
+}
+
+// isUsernsHolder says whether pid is still a holder, rather than gone or
+// reused.
+func isUsernsHolder(pid int) bool {
+	cmdline, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return false
+	}
+	for _, arg := range strings.Split(string(cmdline), "\x00") {
+		if arg == "--"+usernsHoldFlag {
+			return true
+		}
+	}
+	return false
+}
@@ -8,6 +8,7 @@ import (
 	"github.com/urfave/cli"
 	"machinerun.io/atomfs/pkg/common"
 	"machinerun.io/atomfs/pkg/log"
+	"machinerun.io/atomfs/pkg/molecule"
 	"machinerun.io/atomfs/pkg/mount"
 	"machinerun.io/atomfs/pkg/verity"
 )
@@ -22,6 +23,10 @@ var verifyCmd = cli.Command{
 			Name:  "metadir",
 			Usage: "Directory to use for metadata. Use this if /run/atomfs is not writable for some reason.",
 		},
+		cli.BoolFlag{
+			Name:  "restart-dead",
+			Usage: "Remount the image if any of its FUSE daemons have died",
+		},
 	},
 }
 
@@ -64,12 +69,44 @@ func doVerify(ctx *cli.Context) error {
 
 	// quick check that the top level mount is an overlayfs as expected:
 	for _, m := range mounts {
-		if m.Target == mountpoint && m.FSType != "overlay" {
+		if m.Target == mountpoint && m.FSType != "overlay" && m.FSType != molecule.FuseOverlayfsType {
 			return fmt.Errorf("%s is not an overlayfs, are you sure it is a mounted molecule? %+v", mountpoint, m)
 		}
 	}
 
 	allOK := true
+
+	// guest mounts are only as good as the daemons serving them
+	mol, err := molecule.FindMounted(mountpoint, ctx.String("metadir"))
+	if err != nil {
+		log.Warnf("can't check FUSE daemons for %s: %v", mountpoint, err)
+	}
+	dead := mol.DeadDaemons()
+	for _, d := range dead {
+		fmt.Printf("%s: FUSE DAEMON DEAD (pid %d, %s)\n", d.Mountpoint, d.Pid, d.Name())
+		allOK = false
+	}
+	if len(dead) > 0 {
+		if !ctx.Bool("restart-dead") {
+			return fmt.Errorf("%d FUSE daemons for %s have died, use --restart-dead to remount it", len(dead), mountpoint)
+		}
+		if err := mol.Remount(); err != nil {
+			return err
+		}
+		fmt.Printf("%s: remounted\n", mountpoint)
+		allOK = true
+		if mounts, err = mount.ParseMounts("/proc/self/mountinfo"); err != nil {
+			return err
+		}
+	}
+
+	// what verified FUSE mounts check against had better be what the
+	// image's manifest says
+	rootHashes, err := mol.RootHashes()
+	if err != nil {
+		log.Warnf("can't find the root hashes of %s's atoms: %v", mountpoint, err)
+	}
+
 	checkedCount := 0
 	for _, m := range mounts {
 		if !strings.HasPrefix(m.Target, mountsdir) {
@@ -79,6 +116,16 @@ func doVerify(ctx *cli.Context) error {
 			log.Warnf("found squashfuse mount not supported by verify at %q", m.Source)
 			continue
 		}
+		if m.FSType == common.VerityFuseFSType {
+			// the fuse server refuses to return anything that doesn't
+			// match the root hash it was started with, so there's no
+			// device to check, only that hash and that it's still there
+			checkedCount = checkedCount + 1
+			if !verifyFuseMount(m, rootHashes) {
+				allOK = false
+			}
+			continue
+		}
 		if m.FSType != "squashfs" {
 			continue
 		}
@@ -103,3 +150,29 @@ func doVerify(ctx *cli.Context) error {
 	}
 	return fmt.Errorf("Found corrupt devices in molecule")
 }
+
+// verifyFuseMount checks that the verified FUSE mount m is checking what's
+// read against the root hash in rootHashes for its atom, and that its
+// daemon is alive, saying which it's not.
+func verifyFuseMount(m mount.Mount, rootHashes map[string]string) bool {
+	expected, ok := rootHashes[filepath.Base(m.Target)]
+	if !ok {
+		fmt.Printf("%s: NO ROOT HASH TO CHECK %s AGAINST\n", m.Target, m.Source)
+		return false
+	}
+	if m.Source != common.VerityFuseSource(expected) {
+		fmt.Printf("%s: ROOT HASH MISMATCH (mounted with %s, expected %s)\n", m.Target, m.Source, common.VerityFuseSource(expected))
+		return false
+	}
+	d, err := common.ReadFuseDaemon(common.FuseDaemonFile(m.Target))
+	if err != nil {
+		fmt.Printf("%s: FUSE DAEMON UNKNOWN (%v)\n", m.Target, err)
+		return false
+	}
+	if !d.Alive() {
+		fmt.Printf("%s: FUSE DAEMON DEAD (pid %d, %s)\n", m.Target, d.Pid, d.Name())
+		return false
+	}
+	fmt.Printf("%s: OK (verified on read)\n", m.Source)
+	return true
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"github.com/urfave/cli"
+	"machinerun.io/atomfs/pkg/common"
+	"machinerun.io/atomfs/pkg/verityfuse"
+)
+
+// verityFuseCmd is how unprivileged mounts of atoms with verity data run
+// their fuse server; see common.VerityFuse.
+var verityFuseCmd = cli.Command{
+	Name:            common.VerityFuseArg,
+	Usage:           "serve a verity-checked fuse mount of an atom",
+	ArgsUsage:       "fstype image mountpoint roothash",
+	Hidden:          true,
+	SkipFlagParsing: true,
+	Action:          doVerityFuse,
+}
+
+func doVerityFuse(ctx *cli.Context) error {
+	return verityfuse.Serve(ctx.Args())
+}
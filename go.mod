@@ -4,6 +4,8 @@ require (
 	github.com/Masterminds/semver/v3 v3.2.1
 	github.com/apex/log v1.9.0
 	github.com/freddierice/go-losetup v0.0.0-20220711213114-2a14873012db
+	github.com/hanwen/go-fuse/v2 v2.9.0
+	github.com/klauspost/compress v1.15.15
 	github.com/martinjungblut/go-cryptsetup v0.0.0-20220520180014-fd0874fd07a6
 	github.com/opencontainers/go-digest v1.0.0
 	github.com/opencontainers/image-spec v1.1.0
@@ -11,6 +13,7 @@ require (
 	github.com/opencontainers/umoci v0.4.8-0.20220412065115-12453f247749
 	github.com/pkg/errors v0.9.1
 	github.com/stretchr/testify v1.9.0
+	github.com/ulikunitz/xz v0.5.17
 	github.com/urfave/cli v1.22.14
 	golang.org/x/sys v0.28.0
 	google.golang.org/protobuf v1.36.1 // indirect
@@ -22,7 +25,6 @@ require (
 	github.com/cyphar/filepath-securejoin v0.3.5 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/docker/go-units v0.5.0 // indirect
-	github.com/klauspost/compress v1.15.15 // indirect
 	github.com/klauspost/pgzip v1.2.6-0.20220930104621-17e8dac29df8 // indirect
 	github.com/moby/sys/user v0.3.0 // indirect
 	github.com/opencontainers/runtime-spec v1.2.0 // indirect
@@ -2,6 +2,7 @@ package common
 
 import (
 	"os"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -67,3 +68,100 @@ func TestIsEmpytDir(t *testing.T) {
 	assert.NoError(e)
 	assert.True(v)
 }
+
+func TestSourceDateEpoch(t *testing.T) {
+	assert := assert.New(t)
+
+	t.Setenv(SourceDateEpochKey, "")
+	_, ok, err := SourceDateEpoch()
+	assert.NoError(err)
+	assert.False(ok)
+
+	t.Setenv(SourceDateEpochKey, "1700000000")
+	epoch, ok, err := SourceDateEpoch()
+	assert.NoError(err)
+	assert.True(ok)
+	assert.Equal(int64(1700000000), epoch)
+
+	t.Setenv(SourceDateEpochKey, "yesterday")
+	_, _, err = SourceDateEpoch()
+	assert.Error(err)
+}
+
+func TestKernelVersion(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	for release, expected := range map[string]KernelVersion{
+		"6.8.0-31-generic":                   {6, 8},  // Ubuntu
+		"6.1.0-21-amd64":                     {6, 1},  // Debian
+		"6.9.5-200.fc40.x86_64":              {6, 9},  // Fedora
+		"3.10.0-1160.el7.x86_64":             {3, 10}, // CentOS
+		"6.6.31+rpt-rpi-v8":                  {6, 6},  // Raspberry Pi OS
+		"5.15.153.1-microsoft-standard-WSL2": {5, 15},
+		"6.10.0-rc1":                         {6, 10},
+		"4.19.0+":                            {4, 19},
+	} {
+		v, err := ParseKernelVersion(release)
+		assert.NoError(err, release)
+		assert.Equal(expected, v, release)
+	}
+	_, err := ParseKernelVersion("garbage")
+	assert.Error(err)
+
+	assert.True(KernelVersion{6, 1}.AtLeast(KernelVersion{5, 17}))
+	assert.True(KernelVersion{5, 17}.AtLeast(KernelVersion{5, 17}))
+	assert.False(KernelVersion{5, 16}.AtLeast(KernelVersion{5, 17}))
+
+	_, err = RunningKernelVersion()
+	assert.NoError(err)
+
+	err = &UnsupportedFeatureError{Image: "a.img", Feature: "zstd compression", By: "kernel 6.1", Alternatives: []string{"erofsfuse", "goerofs"}}
+	assert.Equal("a.img uses zstd compression, which kernel 6.1 doesn't support; try erofsfuse or goerofs instead", err.Error())
+	err = &UnsupportedFeatureError{Image: "a.img", Feature: "zstd compression", By: "kernel 6.1", Guessed: true}
+	assert.Equal("a.img uses zstd compression, which kernel 6.1 probably doesn't support (judging by its version alone)", err.Error())
+}
+
+func TestKernelConfig(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	config, err := ParseKernelConfig(strings.NewReader(`#
+# Automatically generated file; DO NOT EDIT.
+#
+CONFIG_SQUASHFS=y
+CONFIG_SQUASHFS_XZ=m
+# CONFIG_SQUASHFS_ZSTD is not set
+CONFIG_SQUASHFS_FRAGMENT_CACHE_SIZE=3
+`))
+	assert.NoError(err)
+	for option, expected := range map[string][2]bool{
+		"CONFIG_SQUASHFS":                     {true, true},
+		"CONFIG_SQUASHFS_XZ":                  {true, true},
+		"CONFIG_SQUASHFS_ZSTD":                {false, true},
+		"CONFIG_SQUASHFS_FRAGMENT_CACHE_SIZE": {false, true},
+		"CONFIG_SQUASHFS_LZ4":                 {false, false},
+	} {
+		enabled, ok := config.Enabled(option)
+		assert.Equal(expected, [2]bool{enabled, ok}, option)
+	}
+
+	_, err = RunningKernelConfig()
+	assert.NoError(err)
+}
+
+func TestExcludes(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	eps := NewExcludePaths()
+	eps.AddExclude("/rootfs/usr")
+	eps.AddInclude("/rootfs/usr/bin/ls", false)
+	eps.AddExclude("/rootfs/var/cache")
+
+	assert.True(eps.Excludes("/rootfs/var/cache"))
+	assert.True(eps.Excludes("/rootfs/var/cache/apt/pkgcache.bin"))
+	assert.False(eps.Excludes("/rootfs/var"))
+	assert.False(eps.Excludes("/rootfs/usr/bin/ls"))
+	assert.False(eps.Excludes("/rootfs/usr/lib"))
+}
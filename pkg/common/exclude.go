@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 )
 
@@ -64,7 +65,15 @@ func (eps *ExcludePaths) AddInclude(orig string, isDir bool) {
 
 func (eps *ExcludePaths) String() (string, error) {
 	var buf bytes.Buffer
+
+	// keep the output stable, so that builds can be reproducible
+	excludes := make([]string, 0, len(eps.exclude))
 	for p := range eps.exclude {
+		excludes = append(excludes, p)
+	}
+	sort.Strings(excludes)
+
+	for _, p := range excludes {
 		_, err := buf.WriteString(p)
 		if err != nil {
 			return "", err
@@ -82,3 +91,17 @@ func (eps *ExcludePaths) String() (string, error) {
 
 	return buf.String(), nil
 }
+
+// Excludes says whether p, or a directory it's in, is excluded.
+func (eps *ExcludePaths) Excludes(p string) bool {
+	for {
+		if eps.exclude[p] {
+			return true
+		}
+		parent := filepath.Dir(p)
+		if parent == p {
+			return false
+		}
+		p = parent
+	}
+}
@@ -1,5 +1,106 @@
 package common
 
-import "os/exec"
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"machinerun.io/atomfs/pkg/log"
+)
 
 type FuseCmd func(fsImgFile, extractDir string) (*exec.Cmd, error)
+
+const (
+	// VerityFuseArg is the first argument the atomfs binary (or any program
+	// using VerityFuse) is re-executed with to serve a verified FUSE mount;
+	// such programs should hand the remaining arguments to verityfuse.Serve.
+	VerityFuseArg = "verityfuse"
+
+	// VerityFuseFSType is the type verified FUSE mounts show up with in
+	// mountinfo; their source is "verity:" followed by the root hash.
+	VerityFuseFSType = "fuse.atomfs-verity"
+
+	// VerityFuseReadyFd is the descriptor the server reports success on.
+	VerityFuseReadyFd = 3
+)
+
+// VerityFuseHelper is the program VerityFuse runs to serve verified FUSE
+// mounts, with VerityFuseArg and the mount's arguments, which it must hand
+// to verityfuse.Serve. It's empty until a program opts in, by setting it or
+// with verityfuse.UseSelf as the atomfs binary does, since re-executing
+// whatever program happens to be using the library would do something else
+// entirely.
+var VerityFuseHelper string
+
+// VerityFuseSource is the mount source of a verified FUSE mount of an image
+// with the given root hash.
+func VerityFuseSource(rootHash string) string {
+	return "verity:" + rootHash
+}
+
+// VerityFuse returns a FuseCmd that mounts fsType images by running
+// VerityFuseHelper as a FUSE server which checks every block it reads
+// against the image's verity data and rootHash. It returns once the mount
+// is up.
+func VerityFuse(fsType, rootHash string) FuseCmd {
+	return verityFuse(fsType, rootHash)
+}
+
+// LazyVerityFuse is VerityFuse for an image that isn't local yet, fetched
+// from the OCI distribution repository repo as it's read; see
+// verityfuse.MountLazy.
+func LazyVerityFuse(fsType, rootHash, repo string) FuseCmd {
+	return verityFuse(fsType, rootHash, repo)
+}
+
+func verityFuse(fsType, rootHash string, extra ...string) FuseCmd {
+	return func(fsImgFile, extractDir string) (*exec.Cmd, error) {
+		helper := VerityFuseHelper
+		if helper == "" {
+			return nil, errors.Errorf("no program to serve a verified fuse mount of %s: set common.VerityFuseHelper, e.g. with verityfuse.UseSelf", fsImgFile)
+		}
+
+		// given extractDir of path/to/some/dir[/], log to path/to/some/.dir-verityfuse.log
+		extractDir = strings.TrimSuffix(extractDir, "/")
+		logf := filepath.Join(filepath.Dir(extractDir), "."+filepath.Base(extractDir)+"-verityfuse.log")
+		cmdOut, err := os.OpenFile(logf, os.O_RDWR|os.O_TRUNC|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, errors.Wrapf(err, "couldn't open %s", logf)
+		}
+		defer cmdOut.Close()
+
+		ready, readyW, err := os.Pipe()
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		defer ready.Close()
+
+		cmd := exec.Command(helper, append([]string{VerityFuseArg, fsType, fsImgFile, extractDir, rootHash}, extra...)...)
+		cmd.Stdout = cmdOut
+		cmd.Stderr = cmdOut
+		cmd.ExtraFiles = []*os.File{readyW}
+		// outlive whoever mounted it, as squashfuse does
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+		fmt.Fprintf(cmdOut, "# %s\n", strings.Join(cmd.Args, " "))
+		log.Debugf("Mounting %s -> %s with verified fuse [%s]", fsImgFile, extractDir, logf)
+		err = cmd.Start()
+		readyW.Close()
+		if err != nil {
+			return nil, errors.Wrapf(err, "couldn't start verified fuse server")
+		}
+
+		// the server writes to the pipe once mounted, and exiting closes it
+		msg, err := io.ReadAll(ready)
+		if err != nil || len(msg) == 0 {
+			_ = cmd.Wait()
+			out, _ := os.ReadFile(logf)
+			return nil, errors.Errorf("verified fuse mount of %s failed: %s", fsImgFile, strings.TrimSpace(string(out)))
+		}
+		return cmd, nil
+	}
+}
@@ -0,0 +1,172 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+	"machinerun.io/atomfs/pkg/log"
+)
+
+// FuseDaemon is what's recorded about a FUSE server left serving a mount,
+// so it can be checked on and stopped after whoever started it is gone.
+type FuseDaemon struct {
+	Pid     int      `json:"pid"`
+	Cmdline []string `json:"cmdline"`
+	// StartTime is when the process started, in clock ticks since boot as
+	// /proc/PID/stat has it, to tell it from a later one with the same pid.
+	StartTime  uint64 `json:"start_time"`
+	Mountpoint string `json:"mountpoint"`
+}
+
+// FuseDaemonFile is where the daemon serving a guest mount at mountpoint
+// is recorded: path/to/.dir-fuse.json for path/to/dir, next to its log.
+func FuseDaemonFile(mountpoint string) string {
+	mountpoint = strings.TrimSuffix(mountpoint, "/")
+	return filepath.Join(filepath.Dir(mountpoint), "."+filepath.Base(mountpoint)+"-fuse.json")
+}
+
+// procStartTime returns the start time of pid from /proc/PID/stat, and
+// whether it has exited but not been reaped.
+func procStartTime(pid int) (uint64, bool, error) {
+	content, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, false, err
+	}
+	// the command name is in parentheses and may contain anything, so
+	// count fields from after it
+	stat := string(content)
+	end := strings.LastIndex(stat, ")")
+	if end < 0 {
+		return 0, false, errors.Errorf("bad stat for pid %d", pid)
+	}
+	fields := strings.Fields(stat[end+1:])
+	// state is field 3 and starttime field 22
+	if len(fields) < 20 {
+		return 0, false, errors.Errorf("bad stat for pid %d", pid)
+	}
+	start, err := strconv.ParseUint(fields[19], 10, 64)
+	if err != nil {
+		return 0, false, errors.Errorf("bad stat for pid %d", pid)
+	}
+	return start, fields[0] == "Z", nil
+}
+
+// RecordFuseDaemon writes what's needed to supervise the running cmd,
+// serving mountpoint, to file.
+func RecordFuseDaemon(file string, cmd *exec.Cmd, mountpoint string) error {
+	start, _, err := procStartTime(cmd.Process.Pid)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't find start time of %s", cmd.Path)
+	}
+	d := FuseDaemon{
+		Pid:        cmd.Process.Pid,
+		Cmdline:    cmd.Args,
+		StartTime:  start,
+		Mountpoint: mountpoint,
+	}
+	b, err := json.Marshal(d)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.Wrapf(os.WriteFile(file, b, 0644), "couldn't record fuse daemon")
+}
+
+// ReadFuseDaemon reads a record written by RecordFuseDaemon.
+func ReadFuseDaemon(file string) (*FuseDaemon, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	d := FuseDaemon{}
+	if err := json.Unmarshal(content, &d); err != nil {
+		return nil, errors.Wrapf(err, "bad fuse daemon record %s", file)
+	}
+	return &d, nil
+}
+
+// Name is what d is, for messages.
+func (d FuseDaemon) Name() string {
+	if len(d.Cmdline) == 0 {
+		return "fuse daemon"
+	}
+	name := filepath.Base(d.Cmdline[0])
+	if len(d.Cmdline) > 1 && d.Cmdline[1] == VerityFuseArg {
+		name += " " + VerityFuseArg
+	}
+	return name
+}
+
+// Running says whether the recorded process is still running, rather than
+// gone or its pid reused.
+func (d FuseDaemon) Running() bool {
+	start, zombie, err := procStartTime(d.Pid)
+	return err == nil && !zombie && start == d.StartTime
+}
+
+// Alive says whether d is running and its mount still answers; a mount
+// whose daemon died fails everything with ENOTCONN.
+func (d FuseDaemon) Alive() bool {
+	if !d.Running() {
+		return false
+	}
+	var st unix.Stat_t
+	return unix.Stat(d.Mountpoint, &st) != unix.ENOTCONN
+}
+
+// Stop waits a moment for d to exit, which it does once unmounted, and
+// kills it if it doesn't.
+func (d FuseDaemon) Stop() error {
+	for i := 0; i < 100; i++ {
+		if !d.Running() {
+			return nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	log.Warnf("%s (pid %d) for %s didn't exit, stopping it", d.Name(), d.Pid, d.Mountpoint)
+	if err := unix.Kill(d.Pid, unix.SIGTERM); err != nil && err != unix.ESRCH {
+		return errors.Wrapf(err, "couldn't stop pid %d", d.Pid)
+	}
+	return nil
+}
+
+// IsFuseType says whether a mountinfo filesystem type is a FUSE one.
+func IsFuseType(fsType string) bool {
+	return fsType == "fuse" || strings.HasPrefix(fsType, "fuse.")
+}
+
+// FuseUnmount unmounts a FUSE mount, through fusermount if it was made
+// through it and so can't be unmounted directly, then stops its daemon if
+// one was recorded in daemonFile.
+func FuseUnmount(mountpoint, daemonFile string) error {
+	if err := unix.Unmount(mountpoint, 0); err != nil {
+		fusermount := Which("fusermount3")
+		if fusermount == "" {
+			fusermount = Which("fusermount")
+		}
+		if fusermount == "" {
+			return errors.Wrapf(err, "failed unmounting %v", mountpoint)
+		}
+		if out, err := exec.Command(fusermount, "-u", mountpoint).CombinedOutput(); err != nil {
+			return errors.Wrapf(err, "failed unmounting %v: %s", mountpoint, strings.TrimSpace(string(out)))
+		}
+	}
+
+	d, err := ReadFuseDaemon(daemonFile)
+	if err != nil {
+		// nothing recorded, so nothing to stop
+		log.Debugf("no fuse daemon recorded for %s: %v", mountpoint, err)
+		return nil
+	}
+	if err := d.Stop(); err != nil {
+		return err
+	}
+	return errors.WithStack(os.Remove(daemonFile))
+}
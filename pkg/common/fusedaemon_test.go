@@ -0,0 +1,46 @@
+package common
+
+import (
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFuseDaemonFile(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	assert.Equal("/meta/mounts/.abc-fuse.json", FuseDaemonFile("/meta/mounts/abc"))
+	assert.Equal("/meta/mounts/.abc-fuse.json", FuseDaemonFile("/meta/mounts/abc/"))
+}
+
+func TestFuseDaemonRecord(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	dir := t.TempDir()
+	cmd := exec.Command("sleep", "60")
+	assert.NoError(cmd.Start())
+
+	file := filepath.Join(dir, "daemon.json")
+	assert.NoError(RecordFuseDaemon(file, cmd, dir))
+	d, err := ReadFuseDaemon(file)
+	assert.NoError(err)
+	assert.Equal(cmd.Process.Pid, d.Pid)
+	assert.Equal([]string{"sleep", "60"}, d.Cmdline)
+	assert.Equal("sleep", d.Name())
+	assert.True(d.Running())
+	assert.True(d.Alive())
+
+	// a different start time means the pid was reused
+	reused := *d
+	reused.StartTime++
+	assert.False(reused.Running())
+
+	assert.NoError(cmd.Process.Kill())
+	_ = cmd.Wait()
+	assert.False(d.Running())
+	assert.False(d.Alive())
+}
@@ -0,0 +1,140 @@
+package common
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// KernelVersion is a kernel's major.minor release.
+type KernelVersion struct {
+	Major int
+	Minor int
+}
+
+func (v KernelVersion) String() string {
+	return fmt.Sprintf("%d.%d", v.Major, v.Minor)
+}
+
+// AtLeast says whether v is the same as or newer than o.
+func (v KernelVersion) AtLeast(o KernelVersion) bool {
+	return v.Major > o.Major || (v.Major == o.Major && v.Minor >= o.Minor)
+}
+
+// ParseKernelVersion parses the start of a release such as "6.8.0-31-generic".
+func ParseKernelVersion(release string) (KernelVersion, error) {
+	fields := strings.SplitN(release, ".", 3)
+	if len(fields) < 2 {
+		return KernelVersion{}, errors.Errorf("bad kernel release %q", release)
+	}
+	major, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return KernelVersion{}, errors.Errorf("bad kernel release %q", release)
+	}
+	minor := strings.TrimLeft(fields[1], "0123456789")
+	minorNum, err := strconv.Atoi(strings.TrimSuffix(fields[1], minor))
+	if err != nil {
+		return KernelVersion{}, errors.Errorf("bad kernel release %q", release)
+	}
+	return KernelVersion{Major: major, Minor: minorNum}, nil
+}
+
+// RunningKernelVersion returns the version of the running kernel.
+func RunningKernelVersion() (KernelVersion, error) {
+	var uts unix.Utsname
+	if err := unix.Uname(&uts); err != nil {
+		return KernelVersion{}, errors.WithStack(err)
+	}
+	return ParseKernelVersion(unix.ByteSliceToString(uts.Release[:]))
+}
+
+// KernelConfig is a kernel's build configuration, e.g.
+// "CONFIG_SQUASHFS_ZSTD": "y". Options that are not set are "n", and those
+// the kernel doesn't have missing.
+type KernelConfig map[string]string
+
+// ParseKernelConfig parses a kernel's .config.
+func ParseKernelConfig(r io.Reader) (KernelConfig, error) {
+	config := KernelConfig{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if option, ok := strings.CutPrefix(line, "# "); ok {
+			if option, ok = strings.CutSuffix(option, " is not set"); ok {
+				config[option] = "n"
+			}
+			continue
+		}
+		if option, value, ok := strings.Cut(line, "="); ok {
+			config[option] = value
+		}
+	}
+	return config, errors.WithStack(scanner.Err())
+}
+
+// Enabled says whether option is built in or a module, and whether the
+// config says: ok is false if the kernel doesn't have the option.
+func (c KernelConfig) Enabled(option string) (enabled bool, ok bool) {
+	value, ok := c[option]
+	return value == "y" || value == "m", ok
+}
+
+// RunningKernelConfig reads the running kernel's config from /proc/config.gz,
+// or /boot/config-<release>. It returns nil if neither is there, when what
+// the kernel supports can only be guessed from its version.
+func RunningKernelConfig() (KernelConfig, error) {
+	if f, err := os.Open("/proc/config.gz"); err == nil {
+		defer f.Close()
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, errors.Wrapf(err, "couldn't read /proc/config.gz")
+		}
+		defer gz.Close()
+		return ParseKernelConfig(gz)
+	}
+
+	var uts unix.Utsname
+	if err := unix.Uname(&uts); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	f, err := os.Open("/boot/config-" + unix.ByteSliceToString(uts.Release[:]))
+	if err != nil {
+		if os.IsNotExist(err) || os.IsPermission(err) {
+			return nil, nil
+		}
+		return nil, errors.WithStack(err)
+	}
+	defer f.Close()
+	return ParseKernelConfig(f)
+}
+
+// UnsupportedFeatureError says that an image can't be used by one way of
+// mounting or extracting it, and which others could.
+type UnsupportedFeatureError struct {
+	Image   string
+	Feature string
+	// By is what can't handle Feature, e.g. "kernel 5.15" or "goerofs".
+	By string
+	// Guessed says that By was only judged by its version not to support
+	// Feature, e.g. as the kernel's config couldn't be read.
+	Guessed      bool
+	Alternatives []string
+}
+
+func (e *UnsupportedFeatureError) Error() string {
+	msg := fmt.Sprintf("%s uses %s, which %s doesn't support", e.Image, e.Feature, e.By)
+	if e.Guessed {
+		msg = fmt.Sprintf("%s uses %s, which %s probably doesn't support (judging by its version alone)", e.Image, e.Feature, e.By)
+	}
+	if len(e.Alternatives) > 0 {
+		msg += fmt.Sprintf("; try %s instead", strings.Join(e.Alternatives, " or "))
+	}
+	return msg
+}
@@ -7,6 +7,7 @@ import (
 
 	"github.com/pkg/errors"
 	"golang.org/x/sys/unix"
+	"machinerun.io/atomfs/pkg/log"
 	"machinerun.io/atomfs/pkg/mount"
 	"machinerun.io/atomfs/pkg/verity"
 )
@@ -39,6 +40,12 @@ func GuestMount(fsImgFile string, mountpoint string, fuseCmd FuseCmd) error {
 		return err
 	}
 
+	// we won't wait for it, but want to know later whether it's still
+	// serving the mount
+	if err := RecordFuseDaemon(FuseDaemonFile(mountpoint), cmd, mountpoint); err != nil {
+		log.Warnf("%s won't be supervised: %v", mountpoint, err)
+	}
+
 	if err := cmd.Process.Release(); err != nil {
 		return errors.Errorf("Failed to release process after guestmount %s: %v", fsImgFile, err)
 	}
@@ -49,6 +56,14 @@ func GuestMount(fsImgFile string, mountpoint string, fuseCmd FuseCmd) error {
 // it. Only use this if you are sure the underlying devices aren't in use by
 // other mount points.
 func Umount(mountpoint string) error {
+	mounts, err := mount.ParseMounts("/proc/self/mountinfo")
+	if err != nil {
+		return err
+	}
+	if m, found := mounts.FindMount(mountpoint); found && IsFuseType(m.FSType) {
+		return FuseUnmount(mountpoint, FuseDaemonFile(mountpoint))
+	}
+
 	devPath, err := GetBackingDevice(mountpoint)
 
 	err = unix.Unmount(mountpoint, 0)
@@ -99,6 +114,45 @@ func MaybeCleanupBackingDevice(devPath string) error {
 	return nil
 }
 
+// LoopBackingFiles returns the files backing loop devices, mapped to the
+// devices using them: the loop device and any device mapper devices, e.g.
+// dm-verity ones, on top of it.
+func LoopBackingFiles() (map[string][]string, error) {
+	loops, err := filepath.Glob("/sys/block/loop*/loop/backing_file")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	ret := map[string][]string{}
+	for _, f := range loops {
+		content, err := os.ReadFile(f)
+		if err != nil {
+			if os.IsNotExist(err) {
+				// detached since
+				continue
+			}
+			return nil, errors.WithStack(err)
+		}
+		file := strings.TrimSuffix(strings.TrimSpace(string(content)), " (deleted)")
+
+		dev := filepath.Base(filepath.Dir(filepath.Dir(f)))
+		devs := []string{"/dev/" + dev}
+		holders, err := os.ReadDir(filepath.Join("/sys/block", dev, "holders"))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, errors.WithStack(err)
+		}
+		for _, h := range holders {
+			if name, err := os.ReadFile(filepath.Join("/sys/block", h.Name(), "dm", "name")); err == nil {
+				devs = append(devs, "/dev/mapper/"+strings.TrimSpace(string(name)))
+			} else {
+				devs = append(devs, "/dev/"+h.Name())
+			}
+		}
+		ret[file] = append(ret[file], devs...)
+	}
+	return ret, nil
+}
+
 func IsMountpoint(dest string) bool {
 	mounted, err := mount.IsMountpoint(dest)
 	return err == nil && mounted
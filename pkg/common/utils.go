@@ -5,6 +5,7 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"golang.org/x/sys/unix"
@@ -12,6 +13,10 @@ import (
 
 var TestOverrideRuntimeDirKey = "ATOMFS_TEST_RUN_DIR"
 
+// SourceDateEpochKey is the environment variable defined by
+// https://reproducible-builds.org/specs/source-date-epoch/
+const SourceDateEpochKey = "SOURCE_DATE_EPOCH"
+
 func EnsureDir(dir string) error {
 	err := os.MkdirAll(dir, 0755)
 	if err != nil {
@@ -59,6 +64,38 @@ func RuntimeDir(metadir string) string {
 	return testOverrideDir
 }
 
+// SourceDateEpoch returns the timestamp from SOURCE_DATE_EPOCH, and whether
+// it was set at all. When it is set, images should be built reproducibly.
+func SourceDateEpoch() (int64, bool, error) {
+	val := os.Getenv(SourceDateEpochKey)
+	if val == "" {
+		return 0, false, nil
+	}
+	epoch, err := strconv.ParseInt(val, 10, 64)
+	if err != nil || epoch < 0 {
+		return 0, false, fmt.Errorf("invalid %s %q: must be a non-negative integer", SourceDateEpochKey, val)
+	}
+	return epoch, true, nil
+}
+
+// EnvWithout returns the current environment minus the given variables.
+func EnvWithout(keys ...string) []string {
+	env := []string{}
+	for _, kv := range os.Environ() {
+		drop := false
+		for _, k := range keys {
+			if strings.HasPrefix(kv, k+"=") {
+				drop = true
+				break
+			}
+		}
+		if !drop {
+			env = append(env, kv)
+		}
+	}
+	return env
+}
+
 func IsEmptyDir(path string) (bool, error) {
 	fh, err := os.Open(path)
 	if err != nil {
@@ -0,0 +1,174 @@
+package common
+
+import (
+	"archive/tar"
+	"io"
+	"maps"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// OCI layer whiteouts, see the image-spec's layer.md
+	WhiteoutPrefix = ".wh."
+	WhiteoutOpaque = WhiteoutPrefix + WhiteoutPrefix + ".opq"
+
+	// molecules are mounted with "userxattr", so overlay looks for its
+	// opaque marker in the user namespace.
+	OverlayOpaqueXattr = "user.overlay.opaque"
+
+	paxXattrPrefix = "SCHILY.xattr."
+)
+
+type whiteoutReader struct {
+	pr   *io.PipeReader
+	done chan error
+}
+
+// NewOverlayWhiteoutReader returns a reader that yields the tar stream src
+// with OCI whiteouts translated to their overlayfs equivalents: ".wh.name"
+// entries become 0:0 character devices called "name", and a ".wh..wh..opq"
+// entry marks its parent directory opaque via an xattr. Close() returns any
+// error encountered while converting.
+func NewOverlayWhiteoutReader(src io.Reader) io.ReadCloser {
+	pr, pw := io.Pipe()
+	r := &whiteoutReader{pr: pr, done: make(chan error, 1)}
+	go func() {
+		err := convertOCIWhiteouts(src, pw)
+		pw.CloseWithError(err)
+		r.done <- err
+	}()
+	return r
+}
+
+func (r *whiteoutReader) Read(p []byte) (int, error) {
+	return r.pr.Read(p)
+}
+
+func (r *whiteoutReader) Close() error {
+	r.pr.Close()
+	err := <-r.done
+	if errors.Is(err, io.ErrClosedPipe) {
+		// the consumer stopped reading early; it will report why.
+		return nil
+	}
+	return err
+}
+
+func setOpaque(hdr *tar.Header) {
+	if hdr.PAXRecords == nil {
+		hdr.PAXRecords = map[string]string{}
+	}
+	hdr.PAXRecords[paxXattrPrefix+OverlayOpaqueXattr] = "y"
+	// PAX records are only emitted in the PAX format
+	hdr.Format = tar.FormatPAX
+}
+
+func convertOCIWhiteouts(src io.Reader, dst io.Writer) error {
+	tr := tar.NewReader(src)
+	tw := tar.NewWriter(dst)
+
+	// Directory headers are held back by one entry, since the opaque
+	// marker for a directory conventionally follows it immediately and
+	// we'd like to set the xattr on the original header.
+	var pendingDir *tar.Header
+	// The headers of the directories written so far, so one whose opaque
+	// marker comes later can be written again with its own metadata.
+	dirs := map[string]*tar.Header{}
+	flushPending := func() error {
+		if pendingDir == nil {
+			return nil
+		}
+		hdr := pendingDir
+		pendingDir = nil
+		dirs[path.Clean(hdr.Name)] = hdr
+		return tw.WriteHeader(hdr)
+	}
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrapf(err, "failed reading tar stream")
+		}
+
+		dir, base := path.Split(path.Clean(hdr.Name))
+
+		if base == WhiteoutOpaque {
+			if dir == "" {
+				// the marker makes the layer's root opaque
+				dir = "./"
+			}
+			if pendingDir != nil && path.Clean(pendingDir.Name) == path.Clean(dir) {
+				setOpaque(pendingDir)
+				continue
+			}
+
+			// The directory was already written (or never appears in
+			// this layer); emit it (again) carrying the xattr.
+			if err := flushPending(); err != nil {
+				return err
+			}
+			opaque := &tar.Header{
+				Typeflag: tar.TypeDir,
+				Name:     dir,
+				Mode:     0755,
+				Uid:      hdr.Uid,
+				Gid:      hdr.Gid,
+				ModTime:  hdr.ModTime,
+			}
+			if written, ok := dirs[path.Clean(dir)]; ok {
+				copied := *written
+				copied.PAXRecords = maps.Clone(written.PAXRecords)
+				opaque = &copied
+			}
+			setOpaque(opaque)
+			if err := tw.WriteHeader(opaque); err != nil {
+				return errors.Wrapf(err, "failed writing opaque dir %q", dir)
+			}
+			continue
+		}
+
+		if err := flushPending(); err != nil {
+			return err
+		}
+
+		if strings.HasPrefix(base, WhiteoutPrefix) {
+			whiteout := &tar.Header{
+				Typeflag: tar.TypeChar,
+				Name:     path.Join(dir, strings.TrimPrefix(base, WhiteoutPrefix)),
+				Uid:      hdr.Uid,
+				Gid:      hdr.Gid,
+				ModTime:  hdr.ModTime,
+				Devmajor: 0,
+				Devminor: 0,
+			}
+			if err := tw.WriteHeader(whiteout); err != nil {
+				return errors.Wrapf(err, "failed writing whiteout for %q", hdr.Name)
+			}
+			continue
+		}
+
+		if hdr.Typeflag == tar.TypeDir {
+			pendingDir = hdr
+			continue
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return errors.Wrapf(err, "failed writing header for %q", hdr.Name)
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return errors.Wrapf(err, "failed copying %q", hdr.Name)
+		}
+	}
+
+	if err := flushPending(); err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
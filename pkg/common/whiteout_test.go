@@ -0,0 +1,75 @@
+package common
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOverlayWhiteoutReader(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, h := range []*tar.Header{
+		{Typeflag: tar.TypeDir, Name: "a/", Mode: 0755},
+		{Typeflag: tar.TypeReg, Name: "a/.wh..wh..opq"},
+		{Typeflag: tar.TypeReg, Name: "a/.wh.b"},
+		{Typeflag: tar.TypeDir, Name: "c/", Mode: 0700, Uid: 1000, Gid: 1000},
+		{Typeflag: tar.TypeReg, Name: "c/d", Mode: 0644, Size: 3},
+		{Typeflag: tar.TypeReg, Name: "c/.wh..wh..opq", Mode: 0644},
+		// a marker for a dir that isn't in the layer
+		{Typeflag: tar.TypeReg, Name: "e/.wh..wh..opq"},
+		// and one for the root
+		{Typeflag: tar.TypeReg, Name: ".wh..wh..opq"},
+	} {
+		assert.NoError(tw.WriteHeader(h))
+		if h.Size != 0 {
+			_, err := tw.Write([]byte("foo"))
+			assert.NoError(err)
+		}
+	}
+	assert.NoError(tw.Close())
+
+	r := NewOverlayWhiteoutReader(&buf)
+	tr := tar.NewReader(r)
+
+	type entry struct {
+		name   string
+		typ    byte
+		mode   int64
+		uid    int
+		opaque bool
+	}
+	entries := []entry{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(err)
+		_, opaque := hdr.PAXRecords["SCHILY.xattr."+OverlayOpaqueXattr]
+		entries = append(entries, entry{hdr.Name, hdr.Typeflag, hdr.Mode, hdr.Uid, opaque})
+		if hdr.Name == "c/d" {
+			content, err := io.ReadAll(tr)
+			assert.NoError(err)
+			assert.Equal("foo", string(content))
+		}
+	}
+	assert.NoError(r.Close())
+
+	assert.Equal([]entry{
+		{"a/", tar.TypeDir, 0755, 0, true},
+		{"a/b", tar.TypeChar, 0, 0, false},
+		{"c/", tar.TypeDir, 0700, 1000, false},
+		{"c/d", tar.TypeReg, 0644, 0, false},
+		// written again as it was, but opaque
+		{"c/", tar.TypeDir, 0700, 1000, true},
+		{"e/", tar.TypeDir, 0755, 0, true},
+		{"./", tar.TypeDir, 0755, 0, true},
+	}, entries)
+}
@@ -0,0 +1,347 @@
+// Package composefs builds and mounts atoms made the way composefs makes
+// images: an erofs image holding only metadata, whose regular files
+// redirect to objects named by their fs-verity digests in a store shared by
+// every atom in the OCI layout. The image is mounted as an overlay's lower
+// layer with the store as a data-only layer below it, so files that are the
+// same in many atoms are stored, and cached, once. It wraps mkcomposefs,
+// from the composefs project, to write the erofs image.
+package composefs
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+	"machinerun.io/atomfs/pkg/common"
+	"machinerun.io/atomfs/pkg/erofs"
+	"machinerun.io/atomfs/pkg/extract"
+	"machinerun.io/atomfs/pkg/imagefs"
+	"machinerun.io/atomfs/pkg/log"
+	types "machinerun.io/atomfs/pkg/types"
+	vrty "machinerun.io/atomfs/pkg/verity"
+)
+
+const PolicyEnvName = "ATOMFS_COMPOSEFS_EXTRACT_POLICY"
+const DefPolicies = "kmount gocomposefs"
+
+// minKernel is the first kernel whose overlay has everything composefs
+// atoms need: data-only lower layers (6.5), checking fs-verity digests
+// (6.6) and xwhiteouts, so whiteouts get through to the molecule (6.7).
+var minKernel = common.KernelVersion{Major: 6, Minor: 7}
+
+// MetaMountpoint is where the erofs image of the atom mounted at
+// mountpoint is mounted: path/to/.dir-composefs for path/to/dir.
+func MetaMountpoint(mountpoint string) string {
+	mountpoint = strings.TrimSuffix(mountpoint, "/")
+	return filepath.Join(filepath.Dir(mountpoint), "."+filepath.Base(mountpoint)+"-composefs")
+}
+
+// storeFor returns s, or if it's unset the store of the layout image is in.
+func storeFor(image string, s Store) (Store, error) {
+	if s.Dir != "" {
+		return s, nil
+	}
+	return StoreForBlob(image)
+}
+
+// MakeComposefs stores rootfs's files in s and builds an image of them,
+// leaving out what eps excludes. The return values are as for
+// erofs.MakeErofs. A verified image's objects must have fs-verity, so with
+// verity it fails if s's filesystem doesn't support it.
+func MakeComposefs(tempdir string, rootfs string, eps *common.ExcludePaths, s Store, verity vrty.VerityMetadata, opts types.MakeOptions) (io.ReadCloser, string, string, error) {
+	if err := checkMakeOptions(opts); err != nil {
+		return nil, "", "", err
+	}
+	// overlay won't read a verified atom's objects without fs-verity
+	s.RequireVerity = s.RequireVerity || bool(verity)
+	t, err := treeFromDir(s, rootfs, eps)
+	if err != nil {
+		return nil, "", "", err
+	}
+	return build(tempdir, t, verity)
+}
+
+// MakeComposefsFromTar is MakeComposefs for an uncompressed tar layer,
+// which needn't be unpacked first.
+func MakeComposefsFromTar(tempdir string, tarStream io.Reader, s Store, verity vrty.VerityMetadata, opts types.MakeOptions) (io.ReadCloser, string, string, error) {
+	if err := checkMakeOptions(opts); err != nil {
+		return nil, "", "", err
+	}
+	// overlay won't read a verified atom's objects without fs-verity
+	s.RequireVerity = s.RequireVerity || bool(verity)
+	t, err := treeFromTar(s, tarStream)
+	if err != nil {
+		return nil, "", "", err
+	}
+	return build(tempdir, t, verity)
+}
+
+func checkMakeOptions(opts types.MakeOptions) error {
+	if opts.Compression != "" && opts.Compression != "none" {
+		return errors.Errorf("composefs images only hold metadata, and can't be compressed")
+	}
+	if common.Which("mkcomposefs") == "" {
+		return errors.Errorf("no 'mkcomposefs' in PATH")
+	}
+	return nil
+}
+
+// build has mkcomposefs write the image for t.
+func build(tempdir string, t tree, verity vrty.VerityMetadata) (io.ReadCloser, string, string, error) {
+	var rootHash string
+
+	epoch, reproducible, err := common.SourceDateEpoch()
+	if err != nil {
+		return nil, "", rootHash, err
+	}
+	if reproducible {
+		for _, e := range t {
+			e.mtime = time.Unix(epoch, 0)
+		}
+	}
+	t.convertWhiteouts()
+
+	dump, err := os.CreateTemp(tempdir, "atomfs-composefs-dump-")
+	if err != nil {
+		return nil, "", rootHash, errors.WithStack(err)
+	}
+	defer os.Remove(dump.Name())
+	err = t.write(dump)
+	if cerr := dump.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, "", rootHash, errors.Wrapf(err, "couldn't write composefs dump file")
+	}
+
+	tmpImage, err := os.CreateTemp(tempdir, "atomfs-composefs-img-")
+	if err != nil {
+		return nil, "", rootHash, errors.WithStack(err)
+	}
+	tmpImage.Close()
+	defer os.Remove(tmpImage.Name())
+
+	cmd := exec.Command("mkcomposefs", "--from-file", dump.Name(), tmpImage.Name())
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return nil, "", rootHash, errors.Wrap(err, "couldn't build composefs image")
+	}
+
+	if verity {
+		if reproducible {
+			rootHash, err = vrty.AppendReproducibleVerityData(tmpImage.Name())
+		} else {
+			rootHash, err = vrty.AppendVerityData(tmpImage.Name())
+		}
+		if err != nil {
+			return nil, "", rootHash, err
+		}
+	}
+
+	blob, err := os.Open(tmpImage.Name())
+	if err != nil {
+		return nil, "", rootHash, errors.WithStack(err)
+	}
+	return blob, BaseMediaTypeLayerComposefs, rootHash, nil
+}
+
+// Inspect describes a composefs image; it's an erofs one underneath.
+func Inspect(image string) (*types.ImageInfo, error) {
+	info, err := erofs.Inspect(image)
+	if err != nil {
+		return nil, err
+	}
+	info.Type = "composefs"
+	return info, nil
+}
+
+// checkKernel says why this kernel can't mount composefs atoms, if it
+// can't.
+func checkKernel() error {
+	v, err := common.RunningKernelVersion()
+	if err != nil {
+		return err
+	}
+	if !v.AtLeast(minKernel) {
+		return errors.Errorf("composefs atoms need kernel %s, this is %s", minKernel, v)
+	}
+	return nil
+}
+
+// hostMount mounts image's erofs image at MetaMountpoint(mountpoint),
+// protected by dm-verity if there's a rootHash, and the overlay combining
+// it with s at mountpoint. Overlay checks the objects' fs-verity digests
+// against the ones in the image if it's verified, and otherwise wherever
+// the objects have fs-verity enabled.
+func hostMount(image, mountpoint, rootHash string, s Store) error {
+	if err := checkKernel(); err != nil {
+		return err
+	}
+	info, err := erofs.Inspect(image)
+	if err != nil {
+		return err
+	}
+
+	meta := MetaMountpoint(mountpoint)
+	if err := os.MkdirAll(meta, 0755); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := common.HostMount(image, "erofs", meta, rootHash, info.Size, info.VerityOffset); err != nil {
+		return err
+	}
+
+	verity := "on"
+	if rootHash != "" {
+		verity = "require"
+	}
+	opts := fmt.Sprintf("lowerdir=%s::%s,redirect_dir=on,metacopy=on,verity=%s", meta, s.Dir, verity)
+	if err := unix.Mount("composefs", mountpoint, "overlay", unix.MS_RDONLY, opts); err != nil {
+		if uerr := common.Umount(meta); uerr != nil {
+			log.Warnf("cleanup: failed to unmount %s: %v", meta, uerr)
+		}
+		return errors.Wrapf(err, "couldn't mount composefs overlay at %s, opts: %s", mountpoint, opts)
+	}
+	return nil
+}
+
+// Umount unmounts a composefs atom and its erofs image.
+func Umount(mountpoint string) error {
+	if err := unix.Unmount(mountpoint, 0); err != nil {
+		return errors.Wrapf(err, "failed unmounting %v", mountpoint)
+	}
+	meta := MetaMountpoint(mountpoint)
+	if err := common.Umount(meta); err != nil {
+		return err
+	}
+	return errors.WithStack(os.Remove(meta))
+}
+
+type ExtractPolicy = extract.Policy
+
+// Extractors returns all the ways of extracting composefs images, finding
+// their objects in s, or if it's unset in their OCI layout's store.
+func Extractors(s Store) []types.FsExtractor {
+	return []types.FsExtractor{
+		&KernelExtractor{store: s},
+		&GoComposefsExtractor{store: s},
+	}
+}
+
+// KernelExtractor mounts the image, which needs host root.
+type KernelExtractor struct {
+	store Store
+	mutex sync.Mutex
+}
+
+func (k *KernelExtractor) Name() string {
+	return "kmount"
+}
+
+func (k *KernelExtractor) IsAvailable() error {
+	if !common.AmHostRoot() {
+		return errors.Errorf("not host root")
+	}
+	return checkKernel()
+}
+
+func (k *KernelExtractor) Mount(image, extractDir string) error {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	if common.IsMountpoint(extractDir) {
+		return nil
+	}
+	s, err := storeFor(image, k.store)
+	if err != nil {
+		return err
+	}
+	return hostMount(image, extractDir, "", s)
+}
+
+// GoComposefsExtractor extracts with the built in reader, so it needs
+// neither privileges nor any tools.
+type GoComposefsExtractor struct {
+	store Store
+	mutex sync.Mutex
+}
+
+func (k *GoComposefsExtractor) Name() string {
+	return "gocomposefs"
+}
+
+func (k *GoComposefsExtractor) IsAvailable() error {
+	return nil
+}
+
+func (k *GoComposefsExtractor) Mount(image, extractDir string) error {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	// check if already extracted
+	empty, err := common.IsEmptyDir(extractDir)
+	if err != nil {
+		return errors.Wrapf(err, "Error checking for empty dir")
+	}
+	if !empty {
+		return nil
+	}
+
+	s, err := storeFor(image, k.store)
+	if err != nil {
+		return err
+	}
+	log.Debugf("gocomposefs %s -> %s", image, extractDir)
+	cfs, err := OpenWithStore(image, s)
+	if err != nil {
+		return err
+	}
+	defer cfs.Close()
+
+	if err := imagefs.Extract(cfs, extractDir); err != nil {
+		if rmErr := os.RemoveAll(extractDir); rmErr != nil {
+			log.Errorf("Failed to remove %s after failed extraction of %s: %v", extractDir, image, rmErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// ExtractSingleComposefsVerified - extract image to extractDir as policy
+// says, checking it against rootHash first if the policy requires verity.
+func ExtractSingleComposefsVerified(image, extractDir, rootHash string, policy *ExtractPolicy) error {
+	if policy == nil {
+		return errors.Errorf("policy cannot be nil")
+	}
+	if !policy.RequireVerity {
+		return policy.Extract(image, extractDir)
+	}
+	info, err := Inspect(image)
+	if err != nil {
+		return err
+	}
+	return policy.ExtractVerified(image, extractDir, info.VerityOffset, rootHash)
+}
+
+// DefaultExtractPolicy returns the policy ExtractSingleComposefs uses, set
+// up by the extract config file and $ATOMFS_COMPOSEFS_EXTRACT_POLICY.
+func DefaultExtractPolicy() (*ExtractPolicy, error) {
+	return extract.Default("composefs", Extractors(Store{}), PolicyEnvName, DefPolicies)
+}
+
+// ExtractSingleComposefs - extract image, a blob in an OCI layout, to
+// extractDir with the default policy.
+func ExtractSingleComposefs(image, extractDir string) error {
+	policy, err := DefaultExtractPolicy()
+	if err != nil {
+		return err
+	}
+	return ExtractSingleComposefsVerified(image, extractDir, "", policy)
+}
@@ -0,0 +1,216 @@
+package composefs
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"machinerun.io/atomfs/pkg/common"
+	"machinerun.io/atomfs/pkg/fsverity"
+	types "machinerun.io/atomfs/pkg/types"
+	"machinerun.io/atomfs/pkg/verity"
+)
+
+func TestStore(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	ocidir := t.TempDir()
+	s := LayoutStore(ocidir)
+	digest, size, err := s.Add(strings.NewReader("hello"))
+	assert.NoError(err)
+	assert.EqualValues(5, size)
+	content, err := os.ReadFile(s.Path(digest))
+	assert.NoError(err)
+	assert.Equal("hello", string(content))
+	assert.Equal(filepath.Join(ocidir, "objects", digest[:2], digest[2:]), s.Path(digest))
+
+	// the same content is only stored once
+	again, _, err := s.Add(strings.NewReader("hello"))
+	assert.NoError(err)
+	assert.Equal(digest, again)
+	objects, err := filepath.Glob(filepath.Join(ocidir, "objects", "*", "*"))
+	assert.NoError(err)
+	assert.Len(objects, 1)
+
+	found, err := StoreForBlob(filepath.Join(ocidir, "blobs", "sha256", "0123"))
+	assert.NoError(err)
+	assert.Equal(s, found)
+	_, err = StoreForBlob(filepath.Join(ocidir, "image"))
+	assert.Error(err)
+}
+
+func TestStoreRequireVerity(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	ocidir := t.TempDir()
+	s := LayoutStore(ocidir)
+	digest, _, err := s.Add(strings.NewReader("hello"))
+	assert.NoError(err)
+
+	s.RequireVerity = true
+	_, _, err = s.Add(strings.NewReader("hello"))
+	if !hasFsverity(t, ocidir) {
+		assert.ErrorContains(err, "need fs-verity on their objects")
+		_, _, err = s.Add(strings.NewReader("world"))
+		assert.ErrorContains(err, "need fs-verity on their objects")
+		return
+	}
+	// the object added without it has it now
+	assert.NoError(err)
+	assert.NoError(fsverity.Verify(s.Path(digest), digest))
+}
+
+// hasFsverity says whether dir's filesystem supports fs-verity.
+func hasFsverity(t *testing.T, dir string) bool {
+	f, err := os.CreateTemp(dir, "probe-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	return fsverity.Enable(f.Name()) == nil
+}
+
+func TestTreeFromTar(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	mtime := time.Unix(1700000000, 0)
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, h := range []*tar.Header{
+		{Typeflag: tar.TypeDir, Name: "etc/", Mode: 0755, ModTime: mtime},
+		{Typeflag: tar.TypeReg, Name: "etc/os-release", Mode: 0644, Size: 5, ModTime: mtime},
+		{Typeflag: tar.TypeReg, Name: "etc/empty", Mode: 0600, ModTime: mtime},
+		{Typeflag: tar.TypeLink, Name: "etc/link", Linkname: "etc/os-release"},
+		{Typeflag: tar.TypeSymlink, Name: "usr/lib/my file", Linkname: "-", ModTime: mtime},
+		{Typeflag: tar.TypeReg, Name: "etc/.wh.gone", ModTime: mtime},
+		{Typeflag: tar.TypeReg, Name: "var/.wh..wh..opq", ModTime: mtime},
+	} {
+		assert.NoError(tw.WriteHeader(h))
+		if h.Size != 0 {
+			_, err := tw.Write([]byte("hello"))
+			assert.NoError(err)
+		}
+	}
+	assert.NoError(tw.Close())
+
+	s := LayoutStore(t.TempDir())
+	tr, err := treeFromTar(s, &buf)
+	assert.NoError(err)
+	tr.convertWhiteouts()
+
+	var dump bytes.Buffer
+	assert.NoError(tr.write(&dump))
+	lines := strings.Split(strings.TrimSpace(dump.String()), "\n")
+
+	digest, _, err := s.Add(strings.NewReader("hello"))
+	assert.NoError(err)
+	assert.Equal([]string{
+		"/ 0 40755 1 0 0 0 0.0 - - -",
+		"/etc 0 40755 1 0 0 0 1700000000.0 - - - user.overlay.whiteouts=",
+		"/etc/empty 0 100600 1 0 0 0 1700000000.0 - - -",
+		"/etc/gone 0 100644 1 0 0 0 1700000000.0 - - - user.overlay.whiteout=",
+		"/etc/link 0 @120000 - - - - 0.0 /etc/os-release - -",
+		"/etc/os-release 5 100644 1 0 0 0 1700000000.0 " + ObjectPath(digest) + " - " + digest,
+		"/usr 0 40755 1 0 0 0 1700000000.0 - - -",
+		"/usr/lib 0 40755 1 0 0 0 1700000000.0 - - -",
+		`/usr/lib/my\x20file 1 120000 1 0 0 0 1700000000.0 \x2d - -`,
+		"/var 0 40755 1 0 0 0 1700000000.0 - - - user.overlay.opaque=y",
+	}, lines)
+}
+
+func TestReader(t *testing.T) {
+	assert := assert.New(t)
+
+	if common.Which("mkcomposefs") == "" {
+		t.Skip("mkcomposefs not found")
+	}
+
+	rootfs := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(rootfs, "dir", "sub"), 0750))
+	require.NoError(t, os.WriteFile(filepath.Join(rootfs, "dir", "big"), bytes.Repeat([]byte("atomfs"), 100000), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(rootfs, "dir", "sub", "small"), []byte("hello"), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(rootfs, "dir", "same"), []byte("hello"), 0600))
+	require.NoError(t, os.Symlink("dir/sub", filepath.Join(rootfs, "link")))
+
+	ocidir := t.TempDir()
+	s := LayoutStore(ocidir)
+	// a verified image's objects need fs-verity, which not every
+	// filesystem tests run on has
+	v := verity.VerityMetadataPresent
+	if !hasFsverity(t, ocidir) {
+		v = verity.VerityMetadataMissing
+	}
+	reader, mediaType, _, err := MakeComposefs(t.TempDir(), rootfs, nil, s, v, types.MakeOptions{})
+	if err == verity.CryptsetupTooOld {
+		t.Skip("libcryptsetup too old")
+	}
+	require.NoError(t, err)
+	assert.Equal(BaseMediaTypeLayerComposefs, mediaType)
+
+	image := filepath.Join(ocidir, "blobs", "sha256", "image")
+	require.NoError(t, os.MkdirAll(filepath.Dir(image), 0755))
+	out, err := os.Create(image)
+	require.NoError(t, err)
+	_, err = io.Copy(out, reader)
+	require.NoError(t, err)
+	reader.Close()
+	out.Close()
+
+	// small and same share an object
+	objects, err := filepath.Glob(filepath.Join(ocidir, "objects", "*", "*"))
+	assert.NoError(err)
+	assert.Len(objects, 2)
+	needed, err := AtomObjects(image, BaseMediaTypeLayerComposefs)
+	assert.NoError(err)
+	assert.Len(needed, 2)
+	for _, o := range needed {
+		assert.Contains(objects, filepath.Join(s.Dir, o))
+	}
+	needed, err = AtomObjects(image, "")
+	assert.NoError(err)
+	assert.Len(needed, 2)
+	needed, err = AtomObjects(filepath.Join(rootfs, "dir", "big"), "")
+	assert.NoError(err)
+	assert.Empty(needed)
+
+	cfs, err := Open(image)
+	require.NoError(t, err)
+	defer cfs.Close()
+
+	content, err := fs.ReadFile(cfs, "link/small")
+	assert.NoError(err)
+	assert.Equal("hello", string(content))
+	content, err = fs.ReadFile(cfs, "dir/big")
+	assert.NoError(err)
+	assert.Equal(600000, len(content))
+
+	// a corrupted object is noticed
+	for _, o := range objects {
+		fi, err := os.Stat(o)
+		assert.NoError(err)
+		if fi.Size() == 5 {
+			assert.NoError(os.Chmod(o, 0644))
+			assert.NoError(os.WriteFile(o, []byte("jello"), 0644))
+		}
+	}
+	cfs, err = Open(image)
+	assert.NoError(err)
+	defer cfs.Close()
+	_, err = fs.ReadFile(cfs, "dir/same")
+	assert.Error(err)
+
+	extracted := t.TempDir()
+	assert.Error(ExtractSingleComposefsVerified(image, filepath.Join(extracted, "x"), "", &ExtractPolicy{Extractors: Extractors(s)[1:]}))
+}
@@ -0,0 +1,341 @@
+package composefs
+
+import (
+	"archive/tar"
+	"bufio"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+	"machinerun.io/atomfs/pkg/common"
+)
+
+// Molecules are mounted with "userxattr", so whiteouts that have to get
+// through the composefs overlay to the molecule's are written as overlay
+// "xwhiteouts": empty files with an xattr, in a directory marked as having
+// them. A 0:0 character device would be taken as a whiteout by the
+// composefs overlay itself.
+const (
+	xwhiteoutXattr  = "user.overlay.whiteout"
+	xwhiteoutsXattr = "user.overlay.whiteouts"
+)
+
+// entry is a line of the composefs-dump(5) file mkcomposefs builds an
+// image from.
+type entry struct {
+	path  string
+	size  int64
+	mode  uint32
+	uid   uint32
+	gid   uint32
+	rdev  uint64
+	mtime time.Time
+	// payload is a symlink's target or a regular file's object
+	payload string
+	digest  string
+	// hardlink is the path this one is a hard link to
+	hardlink string
+	xattrs   map[string]string
+}
+
+// tree collects a filesystem's entries, keyed by their absolute path.
+type tree map[string]*entry
+
+func newTree() tree {
+	return tree{"/": &entry{path: "/", mode: unix.S_IFDIR | 0755, mtime: time.Unix(0, 0), xattrs: map[string]string{}}}
+}
+
+// add adds e, replacing whatever was at its path, except that a directory
+// keeps the xattrs it had unless they're replaced.
+func (t tree) add(e *entry) {
+	e.path = path.Join("/", e.path)
+	if old, ok := t[e.path]; ok && old.mode&unix.S_IFMT == unix.S_IFDIR && e.mode&unix.S_IFMT == unix.S_IFDIR {
+		for k, v := range old.xattrs {
+			if _, ok := e.xattrs[k]; !ok {
+				e.xattrs[k] = v
+			}
+		}
+	}
+	t[e.path] = e
+
+	// tar streams needn't have entries for every directory
+	for dir := path.Dir(e.path); dir != "/"; dir = path.Dir(dir) {
+		if _, ok := t[dir]; ok {
+			break
+		}
+		t[dir] = &entry{path: dir, mode: unix.S_IFDIR | 0755, mtime: e.mtime, xattrs: map[string]string{}}
+	}
+}
+
+// convertWhiteouts turns 0:0 character devices into xwhiteouts.
+func (t tree) convertWhiteouts() {
+	for p, e := range t {
+		if e.mode&unix.S_IFMT != unix.S_IFCHR || e.rdev != 0 {
+			continue
+		}
+		e.mode = unix.S_IFREG | 0644
+		e.size = 0
+		e.xattrs[xwhiteoutXattr] = ""
+		t[path.Dir(p)].xattrs[xwhiteoutsXattr] = ""
+	}
+}
+
+// escape escapes s for a dump file field: anything but printable ASCII,
+// backslashes and the characters in special (such as "=" in xattrs) are
+// written as hex, as is a lone "-", which would mean there's no value.
+func escape(s, special string) string {
+	if s == "-" {
+		return `\x2d`
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c <= ' ' || c >= 0x7f || c == '\\' || strings.IndexByte(special, c) >= 0 {
+			fmt.Fprintf(&b, `\x%02x`, c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// optional is a field that's "-" when empty.
+func optional(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return escape(s, "")
+}
+
+// write writes t as a dump file, parents before their children.
+func (t tree) write(w io.Writer) error {
+	paths := make([]string, 0, len(t))
+	for p := range t {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	bw := bufio.NewWriter(w)
+	for _, p := range paths {
+		e := t[p]
+		if e.hardlink != "" {
+			fmt.Fprintf(bw, "%s 0 @120000 - - - - 0.0 %s - -\n", escape(e.path, ""), escape(e.hardlink, ""))
+			continue
+		}
+
+		fmt.Fprintf(bw, "%s %d %o 1 %d %d %d %d.%d %s - %s",
+			escape(e.path, ""), e.size, e.mode, e.uid, e.gid, e.rdev,
+			e.mtime.Unix(), e.mtime.Nanosecond(), optional(e.payload), optional(e.digest))
+
+		names := make([]string, 0, len(e.xattrs))
+		for k := range e.xattrs {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		for _, k := range names {
+			fmt.Fprintf(bw, " %s=%s", escape(k, "="), escape(e.xattrs[k], "="))
+		}
+		bw.WriteString("\n")
+	}
+	return errors.WithStack(bw.Flush())
+}
+
+// treeFromDir stores rootfs's files in s and returns its tree, leaving out
+// anything eps excludes (by its path in the host's filesystem).
+func treeFromDir(s Store, rootfs string, eps *common.ExcludePaths) (tree, error) {
+	t := newTree()
+	// hard links are found by inode
+	inodes := map[uint64]string{}
+
+	err := filepath.WalkDir(rootfs, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if eps != nil && eps.Excludes(p) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		rel, err := filepath.Rel(rootfs, p)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		var st unix.Stat_t
+		if err := unix.Lstat(p, &st); err != nil {
+			return errors.Wrapf(err, "couldn't stat %s", p)
+		}
+		xattrs, err := readXattrs(p)
+		if err != nil {
+			return err
+		}
+		e := &entry{
+			path:   rel,
+			mode:   st.Mode,
+			uid:    st.Uid,
+			gid:    st.Gid,
+			rdev:   st.Rdev,
+			mtime:  time.Unix(st.Mtim.Unix()),
+			xattrs: xattrs,
+		}
+
+		switch st.Mode & unix.S_IFMT {
+		case unix.S_IFREG:
+			if st.Nlink > 1 {
+				if target, ok := inodes[st.Ino]; ok {
+					t.add(&entry{path: rel, hardlink: target})
+					return nil
+				}
+				inodes[st.Ino] = path.Join("/", rel)
+			}
+			if st.Size > 0 {
+				if err := e.store(s, p); err != nil {
+					return err
+				}
+			}
+		case unix.S_IFLNK:
+			target, err := os.Readlink(p)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			e.payload = target
+			e.size = int64(len(target))
+		}
+		t.add(e)
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't walk %s", rootfs)
+	}
+	return t, nil
+}
+
+// store adds the content of the file at p to s, pointing e at it. Empty
+// files needn't redirect anywhere, so aren't stored.
+func (e *entry) store(s Store, p string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+	return e.storeFrom(s, f)
+}
+
+func (e *entry) storeFrom(s Store, r io.Reader) error {
+	digest, size, err := s.Add(r)
+	if err != nil {
+		return err
+	}
+	e.size = size
+	e.digest = digest
+	e.payload = ObjectPath(digest)
+	return nil
+}
+
+func readXattrs(p string) (map[string]string, error) {
+	xattrs := map[string]string{}
+	size, err := unix.Llistxattr(p, nil)
+	if err != nil || size == 0 {
+		// no xattr support is no xattrs
+		return xattrs, nil
+	}
+	buf := make([]byte, size)
+	size, err = unix.Llistxattr(p, buf)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't list xattrs of %s", p)
+	}
+	for _, name := range strings.Split(string(buf[:size]), "\x00") {
+		if name == "" {
+			continue
+		}
+		vsize, err := unix.Lgetxattr(p, name, nil)
+		if err != nil {
+			return nil, errors.Wrapf(err, "couldn't read xattr %s of %s", name, p)
+		}
+		value := make([]byte, vsize)
+		vsize, err = unix.Lgetxattr(p, name, value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "couldn't read xattr %s of %s", name, p)
+		}
+		xattrs[name] = string(value[:vsize])
+	}
+	return xattrs, nil
+}
+
+// treeFromTar stores the files of the uncompressed tar layer r in s and
+// returns its tree, with OCI whiteouts converted to overlay ones.
+func treeFromTar(s Store, r io.Reader) (tree, error) {
+	converted := common.NewOverlayWhiteoutReader(r)
+	t, err := readTar(s, converted)
+	if cerr := converted.Close(); err == nil {
+		err = cerr
+	}
+	return t, err
+}
+
+func readTar(s Store, r io.Reader) (tree, error) {
+	t := newTree()
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed reading tar stream")
+		}
+
+		e := &entry{
+			path:   hdr.Name,
+			mode:   uint32(hdr.Mode) & 07777,
+			uid:    uint32(hdr.Uid),
+			gid:    uint32(hdr.Gid),
+			mtime:  hdr.ModTime,
+			xattrs: map[string]string{},
+		}
+		for k, v := range hdr.PAXRecords {
+			if name, ok := strings.CutPrefix(k, "SCHILY.xattr."); ok {
+				e.xattrs[name] = v
+			}
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			e.mode |= unix.S_IFREG
+			if hdr.Size > 0 {
+				if err := e.storeFrom(s, tr); err != nil {
+					return nil, err
+				}
+			}
+		case tar.TypeLink:
+			e = &entry{path: hdr.Name, hardlink: path.Join("/", hdr.Linkname)}
+		case tar.TypeSymlink:
+			e.mode |= unix.S_IFLNK
+			e.payload = hdr.Linkname
+			e.size = int64(len(hdr.Linkname))
+		case tar.TypeDir:
+			e.mode |= unix.S_IFDIR
+		case tar.TypeChar:
+			e.mode |= unix.S_IFCHR
+			e.rdev = unix.Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor))
+		case tar.TypeBlock:
+			e.mode |= unix.S_IFBLK
+			e.rdev = unix.Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor))
+		case tar.TypeFifo:
+			e.mode |= unix.S_IFIFO
+		default:
+			continue
+		}
+		t.add(e)
+	}
+	return t, nil
+}
@@ -0,0 +1,83 @@
+package composefs
+
+import (
+	"io"
+
+	"github.com/pkg/errors"
+	"machinerun.io/atomfs/pkg/common"
+	"machinerun.io/atomfs/pkg/extract"
+	types "machinerun.io/atomfs/pkg/types"
+	"machinerun.io/atomfs/pkg/verity"
+)
+
+type composefs struct {
+	store Store
+}
+
+// New returns the composefs backend, which finds each image's objects in
+// the store of the OCI layout it's in. It can't make images, since it
+// doesn't know where to store their files.
+func New() *composefs {
+	return &composefs{}
+}
+
+// NewWithStore returns the composefs backend using the store s, such as
+// LayoutStore(ocidir) for the layout images will be added to.
+func NewWithStore(s Store) *composefs {
+	return &composefs{store: s}
+}
+
+func (c *composefs) Make(tempdir string, rootfs string, eps *common.ExcludePaths, verity verity.VerityMetadata, opts types.MakeOptions) (io.ReadCloser, string, string, error) {
+	if c.store.Dir == "" {
+		return nil, "", "", errors.Errorf("no composefs object store to make an image with")
+	}
+	return MakeComposefs(tempdir, rootfs, eps, c.store, verity, opts)
+}
+
+func (c *composefs) MakeFromTar(tempdir string, tarStream io.Reader, verity verity.VerityMetadata, opts types.MakeOptions) (io.ReadCloser, string, string, error) {
+	if c.store.Dir == "" {
+		return nil, "", "", errors.Errorf("no composefs object store to make an image with")
+	}
+	return MakeComposefsFromTar(tempdir, tarStream, c.store, verity, opts)
+}
+
+func (c *composefs) Inspect(fsImgFile string) (*types.ImageInfo, error) {
+	return Inspect(fsImgFile)
+}
+
+func (c *composefs) ExtractSingle(fsImgFile string, extractDir string) error {
+	if c.store.Dir == "" {
+		return ExtractSingleComposefs(fsImgFile, extractDir)
+	}
+	policy, err := extract.NewPolicy(c.Extractors())
+	if err != nil {
+		return err
+	}
+	return ExtractSingleComposefsVerified(fsImgFile, extractDir, "", policy)
+}
+
+func (c *composefs) Extractors() []types.FsExtractor {
+	return Extractors(c.store)
+}
+
+func (c *composefs) ExtractSinglePolicy(fsImgFile, extractDir, rootHash string, policy *extract.Policy) error {
+	return ExtractSingleComposefsVerified(fsImgFile, extractDir, rootHash, policy)
+}
+
+// Mount mounts a composefs atom; that needs host root, since overlay's
+// trusted xattrs, which redirect files to their objects, aren't used in a
+// user namespace.
+func (c *composefs) Mount(fsImgFile, mountpoint, rootHash string) error {
+	if !common.AmHostRoot() {
+		return errors.Errorf("composefs atoms can only be mounted as host root")
+	}
+	s, err := storeFor(fsImgFile, c.store)
+	if err != nil {
+		return err
+	}
+	return hostMount(fsImgFile, mountpoint, rootHash, s)
+}
+
+func (c *composefs) Umount(mountpoint string) error {
+	return Umount(mountpoint)
+}
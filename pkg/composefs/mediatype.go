@@ -0,0 +1,13 @@
+package composefs
+
+import (
+	"strings"
+)
+
+// BaseMediaTypeLayerComposefs is the media type of composefs atoms. They
+// hold only metadata, so there's no compression to add to it.
+const BaseMediaTypeLayerComposefs = "application/vnd.stacker.image.layer.composefs"
+
+func IsComposefsMediaType(mediaType string) bool {
+	return strings.HasPrefix(mediaType, BaseMediaTypeLayerComposefs)
+}
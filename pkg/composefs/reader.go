@@ -0,0 +1,273 @@
+package composefs
+
+import (
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"machinerun.io/atomfs/pkg/erofs"
+	"machinerun.io/atomfs/pkg/fsverity"
+	"machinerun.io/atomfs/pkg/imagefs"
+)
+
+// The overlay xattrs mkcomposefs gives redirected files, and the prefix
+// it escapes the image's own overlay xattrs with, so the composefs overlay
+// passes them on.
+const (
+	redirectXattr        = "trusted.overlay.redirect"
+	metacopyXattr        = "trusted.overlay.metacopy"
+	overlayXattrPrefix   = "trusted.overlay."
+	escapedXattrPrefix   = "trusted.overlay.overlay."
+	metacopyHeaderSize   = 4
+	metacopyDigestSha256 = 1
+)
+
+// FS is a composefs image read without mounting it, presenting what the
+// composefs overlay would: file contents come from the store, checked
+// against their fs-verity digests, and xwhiteouts appear as 0:0 character
+// devices. It implements imagefs.FS.
+type FS struct {
+	meta  *erofs.FS
+	store Store
+
+	mu       sync.Mutex
+	verified map[string]bool
+}
+
+// Open opens the composefs image at path, a blob in an OCI layout whose
+// store has its objects; the returned FS must be closed.
+func Open(path string) (*FS, error) {
+	s, err := StoreForBlob(path)
+	if err != nil {
+		return nil, err
+	}
+	return OpenWithStore(path, s)
+}
+
+// OpenWithStore opens the composefs image at path, with objects in s.
+func OpenWithStore(path string, s Store) (*FS, error) {
+	meta, err := erofs.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &FS{meta: meta, store: s, verified: map[string]bool{}}, nil
+}
+
+func (cfs *FS) Close() error {
+	return cfs.meta.Close()
+}
+
+// Open implements fs.FS, following symlinks within the image.
+func (cfs *FS) Open(name string) (fs.File, error) {
+	f, err := cfs.meta.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	st := imagefs.StatOf(fi)
+	redirect, ok := st.Xattrs[redirectXattr]
+	if !fi.Mode().IsRegular() || !ok {
+		return &file{File: f, cfs: cfs, fi: cfs.convert(fi)}, nil
+	}
+	f.Close()
+
+	object := filepath.Join(cfs.store.Dir, string(redirect))
+	obj, err := os.Open(object)
+	if err != nil {
+		return nil, imagefs.PathError("open", name, err)
+	}
+	if err := cfs.verify(obj, st.Xattrs[metacopyXattr]); err != nil {
+		obj.Close()
+		return nil, imagefs.PathError("open", name, err)
+	}
+	return &objectFile{File: obj, fi: cfs.convert(fi)}, nil
+}
+
+// verify checks obj against the digest in its metacopy xattr, if there is
+// one, once per object.
+func (cfs *FS) verify(obj *os.File, metacopy []byte) error {
+	if len(metacopy) < metacopyHeaderSize || metacopy[3] != metacopyDigestSha256 {
+		return nil
+	}
+	want := hex.EncodeToString(metacopy[metacopyHeaderSize:])
+
+	cfs.mu.Lock()
+	defer cfs.mu.Unlock()
+	if cfs.verified[want] {
+		return nil
+	}
+	got, err := fsverity.Digest(obj)
+	if err != nil {
+		return err
+	}
+	if _, err := obj.Seek(0, io.SeekStart); err != nil {
+		return errors.WithStack(err)
+	}
+	if got != want {
+		return errors.Errorf("object %s has fs-verity digest %s, expected %s", obj.Name(), got, want)
+	}
+	cfs.verified[want] = true
+	return nil
+}
+
+// Stat implements fs.StatFS.
+func (cfs *FS) Stat(name string) (fs.FileInfo, error) {
+	fi, err := cfs.meta.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return cfs.convert(fi), nil
+}
+
+// Lstat is Stat without following a final symlink.
+func (cfs *FS) Lstat(name string) (fs.FileInfo, error) {
+	fi, err := cfs.meta.Lstat(name)
+	if err != nil {
+		return nil, err
+	}
+	return cfs.convert(fi), nil
+}
+
+// ReadLink returns the target of the symlink name.
+func (cfs *FS) ReadLink(name string) (string, error) {
+	return cfs.meta.ReadLink(name)
+}
+
+// ReadDir implements fs.ReadDirFS.
+func (cfs *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	ents, err := cfs.meta.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+	return cfs.convertEntries(ents), nil
+}
+
+func (cfs *FS) convertEntries(ents []fs.DirEntry) []fs.DirEntry {
+	ret := make([]fs.DirEntry, len(ents))
+	for n, e := range ents {
+		ret[n] = &dirEntry{DirEntry: e, cfs: cfs}
+	}
+	return ret
+}
+
+// convert makes the erofs image's fi look as it would through the
+// composefs overlay.
+func (cfs *FS) convert(fi fs.FileInfo) fs.FileInfo {
+	st := imagefs.StatOf(fi)
+	if st == nil {
+		return fi
+	}
+	converted := *st
+	converted.Xattrs = map[string][]byte{}
+	whiteout := false
+	for k, v := range st.Xattrs {
+		switch {
+		case k == xwhiteoutXattr:
+			whiteout = true
+		case k == xwhiteoutsXattr:
+		case strings.HasPrefix(k, escapedXattrPrefix):
+			converted.Xattrs[overlayXattrPrefix+strings.TrimPrefix(k, escapedXattrPrefix)] = v
+		case strings.HasPrefix(k, overlayXattrPrefix):
+			// the composefs overlay's own
+		default:
+			converted.Xattrs[k] = v
+		}
+	}
+	if whiteout {
+		converted.Rdev = 0
+	}
+	return &fileInfo{FileInfo: fi, stat: &converted, whiteout: whiteout}
+}
+
+type fileInfo struct {
+	fs.FileInfo
+	stat     *imagefs.Stat
+	whiteout bool
+}
+
+func (fi *fileInfo) Mode() fs.FileMode {
+	if fi.whiteout {
+		return fs.ModeDevice | fs.ModeCharDevice | fi.FileInfo.Mode().Perm()
+	}
+	return fi.FileInfo.Mode()
+}
+
+func (fi *fileInfo) Size() int64 {
+	if fi.whiteout {
+		return 0
+	}
+	return fi.FileInfo.Size()
+}
+
+func (fi *fileInfo) Sys() any { return fi.stat }
+
+type dirEntry struct {
+	fs.DirEntry
+	cfs *FS
+}
+
+// Type is the converted type, which for a regular file means looking at
+// its xattrs, since it may be a whiteout.
+func (de *dirEntry) Type() fs.FileMode {
+	if !de.DirEntry.Type().IsRegular() {
+		return de.DirEntry.Type()
+	}
+	fi, err := de.Info()
+	if err != nil {
+		return de.DirEntry.Type()
+	}
+	return fi.Mode().Type()
+}
+
+func (de *dirEntry) Info() (fs.FileInfo, error) {
+	fi, err := de.DirEntry.Info()
+	if err != nil {
+		return nil, err
+	}
+	return de.cfs.convert(fi), nil
+}
+
+// file is an open directory, or anything else not redirected to an
+// object.
+type file struct {
+	fs.File
+	cfs *FS
+	fi  fs.FileInfo
+}
+
+func (f *file) Stat() (fs.FileInfo, error) {
+	return f.fi, nil
+}
+
+func (f *file) ReadDir(n int) ([]fs.DirEntry, error) {
+	d, ok := f.File.(fs.ReadDirFile)
+	if !ok {
+		return nil, imagefs.PathError("readdir", f.fi.Name(), fs.ErrInvalid)
+	}
+	ents, err := d.ReadDir(n)
+	return f.cfs.convertEntries(ents), err
+}
+
+// objectFile is a regular file, read from its object. It implements
+// io.ReaderAt and io.Seeker as well.
+type objectFile struct {
+	*os.File
+	fi fs.FileInfo
+}
+
+func (f *objectFile) Stat() (fs.FileInfo, error) {
+	return f.fi, nil
+}
+
+var _ imagefs.FS = &FS{}
+var _ fs.ReadDirFS = &FS{}
+var _ fs.StatFS = &FS{}
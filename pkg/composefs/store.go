@@ -0,0 +1,168 @@
+package composefs
+
+import (
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"machinerun.io/atomfs/pkg/erofs"
+	"machinerun.io/atomfs/pkg/fsverity"
+	"machinerun.io/atomfs/pkg/imagefs"
+	"machinerun.io/atomfs/pkg/log"
+)
+
+// ObjectsDirName is where an OCI layout keeps the objects its composefs
+// atoms' files redirect to, next to its blobs.
+const ObjectsDirName = "objects"
+
+// Store is a directory of file contents named by their fs-verity digests,
+// objects/ab/cdef..., shared by every composefs atom in an OCI layout.
+type Store struct {
+	Dir string
+
+	// RequireVerity makes Add fail unless its object has fs-verity, as it
+	// must for a verified atom's overlay to read it.
+	RequireVerity bool
+}
+
+// LayoutStore returns the store of the OCI layout at ocidir.
+func LayoutStore(ocidir string) Store {
+	return Store{Dir: filepath.Join(ocidir, ObjectsDirName)}
+}
+
+// StoreForBlob returns the store of the OCI layout holding the blob at
+// path, i.e. ocidir/blobs/ALG/HEX.
+func StoreForBlob(path string) (Store, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return Store{}, errors.WithStack(err)
+	}
+	blobs := filepath.Dir(filepath.Dir(abs))
+	if filepath.Base(blobs) != "blobs" {
+		return Store{}, errors.Errorf("%s isn't a blob in an OCI layout", path)
+	}
+	return LayoutStore(filepath.Dir(blobs)), nil
+}
+
+// ObjectPath is where the object with digest is, relative to the store.
+func ObjectPath(digest string) string {
+	return filepath.Join(digest[:2], digest[2:])
+}
+
+// Path is where the object with digest is.
+func (s Store) Path(digest string) string {
+	return filepath.Join(s.Dir, ObjectPath(digest))
+}
+
+// AtomObjects returns the objects, relative to its store, that the atom at
+// path needs: those its files redirect to if mediaType is a composefs one,
+// and none otherwise. mediaType is "" if it isn't known, e.g. for an atom
+// that's mounted but no longer in an image, and then an atom that's an
+// erofs image is taken to be a composefs one; erofs atoms that aren't
+// don't redirect anything. It's for layout.GCOptions.Objects.
+func AtomObjects(path, mediaType string) ([]string, error) {
+	if mediaType != "" && !IsComposefsMediaType(mediaType) {
+		return nil, nil
+	}
+	meta, err := erofs.Open(path)
+	if err != nil {
+		if mediaType == "" {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer meta.Close()
+
+	objects := map[string]bool{}
+	err = fs.WalkDir(meta, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		fi, err := meta.Lstat(name)
+		if err != nil {
+			return err
+		}
+		if redirect, ok := imagefs.StatOf(fi).Xattrs[redirectXattr]; ok {
+			objects[filepath.Clean(strings.TrimPrefix(string(redirect), "/"))] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't find the objects %s needs", path)
+	}
+	ret := make([]string, 0, len(objects))
+	for o := range objects {
+		ret = append(ret, o)
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+// Add stores r's content, unless an object with the same digest is
+// already there, and returns its digest and size. Objects have fs-verity
+// enabled if the store's filesystem supports it; if it doesn't, that's
+// only an error when s.RequireVerity is set.
+func (s Store) Add(r io.Reader) (string, int64, error) {
+	if err := os.MkdirAll(s.Dir, 0755); err != nil {
+		return "", 0, errors.WithStack(err)
+	}
+	tmp, err := os.CreateTemp(s.Dir, ".object-")
+	if err != nil {
+		return "", 0, errors.WithStack(err)
+	}
+	defer os.Remove(tmp.Name())
+
+	v := fsverity.NewHasher()
+	size, err := io.Copy(io.MultiWriter(tmp, v), r)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", 0, errors.Wrapf(err, "couldn't store object")
+	}
+	digest := hex.EncodeToString(v.Sum())
+
+	dest := s.Path(digest)
+	if _, err := os.Stat(dest); err == nil {
+		if s.RequireVerity {
+			// it may have been added for an atom that didn't need it
+			if err := s.enableVerity(dest); err != nil {
+				return "", 0, err
+			}
+		}
+		return digest, size, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return "", 0, errors.WithStack(err)
+	}
+	// objects are never written again, and overlay only needs to read them
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return "", 0, errors.WithStack(err)
+	}
+	if err := s.enableVerity(tmp.Name()); err != nil {
+		return "", 0, err
+	}
+	if err := os.Rename(tmp.Name(), dest); err != nil {
+		return "", 0, errors.WithStack(err)
+	}
+	return digest, size, nil
+}
+
+// enableVerity turns on fs-verity for the object at path, failing if it
+// can't only when s.RequireVerity is set.
+func (s Store) enableVerity(path string) error {
+	err := fsverity.Enable(path)
+	if err == nil {
+		return nil
+	}
+	if s.RequireVerity {
+		return errors.Wrapf(err, "verified composefs atoms need fs-verity on their objects, which %s doesn't support", s.Dir)
+	}
+	log.Debugf("objects in %s won't have fs-verity: %v", s.Dir, err)
+	return nil
+}
@@ -0,0 +1,101 @@
+// Package decompress holds the decompressors the pure-Go image readers need
+// that aren't readily available elsewhere.
+package decompress
+
+import (
+	"github.com/pkg/errors"
+)
+
+var ErrLZ4Corrupt = errors.New("corrupt lz4 block")
+
+// LZ4Block decodes the raw lz4 block src (no frame header) into dst,
+// returning the number of bytes written. It is an error for the block to
+// decode to more than len(dst) bytes, unless partial is set, in which case
+// decoding simply stops once dst is full.
+func LZ4Block(dst, src []byte, partial bool) (int, error) {
+	si, di := 0, 0
+
+	for si < len(src) {
+		token := src[si]
+		si++
+
+		// literals
+		litLen := int(token >> 4)
+		if litLen == 0xf {
+			for {
+				if si >= len(src) {
+					return di, ErrLZ4Corrupt
+				}
+				b := src[si]
+				si++
+				litLen += int(b)
+				if b != 0xff {
+					break
+				}
+			}
+		}
+		if si+litLen > len(src) {
+			return di, ErrLZ4Corrupt
+		}
+		if di+litLen > len(dst) {
+			if !partial {
+				return di, errors.Errorf("lz4 block decodes to more than %d bytes", len(dst))
+			}
+			return copy(dst[di:], src[si:si+litLen]) + di, nil
+		}
+		copy(dst[di:], src[si:si+litLen])
+		si += litLen
+		di += litLen
+
+		// the last sequence has no match
+		if si == len(src) {
+			break
+		}
+
+		// match
+		if si+2 > len(src) {
+			return di, ErrLZ4Corrupt
+		}
+		offset := int(src[si]) | int(src[si+1])<<8
+		si += 2
+		if offset == 0 || offset > di {
+			return di, ErrLZ4Corrupt
+		}
+		matchLen := int(token&0xf) + 4
+		if token&0xf == 0xf {
+			for {
+				if si >= len(src) {
+					return di, ErrLZ4Corrupt
+				}
+				b := src[si]
+				si++
+				matchLen += int(b)
+				if b != 0xff {
+					break
+				}
+			}
+		}
+		if di+matchLen > len(dst) {
+			if !partial {
+				return di, errors.Errorf("lz4 block decodes to more than %d bytes", len(dst))
+			}
+			matchLen = len(dst) - di
+		}
+		// the match may overlap what it is copying, so go byte by byte
+		// unless it can't.
+		start := di - offset
+		if offset >= matchLen {
+			copy(dst[di:di+matchLen], dst[start:start+matchLen])
+		} else {
+			for i := 0; i < matchLen; i++ {
+				dst[di+i] = dst[start+i]
+			}
+		}
+		di += matchLen
+		if partial && di == len(dst) {
+			break
+		}
+	}
+
+	return di, nil
+}
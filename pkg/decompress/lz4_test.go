@@ -0,0 +1,32 @@
+package decompress
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLZ4Block(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	// "abcabcabcabcabcabc!" : 3 literals, then an overlapping match of 15
+	// at offset 3, then a final literal.
+	src := []byte{0x3b, 'a', 'b', 'c', 0x03, 0x00, 0x10, '!'}
+
+	dst := make([]byte, 19)
+	n, err := LZ4Block(dst, src, false)
+	assert.NoError(err)
+	assert.Equal("abcabcabcabcabcabc!", string(dst[:n]))
+
+	_, err = LZ4Block(make([]byte, 10), src, false)
+	assert.Error(err)
+
+	dst = make([]byte, 10)
+	n, err = LZ4Block(dst, src, true)
+	assert.NoError(err)
+	assert.Equal("abcabcabca", string(dst[:n]))
+
+	_, err = LZ4Block(make([]byte, 19), []byte{0x3b, 'a', 'b', 'c', 0x09, 0x00, 0x10, '!'}, false)
+	assert.ErrorIs(err, ErrLZ4Corrupt)
+}
@@ -4,13 +4,14 @@ package erofs
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
-	"runtime"
+	"slices"
 	"strings"
 	"sync"
 	"syscall"
@@ -18,6 +19,8 @@ import (
 
 	"github.com/pkg/errors"
 	"machinerun.io/atomfs/pkg/common"
+	"machinerun.io/atomfs/pkg/extract"
+	"machinerun.io/atomfs/pkg/imagefs"
 	"machinerun.io/atomfs/pkg/log"
 	types "machinerun.io/atomfs/pkg/types"
 	vrty "machinerun.io/atomfs/pkg/verity"
@@ -32,15 +35,27 @@ var once sync.Once
 var erofsFuseInfo = erofsFuseInfoStruct{"", ""}
 
 const PolicyEnvName = "STACKER_EROFS_EXTRACT_POLICY"
-const DefPolicies = "kmount erofsfuse fsck.erofs"
-const AllPolicies = "kmount erofsfuse fsck.erofs"
+const DefPolicies = "kmount erofsfuse fsck.erofs goerofs"
+const AllPolicies = "kmount erofsfuse fsck.erofs goerofs"
 
 func MakeErofs(tempdir string, rootfs string, eps *common.ExcludePaths, verity vrty.VerityMetadata) (io.ReadCloser, string, string, error) {
+	return MakeErofsWithOptions(tempdir, rootfs, eps, verity, types.MakeOptions{})
+}
+
+// MakeErofsWithOptions is MakeErofs with control over compression, physical
+// cluster size and parallelism. The returned media type reflects the
+// compressor used.
+func MakeErofsWithOptions(tempdir string, rootfs string, eps *common.ExcludePaths, verity vrty.VerityMetadata, opts types.MakeOptions) (io.ReadCloser, string, string, error) {
 	var excludesFile string
 	var err error
 	var toExclude string
 	var rootHash string
 
+	settings, err := resolveMakeOptions(opts, mkerofsSupportsCompressor, mkerofsSupportsParallel())
+	if err != nil {
+		return nil, "", rootHash, err
+	}
+
 	if eps != nil {
 		toExclude, err = eps.String()
 		if err != nil {
@@ -80,18 +95,14 @@ func MakeErofs(tempdir string, rootfs string, eps *common.ExcludePaths, verity v
 
 	defer os.Remove(tmpErofs.Name())
 
-	args := []string{tmpErofs.Name(), rootfs}
-	compression := LZ4HCCompression
-	if false { // FIXME: following features are experimental, disabling for now
-		zstdOk, parallelOk := mkerofsSupportsFeature()
-		if zstdOk {
-			args = append(args, "-z", "zstd")
-			compression = ZstdCompression
-		}
-		if parallelOk {
-			args = append(args, "--workers", fmt.Sprintf("%d", runtime.NumCPU()))
-		}
+	reproArgs, reproducible, err := reproducibleArgs()
+	if err != nil {
+		return nil, "", rootHash, err
 	}
+
+	args := []string{tmpErofs.Name(), rootfs}
+	args = append(args, reproArgs...)
+	args = append(args, settings.args()...)
 	if len(toExclude) != 0 {
 		args = append(args, "--exclude-path", excludesFile)
 	}
@@ -103,7 +114,7 @@ func MakeErofs(tempdir string, rootfs string, eps *common.ExcludePaths, verity v
 	}
 
 	if verity {
-		rootHash, err = vrty.AppendVerityData(tmpErofs.Name())
+		rootHash, err = appendVerityData(tmpErofs.Name(), reproducible)
 		if err != nil {
 			return nil, "", rootHash, err
 		}
@@ -114,7 +125,100 @@ func MakeErofs(tempdir string, rootfs string, eps *common.ExcludePaths, verity v
 		return nil, "", rootHash, errors.WithStack(err)
 	}
 
-	return blob, GenerateErofsMediaType(compression), rootHash, nil
+	return blob, GenerateErofsMediaType(settings.compression), rootHash, nil
+}
+
+// MakeErofsFromTar streams an uncompressed tar layer into `mkfs.erofs --tar`,
+// avoiding the need to unpack it to disk first (and thus to be root to
+// preserve ownership).  OCI whiteouts in the stream are converted to overlay
+// whiteouts, with the user.overlay xattrs molecules are mounted with.  File
+// data is stored in the image ("--tar=f"), so it's self-contained.  The
+// return values match those of MakeErofs.
+func MakeErofsFromTar(tempdir string, tarStream io.Reader, verity vrty.VerityMetadata, opts types.MakeOptions) (io.ReadCloser, string, string, error) {
+	var rootHash string
+
+	settings, err := resolveMakeOptions(opts, mkerofsSupportsCompressor, mkerofsSupportsParallel())
+	if err != nil {
+		return nil, "", rootHash, err
+	}
+
+	if !mkerofsSupportsTar() {
+		return nil, "", rootHash, errors.Errorf("mkfs.erofs does not support --tar, need erofs-utils >= 1.7")
+	}
+
+	tmpErofs, err := os.CreateTemp(tempdir, "stacker-erofs-img-")
+	if err != nil {
+		return nil, "", rootHash, err
+	}
+	// see MakeErofs for why we only want the name here.
+	tmpErofs.Close()
+	os.Remove(tmpErofs.Name())
+
+	defer os.Remove(tmpErofs.Name())
+
+	reproArgs, reproducible, err := reproducibleArgs()
+	if err != nil {
+		return nil, "", rootHash, err
+	}
+
+	// with no SOURCE argument, mkfs.erofs reads the tarball from stdin.
+	args := []string{"--tar=f"}
+	args = append(args, reproArgs...)
+	args = append(args, settings.args()...)
+	args = append(args, tmpErofs.Name())
+
+	converted := common.NewOverlayWhiteoutReader(tarStream)
+	cmd := exec.Command("mkfs.erofs", args...)
+	cmd.Stdin = converted
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	if convErr := converted.Close(); convErr != nil && err == nil {
+		err = convErr
+	}
+	if err != nil {
+		return nil, "", rootHash, errors.Wrap(err, "couldn't build erofs from tar")
+	}
+
+	if verity {
+		rootHash, err = appendVerityData(tmpErofs.Name(), reproducible)
+		if err != nil {
+			return nil, "", rootHash, err
+		}
+	}
+
+	blob, err := os.Open(tmpErofs.Name())
+	if err != nil {
+		return nil, "", rootHash, errors.WithStack(err)
+	}
+
+	return blob, GenerateErofsMediaType(settings.compression), rootHash, nil
+}
+
+// reproducibleArgs returns the mkfs.erofs arguments which pin the build time,
+// all file timestamps and the filesystem UUID, and whether SOURCE_DATE_EPOCH
+// was set. mkfs.erofs already sorts directory entries.
+func reproducibleArgs() ([]string, bool, error) {
+	epoch, ok, err := common.SourceDateEpoch()
+	if err != nil || !ok {
+		return nil, false, err
+	}
+
+	// derive the UUID from the epoch, so that it is fixed but images built
+	// at different "times" are still distinguishable.
+	sum := sha256.Sum256([]byte(fmt.Sprintf("atomfs erofs uuid %d", epoch)))
+	uuid := fmt.Sprintf("%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+
+	return []string{"-T", fmt.Sprintf("%d", epoch), "-U", uuid}, true, nil
+}
+
+// appendVerityData appends verity data with a content-derived salt for
+// reproducible builds, or a random one otherwise.
+func appendVerityData(file string, reproducible bool) (string, error) {
+	if reproducible {
+		return vrty.AppendReproducibleVerityData(file)
+	}
+	return vrty.AppendVerityData(file)
 }
 
 func findErofsFuseInfo() {
@@ -231,49 +335,22 @@ func erofsFuse(erofsFile, extractDir string) (*exec.Cmd, error) {
 	return cmd, nil
 }
 
-type ExtractPolicy struct {
-	Extractors  []types.FsExtractor
-	Extractor   types.FsExtractor
-	Excuses     map[string]error
-	initialized bool
-	mutex       sync.Mutex
-}
-
-var exPolInfo struct {
-	once   sync.Once
-	err    error
-	policy *ExtractPolicy
-}
+// ExtractPolicy is how erofs images are extracted.
+type ExtractPolicy = extract.Policy
 
-func NewExtractPolicy(args ...string) (*ExtractPolicy, error) {
-	p := &ExtractPolicy{
-		Extractors: []types.FsExtractor{},
-		Excuses:    map[string]error{},
-	}
-
-	allEx := []types.FsExtractor{
+// Extractors returns all the ways of extracting erofs images.
+func Extractors() []types.FsExtractor {
+	return []types.FsExtractor{
 		&KernelExtractor{},
 		&ErofsFuseExtractor{},
 		&FsckErofsExtractor{},
+		&GoErofsExtractor{},
 	}
-	byName := map[string]types.FsExtractor{}
-	for _, i := range allEx {
-		byName[i.Name()] = i
-	}
+}
 
-	for _, i := range args {
-		extractor, ok := byName[i]
-		if !ok {
-			return nil, errors.Errorf("Unknown extractor: '%s'", i)
-		}
-		excuse := extractor.IsAvailable()
-		if excuse != nil {
-			p.Excuses[i] = excuse
-			continue
-		}
-		p.Extractors = append(p.Extractors, extractor)
-	}
-	return p, nil
+// NewExtractPolicy returns a policy using the named extractors in order.
+func NewExtractPolicy(args ...string) (*ExtractPolicy, error) {
+	return extract.NewPolicy(Extractors(), extract.WithOrder(args...))
 }
 
 type FsckErofsExtractor struct {
@@ -333,6 +410,60 @@ func (k *FsckErofsExtractor) Mount(erofsFile, extractDir string) error {
 	return nil
 }
 
+// GoErofsExtractor extracts with the built in erofs reader, so it needs
+// neither privileges nor any tools.
+type GoErofsExtractor struct {
+	mutex sync.Mutex
+}
+
+func (k *GoErofsExtractor) Name() string {
+	return "goerofs"
+}
+
+func (k *GoErofsExtractor) IsAvailable() error {
+	return nil
+}
+
+func (k *GoErofsExtractor) Mount(erofsFile, extractDir string) error {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	// check if already extracted
+	empty, err := common.IsEmptyDir(extractDir)
+	if err != nil {
+		return errors.Wrapf(err, "Error checking for empty dir")
+	}
+	if !empty {
+		return nil
+	}
+
+	log.Debugf("goerofs %s -> %s", erofsFile, extractDir)
+	efs, err := Open(erofsFile)
+	if err != nil {
+		return err
+	}
+	defer efs.Close()
+
+	err = imagefs.Extract(efs, extractDir)
+	if err != nil {
+		if rmErr := os.RemoveAll(extractDir); rmErr != nil {
+			log.Errorf("Failed to remove %s after failed extraction of %s: %v", extractDir, erofsFile, rmErr)
+		}
+		return err
+	}
+
+	empty, err = common.IsEmptyDir(extractDir)
+	if err != nil {
+		return errors.Errorf("Failed to read %s after successful extraction of %s: %v",
+			extractDir, erofsFile, err)
+	}
+	if empty {
+		return errors.Errorf("%s was an empty fs image", erofsFile)
+	}
+
+	return nil
+}
+
 type KernelExtractor struct {
 	mutex sync.Mutex
 }
@@ -358,6 +489,10 @@ func (k *KernelExtractor) Mount(erofsFile, extractDir string) error {
 		return nil
 	}
 
+	if err := checkKernelSupport(erofsFile); err != nil {
+		return err
+	}
+
 	ecmd := []string{"mount", "-terofs", "-oloop,ro", erofsFile, extractDir}
 	var output bytes.Buffer
 	cmd := exec.Command(ecmd[0], ecmd[1:]...)
@@ -424,106 +559,53 @@ func (f *ErofsFuseExtractor) Mount(erofsFile, extractDir string) error {
 	return nil
 }
 
-// ExtractSingleErofsPolicy - extract erofsfile to extractDir
+// ExtractSingleErofsPolicy - extract erofsFile to extractDir
 func ExtractSingleErofsPolicy(erofsFile, extractDir string, policy *ExtractPolicy) error {
-	const initName = "init"
 	if policy == nil {
 		return errors.Errorf("policy cannot be nil")
 	}
+	return policy.Extract(erofsFile, extractDir)
+}
 
-	// avoid taking a lock if already initialized (possibly premature optimization)
-	if !policy.initialized {
-		policy.mutex.Lock()
-		// We may have been waiting on the initializer. If so, then the policy will now be initialized.
-		// if not, then we are the initializer.
-		if !policy.initialized {
-			defer policy.mutex.Unlock()
-			defer func() {
-				policy.initialized = true
-			}()
-		} else {
-			policy.mutex.Unlock()
-		}
+// ExtractSingleErofsVerified - extract erofsFile to extractDir as policy
+// says, checking it against rootHash first if the policy requires verity.
+func ExtractSingleErofsVerified(erofsFile, extractDir, rootHash string, policy *ExtractPolicy) error {
+	if policy == nil {
+		return errors.Errorf("policy cannot be nil")
 	}
-
-	err := os.MkdirAll(extractDir, 0755)
-	if err != nil {
-		return err
+	if !policy.RequireVerity {
+		return policy.Extract(erofsFile, extractDir)
 	}
-
-	fdest, err := filepath.Abs(extractDir)
+	info, err := Inspect(erofsFile)
 	if err != nil {
 		return err
 	}
+	return policy.ExtractVerified(erofsFile, extractDir, info.VerityOffset, rootHash)
+}
 
-	if policy.initialized {
-		if err, ok := policy.Excuses[initName]; ok {
-			return err
-		}
-		return policy.Extractor.Mount(erofsFile, fdest)
-	}
-
-	// At this point we are the initialzer
-	if policy.Excuses == nil {
-		policy.Excuses = map[string]error{}
-	}
-
-	if len(policy.Extractors) == 0 {
-		policy.Excuses[initName] = errors.Errorf("policy had no extractors")
-		return policy.Excuses[initName]
-	}
-
-	var extractor types.FsExtractor
-	allExcuses := []string{}
-	for _, extractor = range policy.Extractors {
-		err = extractor.Mount(erofsFile, fdest)
-		if err == nil {
-			policy.Extractor = extractor
-			log.Debugf("Selected erofs extractor %s", extractor.Name())
-			return nil
-		}
-		policy.Excuses[extractor.Name()] = err
-	}
-
-	for n, exc := range policy.Excuses {
-		allExcuses = append(allExcuses, fmt.Sprintf("%s: %v", n, exc))
-	}
-
-	// nothing worked. populate Excuses[initName]
-	policy.Excuses[initName] = errors.Errorf("No suitable extractor found:\n %s", strings.Join(allExcuses, "\n  "))
-	return policy.Excuses[initName]
+// DefaultExtractPolicy returns the policy ExtractSingleErofs uses, set up
+// by the extract config file and $STACKER_EROFS_EXTRACT_POLICY.
+func DefaultExtractPolicy() (*ExtractPolicy, error) {
+	return extract.Default("erofs", Extractors(), PolicyEnvName, DefPolicies)
 }
 
-// ExtractSingleErofs - extract the erofsFile to extractDir
-// Initialize a extractPolicy struct and then call ExtractSingleErofsPolicy
-// wik()th that.
+// ExtractSingleErofs - extract the erofsFile to extractDir with the
+// default policy.
 func ExtractSingleErofs(erofsFile string, extractDir string) error {
-	exPolInfo.once.Do(func() {
-		val := os.Getenv(PolicyEnvName)
-		if val == "" {
-			val = DefPolicies
-		}
-		exPolInfo.policy, exPolInfo.err = NewExtractPolicy(strings.Fields(val)...)
-		if exPolInfo.err == nil {
-			for k, v := range exPolInfo.policy.Excuses {
-				log.Debugf(" erofs extractor %s is not available: %v", k, v)
-			}
-		}
-	})
-
-	if exPolInfo.err != nil {
-		return exPolInfo.err
+	policy, err := DefaultExtractPolicy()
+	if err != nil {
+		return err
 	}
-
-	return ExtractSingleErofsPolicy(erofsFile, extractDir, exPolInfo.policy)
+	return ExtractSingleErofsPolicy(erofsFile, extractDir, policy)
 }
 
-var checkSupported sync.Once
-var zstdIsSuspported bool
-var parallelIsSupported bool
+var checkMkerofsHelp sync.Once
+var mkerofsHelpText string
 
-func mkerofsSupportsFeature() (bool, bool) {
-	checkSupported.Do(func() {
+// mkerofsHelp returns the output of `mkfs.erofs --help`, which describes the
+// options and compressors it supports.
+func mkerofsHelp() string {
+	checkMkerofsHelp.Do(func() {
 		var stdoutBuffer strings.Builder
 		var stderrBuffer strings.Builder
 
@@ -534,16 +616,42 @@ func mkerofsSupportsFeature() (bool, bool) {
 		// Ignore errs here as `mkerofs --help` exit status code is 1
 		_ = cmd.Run()
 
-		if strings.Contains(stdoutBuffer.String(), "zstd") ||
-			strings.Contains(stderrBuffer.String(), "zstd") {
-			zstdIsSuspported = true
-		}
+		mkerofsHelpText = stdoutBuffer.String() + stderrBuffer.String()
+	})
 
-		if strings.Contains(stdoutBuffer.String(), "workers") ||
-			strings.Contains(stderrBuffer.String(), "workers") {
-			parallelIsSupported = true
+	return mkerofsHelpText
+}
+
+func mkerofsSupportsCompressor(comp ErofsCompression) bool {
+	return helpListsCompressor(mkerofsHelp(), comp)
+}
+
+// helpListsCompressor reports whether comp is one of the compressors
+// `mkfs.erofs --help` lists after "Available compressors are:", either on
+// that line or one per line with their settings after them. Names are
+// matched whole, so lz4 isn't found in lz4hc.
+func helpListsCompressor(help string, comp ErofsCompression) bool {
+	_, list, ok := strings.Cut(help, "Available compressors are:")
+	if !ok {
+		return false
+	}
+	lines := strings.Split(list, "\n")
+	names := strings.Fields(strings.ReplaceAll(lines[0], ",", " "))
+	for _, line := range lines[1:] {
+		fields := strings.Fields(line)
+		// the list ends at the next option or a blank line
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "-") {
+			break
 		}
-	})
+		names = append(names, fields[0])
+	}
+	return slices.Contains(names, string(comp))
+}
+
+func mkerofsSupportsParallel() bool {
+	return strings.Contains(mkerofsHelp(), "--workers")
+}
 
-	return zstdIsSuspported, parallelIsSupported
+func mkerofsSupportsTar() bool {
+	return strings.Contains(mkerofsHelp(), "--tar")
 }
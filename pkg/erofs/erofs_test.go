@@ -0,0 +1,42 @@
+package erofs
+
+import (
+	"io"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"machinerun.io/atomfs/pkg/imagefs/imagefstest"
+	types "machinerun.io/atomfs/pkg/types"
+	"machinerun.io/atomfs/pkg/verity"
+)
+
+func TestMakeErofsFromTar(t *testing.T) {
+	assert := assert.New(t)
+
+	if !mkerofsSupportsTar() {
+		t.Skip("mkfs.erofs doesn't support --tar")
+	}
+
+	tempdir := t.TempDir()
+	reader, mediaType, rootHash, err := MakeErofsFromTar(tempdir, imagefstest.WhiteoutLayer(t), verity.VerityMetadataMissing, types.MakeOptions{})
+	require.NoError(t, err)
+	assert.Equal(GenerateErofsMediaType(LZ4HCCompression), mediaType)
+	assert.Empty(rootHash)
+
+	image := path.Join(tempdir, "layer.erofs")
+	out, err := os.Create(image)
+	require.NoError(t, err)
+	_, err = io.Copy(out, reader)
+	require.NoError(t, err)
+	reader.Close()
+	out.Close()
+
+	efs, err := Open(image)
+	require.NoError(t, err)
+	defer efs.Close()
+
+	imagefstest.CheckWhiteoutLayer(t, efs)
+}
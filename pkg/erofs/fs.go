@@ -6,6 +6,8 @@ import (
 
 	"github.com/pkg/errors"
 	"machinerun.io/atomfs/pkg/common"
+	"machinerun.io/atomfs/pkg/extract"
+	types "machinerun.io/atomfs/pkg/types"
 	"machinerun.io/atomfs/pkg/verity"
 )
 
@@ -16,23 +18,39 @@ func New() *erofs {
 	return &erofs{}
 }
 
-func (er *erofs) Make(tempdir string, rootfs string, eps *common.ExcludePaths, verity verity.VerityMetadata) (io.ReadCloser, string, string, error) {
-	return MakeErofs(tempdir, rootfs, eps, verity)
+func (er *erofs) Make(tempdir string, rootfs string, eps *common.ExcludePaths, verity verity.VerityMetadata, opts types.MakeOptions) (io.ReadCloser, string, string, error) {
+	return MakeErofsWithOptions(tempdir, rootfs, eps, verity, opts)
+}
+
+func (er *erofs) MakeFromTar(tempdir string, tarStream io.Reader, verity verity.VerityMetadata, opts types.MakeOptions) (io.ReadCloser, string, string, error) {
+	return MakeErofsFromTar(tempdir, tarStream, verity, opts)
+}
+
+func (er *erofs) Inspect(fsImgFile string) (*types.ImageInfo, error) {
+	return Inspect(fsImgFile)
 }
 
 func (er *erofs) ExtractSingle(fsImgFile string, extractDir string) error {
 	return ExtractSingleErofs(fsImgFile, extractDir)
 }
 
+func (er *erofs) Extractors() []types.FsExtractor {
+	return Extractors()
+}
+
+func (er *erofs) ExtractSinglePolicy(fsImgFile, extractDir, rootHash string, policy *extract.Policy) error {
+	return ExtractSingleErofsVerified(fsImgFile, extractDir, rootHash, policy)
+}
+
 func (er *erofs) Mount(fsImgFile, mountpoint, rootHash string) error {
 	if !common.AmHostRoot() {
-		return er.guestMount(fsImgFile, mountpoint)
+		return er.guestMount(fsImgFile, mountpoint, rootHash)
 	}
 	err := er.hostMount(fsImgFile, mountpoint, rootHash)
 	if err == nil || rootHash != "" {
 		return err
 	}
-	return er.guestMount(fsImgFile, mountpoint)
+	return er.guestMount(fsImgFile, mountpoint, rootHash)
 }
 
 func fsImgVerityLocation(fsImgFile string) (int64, uint64, error) {
@@ -55,6 +73,10 @@ func fsImgVerityLocation(fsImgFile string) (int64, uint64, error) {
 }
 
 func (er *erofs) hostMount(fsImgFile string, mountpoint string, rootHash string) error {
+	if err := checkKernelSupport(fsImgFile); err != nil {
+		return err
+	}
+
 	veritySize, verityOffset, err := fsImgVerityLocation(fsImgFile)
 	if err != nil {
 		return err
@@ -63,7 +85,13 @@ func (er *erofs) hostMount(fsImgFile string, mountpoint string, rootHash string)
 	return common.HostMount(fsImgFile, "erofs", mountpoint, rootHash, veritySize, verityOffset)
 }
 
-func (er *erofs) guestMount(fsImgFile string, mountpoint string) error {
+// guestMount mounts with FUSE; images with a root hash are served by
+// verityfuse, which checks what it reads against the hash, and the rest by
+// erofsfuse.
+func (er *erofs) guestMount(fsImgFile string, mountpoint string, rootHash string) error {
+	if rootHash != "" {
+		return common.GuestMount(fsImgFile, mountpoint, common.VerityFuse("erofs", rootHash))
+	}
 	return common.GuestMount(fsImgFile, mountpoint, erofsFuse)
 }
 
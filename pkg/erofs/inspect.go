@@ -0,0 +1,75 @@
+package erofs
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	types "machinerun.io/atomfs/pkg/types"
+)
+
+// compatFeatureNames are as dump.erofs prints them, see incompatFeatures.
+var compatFeatureNames = []struct {
+	bit  uint32
+	name string
+}{
+	{FeatureCompatSuperBlockChecksum, "sb_csum"},
+	{0x00000002, "mtime"},
+	{0x00000004, "xattr_filter"},
+}
+
+// features names the features the superblock has set.
+func features(sb *superblock) []string {
+	ret := []string{}
+	for _, f := range compatFeatureNames {
+		if sb.FeatureCompat&f.bit != 0 {
+			ret = append(ret, f.name)
+		}
+	}
+	for _, f := range incompatFeatures {
+		if sb.FeatureIncompat&f.bit != 0 {
+			ret = append(ret, f.name)
+		}
+	}
+	if unknown := unknownFeatures(sb); unknown != 0 {
+		ret = append(ret, fmt.Sprintf("unknown(0x%x)", unknown))
+	}
+	return ret
+}
+
+// compression names the algorithms the image declares.
+func compression(sb *superblock) []string {
+	ret := []string{}
+	for _, alg := range declaredAlgorithms(sb) {
+		ret = append(ret, algorithmName(alg))
+	}
+	return ret
+}
+
+// Inspect describes the erofs image at path from its superblock.
+func Inspect(path string) (*types.ImageInfo, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	sb, err := readSuperblock(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't read superblock of %s", path)
+	}
+	verityOffset, err := verityDataLocation(sb)
+	if err != nil {
+		return nil, err
+	}
+
+	return &types.ImageInfo{
+		Type:         "erofs",
+		Compression:  compression(sb),
+		BlockSize:    1 << sb.BlockSizeBits,
+		Inodes:       sb.Inodes,
+		Features:     features(sb),
+		BuildTime:    time.Unix(int64(sb.BuildTime), int64(sb.BuildTimeNsec)),
+		Size:         fi.Size(),
+		VerityOffset: verityOffset,
+	}, nil
+}
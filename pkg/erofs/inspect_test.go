@@ -0,0 +1,25 @@
+package erofs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInspectNames(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	sb := &superblock{}
+	assert.Equal([]string{}, features(sb))
+	assert.Equal([]string{}, compression(sb))
+
+	sb.FeatureIncompat = FeatureIncompatZeroPadding
+	assert.Equal([]string{"lz4"}, compression(sb))
+
+	sb.FeatureCompat = FeatureCompatSuperBlockChecksum
+	sb.FeatureIncompat = FeatureIncompatZeroPadding | FeatureIncompatComprCfgs | FeatureIncompatFragments
+	sb.Union1 = 1<<zAlgLZ4 | 1<<zAlgZstd
+	assert.Equal([]string{"sb_csum", "0padding", "compr_cfgs", "big_pcluster", "fragments", "dedupe"}, features(sb))
+	assert.Equal([]string{"lz4", "zstd"}, compression(sb))
+}
@@ -10,9 +10,11 @@ type ErofsCompression string
 const (
 	BaseMediaTypeLayerErofs = "application/vnd.stacker.image.layer.erofs"
 
-	LZ4HCCompression ErofsCompression = "lz4hc"
-	LZ4Compression   ErofsCompression = "lz4"
-	ZstdCompression  ErofsCompression = "zstd"
+	LZ4HCCompression   ErofsCompression = "lz4hc"
+	LZ4Compression     ErofsCompression = "lz4"
+	ZstdCompression    ErofsCompression = "zstd"
+	DeflateCompression ErofsCompression = "deflate"
+	LZMACompression    ErofsCompression = "lzma"
 )
 
 func IsErofsMediaType(mediaType string) bool {
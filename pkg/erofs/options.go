@@ -0,0 +1,107 @@
+package erofs
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+	types "machinerun.io/atomfs/pkg/types"
+)
+
+// erofsSettings are validated types.MakeOptions.
+type erofsSettings struct {
+	compression ErofsCompression
+	level       int
+	clusterSize int
+	workers     int
+}
+
+// erofs names some algorithms differently than the other backends do; accept
+// the generic names too.
+var compressionAliases = map[string]ErofsCompression{
+	"gzip": DeflateCompression,
+	"xz":   LZMACompression,
+}
+
+var compressionLevels = map[ErofsCompression][2]int{
+	// mkfs.erofs takes 0 for lz4hc and deflate too, but a zero
+	// CompressionLevel means the compressor's default
+	LZ4HCCompression:   {1, 12},
+	ZstdCompression:    {1, 22},
+	DeflateCompression: {1, 9},
+}
+
+// resolveMakeOptions checks opts against what erofs and mkfs.erofs (as
+// described by supports and parallelOk) can do, filling in defaults.
+func resolveMakeOptions(opts types.MakeOptions, supports func(ErofsCompression) bool, parallelOk bool) (erofsSettings, error) {
+	settings := erofsSettings{
+		compression: ErofsCompression(opts.Compression),
+		level:       opts.CompressionLevel,
+		clusterSize: opts.BlockSize,
+		workers:     opts.Workers,
+	}
+
+	if alias, ok := compressionAliases[opts.Compression]; ok {
+		settings.compression = alias
+	}
+
+	if settings.compression == "" {
+		// lz4hc is what atoms have always been advertised as
+		settings.compression = LZ4HCCompression
+	}
+
+	switch settings.compression {
+	case LZ4Compression, LZ4HCCompression, ZstdCompression, DeflateCompression:
+		if !supports(settings.compression) {
+			return settings, errors.Errorf("mkfs.erofs was built without %s support", settings.compression)
+		}
+	case LZMACompression:
+		// the kernel could mount them, but goerofs, ls, cat and
+		// diff-images couldn't read them
+		return settings, errors.Errorf("erofs %s compression is unsupported: atomfs's erofs reader can't decompress it", settings.compression)
+	default:
+		return settings, errors.Errorf("unsupported erofs compression %q (want one of %s, %s, %s, %s)",
+			opts.Compression, LZ4Compression, LZ4HCCompression, ZstdCompression, DeflateCompression)
+	}
+
+	if settings.level != 0 {
+		bounds, ok := compressionLevels[settings.compression]
+		if !ok {
+			return settings, errors.Errorf("erofs %s compression does not take a level", settings.compression)
+		}
+		if settings.level < bounds[0] || settings.level > bounds[1] {
+			return settings, errors.Errorf("erofs %s compression level must be between %d and %d, not %d",
+				settings.compression, bounds[0], bounds[1], settings.level)
+		}
+	}
+
+	if settings.clusterSize != 0 {
+		cs := settings.clusterSize
+		if cs < blockSize || cs > 1024*1024 || cs%blockSize != 0 {
+			return settings, errors.Errorf("erofs cluster size must be a multiple of %d up to 1M, not %d", blockSize, cs)
+		}
+	}
+
+	if settings.workers < 0 {
+		return settings, errors.Errorf("invalid worker count %d", settings.workers)
+	}
+	if settings.workers != 0 && !parallelOk {
+		return settings, errors.Errorf("mkfs.erofs does not support parallel compression (--workers)")
+	}
+
+	return settings, nil
+}
+
+func (s erofsSettings) args() []string {
+	comp := string(s.compression)
+	if s.level != 0 {
+		comp = fmt.Sprintf("%s,%d", comp, s.level)
+	}
+	args := []string{"-z", comp}
+	if s.clusterSize != 0 {
+		args = append(args, "-C", fmt.Sprintf("%d", s.clusterSize))
+	}
+	if s.workers != 0 {
+		args = append(args, fmt.Sprintf("--workers=%d", s.workers))
+	}
+	return args
+}
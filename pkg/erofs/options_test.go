@@ -0,0 +1,83 @@
+package erofs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	types "machinerun.io/atomfs/pkg/types"
+)
+
+func TestResolveMakeOptions(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	all := func(ErofsCompression) bool { return true }
+	noZstd := func(c ErofsCompression) bool { return c != ZstdCompression }
+
+	s, err := resolveMakeOptions(types.MakeOptions{}, all, false)
+	assert.NoError(err)
+	assert.Equal([]string{"-z", "lz4hc"}, s.args())
+
+	s, err = resolveMakeOptions(types.MakeOptions{Compression: "gzip", CompressionLevel: 6}, all, false)
+	assert.NoError(err)
+	assert.Equal(DeflateCompression, s.compression)
+	assert.Equal([]string{"-z", "deflate,6"}, s.args())
+
+	s, err = resolveMakeOptions(types.MakeOptions{Compression: "zstd", BlockSize: 65536, Workers: 4}, all, true)
+	assert.NoError(err)
+	assert.Equal([]string{"-z", "zstd", "-C", "65536", "--workers=4"}, s.args())
+
+	// the erofs reader can't read lzma
+	_, err = resolveMakeOptions(types.MakeOptions{Compression: "xz"}, all, false)
+	assert.ErrorContains(err, "erofs lzma compression is unsupported")
+
+	for _, bad := range []types.MakeOptions{
+		{Compression: "lzo"},
+		{Compression: "lzma"},
+		{Compression: "lz4", CompressionLevel: 3},
+		{Compression: "zstd", CompressionLevel: 23},
+		{BlockSize: 1000},
+		{BlockSize: 2 << 20},
+		{Workers: -1},
+		{Workers: 2},
+	} {
+		_, err := resolveMakeOptions(bad, all, false)
+		assert.Error(err, "%+v", bad)
+	}
+
+	_, err = resolveMakeOptions(types.MakeOptions{Compression: "zstd"}, noZstd, false)
+	assert.Error(err)
+
+	// the default needs checking too
+	onlyLZ4 := func(c ErofsCompression) bool { return c == LZ4Compression }
+	_, err = resolveMakeOptions(types.MakeOptions{}, onlyLZ4, false)
+	assert.ErrorContains(err, "without lz4hc support")
+}
+
+func TestHelpListsCompressor(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	// erofs-utils 1.7 and later list one compressor per line under -z
+	help := ` -zX[,level=Y]        X=compressor (Y=compression level, Z=dictionary size, optional)
+    [,dictsize=Z]     alternative compressors can be separated by colons(:)
+                      Available compressors are:
+                        lz4hc [<compression_level>=0..12, default=9]
+                        deflate [<compression_level>=0..9, default=1]
+ -C#                  specify the size of compress physical cluster in bytes
+ -x#                  set xattr tolerance to # (< 0, disable xattrs; default 2)
+ --help               display this help and exit
+`
+	assert.True(helpListsCompressor(help, LZ4HCCompression))
+	assert.True(helpListsCompressor(help, DeflateCompression))
+	assert.False(helpListsCompressor(help, LZ4Compression))
+	assert.False(helpListsCompressor(help, ZstdCompression))
+
+	// older ones list them all on one line at the end
+	help = "Usage: mkfs.erofs [OPTIONS] FILE DIRECTORY\n -zX[,Y]  X=compressor\nAvailable compressors are: lz4 lz4hc\n"
+	assert.True(helpListsCompressor(help, LZ4Compression))
+	assert.True(helpListsCompressor(help, LZ4HCCompression))
+	assert.False(helpListsCompressor(help, DeflateCompression))
+
+	assert.False(helpListsCompressor("mkfs.erofs: no compression support\n", LZ4Compression))
+}
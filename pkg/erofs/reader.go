@@ -0,0 +1,868 @@
+package erofs
+
+import (
+	"encoding/binary"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+	"machinerun.io/atomfs/pkg/imagefs"
+)
+
+// The on-disk layout used here is described in the kernel's
+// fs/erofs/erofs_fs.h.
+
+const (
+	nullAddr = 0xffffffff
+
+	chunkFormatBlkbitsMask = 0x1f
+	chunkFormatIndexes     = 0x20
+
+	// metadata blocks kept around before the cache is reset
+	blockCacheSize = 1024
+	dirCacheSize   = 1024
+)
+
+// dirent file types
+const (
+	ftUnknown = iota
+	ftRegular
+	ftDir
+	ftCharDev
+	ftBlockDev
+	ftFifo
+	ftSocket
+	ftSymlink
+)
+
+// FS is an erofs image, read without any help from the kernel or
+// erofs-utils. It implements imagefs.FS.
+type FS struct {
+	r        io.ReaderAt
+	closer   io.Closer
+	sb       *superblock
+	blksz    uint64
+	algs     uint16
+	resolver imagefs.Resolver[*inode]
+
+	mu     sync.Mutex
+	blocks map[uint64][]byte
+	dirs   map[uint64][]dirent
+	zstd   *zstd.Decoder
+}
+
+type inode struct {
+	nid       uint64
+	layout    int
+	extended  bool
+	isize     uint64
+	xattrSize uint64
+	mode      uint16
+	nlink     uint32
+	size      uint64
+	iu        uint32
+	ino       uint32
+	uid       uint32
+	gid       uint32
+	mtime     time.Time
+	target    string
+
+	// compressed files
+	z *zinfo
+}
+
+type dirent struct {
+	name string
+	nid  uint64
+	typ  uint8
+}
+
+// Open opens the erofs image at path; the returned FS must be closed.
+// Any verity data appended to the image is ignored.
+func Open(path string) (*FS, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, errors.WithStack(err)
+	}
+	efs, err := NewReader(f, fi.Size())
+	if err != nil {
+		f.Close()
+		return nil, errors.Wrapf(err, "couldn't read erofs %s", path)
+	}
+	efs.closer = f
+	return efs, nil
+}
+
+// NewReader reads the erofs image of the given size from r.
+func NewReader(r io.ReaderAt, size int64) (*FS, error) {
+	buf := make([]byte, superblockSize)
+	if _, err := r.ReadAt(buf, superblockOffset); err != nil {
+		return nil, errors.Wrapf(err, "couldn't read superblock")
+	}
+	sb, err := parseSuperblock(buf)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkFeatures(sb); err != nil {
+		return nil, err
+	}
+
+	efs := &FS{
+		r:      r,
+		sb:     sb,
+		blksz:  1 << sb.BlockSizeBits,
+		algs:   1, // lz4 only, unless the superblock says otherwise
+		blocks: map[uint64][]byte{},
+		dirs:   map[uint64][]dirent{},
+	}
+	if uint64(sb.Blocks)*efs.blksz > uint64(size) {
+		return nil, errors.Errorf("erofs claims %d blocks but only %d bytes are available", sb.Blocks, size)
+	}
+	if sb.FeatureIncompat&FeatureIncompatComprCfgs != 0 {
+		efs.algs = sb.Union1
+	}
+
+	root, err := efs.readInode(uint64(sb.RootNid))
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't read root inode")
+	}
+	efs.resolver = imagefs.Resolver[*inode]{
+		Root:   root,
+		Lookup: efs.lookup,
+		Link:   efs.link,
+	}
+
+	return efs, nil
+}
+
+// Close closes the underlying image file if the FS was created by Open.
+func (efs *FS) Close() error {
+	if efs.zstd != nil {
+		efs.zstd.Close()
+	}
+	if efs.closer == nil {
+		return nil
+	}
+	return efs.closer.Close()
+}
+
+// readBlock returns block number blk, which is cached as it's likely to hold
+// more metadata we're about to need.
+func (efs *FS) readBlock(blk uint64) ([]byte, error) {
+	efs.mu.Lock()
+	b, ok := efs.blocks[blk]
+	efs.mu.Unlock()
+	if ok {
+		return b, nil
+	}
+
+	if blk >= uint64(efs.sb.Blocks) {
+		return nil, errors.Errorf("block %d is past the end of the image", blk)
+	}
+	b = make([]byte, efs.blksz)
+	if _, err := efs.r.ReadAt(b, int64(blk*efs.blksz)); err != nil {
+		return nil, errors.Wrapf(err, "couldn't read block %d", blk)
+	}
+
+	efs.mu.Lock()
+	if len(efs.blocks) >= blockCacheSize {
+		efs.blocks = map[uint64][]byte{}
+	}
+	efs.blocks[blk] = b
+	efs.mu.Unlock()
+	return b, nil
+}
+
+// readMeta reads n bytes of metadata at pos.
+func (efs *FS) readMeta(pos uint64, n int) ([]byte, error) {
+	ret := make([]byte, 0, n)
+	for len(ret) < n {
+		b, err := efs.readBlock(pos / efs.blksz)
+		if err != nil {
+			return nil, err
+		}
+		off := pos % efs.blksz
+		want := uint64(n - len(ret))
+		if want > efs.blksz-off {
+			want = efs.blksz - off
+		}
+		ret = append(ret, b[off:off+want]...)
+		pos += want
+	}
+	return ret, nil
+}
+
+func (efs *FS) iloc(nid uint64) uint64 {
+	return uint64(efs.sb.MetaBlockAddr)*efs.blksz + nid<<InodeSlotBits
+}
+
+// dataStart is where whatever follows the inode and its xattrs starts.
+func (i *inode) dataStart(efs *FS) uint64 {
+	return efs.iloc(i.nid) + i.isize + i.xattrSize
+}
+
+func (efs *FS) readInode(nid uint64) (*inode, error) {
+	b, err := efs.readMeta(efs.iloc(nid), InodeCompactSize)
+	if err != nil {
+		return nil, err
+	}
+
+	format := binary.LittleEndian.Uint16(b[0:2])
+	i := &inode{
+		nid:      nid,
+		extended: (format>>InodeLayoutBit)&(1<<InodeLayoutBits-1) == InodeLayoutExtended,
+		layout:   int((format >> InodeDataLayoutBit) & (1<<InodeDataLayoutBits - 1)),
+		mode:     binary.LittleEndian.Uint16(b[4:6]),
+	}
+	if xattrCount := binary.LittleEndian.Uint16(b[2:4]); xattrCount != 0 {
+		i.xattrSize = 12 + 4*uint64(xattrCount-1)
+	}
+
+	if i.extended {
+		b, err = efs.readMeta(efs.iloc(nid), InodeExtendedSize)
+		if err != nil {
+			return nil, err
+		}
+		i.isize = InodeExtendedSize
+		i.size = binary.LittleEndian.Uint64(b[8:16])
+		i.iu = binary.LittleEndian.Uint32(b[16:20])
+		i.ino = binary.LittleEndian.Uint32(b[20:24])
+		i.uid = binary.LittleEndian.Uint32(b[24:28])
+		i.gid = binary.LittleEndian.Uint32(b[28:32])
+		i.mtime = time.Unix(int64(binary.LittleEndian.Uint64(b[32:40])), int64(binary.LittleEndian.Uint32(b[40:44])))
+		i.nlink = binary.LittleEndian.Uint32(b[44:48])
+	} else {
+		i.isize = InodeCompactSize
+		i.nlink = uint32(binary.LittleEndian.Uint16(b[6:8]))
+		i.size = uint64(binary.LittleEndian.Uint32(b[8:12]))
+		i.iu = binary.LittleEndian.Uint32(b[16:20])
+		i.ino = binary.LittleEndian.Uint32(b[20:24])
+		i.uid = uint32(binary.LittleEndian.Uint16(b[24:26]))
+		i.gid = uint32(binary.LittleEndian.Uint16(b[26:28]))
+		// compact inodes all share the image's build time
+		i.mtime = time.Unix(int64(efs.sb.BuildTime), int64(efs.sb.BuildTimeNsec))
+	}
+
+	switch i.layout {
+	case InodeDataLayoutFlatPlain, InodeDataLayoutFlatInline, InodeDataLayoutChunkBased:
+	case InodeDataLayoutFlatCompressionLegacy, InodeDataLayoutFlatCompression:
+		if i.z, err = efs.readZinfo(i); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.Errorf("inode %d has unknown data layout %d", nid, i.layout)
+	}
+
+	if i.isSymlink() {
+		if i.size > unix.PathMax {
+			return nil, errors.Errorf("symlink target of %d bytes", i.size)
+		}
+		target := make([]byte, i.size)
+		if _, err := efs.readData(i, target, 0); err != nil && err != io.EOF {
+			return nil, err
+		}
+		i.target = string(target)
+	}
+
+	return i, nil
+}
+
+func (i *inode) isDir() bool {
+	return i.mode&unix.S_IFMT == unix.S_IFDIR
+}
+
+func (i *inode) isSymlink() bool {
+	return i.mode&unix.S_IFMT == unix.S_IFLNK
+}
+
+func (i *inode) isRegular() bool {
+	return i.mode&unix.S_IFMT == unix.S_IFREG
+}
+
+func (i *inode) fileMode() fs.FileMode {
+	m := fs.FileMode(i.mode & 0777)
+	switch i.mode & unix.S_IFMT {
+	case unix.S_IFDIR:
+		m |= fs.ModeDir
+	case unix.S_IFLNK:
+		m |= fs.ModeSymlink
+	case unix.S_IFBLK:
+		m |= fs.ModeDevice
+	case unix.S_IFCHR:
+		m |= fs.ModeDevice | fs.ModeCharDevice
+	case unix.S_IFIFO:
+		m |= fs.ModeNamedPipe
+	case unix.S_IFSOCK:
+		m |= fs.ModeSocket
+	}
+	if i.mode&unix.S_ISUID != 0 {
+		m |= fs.ModeSetuid
+	}
+	if i.mode&unix.S_ISGID != 0 {
+		m |= fs.ModeSetgid
+	}
+	if i.mode&unix.S_ISVTX != 0 {
+		m |= fs.ModeSticky
+	}
+	return m
+}
+
+func typeMode(ft uint8) fs.FileMode {
+	switch ft {
+	case ftDir:
+		return fs.ModeDir
+	case ftSymlink:
+		return fs.ModeSymlink
+	case ftBlockDev:
+		return fs.ModeDevice
+	case ftCharDev:
+		return fs.ModeDevice | fs.ModeCharDevice
+	case ftFifo:
+		return fs.ModeNamedPipe
+	case ftSocket:
+		return fs.ModeSocket
+	}
+	return 0
+}
+
+// readData reads the contents of i at off into p, returning io.EOF if it
+// runs out.
+func (efs *FS) readData(i *inode, p []byte, off uint64) (int, error) {
+	if off >= i.size {
+		return 0, io.EOF
+	}
+	want := p
+	if uint64(len(want)) > i.size-off {
+		want = want[:i.size-off]
+	}
+
+	var err error
+	switch i.layout {
+	case InodeDataLayoutFlatPlain, InodeDataLayoutFlatInline:
+		err = efs.readFlat(i, want, off)
+	case InodeDataLayoutChunkBased:
+		err = efs.readChunked(i, want, off)
+	default:
+		err = efs.readCompressed(i, want, off)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(want) < len(p) {
+		return len(want), io.EOF
+	}
+	return len(want), nil
+}
+
+func (efs *FS) readFlat(i *inode, p []byte, off uint64) error {
+	// in the inline layout the last block is stored right after the inode
+	blocks := (i.size + efs.blksz - 1) / efs.blksz
+	if i.layout == InodeDataLayoutFlatInline {
+		blocks--
+	}
+	inlineStart := blocks * efs.blksz
+
+	for len(p) > 0 {
+		var n int
+		if off < inlineStart {
+			want := p
+			if uint64(len(want)) > inlineStart-off {
+				want = want[:inlineStart-off]
+			}
+			pos := uint64(i.iu)*efs.blksz + off
+			if _, err := efs.r.ReadAt(want, int64(pos)); err != nil {
+				return errors.Wrapf(err, "couldn't read inode %d data", i.nid)
+			}
+			n = len(want)
+		} else {
+			b, err := efs.readMeta(i.dataStart(efs)+off-inlineStart, len(p))
+			if err != nil {
+				return err
+			}
+			n = copy(p, b)
+		}
+		p = p[n:]
+		off += uint64(n)
+	}
+	return nil
+}
+
+func (efs *FS) readChunked(i *inode, p []byte, off uint64) error {
+	format := uint16(i.iu)
+	chunkBits := uint64(efs.sb.BlockSizeBits) + uint64(format&chunkFormatBlkbitsMask)
+	if chunkBits > 63 {
+		return errors.Errorf("inode %d has bad chunk format %x", i.nid, format)
+	}
+	chunkSize := uint64(1) << chunkBits
+	unit := uint64(4)
+	if format&chunkFormatIndexes != 0 {
+		unit = 8
+	}
+	indexStart := (i.dataStart(efs) + unit - 1) / unit * unit
+
+	for len(p) > 0 {
+		chunk := off >> chunkBits
+		within := off & (chunkSize - 1)
+		want := p
+		if uint64(len(want)) > chunkSize-within {
+			want = want[:chunkSize-within]
+		}
+
+		idx, err := efs.readMeta(indexStart+chunk*unit, int(unit))
+		if err != nil {
+			return err
+		}
+		var blkaddr uint32
+		if unit == 8 {
+			if device := binary.LittleEndian.Uint16(idx[2:4]); device != 0 {
+				return errors.Errorf("inode %d refers to extra device %d", i.nid, device)
+			}
+			blkaddr = binary.LittleEndian.Uint32(idx[4:8])
+		} else {
+			blkaddr = binary.LittleEndian.Uint32(idx[0:4])
+		}
+
+		if blkaddr == nullAddr {
+			for n := range want {
+				want[n] = 0
+			}
+		} else if _, err := efs.r.ReadAt(want, int64(uint64(blkaddr)*efs.blksz+within)); err != nil {
+			return errors.Wrapf(err, "couldn't read inode %d data", i.nid)
+		}
+
+		p = p[len(want):]
+		off += uint64(len(want))
+	}
+	return nil
+}
+
+var xattrPrefixes = map[uint8]string{
+	1: "user.",
+	2: "system.posix_acl_access",
+	3: "system.posix_acl_default",
+	4: "trusted.",
+	6: "security.",
+}
+
+// parseXattr parses the xattr entry at the start of b, returning its name,
+// value and (aligned) size.
+func parseXattr(b []byte) (string, []byte, int, error) {
+	if len(b) < 4 {
+		return "", nil, 0, errors.Errorf("truncated xattr entry")
+	}
+	nameLen := int(b[0])
+	index := b[1]
+	valueSize := int(binary.LittleEndian.Uint16(b[2:4]))
+	size := 4 + nameLen + valueSize
+	if size > len(b) {
+		return "", nil, 0, errors.Errorf("truncated xattr entry")
+	}
+	prefix, ok := xattrPrefixes[index]
+	if !ok {
+		return "", nil, 0, errors.Errorf("unsupported xattr name index %d", index)
+	}
+	name := prefix + string(b[4:4+nameLen])
+	value := append([]byte{}, b[4+nameLen:size]...)
+	return name, value, (size + 3) &^ 3, nil
+}
+
+func (efs *FS) readXattrs(i *inode) (map[string][]byte, error) {
+	if i.xattrSize == 0 {
+		return nil, nil
+	}
+	body, err := efs.readMeta(efs.iloc(i.nid)+i.isize, int(i.xattrSize))
+	if err != nil {
+		return nil, err
+	}
+
+	xattrs := map[string][]byte{}
+	shared := int(body[4])
+	if 12+4*shared > len(body) {
+		return nil, errors.Errorf("inode %d has bad xattr header", i.nid)
+	}
+	for n := 0; n < shared; n++ {
+		id := uint64(binary.LittleEndian.Uint32(body[12+4*n:]))
+		pos := uint64(efs.sb.XattrBlockAddr)*efs.blksz + id*4
+		// an entry's header says how long it is
+		hdr, err := efs.readMeta(pos, 4)
+		if err != nil {
+			return nil, err
+		}
+		entry, err := efs.readMeta(pos, 4+int(hdr[0])+int(binary.LittleEndian.Uint16(hdr[2:4])))
+		if err != nil {
+			return nil, err
+		}
+		name, value, _, err := parseXattr(entry)
+		if err != nil {
+			return nil, err
+		}
+		xattrs[name] = value
+	}
+
+	inline := body[12+4*shared:]
+	for len(inline) > 0 {
+		name, value, size, err := parseXattr(inline)
+		if err != nil {
+			return nil, err
+		}
+		xattrs[name] = value
+		if size > len(inline) {
+			break
+		}
+		inline = inline[size:]
+	}
+	return xattrs, nil
+}
+
+// readDir returns the entries of the directory i, minus "." and "..".
+func (efs *FS) readDir(i *inode) ([]dirent, error) {
+	if !i.isDir() {
+		return nil, unix.ENOTDIR
+	}
+
+	efs.mu.Lock()
+	ents, ok := efs.dirs[i.nid]
+	efs.mu.Unlock()
+	if ok {
+		return ents, nil
+	}
+
+	block := make([]byte, efs.blksz)
+	for off := uint64(0); off < i.size; off += efs.blksz {
+		n, err := efs.readData(i, block, off)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		b := block[:n]
+		if len(b) < DirentSize {
+			return nil, errors.Errorf("directory %d has a short block", i.nid)
+		}
+
+		count := int(binary.LittleEndian.Uint16(b[8:10])) / DirentSize
+		if count == 0 || count*DirentSize > len(b) {
+			return nil, errors.Errorf("directory %d has a bad block", i.nid)
+		}
+		for d := 0; d < count; d++ {
+			de := b[d*DirentSize:]
+			start := int(binary.LittleEndian.Uint16(de[8:10]))
+			end := len(b)
+			if d+1 < count {
+				end = int(binary.LittleEndian.Uint16(de[DirentSize+8 : DirentSize+10]))
+			}
+			if start > end || end > len(b) {
+				return nil, errors.Errorf("directory %d has a bad entry", i.nid)
+			}
+			name := b[start:end]
+			// the last name in a block may be NUL padded
+			for len(name) > 0 && name[len(name)-1] == 0 {
+				name = name[:len(name)-1]
+			}
+			if string(name) == "." || string(name) == ".." {
+				continue
+			}
+			if len(name) > MaxNameLen || !imagefs.ValidName(string(name)) {
+				return nil, errors.Errorf("bad directory entry name %q", name)
+			}
+			ents = append(ents, dirent{
+				name: string(name),
+				nid:  binary.LittleEndian.Uint64(de[0:8]),
+				typ:  de[10],
+			})
+		}
+	}
+
+	sort.Slice(ents, func(a, b int) bool { return ents[a].name < ents[b].name })
+
+	efs.mu.Lock()
+	if len(efs.dirs) >= dirCacheSize {
+		efs.dirs = map[uint64][]dirent{}
+	}
+	efs.dirs[i.nid] = ents
+	efs.mu.Unlock()
+	return ents, nil
+}
+
+func (efs *FS) lookup(dir *inode, name string) (*inode, error) {
+	ents, err := efs.readDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	n := sort.Search(len(ents), func(i int) bool { return ents[i].name >= name })
+	if n == len(ents) || ents[n].name != name {
+		return nil, fs.ErrNotExist
+	}
+	return efs.readInode(ents[n].nid)
+}
+
+func (efs *FS) link(i *inode) (string, bool, error) {
+	return i.target, i.isSymlink(), nil
+}
+
+func (efs *FS) resolve(op, name string, follow bool) (*inode, error) {
+	if !fs.ValidPath(name) {
+		return nil, imagefs.PathError(op, name, fs.ErrInvalid)
+	}
+	i, err := efs.resolver.Resolve(name, follow)
+	if err != nil {
+		return nil, imagefs.PathError(op, name, err)
+	}
+	return i, nil
+}
+
+func (efs *FS) stat(name string, i *inode) (fs.FileInfo, error) {
+	xattrs, err := efs.readXattrs(i)
+	if err != nil {
+		return nil, err
+	}
+	st := &imagefs.Stat{
+		Ino:    uint64(i.ino),
+		Nlink:  i.nlink,
+		Uid:    i.uid,
+		Gid:    i.gid,
+		Xattrs: xattrs,
+	}
+	if fm := i.fileMode(); fm&fs.ModeDevice != 0 {
+		// the kernel's new_encode_dev()
+		major := (i.iu >> 8) & 0xfff
+		minor := (i.iu & 0xff) | ((i.iu >> 12) & 0xfff00)
+		st.Rdev = unix.Mkdev(major, minor)
+	}
+	return &fileInfo{name: name, i: i, stat: st}, nil
+}
+
+func baseName(name string) string {
+	for n := len(name) - 1; n >= 0; n-- {
+		if name[n] == '/' {
+			return name[n+1:]
+		}
+	}
+	return name
+}
+
+// Open implements fs.FS, following symlinks within the image.
+func (efs *FS) Open(name string) (fs.File, error) {
+	i, err := efs.resolve("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return &file{efs: efs, name: name, i: i}, nil
+}
+
+// Stat implements fs.StatFS.
+func (efs *FS) Stat(name string) (fs.FileInfo, error) {
+	i, err := efs.resolve("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := efs.stat(baseName(name), i)
+	if err != nil {
+		return nil, imagefs.PathError("stat", name, err)
+	}
+	return fi, nil
+}
+
+// Lstat is Stat without following a final symlink.
+func (efs *FS) Lstat(name string) (fs.FileInfo, error) {
+	i, err := efs.resolve("lstat", name, false)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := efs.stat(baseName(name), i)
+	if err != nil {
+		return nil, imagefs.PathError("lstat", name, err)
+	}
+	return fi, nil
+}
+
+// ReadLink returns the target of the symlink name.
+func (efs *FS) ReadLink(name string) (string, error) {
+	i, err := efs.resolve("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+	if !i.isSymlink() {
+		return "", imagefs.PathError("readlink", name, fs.ErrInvalid)
+	}
+	return i.target, nil
+}
+
+// ReadDir implements fs.ReadDirFS.
+func (efs *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	i, err := efs.resolve("readdir", name, true)
+	if err != nil {
+		return nil, err
+	}
+	ents, err := efs.dirEntries(i)
+	if err != nil {
+		return nil, imagefs.PathError("readdir", name, err)
+	}
+	return ents, nil
+}
+
+func (efs *FS) dirEntries(i *inode) ([]fs.DirEntry, error) {
+	ents, err := efs.readDir(i)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]fs.DirEntry, len(ents))
+	for n, e := range ents {
+		ret[n] = &dirEntry{efs: efs, dirent: e}
+	}
+	return ret, nil
+}
+
+type fileInfo struct {
+	name string
+	i    *inode
+	stat *imagefs.Stat
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return int64(fi.i.size) }
+func (fi *fileInfo) Mode() fs.FileMode  { return fi.i.fileMode() }
+func (fi *fileInfo) ModTime() time.Time { return fi.i.mtime }
+func (fi *fileInfo) IsDir() bool        { return fi.i.isDir() }
+func (fi *fileInfo) Sys() any           { return fi.stat }
+
+type dirEntry struct {
+	efs *FS
+	dirent
+}
+
+func (de *dirEntry) Name() string      { return de.name }
+func (de *dirEntry) IsDir() bool       { return de.typ == ftDir }
+func (de *dirEntry) Type() fs.FileMode { return typeMode(de.typ) }
+
+func (de *dirEntry) Info() (fs.FileInfo, error) {
+	i, err := de.efs.readInode(de.nid)
+	if err != nil {
+		return nil, err
+	}
+	return de.efs.stat(de.name, i)
+}
+
+// file is an open file or directory. Regular files implement io.ReaderAt
+// and io.Seeker as well.
+type file struct {
+	efs    *FS
+	name   string
+	i      *inode
+	offset int64
+	// directories
+	ents []fs.DirEntry
+	read bool
+	// the last decompressed extent of a compressed file
+	extent *zextent
+}
+
+func (f *file) Stat() (fs.FileInfo, error) {
+	return f.efs.stat(baseName(f.name), f.i)
+}
+
+func (f *file) Close() error {
+	return nil
+}
+
+func (f *file) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !f.i.isDir() {
+		return nil, imagefs.PathError("readdir", f.name, unix.ENOTDIR)
+	}
+	if !f.read {
+		ents, err := f.efs.dirEntries(f.i)
+		if err != nil {
+			return nil, imagefs.PathError("readdir", f.name, err)
+		}
+		f.ents = ents
+		f.read = true
+	}
+	if n <= 0 {
+		ents := f.ents
+		f.ents = nil
+		return ents, nil
+	}
+	if len(f.ents) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(f.ents) {
+		n = len(f.ents)
+	}
+	ents := f.ents[:n]
+	f.ents = f.ents[n:]
+	return ents, nil
+}
+
+func (f *file) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.offset)
+	f.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += int64(f.i.size)
+	default:
+		return 0, imagefs.PathError("seek", f.name, fs.ErrInvalid)
+	}
+	if offset < 0 {
+		return 0, imagefs.PathError("seek", f.name, fs.ErrInvalid)
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *file) ReadAt(p []byte, off int64) (int, error) {
+	if !f.i.isRegular() || off < 0 {
+		return 0, imagefs.PathError("read", f.name, fs.ErrInvalid)
+	}
+
+	if f.i.z == nil {
+		n, err := f.efs.readData(f.i, p, uint64(off))
+		if err != nil && err != io.EOF {
+			err = imagefs.PathError("read", f.name, err)
+		}
+		return n, err
+	}
+
+	// compressed files are read an extent at a time, keeping the last
+	// one since reads are usually sequential.
+	total := 0
+	for len(p) > 0 && uint64(off) < f.i.size {
+		if f.extent == nil || !f.extent.contains(uint64(off)) {
+			ext, err := f.efs.decompressExtent(f.i, uint64(off))
+			if err != nil {
+				return total, imagefs.PathError("read", f.name, err)
+			}
+			f.extent = ext
+		}
+		n := copy(p, f.extent.data[uint64(off)-f.extent.la:])
+		p = p[n:]
+		off += int64(n)
+		total += n
+	}
+	if len(p) > 0 {
+		return total, io.EOF
+	}
+	return total, nil
+}
+
+var _ imagefs.FS = &FS{}
+var _ fs.ReadDirFS = &FS{}
+var _ fs.StatFS = &FS{}
@@ -0,0 +1,125 @@
+package erofs
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"machinerun.io/atomfs/pkg/common"
+	"machinerun.io/atomfs/pkg/imagefs"
+	types "machinerun.io/atomfs/pkg/types"
+	"machinerun.io/atomfs/pkg/verity"
+)
+
+func TestReader(t *testing.T) {
+	assert := assert.New(t)
+
+	if common.Which("mkfs.erofs") == "" {
+		t.Skip("mkfs.erofs not found")
+	}
+
+	rootfs, err := os.MkdirTemp("", "stacker_reader_test_rootfs")
+	require.NoError(t, err)
+	defer os.RemoveAll(rootfs)
+
+	// some compressible data, followed by some that isn't, so the file
+	// has both compressed and plain pclusters
+	big := make([]byte, 300*1024)
+	for i := range big[:200*1024] {
+		big[i] = byte(i % 251)
+	}
+	seed := uint32(1)
+	for i := 200 * 1024; i < len(big); i++ {
+		seed = seed*1664525 + 1013904223
+		big[i] = byte(seed >> 24)
+	}
+	require.NoError(t, os.MkdirAll(path.Join(rootfs, "dir", "sub"), 0750))
+	require.NoError(t, os.WriteFile(path.Join(rootfs, "dir", "big"), big, 0644))
+	require.NoError(t, os.WriteFile(path.Join(rootfs, "dir", "sub", "small"), []byte("hello"), 0600))
+	require.NoError(t, os.Symlink("dir/sub", path.Join(rootfs, "link")))
+	require.NoError(t, os.Link(path.Join(rootfs, "dir", "big"), path.Join(rootfs, "hardlink")))
+
+	for _, opts := range []types.MakeOptions{
+		{},
+		// big pclusters
+		{BlockSize: 64 * 1024},
+	} {
+		tempdir, err := os.MkdirTemp("", "stacker_reader_test_tempdir")
+		require.NoError(t, err)
+		defer os.RemoveAll(tempdir)
+
+		reader, _, _, err := MakeErofsWithOptions(tempdir, rootfs, nil, verity.VerityMetadataPresent, opts)
+		if err == verity.CryptsetupTooOld {
+			t.Skip("libcryptsetup too old")
+		}
+		require.NoError(t, err)
+
+		image := path.Join(tempdir, "foo.erofs")
+		out, err := os.Create(image)
+		require.NoError(t, err)
+		_, err = io.Copy(out, reader)
+		require.NoError(t, err)
+		reader.Close()
+		out.Close()
+
+		efs, err := Open(image)
+		require.NoError(t, err)
+		defer efs.Close()
+
+		content, err := fs.ReadFile(efs, "dir/big")
+		assert.NoError(err)
+		assert.Equal(big, content)
+
+		// Open follows symlinks, Lstat and ReadLink don't
+		content, err = fs.ReadFile(efs, "link/small")
+		assert.NoError(err)
+		assert.Equal("hello", string(content))
+
+		fi, err := efs.Lstat("link")
+		assert.NoError(err)
+		assert.Equal(fs.ModeSymlink, fi.Mode().Type())
+		target, err := efs.ReadLink("link")
+		assert.NoError(err)
+		assert.Equal("dir/sub", target)
+
+		fi, err = efs.Stat("dir/sub")
+		assert.NoError(err)
+		assert.True(fi.IsDir())
+		assert.Equal(fs.FileMode(0750), fi.Mode().Perm())
+
+		a, err := efs.Stat("dir/big")
+		assert.NoError(err)
+		b, err := efs.Stat("hardlink")
+		assert.NoError(err)
+		assert.Equal(imagefs.StatOf(a).Ino, imagefs.StatOf(b).Ino)
+		assert.Equal(uint32(2), imagefs.StatOf(a).Nlink)
+
+		ents, err := efs.ReadDir(".")
+		assert.NoError(err)
+		names := []string{}
+		for _, e := range ents {
+			names = append(names, e.Name())
+		}
+		assert.Equal([]string{"dir", "hardlink", "link"}, names)
+
+		_, err = efs.Open("nope")
+		assert.ErrorIs(err, fs.ErrNotExist)
+
+		// and the extractor built on it
+		extractDir := path.Join(tempdir, "extracted")
+		policy, err := NewExtractPolicy("goerofs")
+		assert.NoError(err)
+		assert.NoError(ExtractSingleErofsPolicy(image, extractDir, policy))
+
+		content, err = os.ReadFile(path.Join(extractDir, "link", "small"))
+		assert.NoError(err)
+		assert.Equal("hello", string(content))
+		content, err = os.ReadFile(path.Join(extractDir, "hardlink"))
+		assert.NoError(err)
+		assert.Equal(big, content)
+	}
+}
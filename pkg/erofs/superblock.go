@@ -8,6 +8,7 @@ import (
 	"os"
 
 	"github.com/pkg/errors"
+	"machinerun.io/atomfs/pkg/common"
 )
 
 /*
@@ -72,11 +73,24 @@ const (
 // Features w/o backward compatibility.
 //
 // Any features that aren't in FeatureIncompatSupported are incompatible
-// with this implementation.
-//
-// This is not exhaustive, unused features are not listed.
+// with the reader in this package; the kernel and erofs-utils may of
+// course still handle them.
 const (
-	FeatureIncompatSupported = 0x0
+	FeatureIncompatZeroPadding   = 0x00000001
+	FeatureIncompatComprCfgs     = 0x00000002
+	FeatureIncompatBigPcluster   = 0x00000002
+	FeatureIncompatChunkedFile   = 0x00000004
+	FeatureIncompatDeviceTable   = 0x00000008
+	FeatureIncompatZtailpacking  = 0x00000010
+	FeatureIncompatFragments     = 0x00000020
+	FeatureIncompatDedupe        = 0x00000020
+	FeatureIncompatXattrPrefixes = 0x00000040
+
+	FeatureIncompatSupported = FeatureIncompatZeroPadding |
+		FeatureIncompatComprCfgs |
+		FeatureIncompatBigPcluster |
+		FeatureIncompatChunkedFile |
+		FeatureIncompatZtailpacking
 )
 
 // Sizes of on-disk structures in bytes.
@@ -167,10 +181,6 @@ func parseSuperblock(b []byte) (*superblock, error) {
 		Reserved:        [38]byte(b[90:128]),
 	}
 
-	if featureIncompat := sb.FeatureIncompat & ^uint32(FeatureIncompatSupported); featureIncompat != 0 {
-		return nil, errors.Errorf("unsupported incompatible features detected: 0x%x", featureIncompat)
-	}
-
 	if (1<<sb.BlockSizeBits)%os.Getpagesize() != 0 {
 		return nil, errors.Errorf("unsupported block size: 0x%x", 1<<sb.BlockSizeBits)
 	}
@@ -178,6 +188,21 @@ func parseSuperblock(b []byte) (*superblock, error) {
 	return sb, nil
 }
 
+// checkFeatures returns an error if the image uses features the reader in
+// this package doesn't understand. Finding the end of the image for verity
+// doesn't need any of them, so parseSuperblock doesn't check.
+func checkFeatures(sb *superblock) error {
+	if what := unsupportedByReader(sb); what != "" {
+		return &common.UnsupportedFeatureError{
+			Image:        "erofs image",
+			Feature:      what,
+			By:           "goerofs",
+			Alternatives: []string{"kmount", "erofsfuse", "fsck.erofs"},
+		}
+	}
+	return nil
+}
+
 func readSuperblock(path string) (*superblock, error) {
 	reader, err := os.Open(path)
 	if err != nil {
@@ -0,0 +1,191 @@
+package erofs
+
+import (
+	"fmt"
+	"os"
+
+	"machinerun.io/atomfs/pkg/common"
+)
+
+// featureInfo describes an incompatible feature: an image using one can
+// only be read by something that understands it.
+type featureInfo struct {
+	bit  uint32
+	name string
+	// sysfs is the feature's name in /sys/fs/erofs/features, for kernels
+	// that list what they support there
+	sysfs string
+	// kernel is the first release that supports the feature
+	kernel common.KernelVersion
+}
+
+// Names are as dump.erofs prints them. Some bits have two names, the kernel
+// having reused them for related features.
+var incompatFeatures = []featureInfo{
+	{FeatureIncompatZeroPadding, "0padding", "zero_padding", common.KernelVersion{Major: 5, Minor: 3}},
+	{FeatureIncompatComprCfgs, "compr_cfgs", "compr_cfgs", common.KernelVersion{Major: 5, Minor: 13}},
+	{FeatureIncompatBigPcluster, "big_pcluster", "big_pcluster", common.KernelVersion{Major: 5, Minor: 13}},
+	{FeatureIncompatChunkedFile, "chunked_file", "chunked_file", common.KernelVersion{Major: 5, Minor: 15}},
+	{FeatureIncompatDeviceTable, "device_table", "device_table", common.KernelVersion{Major: 5, Minor: 16}},
+	{FeatureIncompatZtailpacking, "ztailpacking", "ztailpacking", common.KernelVersion{Major: 5, Minor: 17}},
+	{FeatureIncompatFragments, "fragments", "fragments", common.KernelVersion{Major: 6, Minor: 1}},
+	{FeatureIncompatDedupe, "dedupe", "dedupe", common.KernelVersion{Major: 6, Minor: 1}},
+	{FeatureIncompatXattrPrefixes, "xattr_prefixes", "", common.KernelVersion{Major: 6, Minor: 4}},
+}
+
+// algorithms are indexed by their on-disk number.
+var algorithms = []struct {
+	name   string
+	kernel common.KernelVersion
+	// config is the kernel config option for it
+	config string
+	// whether the reader in this package can decompress it
+	goerofs bool
+}{
+	zAlgLZ4:     {"lz4", common.KernelVersion{Major: 5, Minor: 3}, "CONFIG_EROFS_FS_ZIP", true},
+	zAlgLZMA:    {"lzma", common.KernelVersion{Major: 5, Minor: 16}, "CONFIG_EROFS_FS_ZIP_LZMA", false},
+	zAlgDeflate: {"deflate", common.KernelVersion{Major: 6, Minor: 6}, "CONFIG_EROFS_FS_ZIP_DEFLATE", true},
+	zAlgZstd:    {"zstd", common.KernelVersion{Major: 6, Minor: 10}, "CONFIG_EROFS_FS_ZIP_ZSTD", true},
+}
+
+const sysfsFeatures = "/sys/fs/erofs/features"
+
+// declaredAlgorithms returns the on-disk numbers of the algorithms the image
+// may use.
+func declaredAlgorithms(sb *superblock) []int {
+	if sb.FeatureIncompat&FeatureIncompatComprCfgs == 0 {
+		if sb.FeatureIncompat&FeatureIncompatZeroPadding != 0 {
+			return []int{zAlgLZ4}
+		}
+		return []int{}
+	}
+	ret := []int{}
+	for alg := 0; alg < 16; alg++ {
+		if sb.Union1&(1<<alg) != 0 {
+			ret = append(ret, alg)
+		}
+	}
+	return ret
+}
+
+func algorithmName(alg int) string {
+	if alg < len(algorithms) {
+		return algorithms[alg].name
+	}
+	return fmt.Sprintf("unknown(%d)", alg)
+}
+
+func unknownFeatures(sb *superblock) uint32 {
+	known := uint32(0)
+	for _, f := range incompatFeatures {
+		known |= f.bit
+	}
+	return sb.FeatureIncompat &^ known
+}
+
+// unsupportedByKernel describes the first thing about the image that kernel
+// can't handle, or returns "" if it can mount it. sysfs holds the features
+// the kernel lists as supported, if it does, and config its config, if it's
+// known; what they say wins over kernel's version. guessed says whether
+// anything was judged by the version alone.
+func unsupportedByKernel(sb *superblock, kernel common.KernelVersion, sysfs map[string]bool, config common.KernelConfig) (what string, guessed bool) {
+	if unknown := unknownFeatures(sb); unknown != 0 {
+		return fmt.Sprintf("unknown incompatible features 0x%x", unknown), false
+	}
+	for _, f := range incompatFeatures {
+		if sb.FeatureIncompat&f.bit == 0 {
+			continue
+		}
+		if sysfs != nil && f.sysfs != "" {
+			if !sysfs[f.sysfs] {
+				return fmt.Sprintf("feature %s (kernel %s or later)", f.name, f.kernel), false
+			}
+			continue
+		}
+		guessed = true
+		if !kernel.AtLeast(f.kernel) {
+			return fmt.Sprintf("feature %s (kernel %s or later)", f.name, f.kernel), true
+		}
+	}
+	for _, alg := range declaredAlgorithms(sb) {
+		if alg >= len(algorithms) {
+			return fmt.Sprintf("%s compression", algorithmName(alg)), false
+		}
+		a := algorithms[alg]
+		if enabled, ok := config.Enabled(a.config); ok {
+			if !enabled {
+				return fmt.Sprintf("%s compression (%s is not set)", a.name, a.config), false
+			}
+			continue
+		}
+		guessed = true
+		if !kernel.AtLeast(a.kernel) {
+			return fmt.Sprintf("%s compression (kernel %s or later)", a.name, a.kernel), true
+		}
+	}
+	return "", guessed
+}
+
+// unsupportedByReader is unsupportedByKernel for the reader in this package.
+func unsupportedByReader(sb *superblock) string {
+	if unsupported := sb.FeatureIncompat &^ uint32(FeatureIncompatSupported); unsupported != 0 {
+		for _, f := range incompatFeatures {
+			if unsupported&f.bit != 0 {
+				return fmt.Sprintf("feature %s", f.name)
+			}
+		}
+		return fmt.Sprintf("unknown incompatible features 0x%x", unsupported)
+	}
+	for _, alg := range declaredAlgorithms(sb) {
+		if alg >= len(algorithms) || !algorithms[alg].goerofs {
+			return fmt.Sprintf("%s compression", algorithmName(alg))
+		}
+	}
+	return ""
+}
+
+func readSysfsFeatures() map[string]bool {
+	ents, err := os.ReadDir(sysfsFeatures)
+	if err != nil {
+		return nil
+	}
+	ret := map[string]bool{}
+	for _, e := range ents {
+		ret[e.Name()] = true
+	}
+	return ret
+}
+
+// checkKernelSupport returns an error naming what the running kernel can't
+// handle about the image at path, so we can fail before mount(2) gives a
+// bare EINVAL.
+func checkKernelSupport(path string) error {
+	sb, err := readSuperblock(path)
+	if err != nil {
+		return err
+	}
+	kernel, err := common.RunningKernelVersion()
+	if err != nil {
+		return err
+	}
+	config, err := common.RunningKernelConfig()
+	if err != nil {
+		return err
+	}
+	what, guessed := unsupportedByKernel(sb, kernel, readSysfsFeatures(), config)
+	if what == "" {
+		return nil
+	}
+
+	alternatives := []string{"erofsfuse", "fsck.erofs"}
+	if unsupportedByReader(sb) == "" {
+		alternatives = append(alternatives, "goerofs")
+	}
+	return &common.UnsupportedFeatureError{
+		Image:        path,
+		Feature:      what,
+		By:           "kernel " + kernel.String(),
+		Guessed:      guessed,
+		Alternatives: alternatives,
+	}
+}
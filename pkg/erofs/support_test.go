@@ -0,0 +1,52 @@
+package erofs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"machinerun.io/atomfs/pkg/common"
+)
+
+func TestKernelSupport(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	v := func(major, minor int) common.KernelVersion { return common.KernelVersion{Major: major, Minor: minor} }
+
+	check := func(sb *superblock, kernel common.KernelVersion, sysfs map[string]bool, config common.KernelConfig) [2]any {
+		what, guessed := unsupportedByKernel(sb, kernel, sysfs, config)
+		return [2]any{what, guessed}
+	}
+
+	sb := &superblock{FeatureIncompat: FeatureIncompatZeroPadding | FeatureIncompatChunkedFile}
+	assert.Equal([2]any{"", true}, check(sb, v(5, 15), nil, nil))
+	assert.Equal([2]any{"feature chunked_file (kernel 5.15 or later)", true}, check(sb, v(5, 10), nil, nil))
+	// what the kernel lists in sysfs wins over its version
+	assert.Equal([2]any{"", false}, check(sb, v(5, 10), map[string]bool{"zero_padding": true, "chunked_file": true}, common.KernelConfig{"CONFIG_EROFS_FS_ZIP": "y"}))
+	assert.Equal([2]any{"feature chunked_file (kernel 5.15 or later)", false}, check(sb, v(6, 1), map[string]bool{"zero_padding": true}, nil))
+
+	sb = &superblock{FeatureIncompat: FeatureIncompatZeroPadding | FeatureIncompatComprCfgs, Union1: 1<<zAlgLZ4 | 1<<zAlgZstd}
+	sysfs := map[string]bool{"zero_padding": true, "compr_cfgs": true, "big_pcluster": true}
+	assert.Equal([2]any{"zstd compression (kernel 6.10 or later)", true}, check(sb, v(6, 8), sysfs, nil))
+	assert.Equal([2]any{"", true}, check(sb, v(6, 10), sysfs, nil))
+	// and so does its config
+	config := common.KernelConfig{"CONFIG_EROFS_FS_ZIP": "y", "CONFIG_EROFS_FS_ZIP_ZSTD": "n"}
+	assert.Equal([2]any{"zstd compression (CONFIG_EROFS_FS_ZIP_ZSTD is not set)", false}, check(sb, v(6, 12), sysfs, config))
+	config["CONFIG_EROFS_FS_ZIP_ZSTD"] = "y"
+	assert.Equal([2]any{"", false}, check(sb, v(6, 8), sysfs, config))
+	assert.Equal("", unsupportedByReader(sb))
+
+	sb.Union1 = 1 << zAlgLZMA
+	assert.Equal("lzma compression", unsupportedByReader(sb))
+	assert.Error(checkFeatures(sb))
+
+	sb = &superblock{FeatureIncompat: FeatureIncompatFragments}
+	assert.Equal("feature fragments", unsupportedByReader(sb))
+	err := checkFeatures(sb)
+	assert.ErrorContains(err, "fragments")
+	assert.ErrorContains(err, "erofsfuse")
+
+	sb = &superblock{FeatureIncompat: 0x80000000}
+	assert.Equal([2]any{"unknown incompatible features 0x80000000", false}, check(sb, v(6, 10), nil, nil))
+	assert.Equal("unknown incompatible features 0x80000000", unsupportedByReader(sb))
+}
@@ -0,0 +1,627 @@
+package erofs
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	"machinerun.io/atomfs/pkg/decompress"
+)
+
+// Compressed files are mapped the way the kernel's fs/erofs/zmap.c does it;
+// the names below follow that code so the two can be read side by side.
+
+const (
+	zAdviseCompacted2B      = 0x0001
+	zAdviseBigPcluster1     = 0x0002
+	zAdviseBigPcluster2     = 0x0004
+	zAdviseInlinePcluster   = 0x0008
+	zAdviseInterlaced       = 0x0010
+	zAdviseFragmentPcluster = 0x0020
+
+	zFragmentInodeBit = 7
+
+	lclusterTypePlain   = 0
+	lclusterTypeHead1   = 1
+	lclusterTypeNonhead = 2
+	lclusterTypeHead2   = 3
+
+	liLclusterTypeMask = 0x3
+	liPartialRef       = 1 << 15
+	liD0Cblkcnt        = 1 << 11
+
+	// on-disk compression algorithms, plus the two ways uncompressed
+	// pclusters are stored
+	zAlgLZ4        = 0
+	zAlgLZMA       = 1
+	zAlgDeflate    = 2
+	zAlgZstd       = 3
+	zAlgShifted    = 4
+	zAlgInterlaced = 5
+
+	// the largest pcluster and extent the kernel will read
+	maxPclusterSize = 1 << 20
+	maxExtentSize   = 12 * maxPclusterSize
+)
+
+type zinfo struct {
+	advise       uint16
+	algs         [2]uint8
+	lclusterBits uint
+	// ztailpacking, the tail pcluster is stored inline after the indexes
+	idataSize   uint64
+	idataOff    uint64
+	tailHeadLcn uint64
+}
+
+// zextent is a decompressed extent of a file, starting at la.
+type zextent struct {
+	la   uint64
+	data []byte
+}
+
+func (e *zextent) contains(off uint64) bool {
+	return off >= e.la && off-e.la < uint64(len(e.data))
+}
+
+// zmapping is where the extent covering some offset is stored.
+type zmapping struct {
+	la, llen uint64
+	pa, plen uint64
+	alg      uint8
+	inline   bool
+}
+
+// zrecorder is the kernel's z_erofs_maprecorder: the state of one lookup.
+type zrecorder struct {
+	efs *FS
+	i   *inode
+
+	lcn            uint64
+	typ            uint8
+	headtype       uint8
+	clusterofs     uint64
+	delta          [2]uint64
+	pblk           uint64
+	compressedBlks uint64
+	nextPackOff    uint64
+	partialRef     bool
+}
+
+func align(v, a uint64) uint64 {
+	return (v + a - 1) / a * a
+}
+
+func (efs *FS) readZinfo(i *inode) (*zinfo, error) {
+	h, err := efs.readMeta(align(i.dataStart(efs), 8), 8)
+	if err != nil {
+		return nil, err
+	}
+	if h[7]>>zFragmentInodeBit != 0 {
+		return nil, errors.Errorf("inode %d is stored in a fragment, which is not supported", i.nid)
+	}
+
+	z := &zinfo{
+		idataSize:    uint64(binary.LittleEndian.Uint16(h[2:4])),
+		advise:       binary.LittleEndian.Uint16(h[4:6]),
+		algs:         [2]uint8{h[6] & 0xf, h[6] >> 4},
+		lclusterBits: uint(efs.sb.BlockSizeBits) + uint(h[7]&7),
+	}
+	if z.advise&zAdviseFragmentPcluster != 0 {
+		return nil, errors.Errorf("inode %d has fragments, which are not supported", i.nid)
+	}
+	if i.layout == InodeDataLayoutFlatCompression {
+		if (z.advise&zAdviseBigPcluster1 == 0) != (z.advise&zAdviseBigPcluster2 == 0) {
+			return nil, errors.Errorf("inode %d has inconsistent big pcluster flags", i.nid)
+		}
+		if z.lclusterBits > 14 {
+			return nil, errors.Errorf("inode %d has unsupported cluster bits %d", i.nid, z.lclusterBits)
+		}
+	}
+	i.z = z
+
+	if z.advise&zAdviseInlinePcluster != 0 && i.size > 0 {
+		m := &zrecorder{efs: efs, i: i}
+		_, _, packOff, err := m.findHead(i.size - 1)
+		if err != nil {
+			return nil, err
+		}
+		z.idataOff = packOff
+		z.tailHeadLcn = m.lcn
+	}
+	return z, nil
+}
+
+func (m *zrecorder) load(lcn uint64, lookahead bool) error {
+	if m.i.layout == InodeDataLayoutFlatCompressionLegacy {
+		return m.loadFull(lcn)
+	}
+	return m.loadCompact(lcn, lookahead)
+}
+
+// loadFull reads one of the 8 byte indexes of the legacy layout.
+func (m *zrecorder) loadFull(lcn uint64) error {
+	z := m.i.z
+	pos := align(m.i.dataStart(m.efs), 8) + 16 + lcn*8
+	di, err := m.efs.readMeta(pos, 8)
+	if err != nil {
+		return err
+	}
+
+	m.lcn = lcn
+	m.nextPackOff = pos + 8
+	advise := binary.LittleEndian.Uint16(di[0:2])
+	m.typ = uint8(advise & liLclusterTypeMask)
+	if m.typ == lclusterTypeNonhead {
+		m.clusterofs = 1 << z.lclusterBits
+		m.delta[0] = uint64(binary.LittleEndian.Uint16(di[4:6]))
+		if m.delta[0]&liD0Cblkcnt != 0 {
+			if z.advise&(zAdviseBigPcluster1|zAdviseBigPcluster2) == 0 {
+				return errors.Errorf("inode %d has a block count without big pclusters", m.i.nid)
+			}
+			m.compressedBlks = m.delta[0] &^ liD0Cblkcnt
+			m.delta[0] = 1
+		}
+		m.delta[1] = uint64(binary.LittleEndian.Uint16(di[6:8]))
+		return nil
+	}
+
+	m.partialRef = advise&liPartialRef != 0
+	m.clusterofs = uint64(binary.LittleEndian.Uint16(di[2:4]))
+	if m.clusterofs >= 1<<z.lclusterBits {
+		return errors.Errorf("inode %d has bad cluster offset %d", m.i.nid, m.clusterofs)
+	}
+	m.pblk = uint64(binary.LittleEndian.Uint32(di[4:8]))
+	return nil
+}
+
+// loadCompact finds lcn in the packs of compacted indexes, which start with
+// enough 4 byte entries to align the 2 byte ones to 32 bytes.
+func (m *zrecorder) loadCompact(lcn uint64, lookahead bool) error {
+	ebase := align(m.i.dataStart(m.efs), 8) + 8
+	totalIdx := (m.i.size + m.efs.blksz - 1) / m.efs.blksz
+	if lcn >= totalIdx {
+		return errors.Errorf("inode %d has no logical cluster %d", m.i.nid, lcn)
+	}
+
+	m.lcn = lcn
+	initial4B := ((32 - ebase%32) / 4) & 7
+	compacted2B := uint64(0)
+	if m.i.z.advise&zAdviseCompacted2B != 0 && initial4B < totalIdx {
+		compacted2B = (totalIdx - initial4B) / 16 * 16
+	}
+
+	pos := ebase
+	shift := uint(2)
+	switch {
+	case lcn < initial4B:
+	case lcn-initial4B < compacted2B:
+		pos += initial4B * 4
+		lcn -= initial4B
+		shift = 1
+	default:
+		pos += initial4B*4 + compacted2B*2
+		lcn -= initial4B + compacted2B
+	}
+	return m.unpackCompacted(shift, pos+lcn<<shift, lookahead)
+}
+
+func decodeCompactedBits(lobits uint, in []byte, pos uint) (uint64, uint8) {
+	v := binary.LittleEndian.Uint32(in[pos/8:]) >> (pos & 7)
+	return uint64(v & (1<<lobits - 1)), uint8((v >> lobits) & 3)
+}
+
+// compactedLookahead is the distance from entry i to the next head.
+func compactedLookahead(lobits, encodebits uint, vcnt int, in []byte, i int) uint64 {
+	var lo, d1 uint64
+	for ; i < vcnt; i++ {
+		var typ uint8
+		lo, typ = decodeCompactedBits(lobits, in, encodebits*uint(i))
+		if typ != lclusterTypeNonhead {
+			return d1
+		}
+		d1++
+	}
+	// the last entry of a pack holds delta[1] rather than delta[0]
+	if lo&liD0Cblkcnt == 0 {
+		d1 += lo - 1
+	}
+	return d1
+}
+
+func (m *zrecorder) unpackCompacted(shift uint, pos uint64, lookahead bool) error {
+	z := m.i.z
+	var vcnt int
+	switch {
+	case shift == 2 && z.lclusterBits <= 14:
+		vcnt = 2
+	case shift == 1 && z.lclusterBits <= 12:
+		vcnt = 16
+	default:
+		return errors.Errorf("inode %d has unsupported compacted indexes", m.i.nid)
+	}
+
+	packSize := uint64(vcnt) << shift
+	packStart := pos / packSize * packSize
+	in, err := m.efs.readMeta(packStart, int(packSize))
+	if err != nil {
+		return err
+	}
+	m.nextPackOff = packStart + packSize
+
+	bigPcluster := z.advise&zAdviseBigPcluster1 != 0
+	lobits := z.lclusterBits
+	if lobits < 12 {
+		lobits = 12
+	}
+	encodebits := uint((packSize-4)*8) / uint(vcnt)
+	i := int((pos - packStart) >> shift)
+
+	lo, typ := decodeCompactedBits(lobits, in, encodebits*uint(i))
+	m.typ = typ
+	if typ == lclusterTypeNonhead {
+		m.clusterofs = 1 << z.lclusterBits
+		if lookahead {
+			m.delta[1] = compactedLookahead(lobits, encodebits, vcnt, in, i)
+		}
+		if lo&liD0Cblkcnt != 0 {
+			if !bigPcluster {
+				return errors.Errorf("inode %d has a block count without big pclusters", m.i.nid)
+			}
+			m.compressedBlks = lo &^ liD0Cblkcnt
+			m.delta[0] = 1
+			return nil
+		} else if i+1 != vcnt {
+			m.delta[0] = lo
+			return nil
+		}
+		// the last entry holds delta[1], so work delta[0] out from the
+		// one before it
+		lo, typ = decodeCompactedBits(lobits, in, encodebits*uint(i-1))
+		if typ != lclusterTypeNonhead {
+			lo = 0
+		} else if lo&liD0Cblkcnt != 0 {
+			lo = 1
+		}
+		m.delta[0] = lo + 1
+		return nil
+	}
+
+	m.clusterofs = lo
+	m.delta[0] = 0
+
+	// the pack only records the first pblk, so count the pclusters
+	// before this one
+	var nblk uint64
+	if !bigPcluster {
+		nblk = 1
+		for i > 0 {
+			i--
+			lo, typ = decodeCompactedBits(lobits, in, encodebits*uint(i))
+			if typ == lclusterTypeNonhead {
+				i -= int(lo)
+			}
+			if i >= 0 {
+				nblk++
+			}
+		}
+	} else {
+		for i > 0 {
+			i--
+			lo, typ = decodeCompactedBits(lobits, in, encodebits*uint(i))
+			if typ == lclusterTypeNonhead {
+				if lo&liD0Cblkcnt != 0 {
+					i--
+					nblk += lo &^ liD0Cblkcnt
+					continue
+				}
+				if lo <= 1 {
+					return errors.Errorf("inode %d has a bad compacted index", m.i.nid)
+				}
+				i -= int(lo) - 2
+				continue
+			}
+			nblk++
+		}
+	}
+	m.pblk = uint64(binary.LittleEndian.Uint32(in[packSize-4:])) + nblk
+	return nil
+}
+
+// lookback walks back from a non-head lcluster to its head.
+func (m *zrecorder) lookback(distance uint64) (uint64, error) {
+	for m.lcn >= distance {
+		if err := m.load(m.lcn-distance, false); err != nil {
+			return 0, err
+		}
+		if m.typ != lclusterTypeNonhead {
+			m.headtype = m.typ
+			return m.lcn<<m.i.z.lclusterBits | m.clusterofs, nil
+		}
+		if m.delta[0] == 0 {
+			return 0, errors.Errorf("inode %d has a bad lookback distance", m.i.nid)
+		}
+		distance = m.delta[0]
+	}
+	return 0, errors.Errorf("inode %d has a lookback past its start", m.i.nid)
+}
+
+// findHead finds the head lcluster of the extent covering ofs, returning
+// where the extent starts, where the lookup says it ends and the end of the
+// index pack that covers ofs.
+func (m *zrecorder) findHead(ofs uint64) (uint64, uint64, uint64, error) {
+	z := m.i.z
+	initial := ofs >> z.lclusterBits
+	endoff := ofs & (1<<z.lclusterBits - 1)
+
+	if err := m.load(initial, false); err != nil {
+		return 0, 0, 0, err
+	}
+	packOff := m.nextPackOff
+	end := (m.lcn + 1) << z.lclusterBits
+
+	if m.typ != lclusterTypeNonhead {
+		if endoff >= m.clusterofs {
+			m.headtype = m.typ
+			if z.advise&zAdviseInlinePcluster != 0 && end > m.i.size {
+				end = m.i.size
+			}
+			return m.lcn<<z.lclusterBits | m.clusterofs, end, packOff, nil
+		}
+		if m.lcn == 0 {
+			return 0, 0, 0, errors.Errorf("inode %d has a bad first cluster", m.i.nid)
+		}
+		end = m.lcn<<z.lclusterBits | m.clusterofs
+		m.delta[0] = 1
+	}
+
+	la, err := m.lookback(m.delta[0])
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	return la, end, packOff, nil
+}
+
+// compressedLen is the size of the head's pcluster.
+func (m *zrecorder) compressedLen() (uint64, error) {
+	z := m.i.z
+	if m.headtype == lclusterTypePlain ||
+		(m.headtype == lclusterTypeHead1 && z.advise&zAdviseBigPcluster1 == 0) ||
+		(m.headtype == lclusterTypeHead2 && z.advise&zAdviseBigPcluster2 == 0) {
+		return 1 << z.lclusterBits, nil
+	}
+
+	if m.compressedBlks == 0 {
+		if err := m.load(m.lcn+1, false); err != nil {
+			return 0, err
+		}
+		switch {
+		case m.typ != lclusterTypeNonhead:
+			// no block count, so it's a single lcluster
+			m.compressedBlks = 1 << (z.lclusterBits - uint(m.efs.sb.BlockSizeBits))
+		case m.delta[0] != 1 || m.compressedBlks == 0:
+			return 0, errors.Errorf("inode %d has a bad pcluster block count", m.i.nid)
+		}
+	}
+	return m.compressedBlks * m.efs.blksz, nil
+}
+
+// decompressedLen walks forward from the head at la to the next one, giving
+// the length of the whole extent.
+func (m *zrecorder) decompressedLen(la uint64) (uint64, error) {
+	z := m.i.z
+	lcn := m.lcn
+	headLcn := la >> z.lclusterBits
+	for {
+		if lcn<<z.lclusterBits >= m.i.size {
+			return m.i.size - la, nil
+		}
+		if err := m.load(lcn, true); err != nil {
+			return 0, err
+		}
+		if m.typ != lclusterTypeNonhead {
+			if lcn != headLcn {
+				break
+			}
+			m.delta[1] = 1
+		}
+		if m.delta[1] == 0 {
+			break
+		}
+		lcn += m.delta[1]
+	}
+	end := lcn<<z.lclusterBits + m.clusterofs
+	if end <= la {
+		return 0, errors.Errorf("inode %d has an empty extent at %d", m.i.nid, la)
+	}
+	return end - la, nil
+}
+
+// zmap finds the whole extent of compressed inode i covering ofs.
+func (efs *FS) zmap(i *inode, ofs uint64) (*zmapping, error) {
+	z := i.z
+	m := &zrecorder{efs: efs, i: i}
+	la, _, _, err := m.findHead(ofs)
+	if err != nil {
+		return nil, err
+	}
+
+	zm := &zmapping{la: la}
+	if z.advise&zAdviseInlinePcluster != 0 && m.lcn == z.tailHeadLcn {
+		zm.inline = true
+		zm.pa = z.idataOff
+		zm.plen = z.idataSize
+	} else {
+		zm.pa = m.pblk * efs.blksz
+		if zm.plen, err = m.compressedLen(); err != nil {
+			return nil, err
+		}
+	}
+
+	headtype := m.headtype
+	if headtype == lclusterTypePlain {
+		zm.alg = zAlgShifted
+		if z.advise&zAdviseInterlaced != 0 {
+			zm.alg = zAlgInterlaced
+		}
+	} else {
+		zm.alg = z.algs[0]
+		if headtype == lclusterTypeHead2 {
+			zm.alg = z.algs[1]
+		}
+		if efs.algs&(1<<zm.alg) == 0 {
+			return nil, errors.Errorf("inode %d uses compression %d which the image doesn't declare", i.nid, zm.alg)
+		}
+	}
+
+	if zm.llen, err = m.decompressedLen(la); err != nil {
+		return nil, err
+	}
+	if headtype == lclusterTypePlain && zm.llen > zm.plen {
+		return nil, errors.Errorf("inode %d has an uncompressed extent larger than its pcluster", i.nid)
+	}
+	if zm.plen > maxPclusterSize || zm.llen > maxExtentSize {
+		return nil, errors.Errorf("inode %d has an extent too large to read", i.nid)
+	}
+	return zm, nil
+}
+
+// readCompressed reads from a compressed file without keeping anything
+// around, which is fine for the likes of symlinks and directories.
+func (efs *FS) readCompressed(i *inode, p []byte, off uint64) error {
+	for len(p) > 0 {
+		ext, err := efs.decompressExtent(i, off)
+		if err != nil {
+			return err
+		}
+		n := copy(p, ext.data[off-ext.la:])
+		p = p[n:]
+		off += uint64(n)
+	}
+	return nil
+}
+
+func (efs *FS) decompressExtent(i *inode, off uint64) (*zextent, error) {
+	zm, err := efs.zmap(i, off)
+	if err != nil {
+		return nil, err
+	}
+	if zm.la > off || off-zm.la >= zm.llen {
+		return nil, errors.Errorf("inode %d maps offset %d outside its extent", i.nid, off)
+	}
+
+	var src []byte
+	if zm.inline {
+		if src, err = efs.readMeta(zm.pa, int(zm.plen)); err != nil {
+			return nil, err
+		}
+	} else {
+		src = make([]byte, zm.plen)
+		if _, err := efs.r.ReadAt(src, int64(zm.pa)); err != nil {
+			return nil, errors.Wrapf(err, "couldn't read inode %d pcluster", i.nid)
+		}
+	}
+
+	data, err := efs.decodeExtent(zm, src)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't decompress inode %d at %d", i.nid, zm.la)
+	}
+	return &zextent{la: zm.la, data: data}, nil
+}
+
+func (efs *FS) decodeExtent(zm *zmapping, src []byte) ([]byte, error) {
+	llen := int(zm.llen)
+
+	switch zm.alg {
+	case zAlgShifted:
+		if llen > len(src) {
+			return nil, errors.Errorf("short pcluster")
+		}
+		return src[:llen], nil
+	case zAlgInterlaced:
+		// the pcluster is rotated so that each block lands where the
+		// file's block would be
+		if llen > len(src) {
+			return nil, errors.Errorf("short pcluster")
+		}
+		cur := int(efs.blksz - zm.la%efs.blksz)
+		if cur > llen {
+			cur = llen
+		}
+		dst := make([]byte, 0, llen)
+		dst = append(dst, src[len(src)-cur:]...)
+		return append(dst, src[:llen-cur]...), nil
+	}
+
+	// compressed data is padded with leading zeros to end on a block
+	// boundary, as long as the image says so for lz4
+	if zm.alg != zAlgLZ4 || efs.sb.FeatureIncompat&FeatureIncompatZeroPadding != 0 {
+		pad := len(src)
+		if limit := int(efs.blksz - zm.pa%efs.blksz); pad > limit {
+			pad = limit
+		}
+		n := 0
+		for n < pad && src[n] == 0 {
+			n++
+		}
+		if n == pad {
+			return nil, errors.Errorf("pcluster is all padding")
+		}
+		src = src[n:]
+	}
+
+	switch zm.alg {
+	case zAlgLZ4:
+		// deduplicated extents may only use the start of a pcluster
+		dst := make([]byte, llen)
+		n, err := decompress.LZ4Block(dst, src, true)
+		if err != nil {
+			return nil, err
+		}
+		if n != llen {
+			return nil, errors.Errorf("lz4 pcluster decompressed to %d bytes instead of %d", n, llen)
+		}
+		return dst, nil
+	case zAlgDeflate:
+		fr := flate.NewReader(bytes.NewReader(src))
+		defer fr.Close()
+		dst := make([]byte, llen)
+		if _, err := io.ReadFull(fr, dst); err != nil {
+			return nil, err
+		}
+		return dst, nil
+	case zAlgZstd:
+		dec, err := efs.zstdDecoder()
+		if err != nil {
+			return nil, err
+		}
+		dst, err := dec.DecodeAll(src, make([]byte, 0, llen))
+		if err != nil {
+			return nil, err
+		}
+		if len(dst) < llen {
+			return nil, errors.Errorf("zstd pcluster decompressed to %d bytes instead of %d", len(dst), llen)
+		}
+		return dst[:llen], nil
+	case zAlgLZMA:
+		return nil, errors.Errorf("lzma compressed erofs is not supported")
+	default:
+		return nil, errors.Errorf("unknown erofs compression %d", zm.alg)
+	}
+}
+
+func (efs *FS) zstdDecoder() (*zstd.Decoder, error) {
+	efs.mu.Lock()
+	defer efs.mu.Unlock()
+	if efs.zstd == nil {
+		dec, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(0), zstd.WithDecoderMaxMemory(uint64(maxExtentSize)))
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		efs.zstd = dec
+	}
+	return efs.zstd, nil
+}
@@ -0,0 +1,72 @@
+package erofs
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompactedIndexes(t *testing.T) {
+	assert := assert.New(t)
+
+	// two packs of 4 byte compacted indexes: each has two 16 bit entries
+	// (12 bits of offset or delta, then the type) and a base block address
+	img := make([]byte, blockSize)
+	copy(img, []byte{
+		0x00, 0x10, // head1, clusterofs 0
+		0x01, 0x20, // nonhead, the last one in the pack so delta[1] = 1
+		10, 0, 0, 0,
+		0x64, 0x10, // head1, clusterofs 100
+		0x05, 0x10, // head1, clusterofs 5
+		11, 0, 0, 0,
+	})
+	efs := &FS{
+		r:      bytes.NewReader(img),
+		sb:     &superblock{BlockSizeBits: 12, Blocks: 1},
+		blksz:  blockSize,
+		blocks: map[uint64][]byte{},
+	}
+	m := &zrecorder{efs: efs, i: &inode{z: &zinfo{lclusterBits: 12}}}
+
+	assert.NoError(m.unpackCompacted(2, 0, false))
+	assert.Equal(uint8(lclusterTypeHead1), m.typ)
+	assert.Equal(uint64(0), m.clusterofs)
+	// the base is one before the first pcluster
+	assert.Equal(uint64(11), m.pblk)
+	assert.Equal(uint64(8), m.nextPackOff)
+
+	assert.NoError(m.unpackCompacted(2, 4, true))
+	assert.Equal(uint8(lclusterTypeNonhead), m.typ)
+	assert.Equal(uint64(1), m.delta[0])
+	assert.Equal(uint64(1), m.delta[1])
+
+	assert.NoError(m.unpackCompacted(2, 8, false))
+	assert.Equal(uint8(lclusterTypeHead1), m.typ)
+	assert.Equal(uint64(100), m.clusterofs)
+	assert.Equal(uint64(12), m.pblk)
+
+	assert.NoError(m.unpackCompacted(2, 12, false))
+	assert.Equal(uint64(5), m.clusterofs)
+	assert.Equal(uint64(13), m.pblk)
+	assert.Equal(uint64(16), m.nextPackOff)
+}
+
+func TestDecodeInterlaced(t *testing.T) {
+	assert := assert.New(t)
+
+	efs := &FS{blksz: blockSize}
+	src := make([]byte, blockSize)
+	for i := range src {
+		src[i] = byte(i)
+	}
+
+	// the rest of the first block comes from the end of the pcluster
+	data, err := efs.decodeExtent(&zmapping{la: 3*blockSize + 100, llen: blockSize, plen: blockSize, alg: zAlgInterlaced}, src)
+	assert.NoError(err)
+	assert.Equal(append(append([]byte{}, src[100:]...), src[:100]...), data)
+
+	data, err = efs.decodeExtent(&zmapping{la: 100, llen: 50, plen: blockSize, alg: zAlgShifted}, src)
+	assert.NoError(err)
+	assert.Equal(src[:50], data)
+}
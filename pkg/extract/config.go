@@ -0,0 +1,124 @@
+package extract
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"machinerun.io/atomfs/pkg/log"
+)
+
+// ConfigEnvName names a config file to use instead of DefaultConfigFile.
+const ConfigEnvName = "ATOMFS_EXTRACT_CONFIG"
+
+// DefaultConfigFile configures the default policies, if it exists. It maps
+// filesystem names (squashfs, erofs) to Configs, e.g.
+//
+//	{"squashfs": {"extractors": ["kmount", "gosquash"], "timeout": "5m"}}
+const DefaultConfigFile = "/etc/atomfs/extract.json"
+
+// Config is how a config file sets up a filesystem's default policy.
+type Config struct {
+	// Extractors are the extractors to use, in order.
+	Extractors []string `json:"extractors,omitempty"`
+	// Timeout is a duration such as "30s".
+	Timeout       string `json:"timeout,omitempty"`
+	RequireVerity bool   `json:"require_verity,omitempty"`
+}
+
+// Options returns the options that set up a policy as c says.
+func (c Config) Options() ([]Option, error) {
+	opts := []Option{WithRequireVerity(c.RequireVerity)}
+	if len(c.Extractors) > 0 {
+		opts = append(opts, WithOrder(c.Extractors...))
+	}
+	if c.Timeout != "" {
+		timeout, err := time.ParseDuration(c.Timeout)
+		if err != nil {
+			return nil, errors.Wrapf(err, "bad extract timeout %q", c.Timeout)
+		}
+		opts = append(opts, WithTimeout(timeout))
+	}
+	return opts, nil
+}
+
+// LoadConfig reads a config file; one that doesn't exist configures
+// nothing.
+func LoadConfig(path string) (map[string]Config, error) {
+	configs := map[string]Config{}
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return configs, nil
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if err := json.Unmarshal(content, &configs); err != nil {
+		return nil, errors.Wrapf(err, "bad extract config %s", path)
+	}
+	return configs, nil
+}
+
+var defaults struct {
+	mutex    sync.Mutex
+	policies map[string]*Policy
+}
+
+// Default returns the default policy for the filesystem fsName, whose
+// extractors are all. It's set up by the config file, except that the
+// environment variable envName, a space separated list of extractors,
+// overrides the order, and defOrder is used if neither gives one. It's
+// made once and shared, unless making it fails or ResetDefaults is called.
+func Default(fsName string, all []Extractor, envName, defOrder string) (*Policy, error) {
+	defaults.mutex.Lock()
+	defer defaults.mutex.Unlock()
+
+	if p, ok := defaults.policies[fsName]; ok {
+		return p, nil
+	}
+
+	path := os.Getenv(ConfigEnvName)
+	if path == "" {
+		path = DefaultConfigFile
+	}
+	configs, err := LoadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	config := configs[fsName]
+	if val := os.Getenv(envName); val != "" {
+		config.Extractors = strings.Fields(val)
+	}
+	if len(config.Extractors) == 0 {
+		config.Extractors = strings.Fields(defOrder)
+	}
+
+	opts, err := config.Options()
+	if err != nil {
+		return nil, err
+	}
+	p, err := NewPolicy(all, opts...)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range p.Excuses {
+		log.Debugf(" %s extractor %s is not available: %v", fsName, k, v)
+	}
+
+	if defaults.policies == nil {
+		defaults.policies = map[string]*Policy{}
+	}
+	defaults.policies[fsName] = p
+	return p, nil
+}
+
+// ResetDefaults drops the default policies, so the next Default reads the
+// config file and environment again.
+func ResetDefaults() {
+	defaults.mutex.Lock()
+	defer defaults.mutex.Unlock()
+	defaults.policies = nil
+}
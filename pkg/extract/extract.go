@@ -0,0 +1,250 @@
+// Package extract chooses how filesystem images are extracted (or mounted
+// somewhere to be read from): each filesystem offers several Extractors,
+// and a Policy tries the ones it's configured with in order, sticking with
+// the first that works.
+package extract
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"machinerun.io/atomfs/pkg/log"
+	"machinerun.io/atomfs/pkg/verity"
+)
+
+// Extractor is one way of extracting a filesystem's images.
+type Extractor interface {
+	Name() string
+	IsAvailable() error
+	// Mount - Mount or extract path to dest.
+	//   Return nil on "already extracted"
+	//   Return error on failure.
+	Mount(path, dest string) error
+}
+
+// Policy says which extractors to use, in what order, and how.
+type Policy struct {
+	// Extractors are the available extractors, in the order to try them.
+	Extractors []Extractor
+	// Extractor is the one chosen, once one has worked.
+	Extractor Extractor
+	// Excuses say why extractors weren't used or didn't work.
+	Excuses map[string]error
+	// Timeout bounds each extraction, when non-zero. An extractor that
+	// takes too long can't be stopped, and is left to finish in the
+	// background, so no other is tried in the same dest; the extraction
+	// fails, and the next one tries them all again.
+	Timeout time.Duration
+	// RequireVerity refuses to extract images without checking all of
+	// them against their root hash first.
+	RequireVerity bool
+
+	order       []string
+	initialized bool
+	mutex       sync.Mutex
+}
+
+// initExcuse is the excuse recorded when no extractor worked.
+const initExcuse = "init"
+
+// Option configures a Policy.
+type Option func(*Policy) error
+
+// WithOrder uses only the named extractors, in that order.
+func WithOrder(names ...string) Option {
+	return func(p *Policy) error {
+		p.order = append([]string{}, names...)
+		return nil
+	}
+}
+
+// WithTimeout bounds each extraction.
+func WithTimeout(d time.Duration) Option {
+	return func(p *Policy) error {
+		p.Timeout = d
+		return nil
+	}
+}
+
+// WithRequireVerity makes the policy check images against their root hash
+// before extracting them.
+func WithRequireVerity(require bool) Option {
+	return func(p *Policy) error {
+		p.RequireVerity = require
+		return nil
+	}
+}
+
+// NewPolicy makes a policy choosing among all, a filesystem's extractors.
+// Without WithOrder they're tried in the order given.
+func NewPolicy(all []Extractor, opts ...Option) (*Policy, error) {
+	p := &Policy{
+		Extractors: []Extractor{},
+		Excuses:    map[string]error{},
+	}
+	for _, opt := range opts {
+		if err := opt(p); err != nil {
+			return nil, err
+		}
+	}
+
+	byName := map[string]Extractor{}
+	for _, e := range all {
+		byName[e.Name()] = e
+	}
+	order := p.order
+	if order == nil {
+		for _, e := range all {
+			order = append(order, e.Name())
+		}
+	}
+
+	for _, name := range order {
+		extractor, ok := byName[name]
+		if !ok {
+			return nil, errors.Errorf("Unknown extractor: '%s'", name)
+		}
+		if excuse := extractor.IsAvailable(); excuse != nil {
+			p.Excuses[name] = excuse
+			continue
+		}
+		p.Extractors = append(p.Extractors, extractor)
+	}
+	return p, nil
+}
+
+// Reset forgets which extractor was chosen, or that none worked, so the
+// next extraction tries them all again.
+func (p *Policy) Reset() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.Extractor = nil
+	delete(p.Excuses, initExcuse)
+	p.initialized = false
+}
+
+// Extract extracts image to dest.
+func (p *Policy) Extract(image, dest string) error {
+	if p.RequireVerity {
+		return errors.Errorf("policy requires verity, but no root hash was given for %s", image)
+	}
+	return p.extract(image, dest)
+}
+
+// ExtractVerified extracts image to dest, first checking it against
+// rootHash if the policy requires verity. The image's verity data starts
+// at verityOffset.
+func (p *Policy) ExtractVerified(image, dest string, verityOffset uint64, rootHash string) error {
+	if p.RequireVerity {
+		if rootHash == "" {
+			return errors.Errorf("policy requires verity, but %s has no root hash", image)
+		}
+		if err := verity.VerifyImage(image, verityOffset, rootHash); err != nil {
+			return err
+		}
+	}
+	return p.extract(image, dest)
+}
+
+func (p *Policy) extract(image, dest string) error {
+	timedOut := false
+	// avoid taking a lock if already initialized (possibly premature optimization)
+	if !p.initialized {
+		p.mutex.Lock()
+		// We may have been waiting on the initializer. If so, then the policy will now be initialized.
+		// if not, then we are the initializer.
+		if !p.initialized {
+			defer p.mutex.Unlock()
+			defer func() {
+				p.initialized = !timedOut
+			}()
+		} else {
+			p.mutex.Unlock()
+		}
+	}
+
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return err
+	}
+
+	fdest, err := filepath.Abs(dest)
+	if err != nil {
+		return err
+	}
+
+	if p.initialized {
+		if err, ok := p.Excuses[initExcuse]; ok {
+			return err
+		}
+		return p.mount(p.Extractor, image, fdest)
+	}
+
+	// At this point we are the initializer
+	if p.Excuses == nil {
+		p.Excuses = map[string]error{}
+	}
+
+	if len(p.Extractors) == 0 {
+		p.Excuses[initExcuse] = errors.Errorf("policy had no extractors")
+		return p.Excuses[initExcuse]
+	}
+
+	for _, extractor := range p.Extractors {
+		err = p.mount(extractor, image, fdest)
+		if err == nil {
+			p.Extractor = extractor
+			log.Debugf("Selected extractor %s", extractor.Name())
+			return nil
+		}
+		p.Excuses[extractor.Name()] = err
+		if errors.As(err, &timeoutError{}) {
+			timedOut = true
+			return errors.Wrapf(err, "not trying other extractors in %s, which %s may still be writing to", fdest, extractor.Name())
+		}
+	}
+
+	allExcuses := []string{}
+	for n, exc := range p.Excuses {
+		allExcuses = append(allExcuses, fmt.Sprintf("%s: %v", n, exc))
+	}
+	sort.Strings(allExcuses)
+
+	// nothing worked. populate Excuses[initExcuse]
+	p.Excuses[initExcuse] = errors.Errorf("No suitable extractor found:\n %s", strings.Join(allExcuses, "\n  "))
+	return p.Excuses[initExcuse]
+}
+
+// mount runs extractor within the policy's timeout.
+func (p *Policy) mount(extractor Extractor, image, dest string) error {
+	if p.Timeout == 0 {
+		return extractor.Mount(image, dest)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- extractor.Mount(image, dest)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(p.Timeout):
+		return errors.WithStack(timeoutError{extractor: extractor.Name(), image: image, timeout: p.Timeout})
+	}
+}
+
+// timeoutError says an extractor took too long, and may still be running.
+type timeoutError struct {
+	extractor string
+	image     string
+	timeout   time.Duration
+}
+
+func (e timeoutError) Error() string {
+	return fmt.Sprintf("%s didn't extract %s within %s", e.extractor, e.image, e.timeout)
+}
@@ -0,0 +1,157 @@
+package extract
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeExtractor struct {
+	name        string
+	unavailable bool
+	fail        bool
+	delay       time.Duration
+	calls       int
+}
+
+func (f *fakeExtractor) Name() string {
+	return f.name
+}
+
+func (f *fakeExtractor) IsAvailable() error {
+	if f.unavailable {
+		return errors.Errorf("%s isn't here", f.name)
+	}
+	return nil
+}
+
+func (f *fakeExtractor) Mount(path, dest string) error {
+	f.calls++
+	time.Sleep(f.delay)
+	if f.fail {
+		return errors.Errorf("%s failed", f.name)
+	}
+	return nil
+}
+
+func TestNewPolicy(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	a, b, c := &fakeExtractor{name: "a"}, &fakeExtractor{name: "b", unavailable: true}, &fakeExtractor{name: "c"}
+	all := []Extractor{a, b, c}
+
+	p, err := NewPolicy(all)
+	assert.NoError(err)
+	assert.Equal([]Extractor{a, c}, p.Extractors)
+	assert.Contains(p.Excuses, "b")
+
+	p, err = NewPolicy(all, WithOrder("c", "a"))
+	assert.NoError(err)
+	assert.Equal([]Extractor{c, a}, p.Extractors)
+
+	p, err = NewPolicy(all, WithOrder())
+	assert.NoError(err)
+	assert.Empty(p.Extractors)
+
+	_, err = NewPolicy(all, WithOrder("a", "nope"))
+	assert.Error(err)
+}
+
+func TestPolicyExtract(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	dest := t.TempDir()
+	a, b := &fakeExtractor{name: "a", fail: true}, &fakeExtractor{name: "b"}
+	p, err := NewPolicy([]Extractor{a, b})
+	assert.NoError(err)
+
+	// the first that works is kept
+	assert.NoError(p.Extract("img", dest))
+	assert.Equal(b, p.Extractor)
+	assert.NoError(p.Extract("img", dest))
+	assert.Equal(1, a.calls)
+	assert.Equal(2, b.calls)
+
+	// so is failure, until reset
+	b.fail = true
+	p.Reset()
+	assert.Error(p.Extract("img", dest))
+	assert.Error(p.Extract("img", dest))
+	assert.Equal(2, a.calls)
+	b.fail = false
+	p.Reset()
+	assert.NoError(p.Extract("img", dest))
+}
+
+func TestPolicyTimeout(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	slow, fast := &fakeExtractor{name: "slow", delay: time.Second}, &fakeExtractor{name: "fast"}
+	p, err := NewPolicy([]Extractor{slow, fast}, WithTimeout(10*time.Millisecond))
+	assert.NoError(err)
+	// slow may still be writing to dest, so fast isn't tried there
+	assert.ErrorContains(p.Extract("img", t.TempDir()), "not trying other extractors")
+	assert.Nil(p.Extractor)
+	assert.Equal(0, fast.calls)
+	assert.Contains(p.Excuses["slow"].Error(), "didn't extract")
+
+	// and the policy isn't settled, so the next extraction tries them all
+	assert.False(p.initialized)
+	assert.NotContains(p.Excuses, initExcuse)
+}
+
+func TestPolicyRequireVerity(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	a := &fakeExtractor{name: "a"}
+	p, err := NewPolicy([]Extractor{a}, WithRequireVerity(true))
+	assert.NoError(err)
+	assert.Error(p.Extract("img", t.TempDir()))
+	assert.Error(p.ExtractVerified("img", t.TempDir(), 0, ""))
+	assert.Equal(0, a.calls)
+}
+
+func TestConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	config := filepath.Join(t.TempDir(), "extract.json")
+	assert.NoError(os.WriteFile(config, []byte(`{"fake": {"extractors": ["b"], "timeout": "1m", "require_verity": true}}`), 0644))
+	configs, err := LoadConfig(config)
+	assert.NoError(err)
+	assert.Equal(Config{Extractors: []string{"b"}, Timeout: "1m", RequireVerity: true}, configs["fake"])
+
+	configs, err = LoadConfig(filepath.Join(t.TempDir(), "missing.json"))
+	assert.NoError(err)
+	assert.Empty(configs)
+
+	_, err = Config{Timeout: "soon"}.Options()
+	assert.Error(err)
+
+	a, b := &fakeExtractor{name: "a"}, &fakeExtractor{name: "b"}
+	t.Setenv(ConfigEnvName, config)
+	t.Setenv("FAKE_EXTRACT_POLICY", "")
+	ResetDefaults()
+	p, err := Default("fake", []Extractor{a, b}, "FAKE_EXTRACT_POLICY", "a b")
+	assert.NoError(err)
+	assert.Equal([]Extractor{b}, p.Extractors)
+	assert.Equal(time.Minute, p.Timeout)
+	assert.True(p.RequireVerity)
+
+	// shared until reset, and the environment overrides the order
+	t.Setenv("FAKE_EXTRACT_POLICY", "a")
+	same, err := Default("fake", []Extractor{a, b}, "FAKE_EXTRACT_POLICY", "a b")
+	assert.NoError(err)
+	assert.Same(p, same)
+	ResetDefaults()
+	p, err = Default("fake", []Extractor{a, b}, "FAKE_EXTRACT_POLICY", "a b")
+	assert.NoError(err)
+	assert.Equal([]Extractor{a}, p.Extractors)
+}
@@ -0,0 +1,32 @@
+package fs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+
+	"machinerun.io/atomfs/pkg/composefs"
+	"machinerun.io/atomfs/pkg/erofs"
+	"machinerun.io/atomfs/pkg/imagefs"
+	"machinerun.io/atomfs/pkg/squashfs"
+	types "machinerun.io/atomfs/pkg/types"
+)
+
+func init() {
+	Register(SquashfsType, squashfs.IsSquashfsMediaType, func() types.Filesystem { return squashfs.New() })
+	RegisterReader(SquashfsType,
+		func(r io.ReaderAt, size int64) (imagefs.Image, error) { return squashfs.NewReader(r, size) },
+		func(header []byte) bool { return bytes.HasPrefix(header, []byte("hsqs")) })
+
+	Register(ErofsType, erofs.IsErofsMediaType, func() types.Filesystem { return erofs.New() })
+	RegisterReader(ErofsType,
+		func(r io.ReaderAt, size int64) (imagefs.Image, error) { return erofs.NewReader(r, size) },
+		func(header []byte) bool {
+			return len(header) >= 1028 && binary.LittleEndian.Uint32(header[1024:]) == 0xe0f5e1e2
+		})
+
+	// composefs images are erofs ones, so they're told apart by media type
+	// alone
+	Register(ComposefsType, composefs.IsComposefsMediaType, func() types.Filesystem { return composefs.New() })
+	RegisterOpener(ComposefsType, func(path string) (imagefs.Image, error) { return composefs.Open(path) })
+}
@@ -1,33 +1,118 @@
 package fs
 
 import (
-	"machinerun.io/atomfs/pkg/erofs"
-	"machinerun.io/atomfs/pkg/squashfs"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+	"machinerun.io/atomfs/pkg/imagefs"
 	types "machinerun.io/atomfs/pkg/types"
 )
 
 const (
-	SquashfsType types.FilesystemType = "squashfs"
-	ErofsType    types.FilesystemType = "erofs"
+	SquashfsType  types.FilesystemType = "squashfs"
+	ErofsType     types.FilesystemType = "erofs"
+	ComposefsType types.FilesystemType = "composefs"
 )
 
+// New returns the registered backend named fsType, or nil if there isn't
+// one.
 func New(fsType types.FilesystemType) types.Filesystem {
-	switch fsType {
-	case SquashfsType:
-		return squashfs.New()
-	case ErofsType:
-		return erofs.New()
+	b, ok := Lookup(fsType)
+	if !ok {
+		return nil
 	}
-
-	return nil
+	return b.New()
 }
 
+// NewFromMediaType returns the registered backend for mediaType, or nil if
+// there isn't one.
 func NewFromMediaType(mediaType string) types.Filesystem {
-	if squashfs.IsSquashfsMediaType(mediaType) {
-		return squashfs.New()
-	} else if erofs.IsErofsMediaType(mediaType) {
-		return erofs.New()
+	b, err := ForMediaType(mediaType)
+	if err != nil {
+		return nil
+	}
+	return b.New()
+}
+
+// OpenFromMediaType opens the image at path with the pure-Go reader for
+// mediaType, which needs neither privileges nor any tools.
+func OpenFromMediaType(mediaType, path string) (imagefs.Image, error) {
+	b, err := ForMediaType(mediaType)
+	if err != nil {
+		return nil, err
+	}
+	if b.Open != nil {
+		return b.Open(path)
+	}
+	if b.NewReader == nil {
+		return nil, errors.Errorf("%s images can't be read without mounting them", b.Name)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, errors.WithStack(err)
+	}
+	img, err := b.NewReader(f, fi.Size())
+	if err != nil {
+		f.Close()
+		return nil, errors.Wrapf(err, "couldn't read %s %s", b.Name, path)
+	}
+	return &closingImage{Image: img, closer: f}, nil
+}
+
+// closingImage closes the file an image was read from along with it.
+type closingImage struct {
+	imagefs.Image
+	closer io.Closer
+}
+
+func (c *closingImage) Close() error {
+	err := c.Image.Close()
+	if cerr := c.closer.Close(); err == nil {
+		err = cerr
 	}
+	return err
+}
 
-	return nil
+// NewReader reads the fsType image of the given size from r with the
+// pure-Go reader.
+func NewReader(fsType types.FilesystemType, r io.ReaderAt, size int64) (imagefs.Image, error) {
+	b, ok := Lookup(fsType)
+	if !ok {
+		return nil, errors.Errorf("unknown filesystem type %s", fsType)
+	}
+	if b.NewReader == nil {
+		return nil, errors.Errorf("%s images can't be read without mounting them", fsType)
+	}
+	return b.NewReader(r, size)
+}
+
+// Detect works out the type of the filesystem image at path from its magic
+// number, for when there's no media type to go on.
+func Detect(path string) (types.FilesystemType, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	defer f.Close()
+
+	buf := make([]byte, DetectHeaderSize)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return "", errors.Wrapf(err, "couldn't read %s", path)
+	}
+	buf = buf[:n]
+
+	for _, b := range Backends() {
+		if b.Detect != nil && b.Detect(buf) {
+			return b.Name, nil
+		}
+	}
+	return "", errors.Errorf("%s isn't an image of any known filesystem", path)
 }
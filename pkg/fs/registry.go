@@ -0,0 +1,144 @@
+package fs
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+	"machinerun.io/atomfs/pkg/imagefs"
+	types "machinerun.io/atomfs/pkg/types"
+)
+
+// MediaTypeMatcher says whether a layer media type is one of a backend's.
+type MediaTypeMatcher func(mediaType string) bool
+
+// Factory makes a backend's types.Filesystem.
+type Factory func() types.Filesystem
+
+// ReaderFactory reads a backend's image of the given size from r without
+// mounting it.
+type ReaderFactory func(r io.ReaderAt, size int64) (imagefs.Image, error)
+
+// DetectHeaderSize is how much of an image Detect reads to look for magic
+// numbers.
+const DetectHeaderSize = 4096
+
+// Backend is a registered filesystem type.
+type Backend struct {
+	Name             types.FilesystemType
+	MatchesMediaType MediaTypeMatcher
+	New              Factory
+	// NewReader is the backend's pure-Go reader, if it has one.
+	NewReader ReaderFactory
+	// Open opens an image file with the pure-Go reader, for backends
+	// whose images need more than their own content to be read.
+	Open func(path string) (imagefs.Image, error)
+	// Detect says whether the start of an image (up to DetectHeaderSize
+	// bytes) has the backend's magic number, if it has one.
+	Detect func(header []byte) bool
+}
+
+var registry struct {
+	mutex    sync.RWMutex
+	backends map[types.FilesystemType]*Backend
+}
+
+// Register makes the filesystem type name, made by factory, available to
+// New, and to NewFromMediaType for layers whose media types matches accepts.
+// It's meant to be called from init, and panics if name is already
+// registered, as with database/sql.
+func Register(name types.FilesystemType, matches MediaTypeMatcher, factory Factory) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	if matches == nil || factory == nil {
+		panic(fmt.Sprintf("fs: Register of %s is missing its media type matcher or factory", name))
+	}
+	if _, ok := registry.backends[name]; ok {
+		panic(fmt.Sprintf("fs: Register called twice for %s", name))
+	}
+	if registry.backends == nil {
+		registry.backends = map[types.FilesystemType]*Backend{}
+	}
+	registry.backends[name] = &Backend{Name: name, MatchesMediaType: matches, New: factory}
+}
+
+// RegisterReader adds a pure-Go reader, used by OpenFromMediaType and
+// NewReader, and a magic number check, used by Detect, to the registered
+// backend name. Either may be nil.
+func RegisterReader(name types.FilesystemType, reader ReaderFactory, detect func(header []byte) bool) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	b, ok := registry.backends[name]
+	if !ok {
+		panic(fmt.Sprintf("fs: RegisterReader called for unregistered %s", name))
+	}
+	b.NewReader = reader
+	b.Detect = detect
+}
+
+// RegisterOpener gives the registered backend name a pure-Go reader that
+// OpenFromMediaType uses, for when reading an image takes more than its
+// content, e.g. files it refers to.
+func RegisterOpener(name types.FilesystemType, open func(path string) (imagefs.Image, error)) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	b, ok := registry.backends[name]
+	if !ok {
+		panic(fmt.Sprintf("fs: RegisterOpener called for unregistered %s", name))
+	}
+	b.Open = open
+}
+
+// Lookup returns the backend registered as name.
+func Lookup(name types.FilesystemType) (Backend, bool) {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+
+	b, ok := registry.backends[name]
+	if !ok {
+		return Backend{}, false
+	}
+	return *b, true
+}
+
+// ForMediaType returns the backend for layers of mediaType.
+func ForMediaType(mediaType string) (Backend, error) {
+	for _, b := range Backends() {
+		if b.MatchesMediaType(mediaType) {
+			return b, nil
+		}
+	}
+	return Backend{}, errors.Errorf("unknown media-type %s", mediaType)
+}
+
+// Backends returns the registered backends, ordered by name.
+func Backends() []Backend {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+
+	ret := make([]Backend, 0, len(registry.backends))
+	for _, b := range registry.backends {
+		ret = append(ret, *b)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	return ret
+}
+
+// Availability says which of b's extractors can be used here, with the
+// reason for each that can't.
+func (b Backend) Availability() (available []string, excuses map[string]error) {
+	excuses = map[string]error{}
+	for _, e := range b.New().Extractors() {
+		if err := e.IsAvailable(); err != nil {
+			excuses[e.Name()] = err
+			continue
+		}
+		available = append(available, e.Name())
+	}
+	return available, excuses
+}
@@ -0,0 +1,62 @@
+package fs
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"machinerun.io/atomfs/pkg/squashfs"
+	types "machinerun.io/atomfs/pkg/types"
+)
+
+// unregister removes the backend name, which tests register, from the
+// registry.
+func unregister(name types.FilesystemType) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	delete(registry.backends, name)
+}
+
+// TestRegistry isn't parallel, as it registers a backend, which other tests
+// would see.
+func TestRegistry(t *testing.T) {
+	assert := assert.New(t)
+
+	names := []types.FilesystemType{}
+	for _, b := range Backends() {
+		names = append(names, b.Name)
+	}
+	assert.Equal([]types.FilesystemType{ComposefsType, ErofsType, SquashfsType}, names)
+
+	b, err := ForMediaType(squashfs.GenerateSquashfsMediaType(squashfs.ZstdCompression))
+	assert.NoError(err)
+	assert.Equal(SquashfsType, b.Name)
+	_, err = ForMediaType("application/vnd.oci.image.layer.v1.tar")
+	assert.Error(err)
+	assert.Nil(New("nope"))
+
+	t.Cleanup(func() { unregister("testfs") })
+	Register("testfs", func(mediaType string) bool { return strings.HasPrefix(mediaType, "application/x-testfs") },
+		func() types.Filesystem { return squashfs.New() })
+	assert.Panics(func() {
+		Register("testfs", func(string) bool { return false }, func() types.Filesystem { return nil })
+	})
+	assert.Panics(func() { RegisterReader("unregistered", nil, nil) })
+	RegisterReader("testfs", nil, func(header []byte) bool { return strings.HasPrefix(string(header), "TEST") })
+
+	b, err = ForMediaType("application/x-testfs+gzip")
+	assert.NoError(err)
+	assert.Equal(types.FilesystemType("testfs"), b.Name)
+	assert.NotNil(NewFromMediaType("application/x-testfs+gzip"))
+	_, err = OpenFromMediaType("application/x-testfs", "/dev/null")
+	assert.Error(err)
+
+	img := filepath.Join(t.TempDir(), "img")
+	assert.NoError(os.WriteFile(img, []byte("TEST image"), 0644))
+	fsType, err := Detect(img)
+	assert.NoError(err)
+	assert.Equal(types.FilesystemType("testfs"), fsType)
+}
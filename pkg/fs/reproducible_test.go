@@ -0,0 +1,68 @@
+package fs
+
+import (
+	"crypto/sha256"
+	"io"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"machinerun.io/atomfs/pkg/common"
+	types "machinerun.io/atomfs/pkg/types"
+	"machinerun.io/atomfs/pkg/verity"
+)
+
+// TestReproducibleBuild isn't parallel, as it sets SOURCE_DATE_EPOCH.
+func TestReproducibleBuild(t *testing.T) {
+	t.Setenv(common.SourceDateEpochKey, "1700000000")
+
+	for _, tc := range []struct {
+		fsType types.FilesystemType
+		tool   string
+	}{
+		{SquashfsType, "mksquashfs"},
+		{ErofsType, "mkfs.erofs"},
+	} {
+		t.Run(string(tc.fsType), func(t *testing.T) {
+			if common.Which(tc.tool) == "" {
+				t.Skipf("no %s", tc.tool)
+			}
+			assert := assert.New(t)
+
+			rootfs := t.TempDir()
+			tempdir := t.TempDir()
+			assert.NoError(os.MkdirAll(path.Join(rootfs, "dir"), 0755))
+			assert.NoError(os.WriteFile(path.Join(rootfs, "dir", "foo"), []byte("bar"), 0644))
+			assert.NoError(os.WriteFile(path.Join(rootfs, "baz"), []byte("quux"), 0600))
+
+			build := func(mtime time.Time) (string, string) {
+				// the on-disk timestamps must not leak into the image
+				for _, p := range []string{"dir", "dir/foo", "baz"} {
+					assert.NoError(os.Chtimes(path.Join(rootfs, p), mtime, mtime))
+				}
+
+				reader, _, rootHash, err := New(tc.fsType).Make(tempdir, rootfs, nil, verity.VerityMetadataPresent, types.MakeOptions{})
+				if err == verity.CryptsetupTooOld {
+					t.Skip("libcryptsetup too old")
+				}
+				require.NoError(t, err)
+				defer reader.Close()
+
+				h := sha256.New()
+				_, err = io.Copy(h, reader)
+				assert.NoError(err)
+				return string(h.Sum(nil)), rootHash
+			}
+
+			digest1, rootHash1 := build(time.Unix(1000, 0))
+			digest2, rootHash2 := build(time.Unix(2000, 0))
+
+			assert.NotEmpty(rootHash1)
+			assert.Equal(rootHash1, rootHash2)
+			assert.Equal(digest1, digest2)
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package fsverity
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"hash"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// The fs-verity parameters atomfs uses: sha256 over 4k blocks, unsalted,
+// which is what composefs and overlay's verity= option expect, and what
+// `fsverity enable` does by default.
+const (
+	verityBlockSize = 4096
+	verityHashAlg   = 1 // FS_VERITY_HASH_ALG_SHA256
+	verityLogBlock  = 12
+)
+
+// Hasher computes a file's fs-verity digest as it's written, as
+// described in the kernel's Documentation/filesystems/fsverity.rst.
+type Hasher struct {
+	size int64
+	// block is the data block being filled
+	block []byte
+	// levels[0] holds the hashes of full data blocks not yet packed into
+	// a full level 1 block, and so on up the tree
+	levels [][]byte
+	h      hash.Hash
+}
+
+func NewHasher() *Hasher {
+	return &Hasher{block: make([]byte, 0, verityBlockSize), h: sha256.New()}
+}
+
+func (v *Hasher) Write(p []byte) (int, error) {
+	n := len(p)
+	v.size += int64(n)
+	for len(p) > 0 {
+		c := copy(v.block[len(v.block):verityBlockSize], p)
+		v.block = v.block[:len(v.block)+c]
+		p = p[c:]
+		if len(v.block) == verityBlockSize {
+			v.addHash(0, v.hashBlock(v.block))
+			v.block = v.block[:0]
+		}
+	}
+	return n, nil
+}
+
+func (v *Hasher) hashBlock(b []byte) []byte {
+	v.h.Reset()
+	v.h.Write(b)
+	if len(b) < verityBlockSize {
+		v.h.Write(make([]byte, verityBlockSize-len(b)))
+	}
+	return v.h.Sum(nil)
+}
+
+// addHash adds a block's hash to a level. A full level block is only
+// hashed into the one above once another hash arrives, since until then it
+// may turn out to be the top of the tree.
+func (v *Hasher) addHash(level int, sum []byte) {
+	if level == len(v.levels) {
+		v.levels = append(v.levels, nil)
+	}
+	if len(v.levels[level]) == verityBlockSize {
+		full := v.levels[level]
+		v.levels[level] = nil
+		v.addHash(level+1, v.hashBlock(full))
+	}
+	v.levels[level] = append(v.levels[level], sum...)
+}
+
+// rootHash finishes the Merkle tree: each level's last block is zero padded
+// and hashed into the level above, up to the first level that fits in a
+// single block with nothing above it, whose hash is the root. A file of at
+// most one block has no tree, so its root hash is that of its only block,
+// and an empty file's is all zeros.
+func (v *Hasher) rootHash() []byte {
+	if v.size == 0 {
+		return make([]byte, sha256.Size)
+	}
+	if len(v.block) > 0 {
+		v.addHash(0, v.hashBlock(v.block))
+		v.block = v.block[:0]
+	}
+	if v.size <= verityBlockSize {
+		return v.levels[0]
+	}
+
+	for level := 0; ; level++ {
+		if level == len(v.levels)-1 {
+			return v.hashBlock(v.levels[level])
+		}
+		if len(v.levels[level]) > 0 {
+			pending := v.levels[level]
+			v.levels[level] = nil
+			v.addHash(level+1, v.hashBlock(pending))
+		}
+	}
+}
+
+// Sum returns the fs-verity digest of what's been written: the sha256 of
+// the fsverity_descriptor holding the root hash and the file's size.
+func (v *Hasher) Sum() []byte {
+	var desc bytes.Buffer
+	desc.Write([]byte{1, verityHashAlg, verityLogBlock, 0})
+	desc.Write(make([]byte, 4))
+	binary.Write(&desc, binary.LittleEndian, uint64(v.size))
+	root := make([]byte, 64)
+	copy(root, v.rootHash())
+	desc.Write(root)
+	// salt and reserved
+	desc.Write(make([]byte, 32+144))
+
+	sum := sha256.Sum256(desc.Bytes())
+	return sum[:]
+}
+
+// Digest returns the hex fs-verity digest of r's content, as
+// `fsverity digest` would print it.
+func Digest(r io.Reader) (string, error) {
+	v := NewHasher()
+	if _, err := io.Copy(v, r); err != nil {
+		return "", errors.WithStack(err)
+	}
+	return hex.EncodeToString(v.Sum()), nil
+}
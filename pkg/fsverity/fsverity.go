@@ -0,0 +1,110 @@
+// Package fsverity computes, enables and checks fs-verity digests. Where the
+// filesystem holding an OCI layout supports fs-verity, it protects atoms
+// the way dm-verity does, but without loop and device-mapper setup or host
+// root: the kernel checks each block of a blob against its digest as it's
+// read, including through a loop device.
+package fsverity
+
+import (
+	"encoding/hex"
+	"os"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// DigestAnnotation is the descriptor annotation holding a blob's expected
+// fs-verity digest, in hex as `fsverity measure` prints it.
+const DigestAnnotation = "io.stackeroci.stacker.atomfs_fsverity_digest"
+
+// ErrNotEnabled is returned when a file doesn't have fs-verity, either
+// because it was never enabled or because its filesystem doesn't support it.
+var ErrNotEnabled = errors.New("fs-verity is not enabled")
+
+// maxDigestSize is the kernel's FS_VERITY_MAX_DIGEST_SIZE.
+const maxDigestSize = 64
+
+// Enable turns on fs-verity for the file at path, with the parameters
+// Digest uses, so the kernel checks its content when it's read. The file
+// becomes read only; enabling it again is not an error.
+func Enable(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+
+	arg := unix.FsverityEnableArg{
+		Version:        1,
+		Hash_algorithm: verityHashAlg,
+		Block_size:     verityBlockSize,
+	}
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), unix.FS_IOC_ENABLE_VERITY, uintptr(unsafe.Pointer(&arg)))
+	if errno != 0 && errno != unix.EEXIST {
+		return errors.Wrapf(errno, "couldn't enable fs-verity on %s", path)
+	}
+	return nil
+}
+
+// Measure returns the hex fs-verity digest the kernel has for the file at
+// path, or ErrNotEnabled.
+func Measure(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	defer f.Close()
+
+	buf := make([]byte, unsafe.Sizeof(unix.FsverityDigest{})+maxDigestSize)
+	hdr := (*unix.FsverityDigest)(unsafe.Pointer(&buf[0]))
+	hdr.Size = maxDigestSize
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), unix.FS_IOC_MEASURE_VERITY, uintptr(unsafe.Pointer(&buf[0])))
+	switch errno {
+	case 0:
+	case unix.ENODATA, unix.ENOTTY, unix.EOPNOTSUPP:
+		return "", errors.Wrapf(ErrNotEnabled, "%s", path)
+	default:
+		return "", errors.Wrapf(errno, "couldn't measure fs-verity digest of %s", path)
+	}
+	if hdr.Algorithm != verityHashAlg {
+		return "", errors.Errorf("%s has fs-verity hash algorithm %d, expected sha256", path, hdr.Algorithm)
+	}
+	start := unsafe.Sizeof(unix.FsverityDigest{})
+	return hex.EncodeToString(buf[start : start+uintptr(hdr.Size)]), nil
+}
+
+// Verify checks that the file at path has fs-verity enabled with digest
+// expected, so that the kernel will refuse to read anything else from it.
+func Verify(path, expected string) error {
+	digest, err := Measure(path)
+	if err != nil {
+		return err
+	}
+	if digest != expected {
+		return errors.Errorf("%s has fs-verity digest %s, expected %s", path, digest, expected)
+	}
+	return nil
+}
+
+// EnableAndMeasure computes the fs-verity digest of the file at path,
+// enables fs-verity on it and checks that the kernel agrees, returning the
+// digest.
+func EnableAndMeasure(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	digest, err := Digest(f)
+	f.Close()
+	if err != nil {
+		return "", err
+	}
+	if err := Enable(path); err != nil {
+		return "", err
+	}
+	if err := Verify(path, digest); err != nil {
+		return "", err
+	}
+	return digest, nil
+}
@@ -0,0 +1,55 @@
+package fsverity
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDigest(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	// as `fsverity digest` prints them, at the sizes where the Merkle
+	// tree grows another level
+	for size, expected := range map[int]string{
+		0:      "3d248ca542a24fc62d1c43b916eae5016878e2533c88238480b26128a1f1af95",
+		1:      "b803429503d95915829b29fdbc8bbad142f3abfd11b1cadf5526582e685c0551",
+		4096:   "87a706bdba32be89a173dc11d6a91c08165b4dcfcf743988c94595e82934a41a",
+		4097:   "5c6077f10edc31c27b2a65cbaa199e2cfd36998bf104ccd2f7395eb509682064",
+		524288: "9613b285b37589320574d16f1447444fb68289259e661f4418dc6374ef3c5b9f",
+		524289: "355acec90f25617bed6ee0e57380add05b4abb6855b8c7a9224c142cf027a98a",
+	} {
+		b := make([]byte, size)
+		for i := range b {
+			b[i] = byte((i*7 + i/4096) % 256)
+		}
+		digest, err := Digest(bytes.NewReader(b))
+		assert.NoError(err)
+		assert.Equal(expected, digest, "size %d", size)
+	}
+}
+
+func TestMeasure(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	path := filepath.Join(t.TempDir(), "blob")
+	assert.NoError(os.WriteFile(path, []byte("hello"), 0644))
+
+	digest, err := EnableAndMeasure(path)
+	if err != nil {
+		// not every filesystem tests run on has fs-verity
+		assert.ErrorIs(Verify(path, "00"), ErrNotEnabled)
+		return
+	}
+	expected, err := Digest(bytes.NewReader([]byte("hello")))
+	assert.NoError(err)
+	assert.Equal(expected, digest)
+	assert.NoError(Verify(path, digest))
+	assert.Error(Verify(path, "00"))
+	assert.Error(os.WriteFile(path, []byte("jello"), 0644))
+}
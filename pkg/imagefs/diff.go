@@ -0,0 +1,345 @@
+package imagefs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// ChangeKind is how a path differs between two overlays.
+type ChangeKind string
+
+const (
+	Added    ChangeKind = "added"
+	Removed  ChangeKind = "removed"
+	Modified ChangeKind = "modified"
+)
+
+// What a Modified change can differ in.
+const (
+	DiffType    = "type"
+	DiffSize    = "size"
+	DiffMode    = "mode"
+	DiffOwner   = "owner"
+	DiffXattrs  = "xattrs"
+	DiffContent = "content"
+	DiffTarget  = "target"
+	DiffDevice  = "device"
+)
+
+// Entry describes one side of a Change.
+type Entry struct {
+	Type string `json:"type"`
+	Size int64  `json:"size"`
+	// Mode is as printed by ls, e.g. "-rwxr-xr-x".
+	Mode   string   `json:"mode"`
+	Uid    uint32   `json:"uid"`
+	Gid    uint32   `json:"gid"`
+	Xattrs []string `json:"xattrs,omitempty"`
+	// SHA256 is the content hash of regular files, when it was needed.
+	SHA256 string `json:"sha256,omitempty"`
+	Target string `json:"target,omitempty"`
+	Rdev   uint64 `json:"rdev,omitempty"`
+
+	mode   fs.FileMode
+	xattrs map[string][]byte
+}
+
+// Change is a difference between two overlays at Path, which is absolute
+// as it would be in the mounted image.
+type Change struct {
+	Path        string     `json:"path"`
+	Kind        ChangeKind `json:"change"`
+	Differences []string   `json:"differences,omitempty"`
+	Old         *Entry     `json:"old,omitempty"`
+	New         *Entry     `json:"new,omitempty"`
+}
+
+// Diff compares the merged views a and b. Entries made up of the same
+// layers (by Name) on both sides are identical, so shared atoms are
+// skipped without being read. mtimes are not compared.
+func Diff(a, b *Overlay) ([]Change, error) {
+	d := &differ{a: a, b: b}
+	if err := d.compare(a.resolver.Root, b.resolver.Root); err != nil {
+		return nil, err
+	}
+	return d.changes, nil
+}
+
+type differ struct {
+	a, b    *Overlay
+	changes []Change
+}
+
+func providers(o *Overlay, n *onode) []string {
+	ret := make([]string, len(n.layers))
+	for i, l := range n.layers {
+		ret[i] = o.Layers[l].Name
+	}
+	return ret
+}
+
+func sameProviders(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func typeName(m fs.FileMode) string {
+	switch m.Type() {
+	case 0:
+		return "file"
+	case fs.ModeDir:
+		return "dir"
+	case fs.ModeSymlink:
+		return "symlink"
+	case fs.ModeDevice:
+		return "block"
+	case fs.ModeDevice | fs.ModeCharDevice:
+		return "char"
+	case fs.ModeNamedPipe:
+		return "fifo"
+	case fs.ModeSocket:
+		return "socket"
+	}
+	return "unknown"
+}
+
+func (d *differ) entry(o *Overlay, n *onode) (*Entry, error) {
+	e := &Entry{
+		Type: typeName(n.fi.Mode()),
+		Mode: n.fi.Mode().String(),
+		mode: n.fi.Mode(),
+	}
+	if !n.fi.IsDir() {
+		e.Size = n.fi.Size()
+	}
+	if st := StatOf(n.fi); st != nil {
+		e.Uid = st.Uid
+		e.Gid = st.Gid
+		e.Rdev = st.Rdev
+		e.xattrs = map[string][]byte{}
+		for k, v := range st.Xattrs {
+			if isOverlayXattr(k) {
+				continue
+			}
+			e.xattrs[k] = v
+			e.Xattrs = append(e.Xattrs, k)
+		}
+		sort.Strings(e.Xattrs)
+	}
+	if target, isLink, err := o.link(n); err != nil {
+		return nil, err
+	} else if isLink {
+		e.Target = target
+	}
+	return e, nil
+}
+
+// isOverlayXattr says whether x is how a layer marks an opaque directory,
+// which isn't visible in the mounted image.
+func isOverlayXattr(x string) bool {
+	for _, o := range opaqueXattrs {
+		if x == o {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *differ) hash(o *Overlay, n *onode) (string, error) {
+	f, err := o.Layers[n.layers[0]].FS.Open(n.path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", errors.Wrapf(err, "couldn't read %s", n.path)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func sameXattrs(a, b map[string][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		w, ok := b[k]
+		if !ok || !bytes.Equal(v, w) {
+			return false
+		}
+	}
+	return true
+}
+
+func displayPath(p string) string {
+	return path.Join("/", p)
+}
+
+func (d *differ) compare(na, nb *onode) error {
+	if sameProviders(providers(d.a, na), providers(d.b, nb)) {
+		return nil
+	}
+
+	ea, err := d.entry(d.a, na)
+	if err != nil {
+		return err
+	}
+	eb, err := d.entry(d.b, nb)
+	if err != nil {
+		return err
+	}
+
+	diffs := []string{}
+	if ea.Type != eb.Type {
+		diffs = append(diffs, DiffType)
+	} else {
+		if ea.Size != eb.Size {
+			diffs = append(diffs, DiffSize)
+		}
+		if ea.Type == "file" {
+			if ea.SHA256, err = d.hash(d.a, na); err != nil {
+				return err
+			}
+			if eb.SHA256, err = d.hash(d.b, nb); err != nil {
+				return err
+			}
+			if ea.SHA256 != eb.SHA256 {
+				diffs = append(diffs, DiffContent)
+			}
+		}
+		if ea.Target != eb.Target {
+			diffs = append(diffs, DiffTarget)
+		}
+		if ea.Rdev != eb.Rdev {
+			diffs = append(diffs, DiffDevice)
+		}
+	}
+	if fileMode(ea.mode) != fileMode(eb.mode) {
+		diffs = append(diffs, DiffMode)
+	}
+	if ea.Uid != eb.Uid || ea.Gid != eb.Gid {
+		diffs = append(diffs, DiffOwner)
+	}
+	if !sameXattrs(ea.xattrs, eb.xattrs) {
+		diffs = append(diffs, DiffXattrs)
+	}
+	if len(diffs) > 0 {
+		d.changes = append(d.changes, Change{
+			Path:        displayPath(na.path),
+			Kind:        Modified,
+			Differences: diffs,
+			Old:         ea,
+			New:         eb,
+		})
+	}
+
+	switch {
+	case na.fi.IsDir() && nb.fi.IsDir():
+		return d.compareDirs(na, nb)
+	case na.fi.IsDir():
+		return d.walk(d.a, na, Removed, false)
+	case nb.fi.IsDir():
+		return d.walk(d.b, nb, Added, false)
+	}
+	return nil
+}
+
+func (d *differ) children(o *Overlay, n *onode) (map[string]*onode, []string, error) {
+	ents, err := o.readDir(n)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "couldn't read %s", displayPath(n.path))
+	}
+	ret := map[string]*onode{}
+	names := []string{}
+	for _, e := range ents {
+		c, err := o.lookup(n, e.Name())
+		if err != nil {
+			return nil, nil, err
+		}
+		ret[e.Name()] = c
+		names = append(names, e.Name())
+	}
+	return ret, names, nil
+}
+
+func (d *differ) compareDirs(na, nb *onode) error {
+	ca, namesA, err := d.children(d.a, na)
+	if err != nil {
+		return err
+	}
+	cb, namesB, err := d.children(d.b, nb)
+	if err != nil {
+		return err
+	}
+
+	names := namesA
+	for _, name := range namesB {
+		if _, ok := ca[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		a, inA := ca[name]
+		b, inB := cb[name]
+		switch {
+		case inA && inB:
+			err = d.compare(a, b)
+		case inA:
+			err = d.walk(d.a, a, Removed, true)
+		default:
+			err = d.walk(d.b, b, Added, true)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walk reports n and everything below it as added or removed; self says
+// whether n itself is included.
+func (d *differ) walk(o *Overlay, n *onode, kind ChangeKind, self bool) error {
+	if self {
+		e, err := d.entry(o, n)
+		if err != nil {
+			return err
+		}
+		c := Change{Path: displayPath(n.path), Kind: kind}
+		if kind == Added {
+			c.New = e
+		} else {
+			c.Old = e
+		}
+		d.changes = append(d.changes, c)
+	}
+
+	if !n.fi.IsDir() {
+		return nil
+	}
+	children, names, err := d.children(o, n)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := d.walk(o, children[name], kind, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package imagefs
+
+import (
+	"io/fs"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiff(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	dir := &fstest.MapFile{Mode: fs.ModeDir | 0755}
+	base := mapFS{fstest.MapFS{
+		"usr":              dir,
+		"usr/bin":          dir,
+		"usr/bin/sh":       {Data: []byte("sh"), Mode: 0755},
+		"etc":              dir,
+		"etc/hostname":     {Data: []byte("a")},
+		"etc/motd":         {Data: []byte("hi")},
+		"etc/owned":        {Data: []byte("x"), Sys: &Stat{Uid: 1}},
+		"var":              dir,
+		"var/lib":          dir,
+		"var/lib/old":      {Data: []byte("old")},
+		"var/lib/old-also": {Data: []byte("old")},
+	}}
+	// the same atom by name; its content must not be looked at
+	sameBase := mapFS{fstest.MapFS{
+		"usr":              dir,
+		"usr/bin":          dir,
+		"usr/bin/sh":       {Data: []byte("not read"), Mode: 0755},
+		"etc":              dir,
+		"etc/hostname":     {Data: []byte("a")},
+		"etc/motd":         {Data: []byte("hi")},
+		"etc/owned":        {Data: []byte("x"), Sys: &Stat{Uid: 1}},
+		"var":              dir,
+		"var/lib":          dir,
+		"var/lib/old":      {Data: []byte("old")},
+		"var/lib/old-also": {Data: []byte("old")},
+	}}
+	top := mapFS{fstest.MapFS{
+		"etc":           dir,
+		"etc/hostname":  {Data: []byte("b")},
+		"etc/motd":      {Data: []byte("hi"), Mode: 0600},
+		"etc/owned":     {Data: []byte("x"), Sys: &Stat{Uid: 2, Xattrs: map[string][]byte{"user.x": []byte("1")}}},
+		"etc/link":      {Mode: fs.ModeSymlink, Data: []byte("hostname")},
+		"var":           dir,
+		"var/.wh.lib":   {},
+		"var/lib2":      dir,
+		"var/lib2/file": {Data: []byte("new")},
+	}}
+
+	a, err := NewOverlay([]Layer{{Name: "base", FS: base}})
+	assert.NoError(err)
+	b, err := NewOverlay([]Layer{{Name: "top", FS: top}, {Name: "base", FS: sameBase}})
+	assert.NoError(err)
+
+	changes, err := Diff(a, b)
+	assert.NoError(err)
+
+	summary := map[string]string{}
+	paths := []string{}
+	for _, c := range changes {
+		s := string(c.Kind)
+		for _, d := range c.Differences {
+			s += " " + d
+		}
+		summary[c.Path] = s
+		paths = append(paths, c.Path)
+	}
+	assert.Equal(map[string]string{
+		"/etc/hostname":     "modified content",
+		"/etc/link":         "added",
+		"/etc/motd":         "modified mode",
+		"/etc/owned":        "modified owner xattrs",
+		"/var/lib":          "removed",
+		"/var/lib/old":      "removed",
+		"/var/lib/old-also": "removed",
+		"/var/lib2":         "added",
+		"/var/lib2/file":    "added",
+	}, summary)
+	assert.Equal([]string{"/etc/hostname", "/etc/link", "/etc/motd", "/etc/owned", "/var/lib", "/var/lib/old", "/var/lib/old-also", "/var/lib2", "/var/lib2/file"}, paths)
+
+	for _, c := range changes {
+		if c.Path == "/etc/link" {
+			assert.Equal("symlink", c.New.Type)
+			assert.Equal("hostname", c.New.Target)
+			assert.Nil(c.Old)
+		}
+		if c.Path == "/etc/owned" {
+			assert.Equal(uint32(1), c.Old.Uid)
+			assert.Equal(uint32(2), c.New.Uid)
+			assert.Equal([]string{"user.x"}, c.New.Xattrs)
+		}
+	}
+
+	changes, err = Diff(b, b)
+	assert.NoError(err)
+	assert.Empty(changes)
+}
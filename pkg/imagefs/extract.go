@@ -0,0 +1,203 @@
+package imagefs
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+	"machinerun.io/atomfs/pkg/log"
+)
+
+type extractor struct {
+	fsys   FS
+	dest   string
+	asRoot bool
+	// hardlinks, inode -> first extracted path
+	links map[uint64]string
+	// directories get their final mode and times once they're populated
+	dirs []string
+}
+
+// Extract writes the contents of fsys to dest, which must be empty or not
+// exist. Ownership is only restored when running as root; device nodes and
+// xattrs that can't be created are logged and skipped, as unsquashfs does.
+func Extract(fsys FS, dest string) error {
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return errors.WithStack(err)
+	}
+
+	ex := &extractor{
+		fsys:   fsys,
+		dest:   dest,
+		asRoot: os.Geteuid() == 0,
+		links:  map[uint64]string{},
+	}
+
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		fi, err := fsys.Lstat(name)
+		if err != nil {
+			return err
+		}
+		return ex.extract(name, fi)
+	})
+	if err != nil {
+		return err
+	}
+
+	// children before parents, so setting a parent's mtime sticks
+	sort.Sort(sort.Reverse(sort.StringSlice(ex.dirs)))
+	for _, name := range ex.dirs {
+		fi, err := fsys.Lstat(name)
+		if err != nil {
+			return err
+		}
+		if err := ex.setMetadata(filepath.Join(dest, name), fi); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (ex *extractor) extract(name string, fi fs.FileInfo) error {
+	target := filepath.Join(ex.dest, name)
+	st := StatOf(fi)
+	mode := fi.Mode()
+
+	switch {
+	case mode.IsDir():
+		if name != "." {
+			if err := os.Mkdir(target, 0700); err != nil {
+				return errors.Wrapf(err, "couldn't create %s", name)
+			}
+		}
+		ex.dirs = append(ex.dirs, name)
+		// metadata is set once the contents are in place
+		return nil
+
+	case mode.IsRegular():
+		if st != nil && st.Nlink > 1 {
+			if first, ok := ex.links[st.Ino]; ok {
+				return errors.Wrapf(os.Link(first, target), "couldn't link %s", name)
+			}
+			ex.links[st.Ino] = target
+		}
+		if err := ex.writeFile(name, target); err != nil {
+			return err
+		}
+
+	case mode&fs.ModeSymlink != 0:
+		link, err := ex.fsys.ReadLink(name)
+		if err != nil {
+			return err
+		}
+		if err := os.Symlink(link, target); err != nil {
+			return errors.Wrapf(err, "couldn't create symlink %s", name)
+		}
+
+	default:
+		var devMode uint32
+		var rdev uint64
+		switch {
+		case mode&fs.ModeCharDevice != 0:
+			devMode = unix.S_IFCHR
+		case mode&fs.ModeDevice != 0:
+			devMode = unix.S_IFBLK
+		case mode&fs.ModeNamedPipe != 0:
+			devMode = unix.S_IFIFO
+		case mode&fs.ModeSocket != 0:
+			devMode = unix.S_IFSOCK
+		default:
+			return errors.Errorf("%s has unknown type %s", name, mode.Type())
+		}
+		if st != nil {
+			rdev = st.Rdev
+		}
+		err := unix.Mknod(target, devMode|uint32(mode.Perm()), int(rdev))
+		if errors.Is(err, unix.EPERM) {
+			log.Warnf("skipping %s: not permitted to create device nodes", name)
+			return nil
+		} else if err != nil {
+			return errors.Wrapf(err, "couldn't create %s", name)
+		}
+	}
+
+	return ex.setMetadata(target, fi)
+}
+
+func (ex *extractor) writeFile(name, target string) error {
+	src, err := ex.fsys.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't create %s", name)
+	}
+	defer dst.Close()
+
+	if _, err := io.Copy(dst, src); err != nil {
+		return errors.Wrapf(err, "couldn't extract %s", name)
+	}
+	return dst.Close()
+}
+
+// setMetadata applies ownership, mode, xattrs and mtime, in that order since
+// chown clears setuid bits.
+func (ex *extractor) setMetadata(target string, fi fs.FileInfo) error {
+	st := StatOf(fi)
+	isLink := fi.Mode()&fs.ModeSymlink != 0
+
+	if st != nil && ex.asRoot {
+		if err := os.Lchown(target, int(st.Uid), int(st.Gid)); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	if !isLink {
+		if err := os.Chmod(target, fileMode(fi.Mode())); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	if st != nil {
+		keys := make([]string, 0, len(st.Xattrs))
+		for k := range st.Xattrs {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			err := unix.Lsetxattr(target, k, st.Xattrs[k], 0)
+			if errors.Is(err, unix.EPERM) || errors.Is(err, unix.ENOTSUP) {
+				log.Warnf("skipping xattr %s on %s: %v", k, target, err)
+				continue
+			} else if err != nil {
+				return errors.Wrapf(err, "couldn't set xattr %s on %s", k, target)
+			}
+		}
+	}
+
+	ts := []unix.Timespec{
+		unix.NsecToTimespec(fi.ModTime().UnixNano()),
+		unix.NsecToTimespec(fi.ModTime().UnixNano()),
+	}
+	if err := unix.UtimesNanoAt(unix.AT_FDCWD, target, ts, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return errors.Wrapf(err, "couldn't set times on %s", target)
+	}
+
+	return nil
+}
+
+// fileMode keeps the bits of m that os.Chmod understands.
+func fileMode(m fs.FileMode) fs.FileMode {
+	return m & (fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky)
+}
@@ -0,0 +1,42 @@
+// Package imagefs holds what the pure-Go filesystem image readers have in
+// common: the interface they implement beyond io/fs.FS, the inode details
+// they report, and extraction of an image to a directory.
+package imagefs
+
+import (
+	"io/fs"
+)
+
+// FS is a read-only filesystem image. Open follows symbolic links within the
+// image, Lstat does not follow a final one; ReadLink returns a link's target.
+type FS interface {
+	fs.FS
+	ReadLink(name string) (string, error)
+	Lstat(name string) (fs.FileInfo, error)
+}
+
+// Image is an FS backed by an open image file.
+type Image interface {
+	FS
+	Close() error
+}
+
+// Stat is what the readers return from fs.FileInfo.Sys().
+type Stat struct {
+	Ino   uint64
+	Nlink uint32
+	Uid   uint32
+	Gid   uint32
+	// Rdev is the device number of block and character devices.
+	Rdev uint64
+	// Xattrs holds the extended attributes, keyed by their full name
+	// (e.g. "user.foo").
+	Xattrs map[string][]byte
+}
+
+// StatOf returns the Stat for fi, or nil if fi didn't come from one of the
+// readers.
+func StatOf(fi fs.FileInfo) *Stat {
+	st, _ := fi.Sys().(*Stat)
+	return st
+}
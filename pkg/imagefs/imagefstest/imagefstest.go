@@ -0,0 +1,62 @@
+// Package imagefstest holds fixtures the image builders' tests share.
+package imagefstest
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/fs"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"machinerun.io/atomfs/pkg/common"
+	"machinerun.io/atomfs/pkg/imagefs"
+)
+
+// WhiteoutLayer returns an OCI layer with a directory owned by someone else,
+// a file in it, a whiteout and an opaque directory, for building an image
+// from with a builder's FromTar function.
+func WhiteoutLayer(t testing.TB) *bytes.Buffer {
+	var layer bytes.Buffer
+	tw := tar.NewWriter(&layer)
+	for _, h := range []*tar.Header{
+		{Typeflag: tar.TypeDir, Name: "a/", Mode: 0750, Uid: 1000, Gid: 1000},
+		{Typeflag: tar.TypeReg, Name: "a/f", Mode: 0600, Size: 5},
+		{Typeflag: tar.TypeReg, Name: "a/.wh.gone"},
+		{Typeflag: tar.TypeDir, Name: "b/", Mode: 0755},
+		{Typeflag: tar.TypeReg, Name: "b/.wh..wh..opq"},
+	} {
+		require.NoError(t, tw.WriteHeader(h))
+		if h.Size != 0 {
+			_, err := tw.Write([]byte("hello"))
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, tw.Close())
+	return &layer
+}
+
+// CheckWhiteoutLayer checks that fsys holds what WhiteoutLayer does, with its
+// whiteouts turned into overlay ones.
+func CheckWhiteoutLayer(t testing.TB, fsys imagefs.FS) {
+	assert := assert.New(t)
+
+	fi, err := fsys.Lstat("a")
+	require.NoError(t, err)
+	assert.Equal(fs.ModeDir|0750, fi.Mode())
+	assert.Equal(uint32(1000), imagefs.StatOf(fi).Uid)
+	content, err := fs.ReadFile(fsys, "a/f")
+	assert.NoError(err)
+	assert.Equal("hello", string(content))
+
+	// whiteouts are overlay ones, in the user xattr namespace
+	fi, err = fsys.Lstat("a/gone")
+	require.NoError(t, err)
+	assert.Equal(fs.ModeDevice|fs.ModeCharDevice, fi.Mode().Type())
+	assert.Zero(imagefs.StatOf(fi).Rdev)
+	fi, err = fsys.Lstat("b")
+	require.NoError(t, err)
+	assert.Equal([]byte("y"), imagefs.StatOf(fi).Xattrs[common.OverlayOpaqueXattr])
+	_, err = fsys.Lstat("b/.wh..wh..opq")
+	assert.Error(err)
+}
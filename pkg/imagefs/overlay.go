@@ -0,0 +1,368 @@
+package imagefs
+
+import (
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+	"machinerun.io/atomfs/pkg/common"
+)
+
+// opaqueXattrs mark a directory as hiding whatever the layers below have at
+// the same path: overlayfs uses the trusted namespace unless it's mounted
+// with userxattr, atoms built from OCI layers the user one.
+var opaqueXattrs = []string{"trusted.overlay.opaque", common.OverlayOpaqueXattr}
+
+// Layer is one of the images making up an Overlay.
+type Layer struct {
+	// Name identifies the layer to users, e.g. by the atom's digest.
+	Name string
+	FS   FS
+}
+
+// Overlay is the merged view of a stack of layers that overlayfs would
+// present, without mounting anything. Whiteouts may be either overlayfs
+// style (0:0 character devices and opaque xattrs) or OCI style (".wh."
+// entries).
+type Overlay struct {
+	// Layers holds the layers top most first, as in a molecule.
+	Layers   []Layer
+	resolver Resolver[*onode]
+}
+
+// onode is an entry in the merged view.
+type onode struct {
+	path string
+	// the layers contributing to this entry, top most first; only
+	// directories can have more than one
+	layers []int
+	fi     fs.FileInfo
+}
+
+// NewOverlay returns the merged view of layers, top most first.
+func NewOverlay(layers []Layer) (*Overlay, error) {
+	o := &Overlay{Layers: layers}
+	root := &onode{path: "."}
+	for n, l := range layers {
+		fi, err := l.FS.Lstat(".")
+		if err != nil {
+			return nil, errors.Wrapf(err, "couldn't read root of %s", l.Name)
+		}
+		if root.fi == nil {
+			root.fi = fi
+		}
+		root.layers = append(root.layers, n)
+		if opaque, err := o.isOpaque(n, ".", fi); err != nil {
+			return nil, err
+		} else if opaque {
+			break
+		}
+	}
+	if root.fi == nil {
+		return nil, errors.Errorf("no layers to overlay")
+	}
+
+	o.resolver = Resolver[*onode]{
+		Root:   root,
+		Lookup: o.lookup,
+		Link:   o.link,
+	}
+	return o, nil
+}
+
+func isWhiteout(fi fs.FileInfo) bool {
+	if fi.Mode()&fs.ModeCharDevice == 0 {
+		return false
+	}
+	st := StatOf(fi)
+	return st != nil && st.Rdev == 0
+}
+
+func (o *Overlay) isOpaque(layer int, name string, fi fs.FileInfo) (bool, error) {
+	if st := StatOf(fi); st != nil {
+		for _, x := range opaqueXattrs {
+			if string(st.Xattrs[x]) == "y" {
+				return true, nil
+			}
+		}
+	}
+	return o.exists(layer, path.Join(name, common.WhiteoutOpaque))
+}
+
+func (o *Overlay) exists(layer int, name string) (bool, error) {
+	_, err := o.Layers[layer].FS.Lstat(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// lookupLayer finds name in one layer, reporting whether it's whited out
+// there.
+func (o *Overlay) lookupLayer(layer int, name string) (fs.FileInfo, bool, error) {
+	fi, err := o.Layers[layer].FS.Lstat(name)
+	if err == nil {
+		return fi, isWhiteout(fi), nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, false, err
+	}
+	dir, base := path.Split(name)
+	whiteout, err := o.exists(layer, path.Join(dir, common.WhiteoutPrefix+base))
+	return nil, whiteout, err
+}
+
+func (o *Overlay) lookup(dir *onode, name string) (*onode, error) {
+	if !dir.fi.IsDir() {
+		return nil, unix.ENOTDIR
+	}
+	if strings.HasPrefix(name, common.WhiteoutPrefix) {
+		return nil, fs.ErrNotExist
+	}
+
+	var ret *onode
+	p := path.Join(dir.path, name)
+	for _, n := range dir.layers {
+		fi, whiteout, err := o.lookupLayer(n, p)
+		if err != nil {
+			return nil, err
+		}
+		if whiteout {
+			break
+		}
+		if fi == nil {
+			continue
+		}
+
+		if ret == nil {
+			ret = &onode{path: p, layers: []int{n}, fi: fi}
+			if !fi.IsDir() {
+				break
+			}
+		} else if fi.IsDir() {
+			ret.layers = append(ret.layers, n)
+		} else {
+			// a lower non-directory is hidden by the directory above
+			break
+		}
+
+		opaque, err := o.isOpaque(n, p, fi)
+		if err != nil {
+			return nil, err
+		}
+		if opaque {
+			break
+		}
+	}
+
+	if ret == nil {
+		return nil, fs.ErrNotExist
+	}
+	return ret, nil
+}
+
+func (o *Overlay) link(n *onode) (string, bool, error) {
+	if n.fi.Mode()&fs.ModeSymlink == 0 {
+		return "", false, nil
+	}
+	target, err := o.Layers[n.layers[0]].FS.ReadLink(n.path)
+	return target, true, err
+}
+
+func (o *Overlay) resolve(op, name string, follow bool) (*onode, error) {
+	if !fs.ValidPath(name) {
+		return nil, PathError(op, name, fs.ErrInvalid)
+	}
+	n, err := o.resolver.Resolve(name, follow)
+	if err != nil {
+		return nil, PathError(op, name, err)
+	}
+	return n, nil
+}
+
+// readDir merges the directory n's entries from each of its layers.
+func (o *Overlay) readDir(n *onode) ([]fs.DirEntry, error) {
+	if !n.fi.IsDir() {
+		return nil, unix.ENOTDIR
+	}
+
+	seen := map[string]bool{}
+	ret := []fs.DirEntry{}
+	for _, l := range n.layers {
+		ents, err := fs.ReadDir(o.Layers[l].FS, n.path)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range ents {
+			name := e.Name()
+			if name == common.WhiteoutOpaque {
+				continue
+			}
+			if strings.HasPrefix(name, common.WhiteoutPrefix) {
+				seen[strings.TrimPrefix(name, common.WhiteoutPrefix)] = true
+				continue
+			}
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+
+			if e.Type()&fs.ModeCharDevice != 0 {
+				fi, err := e.Info()
+				if err != nil {
+					return nil, err
+				}
+				if isWhiteout(fi) {
+					continue
+				}
+			}
+			ret = append(ret, &overlayDirEntry{DirEntry: e, layer: l})
+		}
+	}
+
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name() < ret[j].Name() })
+	return ret, nil
+}
+
+// Open implements fs.FS, following symlinks through the merged view.
+func (o *Overlay) Open(name string) (fs.File, error) {
+	n, err := o.resolve("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+	if n.fi.IsDir() {
+		return &overlayDir{o: o, name: name, n: n}, nil
+	}
+	return o.Layers[n.layers[0]].FS.Open(n.path)
+}
+
+// Stat implements fs.StatFS.
+func (o *Overlay) Stat(name string) (fs.FileInfo, error) {
+	n, err := o.resolve("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return n.fi, nil
+}
+
+// Lstat is Stat without following a final symlink.
+func (o *Overlay) Lstat(name string) (fs.FileInfo, error) {
+	n, err := o.resolve("lstat", name, false)
+	if err != nil {
+		return nil, err
+	}
+	return n.fi, nil
+}
+
+// ReadLink returns the target of the symlink name.
+func (o *Overlay) ReadLink(name string) (string, error) {
+	n, err := o.resolve("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+	target, isLink, err := o.link(n)
+	if err != nil {
+		return "", PathError("readlink", name, err)
+	}
+	if !isLink {
+		return "", PathError("readlink", name, fs.ErrInvalid)
+	}
+	return target, nil
+}
+
+// ReadDir implements fs.ReadDirFS. Each entry is the one of the layer
+// providing it, see Provider.
+func (o *Overlay) ReadDir(name string) ([]fs.DirEntry, error) {
+	n, err := o.resolve("readdir", name, true)
+	if err != nil {
+		return nil, err
+	}
+	ents, err := o.readDir(n)
+	if err != nil {
+		return nil, PathError("readdir", name, err)
+	}
+	return ents, nil
+}
+
+// Providers returns the names of the layers making up the entry name,
+// without following a final symlink. Only directories can have more than
+// one, the top most of which provides the directory's metadata.
+func (o *Overlay) Providers(name string) ([]string, error) {
+	n, err := o.resolve("lstat", name, false)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]string, len(n.layers))
+	for i, l := range n.layers {
+		ret[i] = o.Layers[l].Name
+	}
+	return ret, nil
+}
+
+// Provider returns the name of the layer that a directory entry returned by
+// ReadDir came from.
+func (o *Overlay) Provider(e fs.DirEntry) string {
+	oe, ok := e.(*overlayDirEntry)
+	if !ok {
+		return ""
+	}
+	return o.Layers[oe.layer].Name
+}
+
+type overlayDirEntry struct {
+	fs.DirEntry
+	layer int
+}
+
+type overlayDir struct {
+	o    *Overlay
+	name string
+	n    *onode
+	ents []fs.DirEntry
+	read bool
+}
+
+func (d *overlayDir) Stat() (fs.FileInfo, error) {
+	return d.n.fi, nil
+}
+
+func (d *overlayDir) Read([]byte) (int, error) {
+	return 0, PathError("read", d.name, unix.EISDIR)
+}
+
+func (d *overlayDir) Close() error {
+	return nil
+}
+
+func (d *overlayDir) ReadDir(count int) ([]fs.DirEntry, error) {
+	if !d.read {
+		ents, err := d.o.readDir(d.n)
+		if err != nil {
+			return nil, PathError("readdir", d.name, err)
+		}
+		d.ents = ents
+		d.read = true
+	}
+	if count <= 0 {
+		ents := d.ents
+		d.ents = nil
+		return ents, nil
+	}
+	if len(d.ents) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(d.ents) {
+		count = len(d.ents)
+	}
+	ents := d.ents[:count]
+	d.ents = d.ents[count:]
+	return ents, nil
+}
+
+var _ FS = &Overlay{}
+var _ fs.ReadDirFS = &Overlay{}
+var _ fs.StatFS = &Overlay{}
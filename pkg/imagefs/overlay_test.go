@@ -0,0 +1,132 @@
+package imagefs
+
+import (
+	"io/fs"
+	"path"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+// mapFS is enough of an FS for overlay tests; symlinks hold their target as
+// data, and whiteouts are character devices with a zero Stat.
+type mapFS struct {
+	fstest.MapFS
+}
+
+func (m mapFS) Lstat(name string) (fs.FileInfo, error) {
+	f, ok := m.MapFS[name]
+	if !ok || f.Mode&fs.ModeSymlink == 0 {
+		return m.MapFS.Stat(name)
+	}
+	return &linkInfo{name: path.Base(name), f: f}, nil
+}
+
+type linkInfo struct {
+	name string
+	f    *fstest.MapFile
+}
+
+func (l *linkInfo) Name() string       { return l.name }
+func (l *linkInfo) Size() int64        { return int64(len(l.f.Data)) }
+func (l *linkInfo) Mode() fs.FileMode  { return l.f.Mode }
+func (l *linkInfo) ModTime() time.Time { return l.f.ModTime }
+func (l *linkInfo) IsDir() bool        { return false }
+func (l *linkInfo) Sys() any           { return l.f.Sys }
+
+func (m mapFS) ReadLink(name string) (string, error) {
+	f, ok := m.MapFS[name]
+	if !ok || f.Mode&fs.ModeSymlink == 0 {
+		return "", fs.ErrInvalid
+	}
+	return string(f.Data), nil
+}
+
+func TestOverlay(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	dir := &fstest.MapFile{Mode: fs.ModeDir | 0755}
+	whiteout := &fstest.MapFile{Mode: fs.ModeDevice | fs.ModeCharDevice, Sys: &Stat{}}
+
+	lower := mapFS{fstest.MapFS{
+		"etc":                dir,
+		"etc/passwd":         {Data: []byte("lower")},
+		"etc/group":          {Data: []byte("group")},
+		"etc/gone":           {Data: []byte("gone")},
+		"etc/also-gone":      {Data: []byte("gone")},
+		"opaque":             dir,
+		"opaque/hidden":      {Data: []byte("hidden")},
+		"xopaque":            dir,
+		"xopaque/hidden":     {Data: []byte("hidden")},
+		"replaced":           dir,
+		"replaced/hidden":    {Data: []byte("hidden")},
+		"usr":                dir,
+		"usr/lib":            dir,
+		"usr/lib/os-release": {Data: []byte("os")},
+	}}
+	upper := mapFS{fstest.MapFS{
+		"etc":                 dir,
+		"etc/passwd":          {Data: []byte("upper")},
+		"etc/gone":            whiteout,
+		"etc/.wh.also-gone":   {},
+		"opaque":              dir,
+		"opaque/.wh..wh..opq": {},
+		"opaque/new":          {Data: []byte("new")},
+		"xopaque":             {Mode: fs.ModeDir | 0755, Sys: &Stat{Xattrs: map[string][]byte{"trusted.overlay.opaque": []byte("y")}}},
+		"replaced":            {Data: []byte("file now")},
+		"lib":                 {Mode: fs.ModeSymlink, Data: []byte("usr/lib")},
+	}}
+
+	o, err := NewOverlay([]Layer{{Name: "upper", FS: upper}, {Name: "lower", FS: lower}})
+	assert.NoError(err)
+
+	content, err := fs.ReadFile(o, "etc/passwd")
+	assert.NoError(err)
+	assert.Equal("upper", string(content))
+	content, err = fs.ReadFile(o, "etc/group")
+	assert.NoError(err)
+	assert.Equal("group", string(content))
+
+	_, err = o.Stat("etc/gone")
+	assert.ErrorIs(err, fs.ErrNotExist)
+	_, err = o.Stat("etc/also-gone")
+	assert.ErrorIs(err, fs.ErrNotExist)
+	_, err = o.Stat("opaque/hidden")
+	assert.ErrorIs(err, fs.ErrNotExist)
+	_, err = o.Stat("xopaque/hidden")
+	assert.ErrorIs(err, fs.ErrNotExist)
+	_, err = o.Stat("replaced/hidden")
+	assert.ErrorIs(err, unix.ENOTDIR)
+
+	names := func(name string) []string {
+		ents, err := o.ReadDir(name)
+		assert.NoError(err)
+		ret := []string{}
+		for _, e := range ents {
+			ret = append(ret, e.Name()+"@"+o.Provider(e))
+		}
+		return ret
+	}
+	assert.Equal([]string{"group@lower", "passwd@upper"}, names("etc"))
+	assert.Equal([]string{"new@upper"}, names("opaque"))
+	assert.Equal([]string{}, names("xopaque"))
+	assert.Equal([]string{"etc@upper", "lib@upper", "opaque@upper", "replaced@upper", "usr@lower", "xopaque@upper"}, names("."))
+
+	// symlinks in one layer resolve through the merged view
+	content, err = fs.ReadFile(o, "lib/os-release")
+	assert.NoError(err)
+	assert.Equal("os", string(content))
+
+	providers, err := o.Providers("etc")
+	assert.NoError(err)
+	assert.Equal([]string{"upper", "lower"}, providers)
+	providers, err = o.Providers("opaque")
+	assert.NoError(err)
+	assert.Equal([]string{"upper"}, providers)
+
+	assert.NoError(fstest.TestFS(o, "etc/passwd", "etc/group", "opaque/new", "usr/lib/os-release"))
+}
@@ -0,0 +1,91 @@
+package imagefs
+
+import (
+	"io/fs"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// maxSymlinks is the kernel's limit on links followed during one lookup.
+const maxSymlinks = 40
+
+// Resolver walks paths through an image's directory tree, following
+// symlinks within the image the way the kernel would were the image mounted
+// at "/". N is the reader's inode type.
+type Resolver[N any] struct {
+	Root N
+	// Lookup returns the entry name in the directory dir, or an error
+	// wrapping fs.ErrNotExist (or unix.ENOTDIR if dir isn't a directory).
+	Lookup func(dir N, name string) (N, error)
+	// Link returns n's target if it is a symlink.
+	Link func(n N) (target string, isLink bool, err error)
+}
+
+// Resolve looks up name, which must satisfy fs.ValidPath. Symlinks in
+// the leading components are always followed; a symlink as the last
+// component only is when follow is set.
+func (r *Resolver[N]) Resolve(name string, follow bool) (N, error) {
+	stack := []N{r.Root}
+	todo := []string{}
+	if name != "." {
+		todo = strings.Split(name, "/")
+	}
+
+	links := 0
+	for len(todo) > 0 {
+		comp := todo[0]
+		todo = todo[1:]
+
+		switch comp {
+		case "", ".":
+			continue
+		case "..":
+			if len(stack) > 1 {
+				stack = stack[:len(stack)-1]
+			}
+			continue
+		}
+
+		child, err := r.Lookup(stack[len(stack)-1], comp)
+		if err != nil {
+			var zero N
+			return zero, err
+		}
+
+		if len(todo) > 0 || follow {
+			target, isLink, err := r.Link(child)
+			if err != nil {
+				var zero N
+				return zero, err
+			}
+			if isLink {
+				links++
+				if links > maxSymlinks {
+					var zero N
+					return zero, unix.ELOOP
+				}
+				if strings.HasPrefix(target, "/") {
+					stack = stack[:1]
+				}
+				todo = append(strings.Split(target, "/"), todo...)
+				continue
+			}
+		}
+
+		stack = append(stack, child)
+	}
+
+	return stack[len(stack)-1], nil
+}
+
+// ValidName reports whether name is acceptable as a directory entry read
+// from an image; anything else would let extraction escape its target.
+func ValidName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\x00")
+}
+
+// PathError wraps err the way io/fs expects errors to be reported.
+func PathError(op, name string, err error) error {
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
@@ -0,0 +1,77 @@
+package imagefs
+
+import (
+	"io/fs"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+type node struct {
+	children map[string]*node
+	link     string
+	isLink   bool
+}
+
+func TestResolve(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	file := &node{}
+	root := &node{children: map[string]*node{
+		"a": {children: map[string]*node{
+			"file": file,
+			"up":   {link: "../b", isLink: true},
+		}},
+		"b":    {link: "/a", isLink: true},
+		"loop": {link: "loop", isLink: true},
+	}}
+
+	r := Resolver[*node]{
+		Root: root,
+		Lookup: func(dir *node, name string) (*node, error) {
+			if dir.children == nil {
+				return nil, unix.ENOTDIR
+			}
+			n, ok := dir.children[name]
+			if !ok {
+				return nil, fs.ErrNotExist
+			}
+			return n, nil
+		},
+		Link: func(n *node) (string, bool, error) {
+			return n.link, n.isLink, nil
+		},
+	}
+
+	n, err := r.Resolve(".", true)
+	assert.NoError(err)
+	assert.Equal(root, n)
+
+	n, err = r.Resolve("b/up/up/file", false)
+	assert.NoError(err)
+	assert.Equal(file, n)
+
+	n, err = r.Resolve("b", false)
+	assert.NoError(err)
+	assert.Equal(root.children["b"], n)
+
+	n, err = r.Resolve("b", true)
+	assert.NoError(err)
+	assert.Equal(root.children["a"], n)
+
+	_, err = r.Resolve("a/nope", true)
+	assert.ErrorIs(err, fs.ErrNotExist)
+
+	_, err = r.Resolve("a/file/x", true)
+	assert.ErrorIs(err, unix.ENOTDIR)
+
+	_, err = r.Resolve("loop", true)
+	assert.ErrorIs(err, unix.ELOOP)
+
+	assert.True(ValidName("foo"))
+	for _, bad := range []string{"", ".", "..", "a/b", "a\x00"} {
+		assert.False(ValidName(bad), bad)
+	}
+}
@@ -0,0 +1,206 @@
+package layout
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+	"machinerun.io/atomfs/pkg/log"
+)
+
+// DedupeOptions configure Dedupe.
+type DedupeOptions struct {
+	// Store, if not empty, is a directory of blobs shared by layouts, laid
+	// out like their blobs dirs, e.g. /var/lib/atomfs/blobs. The layouts'
+	// blobs are linked to the copies in it, and added to it if it doesn't
+	// have them.
+	Store string
+	// DryRun only says what would be linked.
+	DryRun bool
+}
+
+// DedupeResult is what Dedupe linked, or would have with DryRun.
+type DedupeResult struct {
+	// Linked are the paths of the blobs replaced with links to identical
+	// ones, and Stored those added to the store.
+	Linked []string
+	Stored []string
+	// Saved is the size of the blobs replaced. Reflinks can't be told
+	// apart from copies, so reflinked blobs are linked, and counted, again
+	// each time.
+	Saved int64
+}
+
+// Dedupe replaces identical blobs, by digest, in the OCI layouts at
+// ocidirs with links to one copy: the one in the store if there is one, or
+// the first found otherwise. Reflinks are used where the filesystem can do
+// them, so the copies stay independent files, and hardlinks otherwise. Each
+// copy linked to is checked against its digest first, so a corrupt blob
+// isn't spread. Only blobs are linked: the objects of composefs
+// atoms, which only work in their own layout, are left alone.
+func Dedupe(ocidirs []string, opts DedupeOptions) (DedupeResult, error) {
+	result := DedupeResult{}
+	// the copy of each blob the others are linked to
+	canonical := map[digest.Digest]string{}
+
+	for _, ocidir := range ocidirs {
+		files, err := blobFiles(ocidir)
+		if err != nil {
+			return result, err
+		}
+		for _, f := range files {
+			if f.suffix != "" {
+				continue
+			}
+
+			src, ok := canonical[f.digest]
+			if !ok {
+				if src, err = canonicalCopy(f, opts, &result); err != nil {
+					return result, err
+				}
+				canonical[f.digest] = src
+				if src == f.path {
+					continue
+				}
+			}
+
+			same, err := sameFile(src, f.path)
+			if err != nil {
+				return result, err
+			}
+			if same {
+				continue
+			}
+			if fi, err := os.Stat(src); err == nil && fi.Size() != f.size {
+				log.Warnf("%s is %d bytes, not %d like %s; not linking it", f.path, f.size, fi.Size(), src)
+				continue
+			}
+
+			result.Linked = append(result.Linked, f.path)
+			result.Saved += f.size
+			if opts.DryRun {
+				continue
+			}
+			how, err := link(src, f.path)
+			if err != nil {
+				return result, err
+			}
+			log.Debugf("%s %s to %s", how, f.path, src)
+		}
+	}
+	return result, nil
+}
+
+// canonicalCopy returns the copy of the blob f that its duplicates are
+// linked to: the one in the store, which it's added to if need be, or f
+// itself. It's checked against its digest.
+func canonicalCopy(f blobFile, opts DedupeOptions, result *DedupeResult) (string, error) {
+	src := f.path
+	if opts.Store != "" {
+		stored := filepath.Join(opts.Store, f.digest.Algorithm().String(), f.digest.Encoded())
+		if _, err := os.Stat(stored); err == nil {
+			src = stored
+		} else if !os.IsNotExist(err) {
+			return "", errors.WithStack(err)
+		} else {
+			if err := verify(f.path, f.digest); err != nil {
+				return "", err
+			}
+			result.Stored = append(result.Stored, stored)
+			if opts.DryRun {
+				return f.path, nil
+			}
+			if err := os.MkdirAll(filepath.Dir(stored), 0755); err != nil {
+				return "", errors.WithStack(err)
+			}
+			if _, err := link(f.path, stored); err != nil {
+				return "", err
+			}
+			return stored, nil
+		}
+	}
+	return src, verify(src, f.digest)
+}
+
+// verify checks the blob at path against its digest d.
+func verify(path string, d digest.Digest) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+	verifier := d.Verifier()
+	if _, err := io.Copy(verifier, f); err != nil {
+		return errors.Wrapf(err, "couldn't read %s", path)
+	}
+	if !verifier.Verified() {
+		return errors.Errorf("%s doesn't match its digest %s", path, d)
+	}
+	return nil
+}
+
+// link replaces dst, atomically, with a reflink of src, or a hardlink if
+// the filesystem can't do reflinks. It returns which it made.
+func link(src, dst string) (string, error) {
+	tmp := dst + ".dedupe"
+	if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		return "", errors.WithStack(err)
+	}
+
+	how := "reflinked"
+	if err := reflink(src, tmp); err != nil {
+		log.Debugf("couldn't reflink %s to %s, hardlinking it: %v", src, dst, err)
+		how = "hardlinked"
+		if err := os.Link(src, tmp); err != nil {
+			return "", errors.Wrapf(err, "couldn't link %s to %s", src, dst)
+		}
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return "", errors.WithStack(err)
+	}
+	return how, nil
+}
+
+// reflink makes dst a copy of src sharing its extents, with FICLONE.
+func reflink(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fi.Mode().Perm())
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = unix.IoctlFileClone(int(out.Fd()), int(in.Fd()))
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst)
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// sameFile says whether a and b are links to the same file.
+func sameFile(a, b string) (bool, error) {
+	ai, err := os.Stat(a)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	bi, err := os.Stat(b)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	return os.SameFile(ai, bi), nil
+}
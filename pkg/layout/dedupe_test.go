@@ -0,0 +1,90 @@
+package layout
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDedupe(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	a := newTestLayout(t)
+	a.image("v1", "base", "app v1")
+	b := newTestLayout(t)
+	b.image("v2", "base", "app v2")
+	base := a.blob(testAtomMediaType, []byte("base"))
+
+	result, err := Dedupe([]string{a.ocidir, b.ocidir}, DedupeOptions{DryRun: true})
+	assert.NoError(err)
+	assert.Equal([]string{b.path(base)}, result.Linked)
+	assert.Equal(int64(len("base")), result.Saved)
+	hardlinked, err := sameFile(a.path(base), b.path(base))
+	assert.NoError(err)
+	assert.False(hardlinked)
+
+	result, err = Dedupe([]string{a.ocidir, b.ocidir}, DedupeOptions{})
+	assert.NoError(err)
+	assert.Equal([]string{b.path(base)}, result.Linked)
+	content, err := os.ReadFile(b.path(base))
+	assert.NoError(err)
+	assert.Equal("base", string(content))
+	hardlinked, err = sameFile(a.path(base), b.path(base))
+	assert.NoError(err)
+	if hardlinked {
+		result, err = Dedupe([]string{a.ocidir, b.ocidir}, DedupeOptions{})
+		assert.NoError(err)
+		assert.Empty(result.Linked)
+	}
+}
+
+func TestDedupeStore(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	store := filepath.Join(t.TempDir(), "blobs")
+	a := newTestLayout(t)
+	a.image("v1", "base", "app v1")
+	b := newTestLayout(t)
+	b.image("v2", "base", "app v2")
+	base := a.blob(testAtomMediaType, []byte("base"))
+	stored := filepath.Join(store, "sha256", base.Digest.Encoded())
+
+	result, err := Dedupe([]string{a.ocidir, b.ocidir}, DedupeOptions{Store: store})
+	assert.NoError(err)
+	assert.Contains(result.Stored, stored)
+	assert.Equal([]string{b.path(base)}, result.Linked)
+	for _, f := range []string{stored, a.path(base), b.path(base)} {
+		content, err := os.ReadFile(f)
+		assert.NoError(err)
+		assert.Equal("base", string(content))
+	}
+
+	// a blob the store already has is linked to its copy there
+	c := newTestLayout(t)
+	c.image("v1", "base")
+	result, err = Dedupe([]string{c.ocidir}, DedupeOptions{Store: store})
+	assert.NoError(err)
+	assert.Contains(result.Linked, c.path(base))
+	assert.NotContains(result.Stored, stored)
+}
+
+func TestDedupeCorrupt(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	a := newTestLayout(t)
+	a.image("v1", "base")
+	b := newTestLayout(t)
+	base := b.blob(testAtomMediaType, []byte("base"))
+	assert.NoError(os.WriteFile(a.path(base), []byte("bass"), 0644))
+
+	_, err := Dedupe([]string{a.ocidir, b.ocidir}, DedupeOptions{})
+	assert.ErrorContains(err, "doesn't match its digest")
+	content, err := os.ReadFile(b.path(base))
+	assert.NoError(err)
+	assert.Equal("base", string(content))
+}
@@ -0,0 +1,480 @@
+// Package layout maintains the OCI layouts images are mounted from.
+package layout
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	digest "github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci"
+	"github.com/pkg/errors"
+	"machinerun.io/atomfs/pkg/log"
+	"machinerun.io/atomfs/pkg/registry"
+)
+
+// the docker equivalents of image indexes and manifests, which may be in
+// layouts made with other tools
+const (
+	dockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	dockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+)
+
+// objectsDir is where composefs atoms' files are in a layout, as
+// composefs.ObjectsDirName, named by their fs-verity digests.
+const objectsDir = "objects"
+
+// maxManifestSize is the biggest blob looked at when finding referrers
+// that aren't in the index.
+const maxManifestSize = 4 << 20
+
+// GCOptions configure GC.
+type GCOptions struct {
+	// KeepTags, if not empty, are globs, as for path.Match, of the tags to
+	// keep; the others are removed from the index first.
+	KeepTags []string
+	// DryRun only says what would be removed.
+	DryRun bool
+	// InUse are files, e.g. mounted atoms, that mustn't be removed,
+	// mapped to what's using them, as from molecule.BlobsInUse.
+	InUse map[string][]string
+	// Objects, if set, returns the objects, relative to the layout's
+	// objects dir, that the atom at path needs, as composefs.AtomObjects
+	// does. mediaType is "" for an atom that's only kept as it's in use.
+	// The objects no atom kept needs are removed; without it, they're all
+	// left alone.
+	Objects func(path, mediaType string) ([]string, error)
+}
+
+// GCResult is what GC removed, or would have with DryRun.
+type GCResult struct {
+	// Untagged are the tags, or digests for untagged manifests, removed
+	// from the index.
+	Untagged []string
+	// Removed are the paths of the blobs removed, including partial
+	// downloads, and of the objects removed.
+	Removed []string
+	// InUse are unreferenced blobs kept as they're in use, mapped to
+	// what's using them.
+	InUse map[string][]string
+	// Reclaimed is how much disk space was freed. Blobs with other links,
+	// e.g. deduplicated ones, don't count.
+	Reclaimed int64
+}
+
+// GC removes the blobs in the OCI layout at ocidir that aren't reachable
+// from its index: those of the manifests and indexes in it, their configs
+// and layers, and the manifests referring to any of those, e.g.
+// signatures, whether they're in the index or not. Partial downloads of
+// unreachable blobs, or of blobs that have been completed since, are
+// removed too. Blobs in use are kept, whether they're reachable or not.
+// With opts.Objects, so are the objects the atoms kept need, and the others
+// are removed.
+func GC(ocidir string, opts GCOptions) (GCResult, error) {
+	result := GCResult{InUse: map[string][]string{}}
+
+	oci, err := umoci.OpenLayout(ocidir)
+	if err != nil {
+		return result, err
+	}
+	defer oci.Close()
+	index, err := oci.GetIndex(context.Background())
+	if err != nil {
+		return result, errors.Wrapf(err, "couldn't read index")
+	}
+
+	g := &gc{ocidir: ocidir, reachable: map[digest.Digest]bool{}, layers: map[digest.Digest]string{}}
+	for _, m := range index.Manifests {
+		if keep(m, opts.KeepTags) {
+			if err := g.walk(m); err != nil {
+				return result, err
+			}
+		}
+	}
+
+	files, err := blobFiles(ocidir)
+	if err != nil {
+		return result, err
+	}
+	if err := g.referrers(files); err != nil {
+		return result, err
+	}
+
+	// untagged referrers of what's kept stay in the index
+	kept := []ispec.Descriptor{}
+	for _, m := range index.Manifests {
+		if g.reachable[m.Digest] {
+			kept = append(kept, m)
+			continue
+		}
+		name := m.Annotations[ispec.AnnotationRefName]
+		if name == "" {
+			name = m.Digest.String()
+		}
+		result.Untagged = append(result.Untagged, name)
+	}
+	if len(result.Untagged) > 0 && !opts.DryRun {
+		index.Manifests = kept
+		if err := oci.PutIndex(context.Background(), index); err != nil {
+			return result, errors.Wrapf(err, "couldn't update index")
+		}
+	}
+
+	inUse := newFileSet(opts.InUse)
+	// the atoms that aren't reachable but are kept, whose objects are too
+	keptInUse := []string{}
+	for _, f := range files {
+		if g.reachable[f.digest] && (f.suffix == "" || !f.completed) {
+			continue
+		}
+		// a partial download is in use if the atom being fetched is
+		// mounted lazily
+		if users := inUse.users(strings.TrimSuffix(f.path, f.suffix)); len(users) > 0 {
+			if !g.reachable[f.digest] {
+				result.InUse[f.path] = users
+				if f.suffix == "" {
+					keptInUse = append(keptInUse, f.path)
+				}
+			}
+			continue
+		}
+
+		result.Removed = append(result.Removed, f.path)
+		result.Reclaimed += f.reclaimable
+		if opts.DryRun {
+			continue
+		}
+		log.Debugf("removing %s", f.path)
+		if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+			return result, errors.WithStack(err)
+		}
+	}
+
+	if opts.Objects != nil {
+		if err := g.objects(opts, keptInUse, &result); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// objects removes the objects that neither the reachable atoms nor those
+// in keptInUse need.
+func (g *gc) objects(opts GCOptions, keptInUse []string, result *GCResult) error {
+	dir := filepath.Join(g.ocidir, objectsDir)
+	fanouts, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.WithStack(err)
+	}
+
+	needed := map[string]bool{}
+	need := func(path, mediaType string) error {
+		objects, err := opts.Objects(path, mediaType)
+		if err != nil {
+			return err
+		}
+		for _, o := range objects {
+			needed[o] = true
+		}
+		return nil
+	}
+	for d, mediaType := range g.layers {
+		if err := need(blobPath(g.ocidir, d), mediaType); err != nil {
+			return err
+		}
+	}
+	for _, path := range keptInUse {
+		if err := need(path, ""); err != nil {
+			return err
+		}
+	}
+
+	for _, fanout := range fanouts {
+		// objects being added are beside the fanout dirs
+		if !fanout.IsDir() || len(fanout.Name()) != 2 {
+			continue
+		}
+		entries, err := os.ReadDir(filepath.Join(dir, fanout.Name()))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		for _, e := range entries {
+			object := filepath.Join(fanout.Name(), e.Name())
+			if needed[object] || !e.Type().IsRegular() {
+				continue
+			}
+			path := filepath.Join(dir, object)
+			fi, err := e.Info()
+			if err != nil {
+				if os.IsNotExist(err) {
+					continue
+				}
+				return errors.WithStack(err)
+			}
+			result.Removed = append(result.Removed, path)
+			if st, ok := fi.Sys().(*syscall.Stat_t); ok && st.Nlink == 1 {
+				result.Reclaimed += st.Blocks * 512
+			}
+			if opts.DryRun {
+				continue
+			}
+			log.Debugf("removing %s", path)
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return errors.WithStack(err)
+			}
+		}
+	}
+	return nil
+}
+
+// blobPath is where the blob d is in the layout at ocidir.
+func blobPath(ocidir string, d digest.Digest) string {
+	return filepath.Join(ocidir, ispec.ImageBlobsDir, d.Algorithm().String(), d.Encoded())
+}
+
+// keep says whether the index entry m is kept, i.e. it has one of the tags
+// in globs, or there are none.
+func keep(m ispec.Descriptor, globs []string) bool {
+	if len(globs) == 0 {
+		return true
+	}
+	tag := m.Annotations[ispec.AnnotationRefName]
+	if tag == "" {
+		return false
+	}
+	for _, g := range globs {
+		if ok, _ := path.Match(g, tag); ok {
+			return true
+		}
+	}
+	return false
+}
+
+type gc struct {
+	ocidir    string
+	reachable map[digest.Digest]bool
+	// layers are the reachable manifests' layers' media types
+	layers map[digest.Digest]string
+}
+
+// walk marks d, and the blobs it refers to, reachable.
+func (g *gc) walk(d ispec.Descriptor) error {
+	if g.reachable[d.Digest] {
+		return nil
+	}
+	g.reachable[d.Digest] = true
+
+	switch d.MediaType {
+	case ispec.MediaTypeImageIndex, dockerManifestList:
+		var index ispec.Index
+		if err := g.read(d.Digest, &index); err != nil {
+			return err
+		}
+		for _, m := range index.Manifests {
+			if err := g.walk(m); err != nil {
+				return err
+			}
+		}
+		if index.Subject != nil && g.has(index.Subject.Digest) {
+			return g.walk(*index.Subject)
+		}
+	case ispec.MediaTypeImageManifest, dockerManifest:
+		var manifest ispec.Manifest
+		if err := g.read(d.Digest, &manifest); err != nil {
+			return err
+		}
+		for _, l := range manifest.Layers {
+			g.layers[l.Digest] = l.MediaType
+		}
+		for _, l := range append([]ispec.Descriptor{manifest.Config}, manifest.Layers...) {
+			if err := g.walk(l); err != nil {
+				return err
+			}
+		}
+		if manifest.Subject != nil && g.has(manifest.Subject.Digest) {
+			return g.walk(*manifest.Subject)
+		}
+	}
+	return nil
+}
+
+// has says whether the blob d is in the layout; a referrer's subject
+// needn't be.
+func (g *gc) has(d digest.Digest) bool {
+	_, err := os.Stat(blobPath(g.ocidir, d))
+	return err == nil
+}
+
+// read unmarshals the blob d, which had better be there: it can't be known
+// what it refers to otherwise.
+func (g *gc) read(d digest.Digest, v any) error {
+	content, err := os.ReadFile(blobPath(g.ocidir, d))
+	if err != nil {
+		return errors.Wrapf(err, "couldn't read %s", d)
+	}
+	return errors.Wrapf(json.Unmarshal(content, v), "bad %s", d)
+}
+
+// referrers marks the manifests and indexes among files whose subject is
+// reachable, and what they refer to, reachable, until there are no more.
+func (g *gc) referrers(files []blobFile) error {
+	type referrer struct {
+		desc    ispec.Descriptor
+		subject digest.Digest
+	}
+	candidates := []referrer{}
+	for _, f := range files {
+		if f.suffix != "" || g.reachable[f.digest] || f.size > maxManifestSize {
+			continue
+		}
+		var m struct {
+			MediaType string            `json:"mediaType"`
+			Subject   *ispec.Descriptor `json:"subject"`
+		}
+		content, err := os.ReadFile(f.path)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if json.Unmarshal(content, &m) != nil || m.Subject == nil {
+			continue
+		}
+		candidates = append(candidates, referrer{
+			desc:    ispec.Descriptor{MediaType: m.MediaType, Digest: f.digest, Size: f.size},
+			subject: m.Subject.Digest,
+		})
+	}
+
+	for more := true; more; {
+		more = false
+		for _, c := range candidates {
+			if !g.reachable[c.desc.Digest] && g.reachable[c.subject] {
+				if err := g.walk(c.desc); err != nil {
+					return err
+				}
+				more = true
+			}
+		}
+	}
+	return nil
+}
+
+// blobFile is a file in a layout's blobs dir: a blob, or a partial
+// download of one.
+type blobFile struct {
+	path   string
+	digest digest.Digest
+	// suffix is registry.PartialSuffix or registry.ChunksSuffix for a
+	// partial download, and completed says the blob has been since
+	suffix    string
+	completed bool
+	size      int64
+	// reclaimable is the space removing it frees
+	reclaimable int64
+}
+
+// blobFiles returns the blobs, and partial downloads, in ocidir. Anything
+// else is left alone.
+func blobFiles(ocidir string) ([]blobFile, error) {
+	algs, err := os.ReadDir(filepath.Join(ocidir, ispec.ImageBlobsDir))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	ret := []blobFile{}
+	for _, alg := range algs {
+		dir := filepath.Join(ocidir, ispec.ImageBlobsDir, alg.Name())
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		for _, e := range entries {
+			f := blobFile{path: filepath.Join(dir, e.Name())}
+			encoded := e.Name()
+			for _, suffix := range []string{registry.PartialSuffix, registry.ChunksSuffix} {
+				if strings.HasSuffix(encoded, suffix) {
+					encoded = strings.TrimSuffix(encoded, suffix)
+					f.suffix = suffix
+				}
+			}
+			f.digest = digest.NewDigestFromEncoded(digest.Algorithm(alg.Name()), encoded)
+			if f.digest.Validate() != nil || !e.Type().IsRegular() {
+				continue
+			}
+			if f.suffix != "" {
+				_, err := os.Stat(filepath.Join(dir, encoded))
+				f.completed = err == nil
+			}
+
+			fi, err := e.Info()
+			if err != nil {
+				if os.IsNotExist(err) {
+					continue
+				}
+				return nil, errors.WithStack(err)
+			}
+			f.size = fi.Size()
+			if st, ok := fi.Sys().(*syscall.Stat_t); ok && st.Nlink == 1 {
+				f.reclaimable = st.Blocks * 512
+			}
+			ret = append(ret, f)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].path < ret[j].path })
+	return ret, nil
+}
+
+// fileSet finds what's using files by their path, or by their inode, so
+// other links to them, e.g. as a loop device's backing file, are found too.
+type fileSet struct {
+	paths  map[string][]string
+	inodes map[[2]uint64][]string
+}
+
+func newFileSet(files map[string][]string) fileSet {
+	s := fileSet{paths: map[string][]string{}, inodes: map[[2]uint64][]string{}}
+	for f, users := range files {
+		if abs, err := filepath.Abs(f); err == nil {
+			f = abs
+		}
+		s.paths[f] = append(s.paths[f], users...)
+		if id, ok := inode(f); ok {
+			s.inodes[id] = append(s.inodes[id], users...)
+		}
+	}
+	return s
+}
+
+func (s fileSet) users(f string) []string {
+	if abs, err := filepath.Abs(f); err == nil {
+		f = abs
+	}
+	if users, ok := s.paths[f]; ok {
+		return users
+	}
+	if id, ok := inode(f); ok {
+		return s.inodes[id]
+	}
+	return nil
+}
+
+// inode identifies the file f is, if it exists.
+func inode(f string) ([2]uint64, bool) {
+	fi, err := os.Stat(f)
+	if err != nil {
+		return [2]uint64{}, false
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return [2]uint64{}, false
+	}
+	return [2]uint64{uint64(st.Dev), st.Ino}, true
+}
@@ -0,0 +1,271 @@
+package layout
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci"
+	"github.com/opencontainers/umoci/oci/cas/dir"
+	"github.com/stretchr/testify/assert"
+	"machinerun.io/atomfs/pkg/registry"
+)
+
+const testAtomMediaType = "application/vnd.stacker.image.layer.squashfs+zstd+verity"
+
+type testLayout struct {
+	t      *testing.T
+	ocidir string
+}
+
+func newTestLayout(t *testing.T) testLayout {
+	ocidir := filepath.Join(t.TempDir(), "oci")
+	assert.NoError(t, dir.Create(ocidir))
+	return testLayout{t: t, ocidir: ocidir}
+}
+
+// blob adds content, returning its descriptor.
+func (l testLayout) blob(mediaType string, content []byte) ispec.Descriptor {
+	oci, err := umoci.OpenLayout(l.ocidir)
+	assert.NoError(l.t, err)
+	defer oci.Close()
+	d, size, err := oci.PutBlob(context.Background(), bytes.NewReader(content))
+	assert.NoError(l.t, err)
+	return ispec.Descriptor{MediaType: mediaType, Digest: d, Size: size}
+}
+
+// image adds an image of atoms, tagged as tag if that's not empty, and
+// returns its manifest's descriptor.
+func (l testLayout) image(tag string, atoms ...string) ispec.Descriptor {
+	manifest := ispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ispec.MediaTypeImageManifest,
+		Config:    l.blob(ispec.MediaTypeImageConfig, []byte(`{"architecture":"amd64","os":"linux","rootfs":{"type":"layers"},"tag":"`+tag+`"}`)),
+		Layers:    []ispec.Descriptor{},
+	}
+	for _, a := range atoms {
+		manifest.Layers = append(manifest.Layers, l.blob(testAtomMediaType, []byte(a)))
+	}
+	return l.manifest(tag, manifest)
+}
+
+// manifest adds m, tagged as tag if that's not empty, returning its
+// descriptor.
+func (l testLayout) manifest(tag string, m ispec.Manifest) ispec.Descriptor {
+	content, err := json.Marshal(m)
+	assert.NoError(l.t, err)
+	desc := l.blob(ispec.MediaTypeImageManifest, content)
+	if tag != "" {
+		oci, err := umoci.OpenLayout(l.ocidir)
+		assert.NoError(l.t, err)
+		defer oci.Close()
+		assert.NoError(l.t, oci.UpdateReference(context.Background(), tag, desc))
+	}
+	return desc
+}
+
+// signature adds a signature of subject, in the index untagged if
+// indexed, returning its descriptor.
+func (l testLayout) signature(subject ispec.Descriptor, indexed bool) ispec.Descriptor {
+	desc := l.manifest("", ispec.Manifest{
+		Versioned:    specs.Versioned{SchemaVersion: 2},
+		MediaType:    ispec.MediaTypeImageManifest,
+		ArtifactType: "application/vnd.example.signature",
+		Config:       l.blob(ispec.MediaTypeEmptyJSON, []byte("{}")),
+		Layers:       []ispec.Descriptor{l.blob("application/vnd.example.signature", []byte("signed "+subject.Digest))},
+		Subject:      &subject,
+	})
+	if indexed {
+		oci, err := umoci.OpenLayout(l.ocidir)
+		assert.NoError(l.t, err)
+		defer oci.Close()
+		index, err := oci.GetIndex(context.Background())
+		assert.NoError(l.t, err)
+		index.Manifests = append(index.Manifests, desc)
+		assert.NoError(l.t, oci.PutIndex(context.Background(), index))
+	}
+	return desc
+}
+
+func (l testLayout) path(d ispec.Descriptor) string {
+	return blobPath(l.ocidir, d.Digest)
+}
+
+func TestGC(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	l := newTestLayout(t)
+	v1 := l.image("v1", "base", "app v1")
+	v1sig := l.signature(v1, true)
+	v2 := l.image("v2", "base", "app v2")
+	v2sig := l.signature(v2, false)
+	old := l.blob(testAtomMediaType, []byte("app v0"))
+	orphanSig := l.signature(old, false)
+	// an interrupted download of something no longer wanted
+	assert.NoError(os.WriteFile(l.path(old)+registry.PartialSuffix, []byte("app"), 0644))
+
+	result, err := GC(l.ocidir, GCOptions{DryRun: true})
+	assert.NoError(err)
+	assert.Empty(result.Untagged)
+	// the old atom, its partial download, and the orphaned signature and
+	// its layer; they share the empty config
+	assert.Len(result.Removed, 4)
+	assert.Contains(result.Removed, l.path(old))
+	assert.Contains(result.Removed, l.path(old)+registry.PartialSuffix)
+	assert.Contains(result.Removed, l.path(orphanSig))
+	assert.NotZero(result.Reclaimed)
+	assert.FileExists(l.path(old))
+
+	result, err = GC(l.ocidir, GCOptions{})
+	assert.NoError(err)
+	assert.Len(result.Removed, 4)
+	assert.NoFileExists(l.path(old))
+	assert.NoFileExists(l.path(orphanSig))
+	for _, d := range []ispec.Descriptor{v1, v1sig, v2, v2sig} {
+		assert.FileExists(l.path(d))
+	}
+
+	result, err = GC(l.ocidir, GCOptions{})
+	assert.NoError(err)
+	assert.Empty(result.Removed)
+	assert.Zero(result.Reclaimed)
+}
+
+func TestGCObjects(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	l := newTestLayout(t)
+	l.image("v1", "base", "app v1")
+	mounted := l.blob(testAtomMediaType, []byte("app v0"))
+	objects := filepath.Join(l.ocidir, "objects")
+	for _, o := range []string{"aa/base", "bb/app v1", "cc/app v0", "dd/app v-1", ".object-123"} {
+		assert.NoError(os.MkdirAll(filepath.Dir(filepath.Join(objects, o)), 0755))
+		assert.NoError(os.WriteFile(filepath.Join(objects, o), []byte(o), 0644))
+	}
+
+	// each test atom needs the object named after its content
+	seen := map[string]string{}
+	atomObjects := func(path, mediaType string) ([]string, error) {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		seen[string(content)] = mediaType
+		o, err := filepath.Glob(filepath.Join(objects, "*", string(content)))
+		if err != nil || len(o) != 1 {
+			return nil, err
+		}
+		rel, err := filepath.Rel(objects, o[0])
+		return []string{rel}, err
+	}
+
+	opts := GCOptions{
+		DryRun:  true,
+		InUse:   map[string][]string{l.path(mounted): {"/mnt"}},
+		Objects: atomObjects,
+	}
+	result, err := GC(l.ocidir, opts)
+	assert.NoError(err)
+	assert.Equal([]string{filepath.Join(objects, "dd", "app v-1")}, result.Removed)
+	assert.Equal(map[string]string{"base": testAtomMediaType, "app v1": testAtomMediaType, "app v0": ""}, seen)
+	assert.FileExists(filepath.Join(objects, "dd", "app v-1"))
+
+	opts.DryRun = false
+	result, err = GC(l.ocidir, opts)
+	assert.NoError(err)
+	assert.Len(result.Removed, 1)
+	assert.NoFileExists(filepath.Join(objects, "dd", "app v-1"))
+	for _, o := range []string{"aa/base", "bb/app v1", "cc/app v0", ".object-123"} {
+		assert.FileExists(filepath.Join(objects, o))
+	}
+
+	// without Objects, they're left alone
+	result, err = GC(l.ocidir, GCOptions{})
+	assert.NoError(err)
+	assert.Equal([]string{l.path(mounted)}, result.Removed)
+	assert.FileExists(filepath.Join(objects, "cc", "app v0"))
+}
+
+func TestGCKeepTags(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	l := newTestLayout(t)
+	v1 := l.image("v1", "base", "app v1")
+	v1sig := l.signature(v1, true)
+	v2 := l.image("v2", "base", "app v2")
+	v2sig := l.signature(v2, true)
+	l.image("stable-v2", "base", "app v2")
+
+	result, err := GC(l.ocidir, GCOptions{KeepTags: []string{"v2", "nope-*"}})
+	assert.NoError(err)
+	// stable-v2 has a different config
+	assert.ElementsMatch([]string{"v1", v1sig.Digest.String(), "stable-v2"}, result.Untagged)
+	assert.NoFileExists(l.path(v1))
+	assert.NoFileExists(l.path(v1sig))
+	assert.FileExists(l.path(v2))
+	assert.FileExists(l.path(v2sig))
+
+	oci, err := umoci.OpenLayout(l.ocidir)
+	assert.NoError(err)
+	defer oci.Close()
+	index, err := oci.GetIndex(context.Background())
+	assert.NoError(err)
+	assert.Len(index.Manifests, 2)
+	assert.Equal(v2.Digest, index.Manifests[0].Digest)
+	assert.Equal(v2sig.Digest, index.Manifests[1].Digest)
+}
+
+func TestGCInUse(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	l := newTestLayout(t)
+	l.image("v1", "app v1")
+	mounted := l.blob(testAtomMediaType, []byte("app v0"))
+	lazy := l.blob(testAtomMediaType, []byte("app v-1"))
+	assert.NoError(os.Rename(l.path(lazy), l.path(lazy)+registry.PartialSuffix))
+	assert.NoError(os.WriteFile(l.path(lazy)+registry.ChunksSuffix, []byte{1}, 0644))
+	backing := filepath.Join(t.TempDir(), "backing")
+	linked := l.blob(testAtomMediaType, []byte("app v-2"))
+	assert.NoError(os.Link(l.path(linked), backing))
+
+	result, err := GC(l.ocidir, GCOptions{InUse: map[string][]string{
+		l.path(mounted): {"/mnt"},
+		l.path(lazy):    {"/lazy"},
+		backing:         {"/dev/loop0"},
+	}})
+	assert.NoError(err)
+	assert.Empty(result.Removed)
+	assert.Equal(map[string][]string{
+		l.path(mounted):                       {"/mnt"},
+		l.path(lazy) + registry.PartialSuffix: {"/lazy"},
+		l.path(lazy) + registry.ChunksSuffix:  {"/lazy"},
+		l.path(linked):                        {"/dev/loop0"},
+	}, result.InUse)
+	result, err = GC(l.ocidir, GCOptions{})
+	assert.NoError(err)
+	assert.Len(result.Removed, 4)
+	assert.NoFileExists(l.path(linked))
+}
+
+func TestGCMissingManifest(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	l := newTestLayout(t)
+	v1 := l.image("v1", "app v1")
+	old := l.blob(testAtomMediaType, []byte("app v0"))
+	assert.NoError(os.Remove(l.path(v1)))
+
+	_, err := GC(l.ocidir, GCOptions{})
+	assert.ErrorContains(err, v1.Digest.String())
+	assert.FileExists(l.path(old))
+}
@@ -0,0 +1,147 @@
+package molecule
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/pkg/errors"
+	"machinerun.io/atomfs/pkg/common"
+)
+
+// MountedMolecule is a molecule found through the metadata Mount left for
+// it.
+type MountedMolecule struct {
+	Metadir string
+	Config  MountOCIOpts
+	// Daemons are the FUSE servers for its atoms and overlay, if it was
+	// guest mounted.
+	Daemons []common.FuseDaemon
+}
+
+// DeadDaemons returns those of m's daemons that have died.
+func (m MountedMolecule) DeadDaemons() []common.FuseDaemon {
+	dead := []common.FuseDaemon{}
+	for _, d := range m.Daemons {
+		if !d.Alive() {
+			dead = append(dead, d)
+		}
+	}
+	return dead
+}
+
+// RootHashes returns the root hashes of m's atoms, as its image's manifest
+// has them now, by the encoded digests their mounts are named after. Atoms
+// without one are left out.
+func (m MountedMolecule) RootHashes() (map[string]string, error) {
+	mol, err := BuildMoleculeFromOCI(m.Config)
+	if err != nil {
+		return nil, err
+	}
+	ret := map[string]string{}
+	for _, a := range mol.Atoms {
+		if rootHash := atomRootHash(a); rootHash != "" {
+			ret[a.Digest.Encoded()] = rootHash
+		}
+	}
+	return ret, nil
+}
+
+// ReadMountOCIOpts reads the config Mount saved with WriteToFile.
+func ReadMountOCIOpts(filename string) (MountOCIOpts, error) {
+	opts := MountOCIOpts{}
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return opts, errors.WithStack(err)
+	}
+	return opts, errors.Wrapf(json.Unmarshal(content, &opts), "bad mount config %s", filename)
+}
+
+func readMountedMolecule(metadir string) (MountedMolecule, error) {
+	config, err := ReadMountOCIOpts(filepath.Join(metadir, "config.json"))
+	if err != nil {
+		return MountedMolecule{}, err
+	}
+	m := MountedMolecule{Metadir: metadir, Config: config}
+
+	files, err := filepath.Glob(filepath.Join(metadir, "mounts", ".*-fuse.json"))
+	if err != nil {
+		return m, errors.WithStack(err)
+	}
+	files = append(files, filepath.Join(metadir, fuseOverlayfsDaemonFile))
+	for _, f := range files {
+		d, err := common.ReadFuseDaemon(f)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return m, err
+		}
+		m.Daemons = append(m.Daemons, *d)
+	}
+	return m, nil
+}
+
+// FindMounted returns the molecule mounted at dest, with metadata in
+// metadirArg as for UmountWithMetadir.
+func FindMounted(dest, metadirArg string) (MountedMolecule, error) {
+	dest, err := filepath.Abs(dest)
+	if err != nil {
+		return MountedMolecule{}, errors.Wrapf(err, "couldn't create abs path for %v", dest)
+	}
+	mol := Molecule{config: MountOCIOpts{Target: dest, MetadataDir: metadirArg}}
+	_, metadir, err := mol.MetadataPath()
+	if err != nil {
+		return MountedMolecule{}, err
+	}
+	return readMountedMolecule(metadir)
+}
+
+// ListMounted returns the molecules mounted in this mount namespace with
+// metadata in metadirArg, ordered by target.
+func ListMounted(metadirArg string) ([]MountedMolecule, error) {
+	mountNSName, err := common.GetMountNSName()
+	if err != nil {
+		return nil, err
+	}
+	nsdir := filepath.Join(common.RuntimeDir(metadirArg), "meta", mountNSName)
+	entries, err := os.ReadDir(nsdir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	ret := []MountedMolecule{}
+	for _, e := range entries {
+		metadir := filepath.Join(nsdir, e.Name())
+		if !common.PathExists(filepath.Join(metadir, "config.json")) {
+			// not a molecule, e.g. a mount --userns record
+			continue
+		}
+		m, err := readMountedMolecule(metadir)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, m)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Config.Target < ret[j].Config.Target })
+	return ret, nil
+}
+
+// Remount unmounts m and mounts it again the same way, to replace FUSE
+// daemons that have died: the overlay keeps using the dead atom mounts, so
+// restarting just their daemons wouldn't help. Anything written to an
+// ephemeral overlay, i.e. one without a persist dir, is lost.
+func (m MountedMolecule) Remount() error {
+	if err := UmountWithMetadir(m.Config.Target, m.Config.MetadataDir); err != nil {
+		return err
+	}
+	mol, err := BuildMoleculeFromOCI(m.Config)
+	if err != nil {
+		return err
+	}
+	return mol.Mount(m.Config.Target)
+}
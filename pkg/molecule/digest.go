@@ -0,0 +1,123 @@
+package molecule
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"machinerun.io/atomfs/pkg/common"
+	"machinerun.io/atomfs/pkg/log"
+)
+
+// DigestCheck says when atoms are checked against their digests before
+// they're mounted.
+type DigestCheck string
+
+const (
+	// DigestCheckAuto checks the atoms nothing else protects: those
+	// without a root hash, or an fs-verity digest that's been checked.
+	DigestCheckAuto DigestCheck = ""
+	// DigestCheckAlways checks every atom.
+	DigestCheckAlways DigestCheck = "always"
+	// DigestCheckNever checks none.
+	DigestCheckNever DigestCheck = "never"
+)
+
+// ParseDigestCheck parses "auto", "always" or "never".
+func ParseDigestCheck(s string) (DigestCheck, error) {
+	switch s {
+	case "auto", "":
+		return DigestCheckAuto, nil
+	case string(DigestCheckAlways), string(DigestCheckNever):
+		return DigestCheck(s), nil
+	}
+	return "", errors.Errorf("bad digest check %q, expected auto, always or never", s)
+}
+
+// verifiedDigestsDir is where the digests of the blobs that have been
+// checked are cached, under the runtime dir.
+const verifiedDigestsDir = "verified-digests"
+
+// verifiedDigest is what's cached about a blob whose digest has been
+// checked: if it's still the same size and hasn't been modified since, it
+// needn't be hashed again. The mtime can be set back to what it was, but
+// the ctime can't, so it's what says whether it has been.
+type verifiedDigest struct {
+	Size   int64
+	Mtime  int64
+	Ctime  int64
+	Digest digest.Digest
+}
+
+// verifyDigest checks the blob at path against its digest d, unless the
+// cache in the runtime dir says it has been already.
+func (m Molecule) verifyDigest(path string, d digest.Digest) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return errors.Errorf("unknown stat info type %T", fi.Sys())
+	}
+	cached := verifiedDigest{Size: fi.Size(), Mtime: fi.ModTime().UnixNano(), Ctime: st.Ctim.Nano(), Digest: d}
+	cache := filepath.Join(common.RuntimeDir(m.config.MetadataDir), verifiedDigestsDir, fmt.Sprintf("%d-%d.json", st.Dev, st.Ino))
+
+	if content, err := os.ReadFile(cache); err == nil {
+		var v verifiedDigest
+		if json.Unmarshal(content, &v) == nil && v == cached {
+			log.Debugf("%s has been checked against %s already", path, d)
+			return nil
+		}
+	}
+
+	log.Infof("checking %s against its digest", path)
+	verifier := d.Verifier()
+	if _, err := io.Copy(verifier, f); err != nil {
+		return errors.Wrapf(err, "couldn't read %s", path)
+	}
+	if !verifier.Verified() {
+		return errors.Errorf("%s doesn't match its digest %s", path, d)
+	}
+
+	// it's only a cache, so failing to update it isn't fatal
+	if err := writeVerifiedDigest(cache, cached); err != nil {
+		log.Warnf("couldn't cache the digest of %s: %v", path, err)
+	}
+	return nil
+}
+
+func writeVerifiedDigest(cache string, v verifiedDigest) error {
+	content, err := json.Marshal(v)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if err := common.EnsureDir(filepath.Dir(cache)); err != nil {
+		return err
+	}
+	// written beside it and renamed, so concurrent mounts don't see it
+	// half written
+	tmp, err := os.CreateTemp(filepath.Dir(cache), ".tmp-*")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return errors.WithStack(err)
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Rename(tmp.Name(), cache))
+}
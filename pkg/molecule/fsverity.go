@@ -0,0 +1,84 @@
+package molecule
+
+import (
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci"
+	"github.com/pkg/errors"
+	"machinerun.io/atomfs/pkg/fsverity"
+	"machinerun.io/atomfs/pkg/log"
+	stackeroci "machinerun.io/atomfs/pkg/oci"
+)
+
+// EnableFsverity enables fs-verity on each atom of the image opts names and
+// records their digests in the fsverity.DigestAnnotation of their
+// descriptors, updating the tag to the resulting manifest, which it
+// returns. Atoms are checked against their digests first. Atoms already
+// annotated are only checked against that.
+func EnableFsverity(opts MountOCIOpts) (ispec.Manifest, error) {
+	oci, err := umoci.OpenLayout(opts.OCIDir)
+	if err != nil {
+		return ispec.Manifest{}, err
+	}
+	defer oci.Close()
+
+	man, err := stackeroci.LookupManifest(oci, opts.Tag)
+	if err != nil {
+		return ispec.Manifest{}, err
+	}
+
+	changed := false
+	layers := make([]ispec.Descriptor, len(man.Layers))
+	for i, layer := range man.Layers {
+		blob := opts.AtomsPath(layer.Digest.Encoded())
+		if expected, ok := layer.Annotations[fsverity.DigestAnnotation]; ok {
+			if err := fsverity.Verify(blob, expected); err == nil {
+				layers[i] = layer
+				continue
+			}
+		}
+
+		// the measurement is trusted from then on, so it had better be
+		// of the blob the descriptor describes
+		if err := (Molecule{config: opts}).verifyDigest(blob, layer.Digest); err != nil {
+			return ispec.Manifest{}, errors.Wrapf(err, "not enabling fs-verity on atom %s", layer.Digest)
+		}
+		digest, err := fsverity.EnableAndMeasure(blob)
+		if err != nil {
+			return ispec.Manifest{}, errors.Wrapf(err, "couldn't enable fs-verity on atom %s", layer.Digest)
+		}
+
+		annotations := map[string]string{}
+		for k, v := range layer.Annotations {
+			annotations[k] = v
+		}
+		annotations[fsverity.DigestAnnotation] = digest
+		layer.Annotations = annotations
+		layers[i] = layer
+		changed = true
+	}
+	man.Layers = layers
+
+	if !changed {
+		return man, nil
+	}
+	if _, err := stackeroci.UpdateManifest(oci, opts.Tag, man); err != nil {
+		return ispec.Manifest{}, errors.Wrapf(err, "couldn't update %s", opts.Tag)
+	}
+	return man, nil
+}
+
+// verifyFsverity checks the fs-verity digest of atom's blob against its
+// annotation, if it has one. The kernel then refuses to read anything else
+// from the blob, however it's mounted. It says whether it checked it.
+func (m Molecule) verifyFsverity(atom ispec.Descriptor) (bool, error) {
+	expected, ok := atom.Annotations[fsverity.DigestAnnotation]
+	if !ok {
+		return false, nil
+	}
+	err := fsverity.Verify(m.config.AtomPath(atom.Digest.Encoded()), expected)
+	if errors.Is(err, fsverity.ErrNotEnabled) && m.config.AllowMissingVerityData {
+		log.Warnf("%v has an fs-verity digest, but fs-verity isn't enabled on it", atom.Digest)
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,112 @@
+package molecule
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+	"machinerun.io/atomfs/pkg/common"
+	"machinerun.io/atomfs/pkg/log"
+	"machinerun.io/atomfs/pkg/mount"
+)
+
+// FuseOverlayfsType is the type fuse-overlayfs mounts have in mountinfo.
+const FuseOverlayfsType = "fuse.fuse-overlayfs"
+
+// fuseOverlayfsDaemonFile records, in a molecule's metadata dir, the
+// fuse-overlayfs serving it.
+const fuseOverlayfsDaemonFile = "fuse-overlayfs.json"
+
+// fuseOverlayfsOptions converts kernel overlay mount options to
+// fuse-overlayfs ones, dropping those it doesn't understand.
+func fuseOverlayfsOptions(overlayArgs string) string {
+	opts := []string{}
+	for _, o := range strings.Split(overlayArgs, ",") {
+		for _, keep := range []string{"lowerdir=", "upperdir=", "workdir="} {
+			if strings.HasPrefix(o, keep) {
+				opts = append(opts, o)
+			}
+		}
+	}
+	return strings.Join(opts, ",")
+}
+
+// mountFuseOverlayfs mounts the overlay described by overlayArgs at dest
+// with fuse-overlayfs, for when the kernel won't let us mount overlayfs in
+// a user namespace.
+func mountFuseOverlayfs(metadir, dest, overlayArgs string) error {
+	fuseOverlayfs := common.Which("fuse-overlayfs")
+	if fuseOverlayfs == "" {
+		return errors.Errorf("fuse-overlayfs program not found")
+	}
+
+	dest, err := filepath.Abs(dest)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't get absolute path for %s", dest)
+	}
+
+	logf := filepath.Join(metadir, "fuse-overlayfs.log")
+	cmdOut, err := os.OpenFile(logf, os.O_RDWR|os.O_TRUNC|os.O_CREATE, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't open %s", logf)
+	}
+	defer cmdOut.Close()
+
+	// run it in the foreground so the pid we record is the one serving
+	// the mount
+	cmd := exec.Command(fuseOverlayfs, "-f", "-o", fuseOverlayfsOptions(overlayArgs), dest)
+	cmd.Stdout = cmdOut
+	cmd.Stderr = cmdOut
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	fmt.Fprintf(cmdOut, "# %s\n", strings.Join(cmd.Args, " "))
+	log.Debugf("Mounting overlay at %s with %s [%s]", dest, fuseOverlayfs, logf)
+	if err := cmd.Start(); err != nil {
+		return errors.Wrapf(err, "couldn't start fuse-overlayfs")
+	}
+
+	exited := make(chan struct{})
+	go func() {
+		_ = cmd.Wait()
+		close(exited)
+	}()
+
+	timeout := time.After(30 * time.Second)
+	for {
+		m, mounted, err := mount.FindMount(dest)
+		if err != nil {
+			_ = cmd.Process.Kill()
+			return err
+		}
+		if mounted && m.FSType == FuseOverlayfsType {
+			break
+		}
+
+		select {
+		case <-exited:
+			out, _ := os.ReadFile(logf)
+			return errors.Errorf("fuse-overlayfs failed to mount %s: %s", dest, strings.TrimSpace(string(out)))
+		case <-timeout:
+			_ = cmd.Process.Kill()
+			return errors.Errorf("timed out waiting for fuse-overlayfs to mount %s", dest)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	if err := common.RecordFuseDaemon(filepath.Join(metadir, fuseOverlayfsDaemonFile), cmd, dest); err != nil {
+		_ = unix.Unmount(dest, unix.MNT_DETACH)
+		return err
+	}
+	return nil
+}
+
+// umountFuseOverlayfs unmounts a molecule mounted by mountFuseOverlayfs and
+// makes sure its fuse-overlayfs goes away.
+func umountFuseOverlayfs(metadir, dest string) error {
+	return common.FuseUnmount(dest, filepath.Join(metadir, fuseOverlayfsDaemonFile))
+}
@@ -0,0 +1,158 @@
+package molecule
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+	"machinerun.io/atomfs/pkg/common"
+	"machinerun.io/atomfs/pkg/log"
+	"machinerun.io/atomfs/pkg/userns"
+)
+
+// idmapped mounts need 5.12, and overlayfs only takes them as layers from
+// 5.19.
+var (
+	idmapKernel       = common.KernelVersion{Major: 5, Minor: 12}
+	idmapLayersKernel = common.KernelVersion{Major: 5, Minor: 19}
+)
+
+func (c MountOCIOpts) idmapped() bool {
+	return c.IDMapUserns != "" || len(c.UIDMappings) > 0 || len(c.GIDMappings) > 0
+}
+
+// idmapUserns opens the user namespace c says to idmap with.
+func (c MountOCIOpts) idmapUserns() (*os.File, error) {
+	kernel, err := common.RunningKernelVersion()
+	if err != nil {
+		return nil, err
+	}
+	if !kernel.AtLeast(idmapKernel) {
+		return nil, errors.Errorf("idmapped mounts need kernel %s, this is %s", idmapKernel, kernel)
+	}
+
+	if c.IDMapUserns != "" {
+		f, err := os.Open(c.IDMapUserns)
+		return f, errors.Wrapf(err, "couldn't open user namespace")
+	}
+	if len(c.UIDMappings) == 0 || len(c.GIDMappings) == 0 {
+		return nil, errors.Errorf("idmapping needs both uid and gid mappings")
+	}
+	return newUsernsWithMappings(c.UIDMappings, c.GIDMappings)
+}
+
+func sysProcIDMaps(mappings []userns.Mapping) []syscall.SysProcIDMap {
+	ret := []syscall.SysProcIDMap{}
+	for _, m := range mappings {
+		ret = append(ret, syscall.SysProcIDMap{ContainerID: int(m.ContainerID), HostID: int(m.HostID), Size: int(m.Size)})
+	}
+	return ret
+}
+
+// newUsernsWithMappings makes a user namespace with the given mappings. A
+// user namespace only lives as long as something refers to it, so we start
+// a process in it that stops before running anything, by having it traced,
+// open its namespace and get rid of it.
+func newUsernsWithMappings(uids, gids []userns.Mapping) (*os.File, error) {
+	// the tracer is the thread that started the process
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	cmd := exec.Command("/proc/self/exe")
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags:  syscall.CLONE_NEWUSER,
+		UidMappings: sysProcIDMaps(uids),
+		GidMappings: sysProcIDMaps(gids),
+		Ptrace:      true,
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, errors.Wrapf(err, "couldn't make a user namespace for %v %v", uids, gids)
+	}
+	defer func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	}()
+
+	f, err := os.Open(fmt.Sprintf("/proc/%d/ns/user", cmd.Process.Pid))
+	return f, errors.Wrapf(err, "couldn't open user namespace")
+}
+
+// idmapClone returns a detached copy of the mount at path, idmapped with
+// the user namespace usernsFd.
+func idmapClone(path string, usernsFd int) (int, error) {
+	fd, err := unix.OpenTree(unix.AT_FDCWD, path, unix.OPEN_TREE_CLONE|unix.OPEN_TREE_CLOEXEC)
+	if err != nil {
+		return -1, errors.Wrapf(err, "couldn't clone mount %s", path)
+	}
+	attr := unix.MountAttr{Attr_set: unix.MOUNT_ATTR_IDMAP, Userns_fd: uint64(usernsFd)}
+	if err := unix.MountSetattr(fd, "", unix.AT_EMPTY_PATH, &attr); err != nil {
+		unix.Close(fd)
+		return -1, err
+	}
+	return fd, nil
+}
+
+// replaceMount puts the detached mount fd in place of the mount at path.
+func replaceMount(fd int, path string) error {
+	// the clone keeps the filesystem (and any fuse server) alive
+	if err := unix.Unmount(path, unix.MNT_DETACH); err != nil {
+		return errors.Wrapf(err, "couldn't unmount %s", path)
+	}
+	if err := unix.MoveMount(fd, "", unix.AT_FDCWD, path, unix.MOVE_MOUNT_F_EMPTY_PATH); err != nil {
+		return errors.Wrapf(err, "couldn't mount idmapped %s", path)
+	}
+	return nil
+}
+
+// idmapAtoms idmaps every atom mount in targets, if all their filesystems
+// support it, and says whether they did. Nothing is changed if any don't.
+func idmapAtoms(targets []string, usernsFd int) (bool, error) {
+	fds := []int{}
+	defer func() {
+		for _, fd := range fds {
+			unix.Close(fd)
+		}
+	}()
+
+	for _, target := range targets {
+		fd, err := idmapClone(target, usernsFd)
+		if err == unix.EINVAL || err == unix.EOPNOTSUPP {
+			log.Infof("%s's filesystem can't be idmapped (%v)", target, err)
+			return false, nil
+		}
+		if err != nil {
+			return false, errors.Wrapf(err, "couldn't idmap %s", target)
+		}
+		fds = append(fds, fd)
+	}
+
+	kernel, err := common.RunningKernelVersion()
+	if err != nil {
+		return false, err
+	}
+	if !kernel.AtLeast(idmapLayersKernel) {
+		return false, errors.Errorf("overlay can't use idmapped atoms before kernel %s, this is %s", idmapLayersKernel, kernel)
+	}
+
+	for i, target := range targets {
+		if err := replaceMount(fds[i], target); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// idmapOverlay idmaps the overlay at dest, for when its atoms couldn't be.
+// Not every kernel lets overlayfs itself be idmapped.
+func idmapOverlay(dest string, usernsFd int) error {
+	fd, err := idmapClone(dest, usernsFd)
+	if err != nil {
+		return errors.Wrapf(err, "the atoms' filesystems can't be idmapped, and this kernel can't idmap the overlay at %s either", dest)
+	}
+	defer unix.Close(fd)
+	return replaceMount(fd, dest)
+}
@@ -0,0 +1,58 @@
+package molecule
+
+import (
+	"os"
+	"path/filepath"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"machinerun.io/atomfs/pkg/common"
+)
+
+// BlobsInUse returns the atom blobs that are mounted, mapped to what's
+// using them. They're found through the metadata of the molecules mounted
+// with metadirArg, in any mount namespace, and through the files backing
+// loop devices, which catches atoms mounted with other metadata dirs, or
+// not by atomfs at all.
+func BlobsInUse(metadirArg string) (map[string][]string, error) {
+	configs, err := filepath.Glob(filepath.Join(common.RuntimeDir(metadirArg), "meta", "*", "*", "config.json"))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	ret := map[string][]string{}
+	for _, c := range configs {
+		config, err := ReadMountOCIOpts(c)
+		if err != nil {
+			return nil, err
+		}
+		entries, err := os.ReadDir(filepath.Join(filepath.Dir(c), "mounts"))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, errors.WithStack(err)
+		}
+		for _, e := range entries {
+			// the atoms are mounted at their digests
+			if digest.NewDigestFromEncoded(digest.SHA256, e.Name()).Validate() != nil {
+				continue
+			}
+			blob := config.AtomsPath(e.Name())
+			ret[blob] = append(ret[blob], config.Target)
+			// or the shared copy it was mounted from
+			if stored := config.AtomPath(e.Name()); stored != blob {
+				ret[stored] = append(ret[stored], config.Target)
+			}
+		}
+	}
+
+	backing, err := common.LoopBackingFiles()
+	if err != nil {
+		return nil, err
+	}
+	for file, devs := range backing {
+		ret[file] = append(ret[file], devs...)
+	}
+	return ret, nil
+}
@@ -11,9 +11,13 @@ import (
 	"github.com/pkg/errors"
 	"golang.org/x/sys/unix"
 	"machinerun.io/atomfs/pkg/common"
+	"machinerun.io/atomfs/pkg/composefs"
 	"machinerun.io/atomfs/pkg/fs"
+	"machinerun.io/atomfs/pkg/fsverity"
+	"machinerun.io/atomfs/pkg/imagefs"
 	"machinerun.io/atomfs/pkg/log"
 	"machinerun.io/atomfs/pkg/mount"
+	types "machinerun.io/atomfs/pkg/types"
 	"machinerun.io/atomfs/pkg/verity"
 )
 
@@ -25,6 +29,14 @@ type Molecule struct {
 	config MountOCIOpts
 }
 
+// atomRootHash is the root hash a's annotations give it, if any.
+func atomRootHash(a ispec.Descriptor) string {
+	if rootHash := a.Annotations[verity.VerityRootHashAnnotation]; rootHash != "" {
+		return rootHash
+	}
+	return a.Annotations[verity.VerityRootHashAnnotation_Previous]
+}
+
 // MetadataDir: Return a metadir for this molecule.
 // Returns:
 //
@@ -64,11 +76,15 @@ func (m Molecule) mountUnderlyingAtoms() (error, func()) {
 	// in the case that we have a verity or other mount error we need to
 	// tear down the other underlying atoms so we don't leave verity and loop
 	// devices around unused.
-	atomsMounted := []string{}
+	type mountedAtom struct {
+		target string
+		fsi    types.Filesystem
+	}
+	atomsMounted := []mountedAtom{}
 	cleanupAtoms := func() {
-		for _, target := range atomsMounted {
-			if umountErr := common.Umount(target); umountErr != nil {
-				log.Warnf("cleanup: failed to unmount atom @ target %q: %s", target, umountErr)
+		for _, a := range atomsMounted {
+			if umountErr := a.fsi.Umount(a.target); umountErr != nil {
+				log.Warnf("cleanup: failed to unmount atom @ target %q: %s", a.target, umountErr)
 			}
 		}
 	}
@@ -80,19 +96,25 @@ func (m Molecule) mountUnderlyingAtoms() (error, func()) {
 			return errors.Wrapf(err, "failed to find mounted atoms path for %+v", a), cleanupAtoms
 		}
 
-		rootHash := a.Annotations[verity.VerityRootHashAnnotation]
+		rootHash := atomRootHash(a)
 
-		if rootHash == "" {
-			rootHash = a.Annotations[verity.VerityRootHashAnnotation_Previous]
-		}
+		_, hasFsverity := a.Annotations[fsverity.DigestAnnotation]
 
 		if !m.config.AllowMissingVerityData {
 
-			if rootHash == "" {
-				return errors.Errorf("%v has no root hash in %q or %q, see: %+v", a.Digest, verity.VerityRootHashAnnotation, verity.VerityRootHashAnnotation_Previous, a.Annotations), cleanupAtoms
+			// fs-verity protects the blob itself, whichever way it's mounted
+			if rootHash == "" && !hasFsverity {
+				return errors.Errorf("%v has no root hash in %q or %q, nor an fs-verity digest in %q, see: %+v", a.Digest, verity.VerityRootHashAnnotation, verity.VerityRootHashAnnotation_Previous, fsverity.DigestAnnotation, a.Annotations), cleanupAtoms
 			}
-			if !common.AmHostRoot() {
-				return errors.Errorf("won't guestmount an image with verity data without --allow-missing-verity"), cleanupAtoms
+		}
+
+		blob := m.config.AtomPath(a.Digest.Encoded())
+		lazy := m.config.AtomsRepository != "" && !common.PathExists(blob)
+
+		fsverityChecked := false
+		if !lazy {
+			if fsverityChecked, err = m.verifyFsverity(a); err != nil {
+				return err, cleanupAtoms
 			}
 		}
 
@@ -104,6 +126,20 @@ func (m Molecule) mountUnderlyingAtoms() (error, func()) {
 		mountpoint, mounted := mounts.FindMount(target)
 
 		if mounted {
+			if mountpoint.FSType == common.VerityFuseFSType {
+				// verified in userspace by the fuse server as it's read
+				if rootHash != "" && mountpoint.Source != common.VerityFuseSource(rootHash) {
+					return errors.Errorf("%s is already mounted with root hash %s, expected %s", target, mountpoint.Source, rootHash), cleanupAtoms
+				}
+				continue
+			}
+			if mountpoint.FSType == "overlay" {
+				// a composefs atom; its erofs image is what's on the
+				// verity device
+				if meta, ok := mounts.FindMount(composefs.MetaMountpoint(target)); ok {
+					mountpoint = meta
+				}
+			}
 			if rootHash != "" {
 				err = verity.ConfirmExistingVerityDeviceHash(mountpoint.Source,
 					rootHash,
@@ -119,26 +155,53 @@ func (m Molecule) mountUnderlyingAtoms() (error, func()) {
 			continue
 		}
 
+		// a lazily fetched atom is checked once it's all been fetched
+		check := m.config.DigestCheck
+		if !lazy && (check == DigestCheckAlways || (check == DigestCheckAuto && rootHash == "" && !fsverityChecked)) {
+			if err := m.verifyDigest(blob, a.Digest); err != nil {
+				return err, cleanupAtoms
+			}
+		}
+
 		if err := os.MkdirAll(target, 0755); err != nil {
 			return err, cleanupAtoms
 		}
 
-		fsi := fs.NewFromMediaType(a.MediaType)
-		if fsi == nil {
-			return errors.Errorf("unknown media-type %s", a.MediaType), cleanupAtoms
+		backend, err := fs.ForMediaType(a.MediaType)
+		if err != nil {
+			return err, cleanupAtoms
 		}
 
-		err = fsi.Mount(m.config.AtomsPath(a.Digest.Encoded()), target, rootHash)
+		fsi := backend.New()
+		if lazy {
+			err = mountLazy(backend, blob, target, rootHash, m.config.AtomsRepository)
+		} else {
+			err = fsi.Mount(blob, target, rootHash)
+		}
 		if err != nil {
 			return err, cleanupAtoms
 		}
 
-		atomsMounted = append(atomsMounted, target)
+		atomsMounted = append(atomsMounted, mountedAtom{target: target, fsi: fsi})
 	}
 
 	return nil, noop
 }
 
+// mountLazy mounts the atom that will be at blob once it's been fetched
+// from repo, with verityfuse fetching it as it's read. What's fetched is
+// only as good as the verity data it's checked against, so it needs a root
+// hash.
+func mountLazy(backend fs.Backend, blob, target, rootHash, repo string) error {
+	if rootHash == "" {
+		return errors.Errorf("%s isn't local, and can't be fetched from %s as it's read without a root hash", blob, repo)
+	}
+	if backend.NewReader == nil {
+		return errors.Errorf("%s atoms can't be fetched as they're read", backend.Name)
+	}
+	return common.GuestMount(blob, target, common.LazyVerityFuse(string(backend.Name), rootHash, repo))
+}
+
 // overlayArgs - returns a colon-separated string of dirs to be used as mount
 // options to pass to the kernel to actually mount this molecule.
 func (m Molecule) overlayLowerDirs() (string, error) {
@@ -239,6 +302,14 @@ func (m Molecule) Mount(dest string) error {
 		}
 	}()
 
+	var idmapUserns *os.File
+	if m.config.idmapped() {
+		if idmapUserns, err = m.config.idmapUserns(); err != nil {
+			return err
+		}
+		defer idmapUserns.Close()
+	}
+
 	err, cleanupUnderlyingAtoms := m.mountUnderlyingAtoms()
 	if err != nil {
 		return err
@@ -250,6 +321,23 @@ func (m Molecule) Mount(dest string) error {
 		}
 	}()
 
+	// idmap the atoms if we can, so the verity devices under them don't
+	// depend on the mapping; otherwise the overlay, once it's mounted
+	atomsIdmapped := false
+	if idmapUserns != nil {
+		targets := []string{}
+		for _, a := range m.Atoms {
+			target, err := m.MountedAtomsPath(a.Digest.Encoded())
+			if err != nil {
+				return err
+			}
+			targets = append(targets, target)
+		}
+		if atomsIdmapped, err = idmapAtoms(targets, int(idmapUserns.Fd())); err != nil {
+			return err
+		}
+	}
+
 	err = m.config.WriteToFile(filepath.Join(metadir, "config.json"))
 	if err != nil {
 		return err
@@ -299,7 +387,23 @@ func (m Molecule) Mount(dest string) error {
 
 	err = unix.Mount("overlay", dest, "overlay", 0, overlayArgs)
 	if err != nil {
-		return errors.Wrapf(err, "couldn't do overlay mount to %s, opts: %s", dest, overlayArgs)
+		// older kernels can't mount overlayfs in a user namespace
+		if common.AmHostRoot() {
+			return errors.Wrapf(err, "couldn't do overlay mount to %s, opts: %s", dest, overlayArgs)
+		}
+		log.Infof("overlay mount to %s failed (%v), trying fuse-overlayfs", dest, err)
+		if ferr := mountFuseOverlayfs(metadir, dest, overlayArgs); ferr != nil {
+			return errors.Wrapf(ferr, "couldn't do overlay mount to %s (%v), opts: %s", dest, err, overlayArgs)
+		}
+	}
+
+	if idmapUserns != nil && !atomsIdmapped {
+		if err := idmapOverlay(dest, int(idmapUserns.Fd())); err != nil {
+			if umountErr := unix.Unmount(dest, unix.MNT_DETACH); umountErr != nil {
+				log.Warnf("cleanup: failed to unmount overlay @ %q: %v", dest, umountErr)
+			}
+			return err
+		}
 	}
 
 	// ensure deferred cleanups become noops:
@@ -350,12 +454,29 @@ func UmountWithMetadir(dest, metadirArg string) error {
 
 	// Find all mountpoints underlying the current top Overlay MP
 	underlyingAtomRelPaths := []string{}
+	isFuseOverlay := false
 	for _, m := range mounts {
-		if m.FSType != "overlay" {
+		if m.Target != dest {
 			continue
 		}
 
-		if m.Target != dest {
+		if m.FSType == FuseOverlayfsType {
+			// fuse-overlayfs doesn't show its lowerdirs, but the atoms
+			// are all mounted in the metadir
+			isFuseOverlay = true
+			mountsdir, err := mol.MountedAtomsPath()
+			if err != nil {
+				return err
+			}
+			for _, am := range mounts {
+				if strings.HasPrefix(am.Target, mountsdir+"/") {
+					underlyingAtomRelPaths = append(underlyingAtomRelPaths, am.Target)
+				}
+			}
+			break
+		}
+
+		if m.FSType != "overlay" {
 			continue
 		}
 
@@ -381,7 +502,11 @@ func UmountWithMetadir(dest, metadirArg string) error {
 	}
 
 	// Unmount the top Overlay MP
-	if err := unix.Unmount(dest, 0); err != nil {
+	if isFuseOverlay {
+		if err := umountFuseOverlayfs(metadir, dest); err != nil {
+			return err
+		}
+	} else if err := unix.Unmount(dest, 0); err != nil {
 		return errors.Wrapf(err, "failed to unmount dest, %q", dest)
 	}
 
@@ -400,11 +525,26 @@ func UmountWithMetadir(dest, metadirArg string) error {
 			continue
 		}
 
-		backingDevice, err := common.GetBackingDevice(a)
-		if err != nil {
-			return err
+		atomMount, found := mounts.FindMount(a)
+		if !found {
+			return errors.Errorf("%s is not a mountpoint", a)
 		}
 		log.Debugf("Unmounting underlying atom =%q", a)
+		if common.IsFuseType(atomMount.FSType) {
+			// guest mounted, so there's no device, but maybe a daemon
+			if err := common.FuseUnmount(a, common.FuseDaemonFile(a)); err != nil {
+				return err
+			}
+			continue
+		}
+		if atomMount.FSType == "overlay" {
+			// a composefs atom, whose erofs image is mounted beside it
+			if err := composefs.Umount(a); err != nil {
+				return err
+			}
+			continue
+		}
+		backingDevice := atomMount.Source
 		if err := unix.Unmount(a, 0); err != nil {
 			return err
 		}
@@ -439,3 +579,33 @@ func UmountWithMetadir(dest, metadirArg string) error {
 
 	return nil
 }
+
+// Open returns the merged view of the molecule's atoms, read with the
+// pure-Go image readers so no privileges are needed. Each layer is named
+// after its atom's digest. The returned function closes the atoms.
+func (m Molecule) Open() (*imagefs.Overlay, func(), error) {
+	images := []imagefs.Image{}
+	closeAll := func() {
+		for _, i := range images {
+			i.Close()
+		}
+	}
+
+	layers := []imagefs.Layer{}
+	for _, a := range m.Atoms {
+		image, err := fs.OpenFromMediaType(a.MediaType, m.config.AtomPath(a.Digest.Encoded()))
+		if err != nil {
+			closeAll()
+			return nil, nil, errors.Wrapf(err, "couldn't open atom %s", a.Digest)
+		}
+		images = append(images, image)
+		layers = append(layers, imagefs.Layer{Name: a.Digest.String(), FS: image})
+	}
+
+	overlay, err := imagefs.NewOverlay(layers)
+	if err != nil {
+		closeAll()
+		return nil, nil, err
+	}
+	return overlay, closeAll, nil
+}
@@ -1,12 +1,25 @@
 package molecule
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	digest "github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci"
+	"github.com/opencontainers/umoci/oci/cas/dir"
 	"github.com/stretchr/testify/assert"
+	"machinerun.io/atomfs/pkg/common"
+	"machinerun.io/atomfs/pkg/fsverity"
+	"machinerun.io/atomfs/pkg/userns"
 )
 
 func TestAllowMissingVerityData(t *testing.T) {
@@ -24,3 +37,163 @@ func TestAllowMissingVerityData(t *testing.T) {
 	assert.NotNil(err)
 	assert.Contains(err.Error(), fmt.Sprintf("sha256:%s has no root hash", hash))
 }
+
+func TestVerifyFsverity(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	ocidir := t.TempDir()
+	const hash = "73cd1a9ab86defeb5e22151ceb96b347fc58b4318f64be05046c51d407a364eb"
+	opts := MountOCIOpts{OCIDir: ocidir}
+	assert.NoError(os.MkdirAll(opts.AtomsPath(), 0755))
+	assert.NoError(os.WriteFile(opts.AtomsPath(hash), []byte("atom"), 0644))
+
+	atom := ispec.Descriptor{Digest: digest.NewDigestFromEncoded(digest.Algorithm("sha256"), hash)}
+	mol := Molecule{config: opts}
+	checked, err := mol.verifyFsverity(atom)
+	assert.NoError(err)
+	assert.False(checked)
+
+	// the blob doesn't have fs-verity, where the annotation says it should
+	atom.Annotations = map[string]string{fsverity.DigestAnnotation: "00"}
+	_, err = mol.verifyFsverity(atom)
+	if !errors.Is(err, fsverity.ErrNotEnabled) {
+		assert.ErrorContains(err, "expected 00")
+		return
+	}
+	mol.config.AllowMissingVerityData = true
+	checked, err = mol.verifyFsverity(atom)
+	assert.NoError(err)
+	assert.False(checked)
+}
+
+func TestEnableFsverityChecksDigest(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	ocidir := filepath.Join(t.TempDir(), "oci")
+	assert.NoError(dir.Create(ocidir))
+	oci, err := umoci.OpenLayout(ocidir)
+	assert.NoError(err)
+	defer oci.Close()
+	put := func(content []byte) digest.Digest {
+		d, _, err := oci.PutBlob(context.Background(), bytes.NewReader(content))
+		assert.NoError(err)
+		return d
+	}
+	atom := put([]byte("atom"))
+	manifest, err := json.Marshal(ispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ispec.MediaTypeImageManifest,
+		Config:    ispec.Descriptor{MediaType: ispec.MediaTypeImageConfig, Digest: put([]byte("{}")), Size: 2},
+		Layers:    []ispec.Descriptor{{MediaType: "application/vnd.stacker.image.layer.squashfs", Digest: atom, Size: 4}},
+	})
+	assert.NoError(err)
+	assert.NoError(oci.UpdateReference(context.Background(), "v1", ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    put(manifest),
+		Size:      int64(len(manifest)),
+	}))
+
+	// the blob was tampered with before fs-verity would have stopped it
+	opts := MountOCIOpts{OCIDir: ocidir, Tag: "v1", MetadataDir: t.TempDir()}
+	blob := opts.AtomsPath(atom.Encoded())
+	assert.NoError(os.Chmod(blob, 0644))
+	assert.NoError(os.WriteFile(blob, []byte("bad!"), 0644))
+	_, err = EnableFsverity(opts)
+	assert.ErrorContains(err, "doesn't match its digest")
+	_, err = fsverity.Measure(blob)
+	assert.ErrorIs(err, fsverity.ErrNotEnabled)
+}
+
+func TestFuseOverlayfsOptions(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	assert.Equal("lowerdir=/a:/b", fuseOverlayfsOptions("lowerdir=/a:/b,"+OverlayMountOptions))
+	assert.Equal("lowerdir=/d:/a,upperdir=/p/persist,workdir=/p/work",
+		fuseOverlayfsOptions("lowerdir=/d:/a,upperdir=/p/persist,workdir=/p/work,"+OverlayMountOptions))
+}
+
+func TestIdmapped(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	assert.False(MountOCIOpts{}.idmapped())
+	assert.True(MountOCIOpts{IDMapUserns: "/proc/1/ns/user"}.idmapped())
+	assert.True(MountOCIOpts{UIDMappings: []userns.Mapping{{ContainerID: 0, HostID: 100000, Size: 65536}}}.idmapped())
+
+	_, err := MountOCIOpts{UIDMappings: []userns.Mapping{{ContainerID: 0, HostID: 100000, Size: 65536}}}.idmapUserns()
+	assert.Error(err)
+}
+
+func TestBlobsInUse(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	const hash = "73cd1a9ab86defeb5e22151ceb96b347fc58b4318f64be05046c51d407a364eb"
+	metadir := t.TempDir()
+	opts := MountOCIOpts{OCIDir: "/oci", Target: "/mnt", MetadataDir: metadir}
+	meta := filepath.Join(metadir, "meta", "4026531841", common.ReplacePathSeparators(opts.Target))
+	for _, d := range []string{hash, "workaround"} {
+		assert.NoError(os.MkdirAll(filepath.Join(meta, "mounts", d), 0755))
+	}
+	assert.NoError(opts.WriteToFile(filepath.Join(meta, "config.json")))
+
+	inUse, err := BlobsInUse(metadir)
+	assert.NoError(err)
+	assert.Equal([]string{"/mnt"}, inUse[opts.AtomsPath(hash)])
+	assert.NotContains(inUse, opts.AtomsPath("workaround"))
+}
+
+func TestAtomPath(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	const hash = "73cd1a9ab86defeb5e22151ceb96b347fc58b4318f64be05046c51d407a364eb"
+	opts := MountOCIOpts{OCIDir: t.TempDir(), AtomsStore: t.TempDir()}
+	assert.Equal(opts.AtomsPath(hash), opts.AtomPath(hash))
+
+	stored := filepath.Join(opts.AtomsStore, "sha256", hash)
+	assert.NoError(os.MkdirAll(filepath.Dir(stored), 0755))
+	assert.NoError(os.WriteFile(stored, []byte("atom"), 0644))
+	assert.Equal(stored, opts.AtomPath(hash))
+}
+
+func TestVerifyDigest(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	blob := filepath.Join(t.TempDir(), "blob")
+	assert.NoError(os.WriteFile(blob, []byte("atom"), 0644))
+	d := digest.FromString("atom")
+	mol := Molecule{config: MountOCIOpts{MetadataDir: t.TempDir()}}
+
+	assert.NoError(mol.verifyDigest(blob, d))
+	cached, err := filepath.Glob(filepath.Join(common.RuntimeDir(mol.config.MetadataDir), verifiedDigestsDir, "*.json"))
+	assert.NoError(err)
+	assert.Len(cached, 1)
+	assert.ErrorContains(mol.verifyDigest(blob, digest.FromString("other")), "doesn't match its digest")
+
+	// what's cached is hashed again if it's modified, even if its mtime is
+	// set back; the ctime only changes every clock tick
+	fi, err := os.Stat(blob)
+	assert.NoError(err)
+	time.Sleep(20 * time.Millisecond)
+	assert.NoError(os.WriteFile(blob, []byte("bad!"), 0644))
+	assert.NoError(os.Chtimes(blob, fi.ModTime(), fi.ModTime()))
+	assert.ErrorContains(mol.verifyDigest(blob, d), "doesn't match its digest")
+}
+
+func TestParseDigestCheck(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	for s, expected := range map[string]DigestCheck{"auto": DigestCheckAuto, "always": DigestCheckAlways, "never": DigestCheckNever} {
+		check, err := ParseDigestCheck(s)
+		assert.NoError(err)
+		assert.Equal(expected, check)
+	}
+	_, err := ParseDigestCheck("sometimes")
+	assert.Error(err)
+}
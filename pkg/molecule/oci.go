@@ -7,7 +7,9 @@ import (
 
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/opencontainers/umoci"
+	"machinerun.io/atomfs/pkg/common"
 	stackeroci "machinerun.io/atomfs/pkg/oci"
+	"machinerun.io/atomfs/pkg/userns"
 )
 
 type MountOCIOpts struct {
@@ -18,6 +20,24 @@ type MountOCIOpts struct {
 	WriteableOverlayPath   string
 	AllowMissingVerityData bool
 	MetadataDir            string
+	// IDMapUserns is a user namespace, e.g. /proc/PID/ns/user or
+	// /proc/self/fd/N for one held open, whose mappings the molecule is
+	// idmapped with so its files have the ownership they would in there.
+	IDMapUserns string `json:",omitempty"`
+	// UIDMappings and GIDMappings idmap the molecule with a user namespace
+	// made for the purpose, when IDMapUserns isn't set.
+	UIDMappings []userns.Mapping `json:",omitempty"`
+	GIDMappings []userns.Mapping `json:",omitempty"`
+	// AtomsRepository is an OCI distribution repository, e.g.
+	// https://registry.example.com/library/busybox, that atoms missing
+	// from OCIDir are fetched from as they're read, rather than up front.
+	AtomsRepository string `json:",omitempty"`
+	// AtomsStore is a directory of blobs shared by OCI layouts, laid out
+	// like their blobs dirs, that atoms are mounted from when it has them.
+	AtomsStore string `json:",omitempty"`
+	// DigestCheck says which atoms are checked against their digests
+	// before they're mounted.
+	DigestCheck DigestCheck `json:",omitempty"`
 }
 
 func (c MountOCIOpts) AtomsPath(parts ...string) string {
@@ -25,6 +45,17 @@ func (c MountOCIOpts) AtomsPath(parts ...string) string {
 	return path.Join(append([]string{atoms}, parts...)...)
 }
 
+// AtomPath is where the atom with the sha256 digest encoded is: in
+// AtomsStore if it's there, or in the layout otherwise.
+func (c MountOCIOpts) AtomPath(encoded string) string {
+	if c.AtomsStore != "" {
+		if stored := path.Join(c.AtomsStore, "sha256", encoded); common.PathExists(stored) {
+			return stored
+		}
+	}
+	return c.AtomsPath(encoded)
+}
+
 func (c MountOCIOpts) WriteToFile(filename string) error {
 	b, err := json.Marshal(c)
 	if err != nil {
@@ -58,6 +58,11 @@ func UpdateImageConfig(oci casext.Engine, name string, newConfig ispec.Image, ne
 		Size:      configSize,
 	}
 
+	return UpdateManifest(oci, name, newManifest)
+}
+
+// UpdateManifest points an oci tag at newManifest
+func UpdateManifest(oci casext.Engine, name string, newManifest ispec.Manifest) (ispec.Descriptor, error) {
 	manifestDigest, manifestSize, err := oci.PutBlobJSON(context.Background(), newManifest)
 	if err != nil {
 		return ispec.Descriptor{}, err
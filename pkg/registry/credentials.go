@@ -0,0 +1,135 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Credentials are what a registry is logged in to with.
+type Credentials struct {
+	Username string
+	Password string
+}
+
+// ParseCredentials parses username:password.
+func ParseCredentials(s string) (*Credentials, error) {
+	username, password, ok := strings.Cut(s, ":")
+	if !ok || username == "" {
+		return nil, errors.Errorf("bad credentials, expected username:password")
+	}
+	return &Credentials{Username: username, Password: password}, nil
+}
+
+// dockerConfig is the part of docker's config.json saying how to log in to
+// registries.
+type dockerConfig struct {
+	Auths map[string]struct {
+		Auth     string `json:"auth"`
+		Username string `json:"username"`
+		Password string `json:"password"`
+	} `json:"auths"`
+	CredsStore  string            `json:"credsStore"`
+	CredHelpers map[string]string `json:"credHelpers"`
+}
+
+// DockerConfigFile is where docker keeps its config.json: in $DOCKER_CONFIG,
+// or ~/.docker.
+func DockerConfigFile() string {
+	dir := os.Getenv("DOCKER_CONFIG")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(home, ".docker")
+	}
+	return filepath.Join(dir, "config.json")
+}
+
+// DockerCredentials returns the credentials `docker login` saved for host,
+// e.g. registry.example.com:5000, in DockerConfigFile, or nil if there are
+// none.
+func DockerCredentials(host string) (*Credentials, error) {
+	return dockerCredentials(DockerConfigFile(), host)
+}
+
+func dockerCredentials(configFile, host string) (*Credentials, error) {
+	content, err := os.ReadFile(configFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.WithStack(err)
+	}
+	var config dockerConfig
+	if err := json.Unmarshal(content, &config); err != nil {
+		return nil, errors.Wrapf(err, "bad %s", configFile)
+	}
+
+	if helper := config.CredHelpers[host]; helper != "" {
+		return credentialHelper(helper, host)
+	}
+	for key, auth := range config.Auths {
+		if authHost(key) != host {
+			continue
+		}
+		if auth.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+			if err != nil {
+				return nil, errors.Wrapf(err, "bad auth for %s in %s", key, configFile)
+			}
+			creds, err := ParseCredentials(string(decoded))
+			return creds, errors.Wrapf(err, "bad auth for %s in %s", key, configFile)
+		}
+		if auth.Username != "" {
+			return &Credentials{Username: auth.Username, Password: auth.Password}, nil
+		}
+	}
+	// the auths of hosts whose credentials are in the store are empty
+	if config.CredsStore != "" {
+		return credentialHelper(config.CredsStore, host)
+	}
+	return nil, nil
+}
+
+// authHost is the host a key of a docker config's auths is for; they may
+// be URLs, e.g. https://registry.example.com/v1/.
+func authHost(key string) string {
+	if _, rest, ok := strings.Cut(key, "://"); ok {
+		key = rest
+	}
+	host, _, _ := strings.Cut(key, "/")
+	return host
+}
+
+// credentialHelper gets the credentials for host from the docker
+// credential helper docker-credential-name, or nil if it has none.
+func credentialHelper(name, host string) (*Credentials, error) {
+	cmd := exec.Command("docker-credential-"+name, "get")
+	cmd.Stdin = strings.NewReader(host)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		// helpers say so on stdout
+		if strings.Contains(string(out), "credentials not found") {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "docker-credential-%s couldn't get the credentials for %s: %s", name, host, strings.TrimSpace(stderr.String()+string(out)))
+	}
+	var creds struct {
+		Username string `json:"Username"`
+		Secret   string `json:"Secret"`
+	}
+	if err := json.Unmarshal(out, &creds); err != nil {
+		return nil, errors.Wrapf(err, "bad credentials for %s from docker-credential-%s", host, name)
+	}
+	return &Credentials{Username: creds.Username, Password: creds.Secret}, nil
+}
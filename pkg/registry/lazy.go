@@ -0,0 +1,243 @@
+package registry
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"machinerun.io/atomfs/pkg/log"
+)
+
+// ChunkSize is how much of a blob is fetched at once.
+const ChunkSize = 1 << 20
+
+// PartialSuffix is appended to a blob's path for the cache of a blob that
+// hasn't been fetched entirely; ChunksSuffix for the record of which chunks
+// of it have been.
+const (
+	PartialSuffix = ".partial"
+	ChunksSuffix  = ".chunks"
+)
+
+// LazyBlob reads a blob from a registry, fetching chunks as they're first
+// read into a sparse local cache, where they're kept across restarts. Once
+// every chunk is there and the blob's digest checks out, the cache becomes
+// the blob at its path, as if it had been there all along.
+//
+// Nothing read is checked until then, so it should be read through
+// something that checks it, e.g. a verity.VerifiedReader.
+type LazyBlob struct {
+	repo   *Repository
+	digest digest.Digest
+	path   string
+	size   int64
+
+	mu     sync.Mutex
+	f      *os.File
+	chunks []byte // a bit per chunk, set once fetched; nil when complete
+}
+
+// OpenLazy opens the blob with digest d, whose local path is path, e.g.
+// ocidir/blobs/sha256/HEX, fetching what isn't there from repo. The chunk
+// holding the start of the blob, where filesystem superblocks are, is
+// fetched straight away.
+func OpenLazy(repo *Repository, d digest.Digest, path string) (*LazyBlob, error) {
+	if err := d.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "bad blob digest %q", d)
+	}
+	b := &LazyBlob{repo: repo, digest: d, path: path}
+
+	if f, err := os.Open(path); err == nil {
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, errors.WithStack(err)
+		}
+		b.f = f
+		b.size = fi.Size()
+		return b, nil
+	}
+
+	size, err := repo.BlobSize(d)
+	if err != nil {
+		return nil, err
+	}
+	b.size = size
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	f, err := os.OpenFile(path+PartialSuffix, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	b.f = f
+	if err := f.Truncate(size); err != nil {
+		b.Close()
+		return nil, errors.WithStack(err)
+	}
+
+	nchunks := (size + ChunkSize - 1) / ChunkSize
+	b.chunks = make([]byte, (nchunks+7)/8)
+	if saved, err := os.ReadFile(path + ChunksSuffix); err == nil && len(saved) == len(b.chunks) {
+		b.chunks = saved
+	}
+
+	if size > 0 {
+		b.mu.Lock()
+		err = b.fetch(0)
+		b.mu.Unlock()
+		if err != nil {
+			b.Close()
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// Path is where the blob is cached, which may be read directly for the
+// chunks that have been fetched.
+func (b *LazyBlob) Path() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.chunks == nil {
+		return b.path
+	}
+	return b.path + PartialSuffix
+}
+
+// Size is the size of the blob.
+func (b *LazyBlob) Size() int64 {
+	return b.size
+}
+
+// Complete says whether the whole blob is local.
+func (b *LazyBlob) Complete() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.chunks == nil
+}
+
+func (b *LazyBlob) have(chunk int64) bool {
+	return b.chunks == nil || b.chunks[chunk/8]&(1<<(chunk%8)) != 0
+}
+
+// fetch gets chunk from the registry, if it isn't already here. b.mu must
+// be held.
+func (b *LazyBlob) fetch(chunk int64) error {
+	if b.have(chunk) {
+		return nil
+	}
+	off := chunk * ChunkSize
+	buf := make([]byte, min(ChunkSize, b.size-off))
+	err := b.repo.ReadBlobAt(b.digest, buf, off)
+	if errors.Is(err, ErrRangeIgnored) {
+		log.Debugf("%s doesn't do range requests, fetching all of %s", b.repo.Base, b.digest)
+		return b.fetchAll()
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := b.f.WriteAt(buf, off); err != nil {
+		return errors.Wrapf(err, "couldn't cache blob %s", b.digest)
+	}
+	b.chunks[chunk/8] |= 1 << (chunk % 8)
+	if err := os.WriteFile(b.path+ChunksSuffix, b.chunks, 0644); err != nil {
+		log.Warnf("couldn't record the chunks of %s fetched: %v", b.digest, err)
+	}
+
+	for c := int64(0); c*ChunkSize < b.size; c++ {
+		if !b.have(c) {
+			return nil
+		}
+	}
+	b.finish()
+	return nil
+}
+
+// fetchAll gets the whole blob from the registry, for those that can't send
+// parts of it. b.mu must be held.
+func (b *LazyBlob) fetchAll() error {
+	resp, err := b.repo.do(http.MethodGet, b.repo.BlobURL(b.digest), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := checkStatus(resp, http.StatusOK); err != nil {
+		return errors.Wrapf(err, "couldn't get blob %s", b.digest)
+	}
+	n, err := io.Copy(io.NewOffsetWriter(b.f, 0), io.LimitReader(resp.Body, b.size))
+	if err != nil {
+		return errors.Wrapf(err, "couldn't cache blob %s", b.digest)
+	}
+	if n != b.size {
+		return errors.Errorf("blob %s from %s has %d bytes, expected %d", b.digest, b.repo.Base, n, b.size)
+	}
+
+	for i := range b.chunks {
+		b.chunks[i] = 0xff
+	}
+	if err := os.WriteFile(b.path+ChunksSuffix, b.chunks, 0644); err != nil {
+		log.Warnf("couldn't record the chunks of %s fetched: %v", b.digest, err)
+	}
+	b.finish()
+	return nil
+}
+
+// finish makes the fully fetched cache the blob, if its digest is right.
+// The cache is still good for reading through verity otherwise, so that
+// only gets logged.
+func (b *LazyBlob) finish() {
+	if _, err := b.f.Seek(0, io.SeekStart); err != nil {
+		log.Warnf("couldn't check %s: %v", b.digest, err)
+		return
+	}
+	got, err := b.digest.Algorithm().FromReader(b.f)
+	if err != nil {
+		log.Warnf("couldn't check %s: %v", b.digest, err)
+		return
+	}
+	if got != b.digest {
+		log.Warnf("blob %s fetched from %s has digest %s", b.digest, b.repo.Base, got)
+		return
+	}
+	if err := os.Rename(b.path+PartialSuffix, b.path); err != nil {
+		log.Warnf("couldn't move %s into place: %v", b.digest, err)
+		return
+	}
+	os.Remove(b.path + ChunksSuffix)
+	b.chunks = nil
+	log.Debugf("blob %s is now local", b.digest)
+}
+
+// ReadAt implements io.ReaderAt, fetching the chunks p covers first.
+func (b *LazyBlob) ReadAt(p []byte, off int64) (int, error) {
+	if off >= b.size {
+		return 0, io.EOF
+	}
+	end := min(off+int64(len(p)), b.size)
+
+	b.mu.Lock()
+	for c := off / ChunkSize; c*ChunkSize < end; c++ {
+		if err := b.fetch(c); err != nil {
+			b.mu.Unlock()
+			return 0, err
+		}
+	}
+	b.mu.Unlock()
+
+	n, err := b.f.ReadAt(p[:end-off], off)
+	if err == nil && n < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (b *LazyBlob) Close() error {
+	return b.f.Close()
+}
+
+var _ io.ReaderAt = &LazyBlob{}
@@ -0,0 +1,259 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+
+	digest "github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci"
+	"github.com/opencontainers/umoci/oci/cas/dir"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/pkg/errors"
+	"machinerun.io/atomfs/pkg/log"
+)
+
+// DefaultJobs is how many blobs are transferred at once by default.
+const DefaultJobs = 4
+
+// PullOptions configure Pull.
+type PullOptions struct {
+	// Jobs is how many blobs are downloaded at once; DefaultJobs if 0.
+	Jobs int
+	// NoReferrers skips the manifests, e.g. signatures, that refer to
+	// the image.
+	NoReferrers bool
+	// LocalOnly, if set, says whether atoms of a media type only work in
+	// the layout they were made in, e.g. composefs ones, whose objects
+	// aren't blobs. Images with them aren't pulled.
+	LocalOnly func(mediaType string) bool
+}
+
+// Pull fetches the image with tag or digest ref from repo into the OCI
+// layout at ocidir, creating it if need be, and tags it there as tag, so it
+// can be mounted offline. Blobs already in the layout aren't fetched again.
+// The manifests referring to the image are fetched too, and added to the
+// layout's index untagged. It returns the image's manifest descriptor.
+func Pull(repo *Repository, ref, ocidir, tag string, opts PullOptions) (ispec.Descriptor, error) {
+	if !casext.IsValidReferenceName(tag) {
+		return ispec.Descriptor{}, errors.Errorf("bad tag %q", tag)
+	}
+	if _, err := os.Stat(filepath.Join(ocidir, ispec.ImageLayoutFile)); os.IsNotExist(err) {
+		if err := dir.Create(ocidir); err != nil {
+			return ispec.Descriptor{}, errors.Wrapf(err, "couldn't create OCI layout %s", ocidir)
+		}
+	}
+	oci, err := umoci.OpenLayout(ocidir)
+	if err != nil {
+		return ispec.Descriptor{}, err
+	}
+	defer oci.Close()
+
+	p := &puller{repo: repo, oci: oci, ocidir: ocidir, opts: opts, seen: map[string]bool{}}
+	if p.opts.Jobs <= 0 {
+		p.opts.Jobs = DefaultJobs
+	}
+
+	desc, err := p.image(ref)
+	if err != nil {
+		return ispec.Descriptor{}, err
+	}
+	referrers := []ispec.Descriptor{}
+	if !opts.NoReferrers {
+		if referrers, err = p.referrers(desc); err != nil {
+			return ispec.Descriptor{}, err
+		}
+	}
+
+	if err := oci.UpdateReference(context.Background(), tag, desc); err != nil {
+		return ispec.Descriptor{}, errors.Wrapf(err, "couldn't tag %s", tag)
+	}
+	if err := addToIndex(oci, referrers); err != nil {
+		return ispec.Descriptor{}, err
+	}
+	return desc, nil
+}
+
+type puller struct {
+	repo   *Repository
+	oci    casext.Engine
+	ocidir string
+	opts   PullOptions
+	// manifests already fetched, so referrers can't loop
+	seen map[string]bool
+}
+
+// image fetches the manifest ref and the blobs it refers to. For an index,
+// that's the manifest for this platform.
+func (p *puller) image(ref string) (ispec.Descriptor, error) {
+	content, desc, err := p.manifest(ref)
+	if err != nil {
+		return ispec.Descriptor{}, err
+	}
+	if desc.MediaType != ispec.MediaTypeImageIndex {
+		return desc, nil
+	}
+
+	var index ispec.Index
+	if err := json.Unmarshal(content, &index); err != nil {
+		return ispec.Descriptor{}, errors.Wrapf(err, "bad index %s", ref)
+	}
+	for _, m := range index.Manifests {
+		if m.Platform == nil || (m.Platform.OS == runtime.GOOS && m.Platform.Architecture == runtime.GOARCH) {
+			if _, _, err := p.manifest(m.Digest.String()); err != nil {
+				return ispec.Descriptor{}, err
+			}
+			return m, nil
+		}
+	}
+	return ispec.Descriptor{}, errors.Errorf("%s has no image for %s/%s", ref, runtime.GOOS, runtime.GOARCH)
+}
+
+// manifest fetches the manifest or index ref into the layout and, for a
+// manifest, its config and layers.
+func (p *puller) manifest(ref string) ([]byte, ispec.Descriptor, error) {
+	content, desc, err := p.repo.GetManifest(ref)
+	if err != nil {
+		return nil, ispec.Descriptor{}, err
+	}
+	p.seen[desc.Digest.String()] = true
+	if _, _, err := p.oci.PutBlob(context.Background(), bytes.NewReader(content)); err != nil {
+		return nil, ispec.Descriptor{}, errors.Wrapf(err, "couldn't store manifest %s", desc.Digest)
+	}
+	if desc.MediaType == ispec.MediaTypeImageIndex {
+		return content, desc, nil
+	}
+
+	var manifest ispec.Manifest
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		return nil, ispec.Descriptor{}, errors.Wrapf(err, "bad manifest %s", ref)
+	}
+	if err := checkLocalOnly(ref, manifest, p.opts.LocalOnly); err != nil {
+		return nil, ispec.Descriptor{}, err
+	}
+	if err := p.blobs(append([]ispec.Descriptor{manifest.Config}, manifest.Layers...)); err != nil {
+		return nil, ispec.Descriptor{}, err
+	}
+	return content, desc, nil
+}
+
+// checkLocalOnly fails if one of the layers of manifest, ref, is one that
+// localOnly says can't be moved between layouts.
+func checkLocalOnly(ref string, manifest ispec.Manifest, localOnly func(string) bool) error {
+	if localOnly == nil {
+		return nil
+	}
+	for _, l := range manifest.Layers {
+		if localOnly(l.MediaType) {
+			return errors.Errorf("%s has a %s atom, %s, which only works in the layout it was made in", ref, l.MediaType, l.Digest)
+		}
+	}
+	return nil
+}
+
+// blobs downloads those of descs not already in the layout, opts.Jobs at
+// a time.
+func (p *puller) blobs(descs []ispec.Descriptor) error {
+	todo := []ispec.Descriptor{}
+	queued := map[string]bool{}
+	for _, d := range descs {
+		if d.Size == 0 && d.Digest == "" {
+			continue
+		}
+		if err := d.Digest.Validate(); err != nil {
+			return errors.Wrapf(err, "bad blob digest %q", d.Digest)
+		}
+		if queued[d.Digest.String()] {
+			continue
+		}
+		queued[d.Digest.String()] = true
+		if _, err := os.Stat(p.blobPath(d)); err == nil {
+			log.Debugf("already have blob %s", d.Digest)
+			continue
+		}
+		todo = append(todo, d)
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, p.opts.Jobs)
+	errs := make([]error, len(todo))
+	for i, d := range todo {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, d ispec.Descriptor) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			log.Debugf("fetching blob %s (%d bytes)", d.Digest, d.Size)
+			errs[i] = p.repo.FetchBlob(d, p.blobPath(d))
+		}(i, d)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *puller) blobPath(d ispec.Descriptor) string {
+	return layoutBlobPath(p.ocidir, d.Digest)
+}
+
+// layoutBlobPath is where the blob with digest d is in the OCI layout at
+// ocidir.
+func layoutBlobPath(ocidir string, d digest.Digest) string {
+	return filepath.Join(ocidir, ispec.ImageBlobsDir, d.Algorithm().String(), d.Encoded())
+}
+
+// referrers fetches the manifests referring to desc, and those referring
+// to them, returning their descriptors.
+func (p *puller) referrers(desc ispec.Descriptor) ([]ispec.Descriptor, error) {
+	refs, err := p.repo.Referrers(desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+	ret := []ispec.Descriptor{}
+	for _, r := range refs {
+		if p.seen[r.Digest.String()] {
+			continue
+		}
+		if _, _, err := p.manifest(r.Digest.String()); err != nil {
+			return nil, errors.Wrapf(err, "couldn't fetch referrer %s of %s", r.Digest, desc.Digest)
+		}
+		more, err := p.referrers(r)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(append(ret, r), more...)
+	}
+	return ret, nil
+}
+
+// addToIndex adds the manifests descs to the layout's index, if they're not
+// there already, so they're found and kept.
+func addToIndex(oci casext.Engine, descs []ispec.Descriptor) error {
+	if len(descs) == 0 {
+		return nil
+	}
+	index, err := oci.GetIndex(context.Background())
+	if err != nil {
+		return errors.Wrapf(err, "couldn't read index")
+	}
+	have := map[string]bool{}
+	for _, m := range index.Manifests {
+		have[m.Digest.String()] = true
+	}
+	for _, d := range descs {
+		if !have[d.Digest.String()] {
+			index.Manifests = append(index.Manifests, d)
+			have[d.Digest.String()] = true
+		}
+	}
+	return errors.Wrapf(oci.PutIndex(context.Background(), index), "couldn't update index")
+}
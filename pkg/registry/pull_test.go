@@ -0,0 +1,191 @@
+package registry
+
+import (
+	"context"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci"
+	"github.com/stretchr/testify/assert"
+	stackeroci "machinerun.io/atomfs/pkg/oci"
+)
+
+const testAtomMediaType = "application/vnd.stacker.image.layer.squashfs+zstd+verity"
+
+// addTestImage adds an image of two atoms tagged as tag, and a signature
+// of it, returning the image's manifest, its descriptor and the
+// signature's.
+func addTestImage(t *testing.T, reg *testRegistry, tag string) (ispec.Manifest, ispec.Descriptor, ispec.Descriptor) {
+	rnd := rand.New(rand.NewSource(1))
+	atoms := []ispec.Descriptor{}
+	for _, size := range []int{3 * ChunkSize, 1000} {
+		b := make([]byte, size)
+		rnd.Read(b)
+		atom := reg.addBlob(testAtomMediaType, b)
+		atom.Annotations = map[string]string{"io.stackeroci.stacker.atomfs_verity_root_hash": "00"}
+		atoms = append(atoms, atom)
+	}
+	manifest := ispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ispec.MediaTypeImageManifest,
+		Config:    reg.addBlob(ispec.MediaTypeImageConfig, []byte(`{"architecture":"amd64","os":"linux"}`)),
+		Layers:    atoms,
+	}
+	desc := reg.addManifest(t, tag, ispec.MediaTypeImageManifest, manifest)
+
+	signature := reg.addManifest(t, "", ispec.MediaTypeImageManifest, ispec.Manifest{
+		Versioned:    specs.Versioned{SchemaVersion: 2},
+		MediaType:    ispec.MediaTypeImageManifest,
+		ArtifactType: "application/vnd.example.signature",
+		Config:       reg.addBlob(ispec.MediaTypeEmptyJSON, []byte("{}")),
+		Layers:       []ispec.Descriptor{reg.addBlob("application/vnd.example.signature", []byte("signed"))},
+		Subject:      &desc,
+	})
+	signature.ArtifactType = "application/vnd.example.signature"
+	return manifest, desc, signature
+}
+
+func TestPull(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	reg := newTestRegistry(t)
+	manifest, desc, signature := addTestImage(t, reg, "v1")
+
+	ocidir := filepath.Join(t.TempDir(), "oci")
+	pulled, err := Pull(reg.repo(t), "v1", ocidir, "mine", PullOptions{})
+	assert.NoError(err)
+	assert.Equal(desc.Digest, pulled.Digest)
+	// config, atoms, and the signature's config and layer
+	assert.Equal(5, reg.blobGets)
+
+	oci, err := umoci.OpenLayout(ocidir)
+	assert.NoError(err)
+	defer oci.Close()
+	local, err := stackeroci.LookupManifest(oci, "mine")
+	assert.NoError(err)
+	assert.Equal(manifest.Layers, local.Layers)
+	for _, l := range local.Layers {
+		assert.FileExists(layoutBlobPath(ocidir, l.Digest))
+	}
+
+	// the signature is kept, untagged
+	index, err := oci.GetIndex(context.Background())
+	assert.NoError(err)
+	assert.Len(index.Manifests, 2)
+	assert.Equal(signature.Digest, index.Manifests[1].Digest)
+	assert.Equal("application/vnd.example.signature", index.Manifests[1].ArtifactType)
+	assert.FileExists(layoutBlobPath(ocidir, signature.Digest))
+
+	// nothing's fetched twice
+	_, err = Pull(reg.repo(t), desc.Digest.String(), ocidir, "again", PullOptions{})
+	assert.NoError(err)
+	assert.Equal(5, reg.blobGets)
+	index, err = oci.GetIndex(context.Background())
+	assert.NoError(err)
+	assert.Len(index.Manifests, 3)
+	// images with atoms that only work in the layout they were made in
+	// aren't pulled
+	localOnly := func(mediaType string) bool { return mediaType == testAtomMediaType }
+	_, err = Pull(reg.repo(t), "v1", filepath.Join(t.TempDir(), "oci"), "v1", PullOptions{LocalOnly: localOnly})
+	assert.ErrorContains(err, "only works in the layout it was made in")
+	assert.Equal(5, reg.blobGets)
+}
+
+func TestPullCredentials(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	for _, bearer := range []bool{false, true} {
+		reg := newTestRegistry(t)
+		reg.creds = &Credentials{Username: "me", Password: "secret"}
+		reg.bearer = bearer
+		_, desc, _ := addTestImage(t, reg, "v1")
+		ocidir := filepath.Join(t.TempDir(), "oci")
+
+		anonymous, wrong := "needs credentials", "401 Unauthorized"
+		if bearer {
+			anonymous, wrong = "couldn't get a token", "couldn't get a token for "+reg.URL+"/v2/test as me"
+		}
+		_, err := Pull(reg.repo(t), "v1", ocidir, "v1", PullOptions{})
+		assert.ErrorContains(err, anonymous)
+		repo := reg.repo(t)
+		repo.Credentials = &Credentials{Username: "me", Password: "wrong"}
+		_, err = Pull(repo, "v1", ocidir, "v1", PullOptions{})
+		assert.ErrorContains(err, wrong)
+
+		repo = reg.repo(t)
+		repo.Credentials = reg.creds
+		pulled, err := Pull(repo, "v1", ocidir, "v1", PullOptions{})
+		assert.NoError(err, "bearer %v", bearer)
+		assert.Equal(desc.Digest, pulled.Digest)
+	}
+}
+
+func TestPullResume(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	reg := newTestRegistry(t)
+	manifest, _, _ := addTestImage(t, reg, "v1")
+	big := manifest.Layers[0]
+
+	// an interrupted download of the big atom
+	ocidir := filepath.Join(t.TempDir(), "oci")
+	assert.NoError(os.MkdirAll(filepath.Dir(layoutBlobPath(ocidir, big.Digest)), 0755))
+	assert.NoError(os.WriteFile(filepath.Join(ocidir, ispec.ImageLayoutFile), []byte(`{"imageLayoutVersion":"1.0.0"}`), 0644))
+	assert.NoError(os.WriteFile(filepath.Join(ocidir, "index.json"), []byte(`{"schemaVersion":2,"manifests":[]}`), 0644))
+	partial := reg.blobs[big.Digest][:ChunkSize]
+	assert.NoError(os.WriteFile(layoutBlobPath(ocidir, big.Digest)+PartialSuffix, partial, 0644))
+
+	_, err := Pull(reg.repo(t), "v1", ocidir, "v1", PullOptions{Jobs: 1, NoReferrers: true})
+	assert.NoError(err)
+	assert.Contains(reg.ranges, "bytes=1048576-")
+	content, err := os.ReadFile(layoutBlobPath(ocidir, big.Digest))
+	assert.NoError(err)
+	assert.Equal(reg.blobs[big.Digest], content)
+	assert.NoFileExists(layoutBlobPath(ocidir, big.Digest) + PartialSuffix)
+}
+
+func TestPullChecksDigests(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	reg := newTestRegistry(t)
+	reg.noReferrersAPI = true
+	manifest, _, _ := addTestImage(t, reg, "v1")
+	small := manifest.Layers[1]
+	reg.blobs[small.Digest] = make([]byte, small.Size)
+
+	ocidir := filepath.Join(t.TempDir(), "oci")
+	_, err := Pull(reg.repo(t), "v1", ocidir, "v1", PullOptions{})
+	assert.ErrorContains(err, small.Digest.String())
+	assert.NoFileExists(layoutBlobPath(ocidir, small.Digest))
+	assert.NoFileExists(layoutBlobPath(ocidir, small.Digest) + PartialSuffix)
+
+	_, err = Pull(reg.repo(t), "v2", ocidir, "v1", PullOptions{})
+	assert.ErrorIs(err, ErrNotFound)
+}
+
+func TestPullReferrersFallback(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	reg := newTestRegistry(t)
+	reg.noReferrersAPI = true
+	_, desc, signature := addTestImage(t, reg, "v1")
+	reg.addManifest(t, desc.Digest.Algorithm().String()+"-"+desc.Digest.Encoded(), ispec.MediaTypeImageIndex, ispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ispec.MediaTypeImageIndex,
+		Manifests: []ispec.Descriptor{signature},
+	})
+
+	ocidir := filepath.Join(t.TempDir(), "oci")
+	_, err := Pull(reg.repo(t), "v1", ocidir, "v1", PullOptions{})
+	assert.NoError(err)
+	assert.FileExists(layoutBlobPath(ocidir, signature.Digest))
+}
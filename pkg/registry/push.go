@@ -0,0 +1,430 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/pkg/errors"
+	"machinerun.io/atomfs/pkg/log"
+)
+
+// DefaultRetries is how many times a failed upload is tried again by
+// default, the first time after DefaultRetryDelay, doubling after that.
+const (
+	DefaultRetries    = 3
+	DefaultRetryDelay = time.Second
+)
+
+// PushOptions configure Push.
+type PushOptions struct {
+	// Jobs is how many blobs are uploaded at once; DefaultJobs if 0.
+	Jobs int
+	// ChunkSize, if not 0, is the most uploaded in each request, for
+	// registries or proxies that limit request sizes.
+	ChunkSize int64
+	// MountFrom are other repositories on the registry that blobs are
+	// mounted from, rather than uploaded, if they have them.
+	MountFrom []string
+	// Referrers pushes the manifests in the layout, e.g. signatures,
+	// that refer to the image as well.
+	Referrers bool
+	// Retries is how many times a transfer that failed in a way that
+	// might not happen again is retried; DefaultRetries if 0, and none if
+	// negative. RetryDelay is how long to wait before the first retry;
+	// DefaultRetryDelay if 0.
+	Retries    int
+	RetryDelay time.Duration
+	// LocalOnly, if set, says whether atoms of a media type only work in
+	// the layout they were made in, as for PullOptions. Images with them
+	// aren't pushed.
+	LocalOnly func(mediaType string) bool
+}
+
+// Push uploads the image tagged tag in the OCI layout at ocidir to repo as
+// ref, a tag or the manifest's digest. The manifest is pushed as it is, so
+// its atoms keep their media types and verity annotations. Blobs the
+// repository already has aren't uploaded again. It returns the image's
+// manifest descriptor.
+func Push(ocidir, tag string, repo *Repository, ref string, opts PushOptions) (ispec.Descriptor, error) {
+	oci, err := umoci.OpenLayout(ocidir)
+	if err != nil {
+		return ispec.Descriptor{}, err
+	}
+	defer oci.Close()
+
+	descs, err := oci.ResolveReference(context.Background(), tag)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrapf(err, "couldn't find %s", tag)
+	}
+	if len(descs) == 0 {
+		return ispec.Descriptor{}, errors.Errorf("couldn't find %s", tag)
+	}
+	if len(descs) != 1 {
+		return ispec.Descriptor{}, errors.Errorf("bad descriptor %s", tag)
+	}
+	desc := descs[0].Descriptor()
+	desc.Annotations = nil
+	if desc.MediaType != ispec.MediaTypeImageManifest {
+		return ispec.Descriptor{}, errors.Errorf("%s is a %s, not an image manifest", tag, desc.MediaType)
+	}
+
+	p := &pusher{repo: repo, oci: oci, ocidir: ocidir, opts: opts, seen: map[digest.Digest]bool{}}
+	if p.opts.Jobs <= 0 {
+		p.opts.Jobs = DefaultJobs
+	}
+	if p.opts.Retries == 0 {
+		p.opts.Retries = DefaultRetries
+	}
+	if p.opts.RetryDelay == 0 {
+		p.opts.RetryDelay = DefaultRetryDelay
+	}
+
+	if err := p.manifest(desc, ref); err != nil {
+		return ispec.Descriptor{}, err
+	}
+	if opts.Referrers {
+		if err := p.referrers(desc); err != nil {
+			return ispec.Descriptor{}, err
+		}
+	}
+	return desc, nil
+}
+
+type pusher struct {
+	repo   *Repository
+	oci    casext.Engine
+	ocidir string
+	opts   PushOptions
+	// manifests already pushed, so referrers can't loop
+	seen map[digest.Digest]bool
+}
+
+// manifest pushes the blobs of the manifest desc and then it, as ref.
+func (p *pusher) manifest(desc ispec.Descriptor, ref string) error {
+	p.seen[desc.Digest] = true
+	content, err := os.ReadFile(layoutBlobPath(p.ocidir, desc.Digest))
+	if err != nil {
+		return errors.Wrapf(err, "couldn't read manifest %s", desc.Digest)
+	}
+	var manifest ispec.Manifest
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		return errors.Wrapf(err, "bad manifest %s", desc.Digest)
+	}
+	if err := checkLocalOnly(ref, manifest, p.opts.LocalOnly); err != nil {
+		return err
+	}
+
+	blobs := append([]ispec.Descriptor{manifest.Config}, manifest.Layers...)
+	if err := p.blobs(blobs); err != nil {
+		return err
+	}
+
+	var handled bool
+	err = p.retry(fmt.Sprintf("pushing manifest %s", desc.Digest), func() error {
+		handled, err = p.repo.PutManifest(ref, desc.MediaType, content)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if manifest.Subject == nil || handled {
+		return nil
+	}
+
+	// the registry doesn't know about referrers, so they're listed in an
+	// index tagged after the subject, as the distribution spec says
+	desc.ArtifactType = manifest.ArtifactType
+	if desc.ArtifactType == "" {
+		desc.ArtifactType = manifest.Config.MediaType
+	}
+	desc.Annotations = manifest.Annotations
+	return p.retry(fmt.Sprintf("listing referrer %s", desc.Digest), func() error {
+		return p.repo.addFallbackReferrer(manifest.Subject.Digest, desc)
+	})
+}
+
+// blobs pushes descs, opts.Jobs at a time.
+func (p *pusher) blobs(descs []ispec.Descriptor) error {
+	todo := []ispec.Descriptor{}
+	queued := map[digest.Digest]bool{}
+	for _, d := range descs {
+		if !queued[d.Digest] {
+			queued[d.Digest] = true
+			todo = append(todo, d)
+		}
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, p.opts.Jobs)
+	errs := make([]error, len(todo))
+	for i, d := range todo {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, d ispec.Descriptor) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			errs[i] = p.retry(fmt.Sprintf("pushing blob %s", d.Digest), func() error {
+				return p.repo.PushBlob(d, layoutBlobPath(p.ocidir, d.Digest), p.opts.MountFrom, p.opts.ChunkSize)
+			})
+		}(i, d)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// referrers pushes the manifests in the layout's index whose subject is
+// desc, and those referring to them.
+func (p *pusher) referrers(desc ispec.Descriptor) error {
+	index, err := p.oci.GetIndex(context.Background())
+	if err != nil {
+		return errors.Wrapf(err, "couldn't read index")
+	}
+	for _, m := range index.Manifests {
+		if m.MediaType != ispec.MediaTypeImageManifest || p.seen[m.Digest] {
+			continue
+		}
+		content, err := os.ReadFile(layoutBlobPath(p.ocidir, m.Digest))
+		if err != nil {
+			return errors.Wrapf(err, "couldn't read manifest %s", m.Digest)
+		}
+		var manifest ispec.Manifest
+		if err := json.Unmarshal(content, &manifest); err != nil || manifest.Subject == nil || manifest.Subject.Digest != desc.Digest {
+			continue
+		}
+		m.Annotations = nil
+		if err := p.manifest(m, m.Digest.String()); err != nil {
+			return errors.Wrapf(err, "couldn't push referrer %s of %s", m.Digest, desc.Digest)
+		}
+		if err := p.referrers(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// retry calls f until it succeeds, fails in a way that would happen again,
+// or has been retried opts.Retries times.
+func (p *pusher) retry(what string, f func() error) error {
+	delay := p.opts.RetryDelay
+	for attempt := 0; ; attempt++ {
+		err := f()
+		if err == nil || attempt >= p.opts.Retries || !temporary(err) {
+			return err
+		}
+		log.Infof("%s failed, retrying in %s: %v", what, delay, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// temporary says whether err might not happen if the request were made
+// again: a timeout, the connection being refused or reset, or the registry
+// being overloaded or broken. Other errors, like a name that doesn't
+// resolve or a certificate that doesn't verify, would just happen again.
+func temporary(err error) bool {
+	var se *StatusError
+	if errors.As(err, &se) {
+		return se.StatusCode >= http.StatusInternalServerError || se.StatusCode == http.StatusTooManyRequests
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET)
+}
+
+// HasBlob says whether the repository has the blob with digest d.
+func (r *Repository) HasBlob(d digest.Digest) (bool, error) {
+	resp, err := r.do(http.MethodHead, r.BlobURL(d), nil)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	if err := checkStatus(resp, http.StatusOK); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// PushBlob uploads the blob desc describes from path, unless the
+// repository has it already. If one of the repositories from, on the same
+// registry, has it, it's mounted from there instead. It's uploaded in
+// chunks of chunkSize if that's not 0.
+func (r *Repository) PushBlob(desc ispec.Descriptor, path string, from []string, chunkSize int64) error {
+	if ok, err := r.HasBlob(desc.Digest); err != nil || ok {
+		return err
+	}
+
+	location := ""
+	for _, name := range from {
+		q := url.Values{"mount": {desc.Digest.String()}, "from": {name}}
+		resp, err := r.do(http.MethodPost, r.Base+"/blobs/uploads/?"+q.Encode(), nil)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusCreated {
+			log.Debugf("mounted blob %s from %s", desc.Digest, name)
+			return nil
+		}
+		if err := checkStatus(resp, http.StatusAccepted); err != nil {
+			return errors.Wrapf(err, "couldn't mount blob %s from %s", desc.Digest, name)
+		}
+		// the registry started an upload instead, which is used if
+		// none of the others have it; those left unused expire
+		if location, err = uploadLocation(resp); err != nil {
+			return err
+		}
+	}
+	if location == "" {
+		resp, err := r.do(http.MethodPost, r.Base+"/blobs/uploads/", nil)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if err := checkStatus(resp, http.StatusAccepted); err != nil {
+			return errors.Wrapf(err, "couldn't start uploading blob %s", desc.Digest)
+		}
+		if location, err = uploadLocation(resp); err != nil {
+			return err
+		}
+	}
+
+	section := func(off, n int64) func() (io.ReadCloser, error) {
+		return func() (io.ReadCloser, error) {
+			f, err := os.Open(path)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			return struct {
+				io.Reader
+				io.Closer
+			}{io.NewSectionReader(f, off, n), f}, nil
+		}
+	}
+
+	if chunkSize <= 0 || desc.Size <= chunkSize {
+		return r.finishUpload(desc, location, section(0, desc.Size), desc.Size)
+	}
+	for off := int64(0); off < desc.Size; off += chunkSize {
+		n := min(chunkSize, desc.Size-off)
+		resp, err := r.doBody(http.MethodPatch, location, http.Header{
+			"Content-Type":  {"application/octet-stream"},
+			"Content-Range": {fmt.Sprintf("%d-%d", off, off+n-1)},
+		}, section(off, n), n)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if err := checkStatus(resp, http.StatusAccepted); err != nil {
+			return errors.Wrapf(err, "couldn't upload blob %s", desc.Digest)
+		}
+		if location, err = uploadLocation(resp); err != nil {
+			return err
+		}
+	}
+	return r.finishUpload(desc, location, nil, 0)
+}
+
+// finishUpload completes the upload at location with body, the rest of the
+// blob desc describes.
+func (r *Repository) finishUpload(desc ispec.Descriptor, location string, body func() (io.ReadCloser, error), size int64) error {
+	u, err := url.Parse(location)
+	if err != nil {
+		return errors.Wrapf(err, "bad upload location %q", location)
+	}
+	q := u.Query()
+	q.Set("digest", desc.Digest.String())
+	u.RawQuery = q.Encode()
+
+	resp, err := r.doBody(http.MethodPut, u.String(), http.Header{"Content-Type": {"application/octet-stream"}}, body, size)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return errors.Wrapf(checkStatus(resp, http.StatusCreated), "couldn't upload blob %s", desc.Digest)
+}
+
+// uploadLocation is where the upload resp is about continues.
+func uploadLocation(resp *http.Response) (string, error) {
+	loc := resp.Header.Get("Location")
+	if loc == "" {
+		return "", errors.Errorf("%s %s didn't say where to upload to", resp.Request.Method, resp.Request.URL)
+	}
+	u, err := resp.Request.URL.Parse(loc)
+	if err != nil {
+		return "", errors.Wrapf(err, "bad upload location %q", loc)
+	}
+	return u.String(), nil
+}
+
+// PutManifest uploads the manifest or index content as ref, a tag or its
+// digest. It says whether the registry took note of the manifest's subject,
+// if it has one, for the referrers API.
+func (r *Repository) PutManifest(ref, mediaType string, content []byte) (bool, error) {
+	resp, err := r.doBody(http.MethodPut, r.ManifestURL(ref), http.Header{"Content-Type": {mediaType}},
+		func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(content)), nil }, int64(len(content)))
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	if err := checkStatus(resp, http.StatusCreated); err != nil {
+		return false, errors.Wrapf(err, "couldn't push manifest %s", ref)
+	}
+	return resp.Header.Get("OCI-Subject") != "", nil
+}
+
+// addFallbackReferrer adds desc to the index listing the referrers of
+// subject, for registries without the referrers API.
+func (r *Repository) addFallbackReferrer(subject digest.Digest, desc ispec.Descriptor) error {
+	tag := subject.Algorithm().String() + "-" + subject.Encoded()
+	index := ispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ispec.MediaTypeImageIndex,
+		Manifests: []ispec.Descriptor{},
+	}
+	content, _, err := r.GetManifest(tag)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(content, &index); err != nil {
+			return errors.Wrapf(err, "bad referrers index %s", tag)
+		}
+	case !errors.Is(err, ErrNotFound):
+		return err
+	}
+	for _, m := range index.Manifests {
+		if m.Digest == desc.Digest {
+			return nil
+		}
+	}
+	index.Manifests = append(index.Manifests, desc)
+	content, err = json.Marshal(index)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	_, err = r.PutManifest(tag, ispec.MediaTypeImageIndex, content)
+	return err
+}
@@ -0,0 +1,201 @@
+package registry
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// pulledTestImage makes an OCI layout with the test image tagged as v1 and
+// its signature, returning its path, the image's manifest, its descriptor
+// and the signature's.
+func pulledTestImage(t *testing.T) (string, ispec.Manifest, ispec.Descriptor, ispec.Descriptor) {
+	reg := newTestRegistry(t)
+	manifest, desc, signature := addTestImage(t, reg, "v1")
+	ocidir := filepath.Join(t.TempDir(), "oci")
+	_, err := Pull(reg.repo(t), "v1", ocidir, "v1", PullOptions{})
+	assert.NoError(t, err)
+	return ocidir, manifest, desc, signature
+}
+
+func TestPush(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	ocidir, manifest, desc, signature := pulledTestImage(t)
+	reg := newTestRegistry(t)
+	pushed, err := Push(ocidir, "v1", reg.repo(t), "v2", PushOptions{Referrers: true})
+	assert.NoError(err)
+	assert.Equal(desc.Digest, pushed.Digest)
+	// config, atoms, and the signature's config and layer
+	assert.Equal(5, reg.blobPuts)
+	assert.Zero(reg.patches)
+
+	// the manifest is pushed as it is, with the atoms' media types and
+	// annotations
+	content, pushedDesc, err := reg.repo(t).GetManifest("v2")
+	assert.NoError(err)
+	assert.Equal(desc.Digest, pushedDesc.Digest)
+	var got ispec.Manifest
+	assert.NoError(json.Unmarshal(content, &got))
+	assert.Equal(manifest.Layers, got.Layers)
+	for _, l := range got.Layers {
+		assert.Equal(testAtomMediaType, l.MediaType)
+		assert.Contains(reg.blobs, l.Digest)
+	}
+
+	refs, err := reg.repo(t).Referrers(desc.Digest)
+	assert.NoError(err)
+	assert.Len(refs, 1)
+	assert.Equal(signature.Digest, refs[0].Digest)
+
+	// nothing's uploaded twice
+	_, err = Push(ocidir, "v1", reg.repo(t), "v3", PushOptions{Referrers: true})
+	assert.NoError(err)
+	assert.Equal(5, reg.blobPuts)
+
+	_, err = Push(ocidir, "v2", reg.repo(t), "v3", PushOptions{})
+	assert.ErrorContains(err, "couldn't find v2")
+	// nor are images with atoms that only work in this layout
+	localOnly := func(mediaType string) bool { return mediaType == testAtomMediaType }
+	other := newTestRegistry(t)
+	_, err = Push(ocidir, "v1", other.repo(t), "v1", PushOptions{LocalOnly: localOnly})
+	assert.ErrorContains(err, "only works in the layout it was made in")
+	assert.Zero(other.blobPuts)
+}
+
+func TestPushCredentials(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	ocidir, manifest, desc, _ := pulledTestImage(t)
+	for _, bearer := range []bool{false, true} {
+		reg := newTestRegistry(t)
+		reg.creds = &Credentials{Username: "me", Password: "secret"}
+		reg.bearer = bearer
+
+		_, err := Push(ocidir, "v1", reg.repo(t), "v1", PushOptions{Retries: -1})
+		assert.Error(err, "bearer %v", bearer)
+		assert.Zero(reg.blobPuts)
+
+		// with tokens, the one for checking which blobs it has isn't
+		// enough to upload them
+		repo := reg.repo(t)
+		repo.Credentials = reg.creds
+		pushed, err := Push(ocidir, "v1", repo, "v1", PushOptions{})
+		assert.NoError(err, "bearer %v", bearer)
+		assert.Equal(desc.Digest, pushed.Digest)
+		for _, l := range manifest.Layers {
+			assert.Contains(reg.blobs, l.Digest)
+		}
+	}
+}
+
+func TestPushChunked(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	ocidir, manifest, _, _ := pulledTestImage(t)
+	reg := newTestRegistry(t)
+	_, err := Push(ocidir, "v1", reg.repo(t), "v1", PushOptions{ChunkSize: ChunkSize, Jobs: 1})
+	assert.NoError(err)
+	// the big atom in three chunks, the rest in one request each
+	assert.Equal(3, reg.patches)
+	assert.Equal(3, reg.blobPuts)
+	for _, l := range manifest.Layers {
+		assert.Contains(reg.blobs, l.Digest)
+	}
+	// no referrers unless asked for
+	assert.Len(reg.manifests, 2)
+}
+
+func TestPushMount(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	ocidir, manifest, _, _ := pulledTestImage(t)
+	reg := newTestRegistry(t)
+	big := manifest.Layers[0]
+	reg.mountable[big.Digest] = []byte("whatever other has")
+
+	_, err := Push(ocidir, "v1", reg.repo(t), "v1", PushOptions{MountFrom: []string{"missing", "other"}})
+	assert.NoError(err)
+	assert.Equal(1, reg.mounts)
+	assert.Equal(2, reg.blobPuts)
+	assert.Equal([]byte("whatever other has"), reg.blobs[big.Digest])
+}
+
+func TestPushRetries(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	ocidir, _, desc, _ := pulledTestImage(t)
+	reg := newTestRegistry(t)
+	reg.failures = 1
+	_, err := Push(ocidir, "v1", reg.repo(t), "v1", PushOptions{Retries: -1})
+	var se *StatusError
+	assert.True(errors.As(err, &se))
+	assert.Equal(http.StatusServiceUnavailable, se.StatusCode)
+
+	reg.failures = 3
+	_, err = Push(ocidir, "v1", reg.repo(t), "v1", PushOptions{Jobs: 1, RetryDelay: time.Millisecond})
+	assert.NoError(err)
+	assert.Contains(reg.manifests, desc.Digest.String())
+}
+
+func TestTemporary(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	dial := func(err error) error {
+		return &url.Error{Op: "Put", URL: "https://registry.example/v2/", Err: &net.OpError{Op: "dial", Net: "tcp", Err: err}}
+	}
+
+	for _, err := range []error{
+		&StatusError{StatusCode: http.StatusServiceUnavailable},
+		&StatusError{StatusCode: http.StatusTooManyRequests},
+		&url.Error{Op: "Put", URL: "https://registry.example/v2/", Err: context.DeadlineExceeded},
+		dial(os.NewSyscallError("connect", syscall.ECONNREFUSED)),
+		dial(os.NewSyscallError("read", syscall.ECONNRESET)),
+	} {
+		assert.True(temporary(err), "%v", err)
+	}
+
+	for _, err := range []error{
+		&StatusError{StatusCode: http.StatusNotFound},
+		dial(&net.DNSError{Err: "no such host", Name: "registry.example", IsNotFound: true}),
+		&url.Error{Op: "Put", URL: "https://registry.example/v2/", Err: x509.UnknownAuthorityError{}},
+		errors.New("digest mismatch"),
+	} {
+		assert.False(temporary(err), "%v", err)
+	}
+}
+
+func TestPushReferrersFallback(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	ocidir, _, desc, signature := pulledTestImage(t)
+	reg := newTestRegistry(t)
+	reg.noReferrersAPI = true
+	_, err := Push(ocidir, "v1", reg.repo(t), "v1", PushOptions{Referrers: true})
+	assert.NoError(err)
+
+	refs, err := reg.repo(t).Referrers(desc.Digest)
+	assert.NoError(err)
+	assert.Len(refs, 1)
+	assert.Equal(signature.Digest, refs[0].Digest)
+	assert.Equal("application/vnd.example.signature", refs[0].ArtifactType)
+}
@@ -0,0 +1,490 @@
+// Package registry talks to OCI distribution endpoints, so atoms can be
+// read from a registry rather than a local OCI layout.
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	digest "github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// ErrNotFound is returned when the registry doesn't have what's asked for.
+var ErrNotFound = errors.New("not found")
+
+// ErrRangeIgnored is returned by ReadBlobAt when the registry answers with
+// the whole blob rather than the part asked for; it's better fetched in one
+// go then.
+var ErrRangeIgnored = errors.New("registry ignored the range requested")
+
+// maxManifestSize is the most of a manifest or index that's read; the
+// distribution spec says registries may refuse ones bigger than 4MiB.
+const maxManifestSize = 4 << 20
+
+// Repository is a repository on an OCI distribution endpoint, e.g.
+// https://registry.example.com/library/busybox.
+type Repository struct {
+	// Base is the URL of the repository's API, e.g.
+	// https://registry.example.com/v2/library/busybox
+	Base   string
+	Client *http.Client
+	// Credentials, if set, are sent to registries that ask for them, and
+	// to get tokens with; without them, only anonymous tokens are asked
+	// for.
+	Credentials *Credentials
+
+	mu    sync.Mutex
+	token string
+	// basic says the registry asked for the credentials themselves
+	basic bool
+}
+
+// ParseRepository parses [scheme://]host[:port]/name. Without a scheme,
+// https is used.
+func ParseRepository(ref string) (*Repository, error) {
+	if !strings.Contains(ref, "://") {
+		ref = "https://" + ref
+	}
+	u, err := url.Parse(ref)
+	if err != nil {
+		return nil, errors.Wrapf(err, "bad repository %q", ref)
+	}
+	name := strings.Trim(u.Path, "/")
+	if u.Host == "" || name == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, errors.Errorf("bad repository %q, expected [scheme://]host[:port]/name", ref)
+	}
+	return &Repository{Base: fmt.Sprintf("%s://%s/v2/%s", u.Scheme, u.Host, name), Client: http.DefaultClient}, nil
+}
+
+// ParseReference parses [scheme://]host[:port]/name[:tag|@digest] into
+// the repository and the tag or digest, which defaults to latest.
+func ParseReference(ref string) (*Repository, string, error) {
+	repo, tag := ref, "latest"
+	if i := strings.LastIndex(ref, "@"); i >= 0 {
+		repo, tag = ref[:i], ref[i+1:]
+		if _, err := digest.Parse(tag); err != nil {
+			return nil, "", errors.Wrapf(err, "bad digest in %q", ref)
+		}
+	} else if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+		repo, tag = ref[:i], ref[i+1:]
+	}
+	r, err := ParseRepository(repo)
+	if err != nil {
+		return nil, "", err
+	}
+	return r, tag, nil
+}
+
+// Host is the host, and port if there is one, of the registry the
+// repository is on.
+func (r *Repository) Host() string {
+	u, err := url.Parse(r.Base)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+// ManifestURL is where the manifest with tag or digest ref is.
+func (r *Repository) ManifestURL(ref string) string {
+	return r.Base + "/manifests/" + ref
+}
+
+// BlobURL is where the blob with digest d is.
+func (r *Repository) BlobURL(d digest.Digest) string {
+	return r.Base + "/blobs/" + d.String()
+}
+
+// BlobSize returns the size of the blob with digest d.
+func (r *Repository) BlobSize(d digest.Digest) (int64, error) {
+	resp, err := r.do(http.MethodHead, r.BlobURL(d), nil)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, errors.Errorf("couldn't find blob %s: %s", d, resp.Status)
+	}
+	if resp.ContentLength < 0 {
+		return 0, errors.Errorf("%s didn't say how big blob %s is", r.Base, d)
+	}
+	return resp.ContentLength, nil
+}
+
+// ReadBlobAt reads len(p) bytes of the blob with digest d, starting at off.
+// It fails with ErrRangeIgnored if the registry doesn't do range requests.
+func (r *Repository) ReadBlobAt(d digest.Digest, p []byte, off int64) error {
+	if len(p) == 0 {
+		return nil
+	}
+	resp, err := r.do(http.MethodGet, r.BlobURL(d), http.Header{
+		"Range": {fmt.Sprintf("bytes=%d-%d", off, off+int64(len(p))-1)},
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// rather than reading up to off, which reading the whole
+		// blob a part at a time would do again and again
+		return errors.Wrapf(ErrRangeIgnored, "couldn't read blob %s at %d", d, off)
+	default:
+		return errors.Errorf("couldn't read blob %s at %d: %s", d, off, resp.Status)
+	}
+	if _, err := io.ReadFull(resp.Body, p); err != nil {
+		return errors.Wrapf(err, "couldn't read blob %s at %d", d, off)
+	}
+	return nil
+}
+
+// manifestMediaTypes are the manifests GetManifest accepts.
+var manifestMediaTypes = []string{
+	ispec.MediaTypeImageManifest,
+	ispec.MediaTypeImageIndex,
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+}
+
+// GetManifest fetches the manifest or index with tag or digest ref,
+// returning its content and a descriptor of it. Content fetched by digest
+// is checked against it.
+func (r *Repository) GetManifest(ref string) ([]byte, ispec.Descriptor, error) {
+	resp, err := r.do(http.MethodGet, r.ManifestURL(ref), http.Header{
+		"Accept": {strings.Join(manifestMediaTypes, ", ")},
+	})
+	if err != nil {
+		return nil, ispec.Descriptor{}, err
+	}
+	defer resp.Body.Close()
+	if err := checkStatus(resp, http.StatusOK); err != nil {
+		return nil, ispec.Descriptor{}, errors.Wrapf(err, "couldn't get manifest %s", ref)
+	}
+	content, err := io.ReadAll(io.LimitReader(resp.Body, maxManifestSize+1))
+	if err != nil {
+		return nil, ispec.Descriptor{}, errors.Wrapf(err, "couldn't read manifest %s", ref)
+	}
+	if len(content) > maxManifestSize {
+		return nil, ispec.Descriptor{}, errors.Errorf("manifest %s is too big", ref)
+	}
+
+	desc := ispec.Descriptor{
+		MediaType: resp.Header.Get("Content-Type"),
+		Digest:    digest.FromBytes(content),
+		Size:      int64(len(content)),
+	}
+	var m struct {
+		MediaType string `json:"mediaType"`
+	}
+	if err := json.Unmarshal(content, &m); err == nil && m.MediaType != "" {
+		desc.MediaType = m.MediaType
+	}
+	if d, err := digest.Parse(ref); err == nil {
+		if got := d.Algorithm().FromBytes(content); got != d {
+			return nil, ispec.Descriptor{}, errors.Errorf("manifest %s has digest %s", ref, got)
+		}
+		desc.Digest = d
+	}
+	return content, desc, nil
+}
+
+// Referrers returns the descriptors of the manifests, e.g. signatures,
+// whose subject is the manifest with digest d. Registries without the
+// referrers API are asked for the index tagged as the fallback scheme
+// says, sha256-HEX.
+func (r *Repository) Referrers(d digest.Digest) ([]ispec.Descriptor, error) {
+	resp, err := r.do(http.MethodGet, r.Base+"/referrers/"+d.String(), http.Header{
+		"Accept": {ispec.MediaTypeImageIndex},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var index ispec.Index
+	switch resp.StatusCode {
+	case http.StatusOK:
+		if err := json.NewDecoder(io.LimitReader(resp.Body, maxManifestSize)).Decode(&index); err != nil {
+			return nil, errors.Wrapf(err, "bad referrers of %s", d)
+		}
+	case http.StatusNotFound:
+		content, _, err := r.GetManifest(d.Algorithm().String() + "-" + d.Encoded())
+		if errors.Is(err, ErrNotFound) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(content, &index); err != nil {
+			return nil, errors.Wrapf(err, "bad referrers of %s", d)
+		}
+	default:
+		return nil, errors.Wrapf(checkStatus(resp, http.StatusOK), "couldn't get referrers of %s", d)
+	}
+	return index.Manifests, nil
+}
+
+// FetchBlob downloads the blob desc describes to path, checking its size
+// and digest. A download that was interrupted is resumed from where it got
+// to.
+func (r *Repository) FetchBlob(desc ispec.Descriptor, path string) error {
+	partial := path + PartialSuffix
+	if _, err := os.Stat(path + ChunksSuffix); err == nil {
+		// a LazyBlob's sparse cache, not the start of the blob
+		os.Remove(partial)
+		os.Remove(path + ChunksSuffix)
+	}
+	f, err := os.OpenFile(partial, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+
+	restart := func() (digest.Digester, error) {
+		if err := f.Truncate(0); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return desc.Digest.Algorithm().Digester(), nil
+	}
+
+	digester := desc.Digest.Algorithm().Digester()
+	have, err := io.Copy(digester.Hash(), f)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't read %s", partial)
+	}
+	if have > desc.Size {
+		if digester, err = restart(); err != nil {
+			return err
+		}
+		have = 0
+	}
+
+	if have < desc.Size {
+		header := http.Header{}
+		if have > 0 {
+			header.Set("Range", fmt.Sprintf("bytes=%d-", have))
+		}
+		resp, err := r.do(http.MethodGet, r.BlobURL(desc.Digest), header)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		switch {
+		case resp.StatusCode == http.StatusPartialContent && have > 0:
+		case resp.StatusCode == http.StatusOK:
+			if have > 0 {
+				if digester, err = restart(); err != nil {
+					return err
+				}
+				have = 0
+			}
+		default:
+			return errors.Wrapf(checkStatus(resp, http.StatusOK), "couldn't get blob %s", desc.Digest)
+		}
+		n, err := io.Copy(io.MultiWriter(f, digester.Hash()), io.LimitReader(resp.Body, desc.Size-have+1))
+		if err != nil {
+			return errors.Wrapf(err, "couldn't download blob %s", desc.Digest)
+		}
+		have += n
+	}
+
+	if have != desc.Size || digester.Digest() != desc.Digest {
+		os.Remove(partial)
+		return errors.Errorf("blob %s downloaded from %s has %d bytes with digest %s, expected %d", desc.Digest, r.Base, have, digester.Digest(), desc.Size)
+	}
+	if err := f.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Rename(partial, path))
+}
+
+// StatusError is a response with an unexpected status.
+type StatusError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Status     string
+	Message    string
+}
+
+func (e *StatusError) Error() string {
+	return strings.TrimSpace(fmt.Sprintf("%s %s: %s %s", e.Method, e.URL, e.Status, e.Message))
+}
+
+// checkStatus returns an error, wrapping ErrNotFound for 404s and a
+// *StatusError otherwise, unless resp has one of the statuses want.
+func checkStatus(resp *http.Response, want ...int) error {
+	for _, w := range want {
+		if resp.StatusCode == w {
+			return nil
+		}
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return errors.Wrapf(ErrNotFound, "%s %s", resp.Request.Method, resp.Request.URL)
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return errors.WithStack(&StatusError{
+		Method:     resp.Request.Method,
+		URL:        resp.Request.URL.String(),
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		Message:    strings.TrimSpace(string(msg)),
+	})
+}
+
+// do makes a request, authenticating first if the registry asks.
+func (r *Repository) do(method, url string, header http.Header) (*http.Response, error) {
+	return r.doBody(method, url, header, nil, 0)
+}
+
+// doBody is do for a request with a body of size bytes, which body opens;
+// it may be called again if the request needs to be.
+func (r *Repository) doBody(method, url string, header http.Header, body func() (io.ReadCloser, error), size int64) (*http.Response, error) {
+	// send makes the request with token, or r's if that's empty
+	send := func(token string) (*http.Response, error) {
+		req, err := http.NewRequest(method, url, nil)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if body != nil {
+			if req.Body, err = body(); err != nil {
+				return nil, err
+			}
+			req.GetBody = body
+			req.ContentLength = size
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		r.mu.Lock()
+		if token == "" {
+			token = r.token
+		}
+		basic := r.basic
+		r.mu.Unlock()
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		} else if basic {
+			req.SetBasicAuth(r.Credentials.Username, r.Credentials.Password)
+		}
+		resp, err := r.Client.Do(req)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s %s failed", method, url)
+		}
+		return resp, nil
+	}
+
+	resp, err := send("")
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	challenge := resp.Header.Get("Www-Authenticate")
+	resp.Body.Close()
+	// another request may get a token for a different scope, e.g. pull
+	// rather than push, before this one is made again
+	token, err := r.authenticate(challenge)
+	if err != nil {
+		return nil, err
+	}
+	return send(token)
+}
+
+// authenticate answers a registry's challenge: for Basic, by sending
+// r.Credentials from then on, and for Bearer by getting a token as it
+// describes, with r.Credentials if there are any, see
+// https://distribution.github.io/distribution/spec/auth/token/, which it
+// returns.
+func (r *Repository) authenticate(challenge string) (string, error) {
+	scheme, params, _ := strings.Cut(challenge, " ")
+	if strings.EqualFold(scheme, "Basic") {
+		if r.Credentials == nil {
+			return "", errors.Errorf("%s needs credentials, and there are none", r.Base)
+		}
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.basic = true
+		return "", nil
+	}
+	if !strings.EqualFold(scheme, "Bearer") {
+		return "", errors.Errorf("%s needs %q authentication, which isn't supported", r.Base, scheme)
+	}
+	attrs := challengeParams(params)
+	realm, err := url.Parse(attrs["realm"])
+	if err != nil || attrs["realm"] == "" {
+		return "", errors.Errorf("%s sent a bad challenge %q", r.Base, challenge)
+	}
+	q := realm.Query()
+	for _, k := range []string{"service", "scope"} {
+		if attrs[k] != "" {
+			q.Set(k, attrs[k])
+		}
+	}
+	realm.RawQuery = q.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	if r.Credentials != nil {
+		req.SetBasicAuth(r.Credentials.Username, r.Credentials.Password)
+	}
+	resp, err := r.Client.Do(req)
+	if err != nil {
+		return "", errors.Wrapf(err, "couldn't get a token for %s", r.Base)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		if r.Credentials != nil {
+			return "", errors.Errorf("couldn't get a token for %s as %s: %s", r.Base, r.Credentials.Username, resp.Status)
+		}
+		return "", errors.Errorf("couldn't get a token for %s: %s", r.Base, resp.Status)
+	}
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", errors.Wrapf(err, "bad token for %s", r.Base)
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.token = token.Token
+	return token.Token, nil
+}
+
+// challengeParams parses the key=value parameters of a challenge, which are
+// separated by commas; quoted values may have commas in them, e.g. scopes
+// with several actions, like repository:name:pull,push.
+func challengeParams(params string) map[string]string {
+	attrs := map[string]string{}
+	for {
+		params = strings.TrimLeft(params, " ,")
+		k, rest, ok := strings.Cut(params, "=")
+		if !ok {
+			return attrs
+		}
+		var v string
+		if quoted, ok := strings.CutPrefix(rest, `"`); ok {
+			v, params, _ = strings.Cut(quoted, `"`)
+		} else {
+			v, params, _ = strings.Cut(rest, ",")
+		}
+		attrs[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+}
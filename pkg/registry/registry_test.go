@@ -0,0 +1,277 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRepository(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	r, err := ParseRepository("registry.example.com/library/busybox")
+	assert.NoError(err)
+	assert.Equal("https://registry.example.com/v2/library/busybox", r.Base)
+	r, err = ParseRepository("http://127.0.0.1:5000/atoms/")
+	assert.NoError(err)
+	assert.Equal("http://127.0.0.1:5000/v2/atoms", r.Base)
+
+	for _, bad := range []string{"registry.example.com", "ftp://host/repo", "https:///repo"} {
+		_, err := ParseRepository(bad)
+		assert.Error(err, bad)
+	}
+
+	r, tag, err := ParseReference("127.0.0.1:5000/atoms")
+	assert.NoError(err)
+	assert.Equal("https://127.0.0.1:5000/v2/atoms", r.Base)
+	assert.Equal("latest", tag)
+	r, tag, err = ParseReference("http://127.0.0.1:5000/my/atoms:v1.2")
+	assert.NoError(err)
+	assert.Equal("http://127.0.0.1:5000/v2/my/atoms", r.Base)
+	assert.Equal("v1.2", tag)
+	d := digest.FromString("atom")
+	_, tag, err = ParseReference("registry.example.com/atoms@" + d.String())
+	assert.NoError(err)
+	assert.Equal(d.String(), tag)
+	_, _, err = ParseReference("registry.example.com/atoms@sha256:nope")
+	assert.Error(err)
+}
+
+func TestLazyBlob(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	data := make([]byte, 2*ChunkSize+ChunkSize/2)
+	rand.New(rand.NewSource(1)).Read(data)
+	d := digest.FromBytes(data)
+	small := []byte("small atom")
+	reg := newTestRegistry(t)
+	reg.addBlob("", data)
+	reg.addBlob("", small)
+	repo := reg.repo(t)
+
+	path := filepath.Join(t.TempDir(), "blobs", "sha256", d.Encoded())
+	b, err := OpenLazy(repo, d, path)
+	assert.NoError(err)
+	assert.EqualValues(len(data), b.Size())
+	assert.Equal(path+PartialSuffix, b.Path())
+	// just the superblock's chunk
+	assert.EqualValues(1, reg.blobGets)
+
+	p := make([]byte, 10)
+	_, err = b.ReadAt(p, 2*ChunkSize+5)
+	assert.NoError(err)
+	assert.Equal(data[2*ChunkSize+5:2*ChunkSize+15], p)
+	assert.EqualValues(2, reg.blobGets)
+	assert.False(b.Complete())
+	assert.NoFileExists(path)
+	b.Close()
+
+	// what's been fetched is still there after a restart
+	b, err = OpenLazy(repo, d, path)
+	assert.NoError(err)
+	_, err = b.ReadAt(p, 2*ChunkSize+5)
+	assert.NoError(err)
+	assert.EqualValues(2, reg.blobGets)
+
+	all, err := io.ReadAll(io.NewSectionReader(b, 0, b.Size()))
+	assert.NoError(err)
+	assert.Equal(data, all)
+	assert.EqualValues(3, reg.blobGets)
+	assert.True(b.Complete())
+	b.Close()
+
+	// once it's all there it's a blob like any other
+	content, err := os.ReadFile(path)
+	assert.NoError(err)
+	assert.Equal(data, content)
+	assert.NoFileExists(path + PartialSuffix)
+	assert.NoFileExists(path + ChunksSuffix)
+	b, err = OpenLazy(repo, d, path)
+	assert.NoError(err)
+	assert.Equal(path, b.Path())
+	b.Close()
+
+	// a blob of a single chunk is all there once opened
+	path = filepath.Join(t.TempDir(), digest.FromBytes(small).Encoded())
+	b, err = OpenLazy(repo, digest.FromBytes(small), path)
+	assert.NoError(err)
+	assert.True(b.Complete())
+	assert.Equal(path, b.Path())
+	b.Close()
+
+	_, err = OpenLazy(repo, digest.FromString("missing"), filepath.Join(t.TempDir(), "missing"))
+	assert.Error(err)
+}
+
+func TestLazyBlobIgnoredRanges(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	data := make([]byte, 2*ChunkSize+ChunkSize/2)
+	rand.New(rand.NewSource(1)).Read(data)
+	d := digest.FromBytes(data)
+	reg := newTestRegistry(t)
+	reg.ignoreRanges = true
+	reg.addBlob("", data)
+	repo := reg.repo(t)
+
+	// the first chunk's request gets everything, so it's all fetched
+	// at once rather than once per chunk
+	path := filepath.Join(t.TempDir(), d.Encoded())
+	b, err := OpenLazy(repo, d, path)
+	assert.NoError(err)
+	defer b.Close()
+	assert.EqualValues(2, reg.blobGets)
+	assert.True(b.Complete())
+	assert.Equal(path, b.Path())
+
+	all, err := io.ReadAll(io.NewSectionReader(b, 0, b.Size()))
+	assert.NoError(err)
+	assert.Equal(data, all)
+	assert.EqualValues(2, reg.blobGets)
+	assert.NoFileExists(path + ChunksSuffix)
+}
+
+func TestLazyBlobWrongDigest(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	// the registry serves other content under the digest
+	d := digest.FromString("expected")
+	reg := newTestRegistry(t)
+	reg.blobs[d] = []byte("something else")
+	repo := reg.repo(t)
+
+	path := filepath.Join(t.TempDir(), d.Encoded())
+	b, err := OpenLazy(repo, d, path)
+	assert.NoError(err)
+	defer b.Close()
+	assert.False(b.Complete())
+	assert.NoFileExists(path)
+}
+
+func TestAuthenticate(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	blob := []byte("atom")
+	d := digest.FromBytes(blob)
+	var srv *httptest.Server
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("scope") != "repository:test:pull" {
+			http.Error(w, "bad scope", http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, `{"token": "secret"}`)
+	})
+	mux.HandleFunc("/v2/test/blobs/"+d.String(), func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.Header().Set("Www-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test",scope="repository:test:pull"`, srv.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(blob))
+	})
+	srv = httptest.NewServer(mux)
+	defer srv.Close()
+
+	repo, err := ParseRepository(srv.URL + "/test")
+	assert.NoError(err)
+	size, err := repo.BlobSize(d)
+	assert.NoError(err)
+	assert.EqualValues(len(blob), size)
+	p := make([]byte, 2)
+	assert.NoError(repo.ReadBlobAt(d, p, 2))
+	assert.Equal("om", string(p))
+}
+
+func TestChallengeParams(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	assert.Equal(map[string]string{
+		"realm":   "https://auth.example.com/token",
+		"service": "registry.example.com",
+		"scope":   "repository:library/busybox:pull,push",
+		"error":   "insufficient_scope",
+	}, challengeParams(`realm="https://auth.example.com/token",service="registry.example.com", scope="repository:library/busybox:pull,push",error=insufficient_scope`))
+	assert.Empty(challengeParams(""))
+}
+
+func TestDockerCredentials(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	config := filepath.Join(t.TempDir(), "config.json")
+	creds, err := dockerCredentials(config, "registry.example.com")
+	assert.NoError(err)
+	assert.Nil(creds)
+
+	assert.NoError(os.WriteFile(config, []byte(`{"auths": {
+		"registry.example.com": {"auth": "`+base64.StdEncoding.EncodeToString([]byte("me:se:cret"))+`"},
+		"https://other.example.com:5000/v1/": {"username": "you", "password": "pw"},
+		"bad.example.com": {"auth": "bm9wZQ=="}
+	}}`), 0600))
+	creds, err = dockerCredentials(config, "registry.example.com")
+	assert.NoError(err)
+	assert.Equal(&Credentials{Username: "me", Password: "se:cret"}, creds)
+	creds, err = dockerCredentials(config, "other.example.com:5000")
+	assert.NoError(err)
+	assert.Equal(&Credentials{Username: "you", Password: "pw"}, creds)
+	creds, err = dockerCredentials(config, "other.example.com")
+	assert.NoError(err)
+	assert.Nil(creds)
+	_, err = dockerCredentials(config, "bad.example.com")
+	assert.ErrorContains(err, "bad auth for bad.example.com")
+
+	_, err = ParseCredentials("nopassword")
+	assert.Error(err)
+}
+
+// TestDockerCredentialHelpers isn't parallel, as it sets PATH.
+func TestDockerCredentialHelpers(t *testing.T) {
+	assert := assert.New(t)
+
+	bin := t.TempDir()
+	assert.NoError(os.WriteFile(filepath.Join(bin, "docker-credential-test"), []byte(`#!/bin/sh
+[ "$1" = get ] || exit 2
+read host
+case "$host" in
+helped.example.com|only.example.com) echo "{\"ServerURL\":\"$host\",\"Username\":\"$host\",\"Secret\":\"pw\"}" ;;
+*) echo "credentials not found in native keychain"; exit 1 ;;
+esac
+`), 0755))
+	t.Setenv("PATH", bin+":"+os.Getenv("PATH"))
+
+	config := filepath.Join(t.TempDir(), "config.json")
+	assert.NoError(os.WriteFile(config, []byte(`{
+		"auths": {"helped.example.com": {}},
+		"credsStore": "test",
+		"credHelpers": {"only.example.com": "test", "broken.example.com": "missing"}
+	}`), 0600))
+	creds, err := dockerCredentials(config, "helped.example.com")
+	assert.NoError(err)
+	assert.Equal(&Credentials{Username: "helped.example.com", Password: "pw"}, creds)
+	creds, err = dockerCredentials(config, "only.example.com")
+	assert.NoError(err)
+	assert.Equal(&Credentials{Username: "only.example.com", Password: "pw"}, creds)
+	creds, err = dockerCredentials(config, "unknown.example.com")
+	assert.NoError(err)
+	assert.Nil(creds)
+	_, err = dockerCredentials(config, "broken.example.com")
+	assert.ErrorContains(err, "docker-credential-missing")
+}
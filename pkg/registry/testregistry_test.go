@@ -0,0 +1,282 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+// testRegistry is an in-process stand-in for an OCI distribution
+// endpoint, serving repository "test".
+type testRegistry struct {
+	*httptest.Server
+	// noReferrersAPI makes it answer referrers requests with 404s, as
+	// registries predating the referrers API do
+	noReferrersAPI bool
+	// ignoreRanges makes it answer range requests for blobs with the
+	// whole blob
+	ignoreRanges bool
+	// creds, if set, are needed for everything: as they are, or, with
+	// bearer, to get tokens from /token, which only allow pushing if
+	// that's asked for
+	creds  *Credentials
+	bearer bool
+
+	mu        sync.Mutex
+	blobs     map[digest.Digest][]byte
+	manifests map[string][]byte // by tag and by digest
+	types     map[digest.Digest]string
+	// blobGets counts GETs of blob content, and ranges records the Range
+	// headers of them
+	blobGets int
+	ranges   []string
+
+	// mountable are the blobs of repository "other", which can be
+	// mounted into "test"
+	mountable map[digest.Digest][]byte
+	// uploads are those in progress, by id
+	uploads    map[string]*bytes.Buffer
+	nextUpload int
+	// failures is how many more uploads fail with 503s
+	failures int
+	// blobPuts counts completed uploads, patches chunks uploaded, and
+	// mounts blobs mounted from "other"
+	blobPuts int
+	patches  int
+	mounts   int
+}
+
+func newTestRegistry(t *testing.T) *testRegistry {
+	r := &testRegistry{
+		blobs:     map[digest.Digest][]byte{},
+		manifests: map[string][]byte{},
+		types:     map[digest.Digest]string{},
+		mountable: map[digest.Digest][]byte{},
+		uploads:   map[string]*bytes.Buffer{},
+	}
+	r.Server = httptest.NewServer(http.HandlerFunc(r.serve))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *testRegistry) repo(t *testing.T) *Repository {
+	repo, err := ParseRepository(r.URL + "/test")
+	assert.NoError(t, err)
+	return repo
+}
+
+// addBlob adds content, returning its descriptor.
+func (r *testRegistry) addBlob(mediaType string, content []byte) ispec.Descriptor {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	d := digest.FromBytes(content)
+	r.blobs[d] = content
+	return ispec.Descriptor{MediaType: mediaType, Digest: d, Size: int64(len(content))}
+}
+
+// addManifest adds m, tagged as tag if that's not empty, returning its
+// descriptor.
+func (r *testRegistry) addManifest(t *testing.T, tag, mediaType string, m any) ispec.Descriptor {
+	content, err := json.Marshal(m)
+	assert.NoError(t, err)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	d := digest.FromBytes(content)
+	r.manifests[d.String()] = content
+	r.types[d] = mediaType
+	if tag != "" {
+		r.manifests[tag] = content
+	}
+	return ispec.Descriptor{MediaType: mediaType, Digest: d, Size: int64(len(content))}
+}
+
+func (r *testRegistry) serve(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/token" && r.bearer {
+		r.token(w, req)
+		return
+	}
+	path, ok := strings.CutPrefix(req.URL.Path, "/v2/test/")
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	kind, ref, _ := strings.Cut(path, "/")
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.authorized(w, req) {
+		return
+	}
+	if req.Method != http.MethodGet && req.Method != http.MethodHead && r.failures > 0 {
+		r.failures--
+		http.Error(w, "try again", http.StatusServiceUnavailable)
+		return
+	}
+	switch {
+	case kind == "blobs" && strings.HasPrefix(ref, "uploads/"):
+		r.upload(w, req, strings.TrimPrefix(ref, "uploads/"))
+	case kind == "blobs" && (req.Method == http.MethodGet || req.Method == http.MethodHead):
+		content, ok := r.blobs[digest.Digest(ref)]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		if req.Method == http.MethodGet {
+			r.blobGets++
+			r.ranges = append(r.ranges, req.Header.Get("Range"))
+		}
+		if r.ignoreRanges {
+			req.Header.Del("Range")
+		}
+		http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(content))
+	case kind == "manifests" && (req.Method == http.MethodGet || req.Method == http.MethodHead):
+		content, ok := r.manifests[ref]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Content-Type", r.types[digest.FromBytes(content)])
+		w.Header().Set("Docker-Content-Digest", digest.FromBytes(content).String())
+		http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(content))
+	case kind == "manifests" && req.Method == http.MethodPut:
+		content, err := io.ReadAll(req.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		d := digest.FromBytes(content)
+		r.manifests[d.String()] = content
+		r.manifests[ref] = content
+		r.types[d] = req.Header.Get("Content-Type")
+		var m ispec.Manifest
+		if json.Unmarshal(content, &m) == nil && m.Subject != nil && !r.noReferrersAPI {
+			w.Header().Set("OCI-Subject", m.Subject.Digest.String())
+		}
+		w.Header().Set("Docker-Content-Digest", d.String())
+		w.WriteHeader(http.StatusCreated)
+	case kind == "referrers" && req.Method == http.MethodGet && !r.noReferrersAPI:
+		index := ispec.Index{MediaType: ispec.MediaTypeImageIndex, Manifests: []ispec.Descriptor{}}
+		index.SchemaVersion = 2
+		for d, content := range r.manifests {
+			var m ispec.Manifest
+			if _, err := digest.Parse(d); err != nil || json.Unmarshal(content, &m) != nil {
+				continue
+			}
+			if m.Subject != nil && m.Subject.Digest.String() == ref {
+				index.Manifests = append(index.Manifests, ispec.Descriptor{
+					MediaType:    r.types[digest.Digest(d)],
+					ArtifactType: m.ArtifactType,
+					Digest:       digest.Digest(d),
+					Size:         int64(len(content)),
+				})
+			}
+		}
+		w.Header().Set("Content-Type", ispec.MediaTypeImageIndex)
+		_ = json.NewEncoder(w).Encode(index)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+// authorized says whether req has the credentials, or token, it needs,
+// challenging it for them if not.
+func (r *testRegistry) authorized(w http.ResponseWriter, req *http.Request) bool {
+	if r.creds == nil {
+		return true
+	}
+	actions := "pull"
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		actions = "pull,push"
+	}
+	if r.bearer {
+		token := req.Header.Get("Authorization")
+		if token == "Bearer "+actions || token == "Bearer pull,push" {
+			return true
+		}
+		w.Header().Set("Www-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test",scope="repository:test:%s"`, r.URL, actions))
+	} else {
+		if username, password, ok := req.BasicAuth(); ok && *r.creds == (Credentials{username, password}) {
+			return true
+		}
+		w.Header().Set("Www-Authenticate", `Basic realm="test"`)
+	}
+	w.WriteHeader(http.StatusUnauthorized)
+	return false
+}
+
+// token gives those with the credentials a token, which is the actions
+// they asked for.
+func (r *testRegistry) token(w http.ResponseWriter, req *http.Request) {
+	username, password, ok := req.BasicAuth()
+	if !ok || *r.creds != (Credentials{username, password}) {
+		http.Error(w, "who are you?", http.StatusUnauthorized)
+		return
+	}
+	actions, ok := strings.CutPrefix(req.URL.Query().Get("scope"), "repository:test:")
+	if !ok {
+		http.Error(w, "bad scope", http.StatusBadRequest)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(map[string]string{"token": actions})
+}
+
+// upload handles the blob upload id, or starting one if that's empty.
+func (r *testRegistry) upload(w http.ResponseWriter, req *http.Request, id string) {
+	switch {
+	case req.Method == http.MethodPost && id == "":
+		q := req.URL.Query()
+		if content, ok := r.mountable[digest.Digest(q.Get("mount"))]; ok && q.Get("from") == "other" {
+			r.blobs[digest.Digest(q.Get("mount"))] = content
+			r.mounts++
+			w.Header().Set("Location", "/v2/test/blobs/"+q.Get("mount"))
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		id = strconv.Itoa(r.nextUpload)
+		r.nextUpload++
+		r.uploads[id] = &bytes.Buffer{}
+		w.Header().Set("Location", "/v2/test/blobs/uploads/"+id)
+		w.WriteHeader(http.StatusAccepted)
+	case req.Method == http.MethodPatch && r.uploads[id] != nil:
+		var start, end int
+		if _, err := fmt.Sscanf(req.Header.Get("Content-Range"), "%d-%d", &start, &end); err != nil || start != r.uploads[id].Len() {
+			http.Error(w, "bad range", http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		n, _ := io.Copy(r.uploads[id], req.Body)
+		if n != int64(end-start+1) {
+			http.Error(w, "short chunk", http.StatusBadRequest)
+			return
+		}
+		r.patches++
+		w.Header().Set("Location", "/v2/test/blobs/uploads/"+id)
+		w.WriteHeader(http.StatusAccepted)
+	case req.Method == http.MethodPut && r.uploads[id] != nil:
+		_, _ = io.Copy(r.uploads[id], req.Body)
+		content := r.uploads[id].Bytes()
+		d := digest.Digest(req.URL.Query().Get("digest"))
+		if d != digest.FromBytes(content) {
+			http.Error(w, "digest mismatch", http.StatusBadRequest)
+			return
+		}
+		delete(r.uploads, id)
+		r.blobs[d] = content
+		r.blobPuts++
+		w.Header().Set("Location", "/v2/test/blobs/"+d.String())
+		w.WriteHeader(http.StatusCreated)
+	default:
+		http.NotFound(w, req)
+	}
+}
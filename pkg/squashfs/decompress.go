@@ -0,0 +1,93 @@
+package squashfs
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	"github.com/ulikunitz/xz"
+	"github.com/ulikunitz/xz/lzma"
+	"machinerun.io/atomfs/pkg/common"
+	"machinerun.io/atomfs/pkg/decompress"
+)
+
+// decompressor decodes one compressed block, which squashfs guarantees is
+// at most max bytes once decompressed.
+type decompressor func(src []byte, max int) ([]byte, error)
+
+func readAllMax(r io.Reader, max int) ([]byte, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, max))
+	n, err := io.Copy(buf, io.LimitReader(r, int64(max)+1))
+	if err != nil {
+		return nil, err
+	}
+	if n > int64(max) {
+		return nil, errors.Errorf("block decompresses to more than %d bytes", max)
+	}
+	return buf.Bytes(), nil
+}
+
+func newDecompressor(c compression) (decompressor, error) {
+	switch c {
+	case compressionGzip:
+		return func(src []byte, max int) ([]byte, error) {
+			zr, err := zlib.NewReader(bytes.NewReader(src))
+			if err != nil {
+				return nil, err
+			}
+			defer zr.Close()
+			return readAllMax(zr, max)
+		}, nil
+	case compressionXz:
+		return func(src []byte, max int) ([]byte, error) {
+			xr, err := xz.NewReader(bytes.NewReader(src))
+			if err != nil {
+				return nil, err
+			}
+			return readAllMax(xr, max)
+		}, nil
+	case compressionLzma:
+		return func(src []byte, max int) ([]byte, error) {
+			lr, err := lzma.NewReader(bytes.NewReader(src))
+			if err != nil {
+				return nil, err
+			}
+			return readAllMax(lr, max)
+		}, nil
+	case compressionLz4:
+		return func(src []byte, max int) ([]byte, error) {
+			dst := make([]byte, max)
+			n, err := decompress.LZ4Block(dst, src, false)
+			if err != nil {
+				return nil, err
+			}
+			return dst[:n], nil
+		}, nil
+	case compressionZstd:
+		dec, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return func(src []byte, max int) ([]byte, error) {
+			dst, err := dec.DecodeAll(src, make([]byte, 0, max))
+			if err != nil {
+				return nil, err
+			}
+			if len(dst) > max {
+				return nil, errors.Errorf("block decompresses to more than %d bytes", max)
+			}
+			return dst, nil
+		}, nil
+	case compressionLzo:
+		return nil, &common.UnsupportedFeatureError{
+			Image:        "squashfs image",
+			Feature:      "lzo compression",
+			By:           "gosquash",
+			Alternatives: []string{"kmount", "squashfuse", "unsquashfs"},
+		}
+	default:
+		return nil, errors.Errorf("unknown squashfs compression %d", c)
+	}
+}
@@ -0,0 +1,49 @@
+package squashfs
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/ulikunitz/xz"
+	"github.com/ulikunitz/xz/lzma"
+)
+
+func TestDecompressors(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	data := bytes.Repeat([]byte("atomfs squashfs block "), 100)
+
+	compress := map[compression]func(io.Writer) (io.WriteCloser, error){
+		compressionGzip: func(w io.Writer) (io.WriteCloser, error) { return zlib.NewWriter(w), nil },
+		compressionXz:   func(w io.Writer) (io.WriteCloser, error) { return xz.NewWriter(w) },
+		compressionLzma: func(w io.Writer) (io.WriteCloser, error) { return lzma.NewWriter(w) },
+		compressionZstd: func(w io.Writer) (io.WriteCloser, error) { return zstd.NewWriter(w) },
+	}
+
+	for c, newWriter := range compress {
+		var buf bytes.Buffer
+		w, err := newWriter(&buf)
+		assert.NoError(err)
+		_, err = w.Write(data)
+		assert.NoError(err)
+		assert.NoError(w.Close())
+
+		dec, err := newDecompressor(c)
+		assert.NoError(err)
+
+		out, err := dec(buf.Bytes(), len(data))
+		assert.NoError(err, "compression %d", c)
+		assert.Equal(data, out, "compression %d", c)
+
+		_, err = dec(buf.Bytes(), len(data)-1)
+		assert.Error(err, "compression %d", c)
+	}
+
+	_, err := newDecompressor(compressionLzo)
+	assert.Error(err)
+}
@@ -6,6 +6,8 @@ import (
 
 	"github.com/pkg/errors"
 	"machinerun.io/atomfs/pkg/common"
+	"machinerun.io/atomfs/pkg/extract"
+	types "machinerun.io/atomfs/pkg/types"
 	"machinerun.io/atomfs/pkg/verity"
 )
 
@@ -16,23 +18,39 @@ func New() *squashfs {
 	return &squashfs{}
 }
 
-func (sq *squashfs) Make(tempdir string, rootfs string, eps *common.ExcludePaths, verity verity.VerityMetadata) (io.ReadCloser, string, string, error) {
-	return MakeSquashfs(tempdir, rootfs, eps, verity)
+func (sq *squashfs) Make(tempdir string, rootfs string, eps *common.ExcludePaths, verity verity.VerityMetadata, opts types.MakeOptions) (io.ReadCloser, string, string, error) {
+	return MakeSquashfsWithOptions(tempdir, rootfs, eps, verity, opts)
+}
+
+func (sq *squashfs) MakeFromTar(tempdir string, tarStream io.Reader, verity verity.VerityMetadata, opts types.MakeOptions) (io.ReadCloser, string, string, error) {
+	return MakeSquashfsFromTar(tempdir, tarStream, verity, opts)
+}
+
+func (sq *squashfs) Inspect(fsImgFile string) (*types.ImageInfo, error) {
+	return Inspect(fsImgFile)
 }
 
 func (sq *squashfs) ExtractSingle(fsImgFile string, extractDir string) error {
 	return ExtractSingleSquash(fsImgFile, extractDir)
 }
 
+func (sq *squashfs) Extractors() []types.FsExtractor {
+	return Extractors()
+}
+
+func (sq *squashfs) ExtractSinglePolicy(fsImgFile, extractDir, rootHash string, policy *extract.Policy) error {
+	return ExtractSingleSquashVerified(fsImgFile, extractDir, rootHash, policy)
+}
+
 func (sq *squashfs) Mount(fsImgFile, mountpoint, rootHash string) error {
 	if !common.AmHostRoot() {
-		return sq.guestMount(fsImgFile, mountpoint)
+		return sq.guestMount(fsImgFile, mountpoint, rootHash)
 	}
 	err := sq.hostMount(fsImgFile, mountpoint, rootHash)
 	if err == nil || rootHash != "" {
 		return err
 	}
-	return sq.guestMount(fsImgFile, mountpoint)
+	return sq.guestMount(fsImgFile, mountpoint, rootHash)
 }
 
 func fsImgVerityLocation(fsImgFile string) (int64, uint64, error) {
@@ -55,6 +73,10 @@ func fsImgVerityLocation(fsImgFile string) (int64, uint64, error) {
 }
 
 func (sq *squashfs) hostMount(fsImgFile string, mountpoint string, rootHash string) error {
+	if err := checkKernelSupport(fsImgFile); err != nil {
+		return err
+	}
+
 	veritySize, verityOffset, err := fsImgVerityLocation(fsImgFile)
 	if err != nil {
 		return err
@@ -63,7 +85,13 @@ func (sq *squashfs) hostMount(fsImgFile string, mountpoint string, rootHash stri
 	return common.HostMount(fsImgFile, "squashfs", mountpoint, rootHash, veritySize, verityOffset)
 }
 
-func (sq *squashfs) guestMount(fsImgFile string, mountpoint string) error {
+// guestMount mounts with FUSE; images with a root hash are served by
+// verityfuse, which checks what it reads against the hash, and the rest by
+// squashfuse.
+func (sq *squashfs) guestMount(fsImgFile string, mountpoint string, rootHash string) error {
+	if rootHash != "" {
+		return common.GuestMount(fsImgFile, mountpoint, common.VerityFuse("squashfs", rootHash))
+	}
 	return common.GuestMount(fsImgFile, mountpoint, squashFuse)
 }
 
@@ -0,0 +1,81 @@
+package squashfs
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/pkg/errors"
+	types "machinerun.io/atomfs/pkg/types"
+)
+
+func (c compression) String() string {
+	switch c {
+	case compressionGzip:
+		return "gzip"
+	case compressionLzma:
+		return "lzma"
+	case compressionLzo:
+		return "lzo"
+	case compressionXz:
+		return "xz"
+	case compressionLz4:
+		return "lz4"
+	case compressionZstd:
+		return "zstd"
+	}
+	return fmt.Sprintf("unknown(%d)", uint16(c))
+}
+
+// features names the flags that are set, as mksquashfs/unsquashfs -s would
+// describe them.
+func (s *superblockFlags) features() []string {
+	ret := []string{}
+	for _, f := range []struct {
+		set  bool
+		name string
+	}{
+		{s.uncompressedInodes, "uncompressed-inodes"},
+		{s.uncompressedData, "uncompressed-data"},
+		{s.uncompressedFragments, "uncompressed-fragments"},
+		{s.noFragments, "no-fragments"},
+		{s.alwaysFragments, "always-fragments"},
+		{s.dedup, "duplicates-removed"},
+		{s.exportable, "exportable"},
+		{s.uncompressedXattrs, "uncompressed-xattrs"},
+		{s.noXattrs, "no-xattrs"},
+		{s.compressorOptions, "compressor-options"},
+		{s.uncompressedIDs, "uncompressed-ids"},
+	} {
+		if f.set {
+			ret = append(ret, f.name)
+		}
+	}
+	return ret
+}
+
+// Inspect describes the squashfs image at path from its superblock.
+func Inspect(path string) (*types.ImageInfo, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	sb, err := readSuperblock(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't read superblock of %s", path)
+	}
+	verityOffset, err := verityDataLocation(sb)
+	if err != nil {
+		return nil, err
+	}
+
+	return &types.ImageInfo{
+		Type:         "squashfs",
+		Compression:  []string{sb.compression.String()},
+		BlockSize:    sb.blocksize,
+		Inodes:       uint64(sb.inodes),
+		Features:     sb.features(),
+		BuildTime:    sb.modTime,
+		Size:         fi.Size(),
+		VerityOffset: verityOffset,
+	}, nil
+}
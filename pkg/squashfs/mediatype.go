@@ -11,6 +11,8 @@ const (
 	BaseMediaTypeLayerSquashfs = "application/vnd.stacker.image.layer.squashfs"
 
 	GzipCompression SquashfsCompression = "gzip"
+	XzCompression   SquashfsCompression = "xz"
+	Lz4Compression  SquashfsCompression = "lz4"
 	ZstdCompression SquashfsCompression = "zstd"
 )
 
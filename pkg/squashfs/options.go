@@ -0,0 +1,114 @@
+package squashfs
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+	types "machinerun.io/atomfs/pkg/types"
+)
+
+// squashfsSettings are validated types.MakeOptions.
+type squashfsSettings struct {
+	compression SquashfsCompression
+	// hc is lz4's high compression mode, asked for as lz4hc
+	hc        bool
+	level     int
+	blockSize int
+	workers   int
+}
+
+var compressionLevels = map[SquashfsCompression][2]int{
+	GzipCompression: {1, 9},
+	ZstdCompression: {1, 22},
+}
+
+// resolveMakeOptions checks opts against what squashfs and the build tool
+// (as described by supports) can do, filling in defaults.
+func resolveMakeOptions(opts types.MakeOptions, supports func(SquashfsCompression) bool) (squashfsSettings, error) {
+	settings := squashfsSettings{
+		compression: SquashfsCompression(opts.Compression),
+		level:       opts.CompressionLevel,
+		blockSize:   opts.BlockSize,
+		workers:     opts.Workers,
+	}
+
+	// lz4hc images are lz4 ones, only compressed harder
+	if opts.Compression == "lz4hc" {
+		settings.compression = Lz4Compression
+		settings.hc = true
+	}
+
+	switch settings.compression {
+	case "":
+		settings.compression = GzipCompression
+		if supports(ZstdCompression) {
+			settings.compression = ZstdCompression
+		}
+	case GzipCompression, XzCompression, Lz4Compression, ZstdCompression:
+		if !supports(settings.compression) {
+			return settings, errors.Errorf("squashfs tools were built without %s support", settings.compression)
+		}
+	default:
+		return settings, errors.Errorf("unsupported squashfs compression %q (want one of %s, %s, %s, lz4hc, %s)",
+			opts.Compression, GzipCompression, XzCompression, Lz4Compression, ZstdCompression)
+	}
+
+	if settings.level != 0 {
+		bounds, ok := compressionLevels[settings.compression]
+		if !ok {
+			return settings, errors.Errorf("squashfs %s compression does not take a level", settings.compression)
+		}
+		if settings.level < bounds[0] || settings.level > bounds[1] {
+			return settings, errors.Errorf("squashfs %s compression level must be between %d and %d, not %d",
+				settings.compression, bounds[0], bounds[1], settings.level)
+		}
+	}
+
+	if settings.blockSize != 0 {
+		bs := settings.blockSize
+		if bs < 4096 || bs > 1024*1024 || bs&(bs-1) != 0 {
+			return settings, errors.Errorf("squashfs block size must be a power of two between 4K and 1M, not %d", bs)
+		}
+	}
+
+	if settings.workers < 0 {
+		return settings, errors.Errorf("invalid worker count %d", settings.workers)
+	}
+
+	return settings, nil
+}
+
+// mksquashfsArgs are the arguments for mksquashfs and sqfstar.
+func (s squashfsSettings) mksquashfsArgs() []string {
+	args := []string{"-comp", string(s.compression)}
+	if s.hc {
+		args = append(args, "-Xhc")
+	}
+	if s.level != 0 {
+		args = append(args, "-Xcompression-level", fmt.Sprintf("%d", s.level))
+	}
+	if s.blockSize != 0 {
+		args = append(args, "-b", fmt.Sprintf("%d", s.blockSize))
+	}
+	if s.workers != 0 {
+		args = append(args, "-processors", fmt.Sprintf("%d", s.workers))
+	}
+	return args
+}
+
+func (s squashfsSettings) tar2sqfsArgs() []string {
+	args := []string{"--compressor", string(s.compression)}
+	if s.hc {
+		args = append(args, "--comp-extra", "hc")
+	}
+	if s.level != 0 {
+		args = append(args, "--comp-extra", fmt.Sprintf("level=%d", s.level))
+	}
+	if s.blockSize != 0 {
+		args = append(args, "--block-size", fmt.Sprintf("%d", s.blockSize))
+	}
+	if s.workers != 0 {
+		args = append(args, "--num-jobs", fmt.Sprintf("%d", s.workers))
+	}
+	return args
+}
@@ -0,0 +1,56 @@
+package squashfs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	types "machinerun.io/atomfs/pkg/types"
+)
+
+func TestResolveMakeOptions(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	all := func(SquashfsCompression) bool { return true }
+	noZstd := func(c SquashfsCompression) bool { return c != ZstdCompression }
+
+	s, err := resolveMakeOptions(types.MakeOptions{}, all)
+	assert.NoError(err)
+	assert.Equal([]string{"-comp", "zstd"}, s.mksquashfsArgs())
+
+	s, err = resolveMakeOptions(types.MakeOptions{}, noZstd)
+	assert.NoError(err)
+	assert.Equal(GzipCompression, s.compression)
+
+	s, err = resolveMakeOptions(types.MakeOptions{Compression: "xz", BlockSize: 1 << 20, Workers: 2}, all)
+	assert.NoError(err)
+	assert.Equal([]string{"-comp", "xz", "-b", "1048576", "-processors", "2"}, s.mksquashfsArgs())
+	assert.Equal([]string{"--compressor", "xz", "--block-size", "1048576", "--num-jobs", "2"}, s.tar2sqfsArgs())
+
+	s, err = resolveMakeOptions(types.MakeOptions{Compression: "zstd", CompressionLevel: 19}, all)
+	assert.NoError(err)
+	assert.Equal([]string{"-comp", "zstd", "-Xcompression-level", "19"}, s.mksquashfsArgs())
+	assert.Equal([]string{"--compressor", "zstd", "--comp-extra", "level=19"}, s.tar2sqfsArgs())
+
+	s, err = resolveMakeOptions(types.MakeOptions{Compression: "lz4hc"}, all)
+	assert.NoError(err)
+	assert.Equal(Lz4Compression, s.compression)
+	assert.Equal([]string{"-comp", "lz4", "-Xhc"}, s.mksquashfsArgs())
+	assert.Equal([]string{"--compressor", "lz4", "--comp-extra", "hc"}, s.tar2sqfsArgs())
+
+	for _, bad := range []types.MakeOptions{
+		{Compression: "lzo"},
+		{Compression: "lz4hc", CompressionLevel: 3},
+		{Compression: "zstd", CompressionLevel: 23},
+		{Compression: "lz4", CompressionLevel: 3},
+		{BlockSize: 3000},
+		{BlockSize: 2 << 20},
+		{Workers: -1},
+	} {
+		_, err := resolveMakeOptions(bad, all)
+		assert.Error(err, "%+v", bad)
+	}
+
+	_, err = resolveMakeOptions(types.MakeOptions{Compression: "zstd"}, noZstd)
+	assert.Error(err)
+}
@@ -0,0 +1,1099 @@
+package squashfs
+
+import (
+	"encoding/binary"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+	"machinerun.io/atomfs/pkg/imagefs"
+)
+
+// The on-disk layout used here is described in the kernel's
+// fs/squashfs/squashfs_fs.h.
+
+const (
+	metadataBlockSize    = 8192
+	metadataUncompressed = 0x8000
+	dataUncompressed     = 1 << 24
+	noFragment           = 0xffffffff
+	noXattr              = 0xffffffff
+	invalidTable         = 0xffffffffffffffff
+
+	// decompressed metadata blocks kept around before the cache is reset
+	metadataCacheSize = 4096
+	dirCacheSize      = 1024
+)
+
+const (
+	inodeDir = iota + 1
+	inodeFile
+	inodeSymlink
+	inodeBlockDev
+	inodeCharDev
+	inodeFifo
+	inodeSocket
+	inodeLDir
+	inodeLFile
+	inodeLSymlink
+	inodeLBlockDev
+	inodeLCharDev
+	inodeLFifo
+	inodeLSocket
+)
+
+// FS is a squashfs image, read without any help from the kernel or
+// squashfs-tools. It implements imagefs.FS.
+type FS struct {
+	r          io.ReaderAt
+	closer     io.Closer
+	sb         *superblock
+	decompress decompressor
+	ids        []uint32
+	fragments  []fragment
+	// xattrStart is where the xattr key/value metadata blocks start, and
+	// xattrIDs are the entries inodes' xattr indexes refer to.
+	xattrStart uint64
+	xattrIDs   []xattrID
+	resolver   imagefs.Resolver[*inode]
+
+	mu        sync.Mutex
+	metadata  map[uint64]metadataBlock
+	dirs      map[uint64][]dirent
+	lastFrag  uint32
+	fragCache []byte
+}
+
+type metadataBlock struct {
+	data []byte
+	next uint64
+}
+
+type fragment struct {
+	start uint64
+	size  uint32
+}
+
+type xattrID struct {
+	ref   uint64
+	count uint32
+}
+
+type inode struct {
+	ref    uint64
+	typ    uint16
+	perm   uint16
+	uid    uint32
+	gid    uint32
+	mtime  uint32
+	ino    uint32
+	nlink  uint32
+	xattr  uint32
+	rdev   uint32
+	target string
+
+	// directories
+	dirBlock  uint32
+	dirOffset uint16
+	dirSize   uint32
+
+	// regular files
+	startBlock uint64
+	fileSize   uint64
+	fragment   uint32
+	fragOffset uint32
+	blocks     []uint32
+}
+
+type dirent struct {
+	name string
+	ref  uint64
+	typ  uint16
+}
+
+// Open opens the squashfs image at path; the returned FS must be closed.
+// Any verity data appended to the image is ignored.
+func Open(path string) (*FS, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, errors.WithStack(err)
+	}
+	sfs, err := NewReader(f, fi.Size())
+	if err != nil {
+		f.Close()
+		return nil, errors.Wrapf(err, "couldn't read squashfs %s", path)
+	}
+	sfs.closer = f
+	return sfs, nil
+}
+
+// NewReader reads the squashfs image of the given size from r.
+func NewReader(r io.ReaderAt, size int64) (*FS, error) {
+	buf := make([]byte, superblockSize)
+	if _, err := r.ReadAt(buf, 0); err != nil {
+		return nil, errors.Wrapf(err, "couldn't read superblock")
+	}
+	sb, err := parseSuperblock(buf)
+	if err != nil {
+		return nil, err
+	}
+	if sb.size > uint64(size) {
+		return nil, errors.Errorf("squashfs claims %d bytes but only %d are available", sb.size, size)
+	}
+
+	dec, err := newDecompressor(sb.compression)
+	if err != nil {
+		return nil, err
+	}
+
+	sfs := &FS{
+		r:          r,
+		sb:         sb,
+		decompress: dec,
+		metadata:   map[uint64]metadataBlock{},
+		dirs:       map[uint64][]dirent{},
+		lastFrag:   noFragment,
+	}
+
+	if err := sfs.readIDs(); err != nil {
+		return nil, err
+	}
+	if err := sfs.readFragments(); err != nil {
+		return nil, err
+	}
+	if err := sfs.readXattrIDs(); err != nil {
+		return nil, err
+	}
+
+	root, err := sfs.readInode(sb.rootInode.toUint64())
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't read root inode")
+	}
+	sfs.resolver = imagefs.Resolver[*inode]{
+		Root:   root,
+		Lookup: sfs.lookup,
+		Link: func(i *inode) (string, bool, error) {
+			return i.target, i.isSymlink(), nil
+		},
+	}
+
+	return sfs, nil
+}
+
+// Close closes the underlying image file if the FS was created by Open.
+func (sfs *FS) Close() error {
+	if sfs.closer == nil {
+		return nil
+	}
+	return sfs.closer.Close()
+}
+
+// readMetadataBlock returns the decompressed metadata block at pos, and
+// the position of the one after it.
+func (sfs *FS) readMetadataBlock(pos uint64) (metadataBlock, error) {
+	sfs.mu.Lock()
+	mb, ok := sfs.metadata[pos]
+	sfs.mu.Unlock()
+	if ok {
+		return mb, nil
+	}
+
+	hdr := make([]byte, 2)
+	if _, err := sfs.r.ReadAt(hdr, int64(pos)); err != nil {
+		return mb, errors.Wrapf(err, "couldn't read metadata block at %d", pos)
+	}
+	length := binary.LittleEndian.Uint16(hdr)
+	compressed := length&metadataUncompressed == 0
+	length &^= metadataUncompressed
+	if length > metadataBlockSize {
+		return mb, errors.Errorf("metadata block at %d is %d bytes", pos, length)
+	}
+
+	raw := make([]byte, length)
+	if _, err := sfs.r.ReadAt(raw, int64(pos)+2); err != nil {
+		return mb, errors.Wrapf(err, "couldn't read metadata block at %d", pos)
+	}
+	if compressed {
+		var err error
+		raw, err = sfs.decompress(raw, metadataBlockSize)
+		if err != nil {
+			return mb, errors.Wrapf(err, "couldn't decompress metadata block at %d", pos)
+		}
+	}
+
+	mb = metadataBlock{data: raw, next: pos + 2 + uint64(length)}
+	sfs.mu.Lock()
+	if len(sfs.metadata) >= metadataCacheSize {
+		sfs.metadata = map[uint64]metadataBlock{}
+	}
+	sfs.metadata[pos] = mb
+	sfs.mu.Unlock()
+	return mb, nil
+}
+
+// metadataReader reads a run of metadata, which may span blocks.
+type metadataReader struct {
+	sfs  *FS
+	next uint64
+	data []byte
+}
+
+func (sfs *FS) newMetadataReader(block uint64, offset uint16) (*metadataReader, error) {
+	mr := &metadataReader{sfs: sfs, next: block}
+	if err := mr.skip(int(offset)); err != nil {
+		return nil, err
+	}
+	return mr, nil
+}
+
+func (mr *metadataReader) Read(p []byte) (int, error) {
+	if len(mr.data) == 0 {
+		mb, err := mr.sfs.readMetadataBlock(mr.next)
+		if err != nil {
+			return 0, err
+		}
+		if len(mb.data) == 0 {
+			return 0, io.ErrUnexpectedEOF
+		}
+		mr.data = mb.data
+		mr.next = mb.next
+	}
+	n := copy(p, mr.data)
+	mr.data = mr.data[n:]
+	return n, nil
+}
+
+func (mr *metadataReader) read(n int) ([]byte, error) {
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(mr, buf); err != nil {
+		return nil, errors.Wrapf(err, "couldn't read metadata")
+	}
+	return buf, nil
+}
+
+func (mr *metadataReader) skip(n int) error {
+	_, err := io.CopyN(io.Discard, mr, int64(n))
+	return err
+}
+
+func (mr *metadataReader) u16() (uint16, error) {
+	b, err := mr.read(2)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint16(b), nil
+}
+
+func (mr *metadataReader) u32() (uint32, error) {
+	b, err := mr.read(4)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(b), nil
+}
+
+// readTable reads count entries of entrySize bytes from a table whose
+// metadata block locations are listed at indexPos.
+func (sfs *FS) readTable(indexPos uint64, count int, entrySize int) ([]byte, error) {
+	total := count * entrySize
+	nblocks := (total + metadataBlockSize - 1) / metadataBlockSize
+	if uint64(nblocks)*8 > sfs.sb.size {
+		return nil, errors.Errorf("table at %d has impossible size %d", indexPos, total)
+	}
+	index := make([]byte, 8*nblocks)
+	if _, err := sfs.r.ReadAt(index, int64(indexPos)); err != nil {
+		return nil, errors.Wrapf(err, "couldn't read table index at %d", indexPos)
+	}
+
+	table := make([]byte, 0, total)
+	for i := 0; i < nblocks; i++ {
+		mb, err := sfs.readMetadataBlock(binary.LittleEndian.Uint64(index[8*i:]))
+		if err != nil {
+			return nil, err
+		}
+		table = append(table, mb.data...)
+	}
+	if len(table) < total {
+		return nil, errors.Errorf("table at %d is truncated", indexPos)
+	}
+	return table[:total], nil
+}
+
+func (sfs *FS) readIDs() error {
+	table, err := sfs.readTable(sfs.sb.idTableStart, int(sfs.sb.idCount), 4)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't read id table")
+	}
+	sfs.ids = make([]uint32, sfs.sb.idCount)
+	for i := range sfs.ids {
+		sfs.ids[i] = binary.LittleEndian.Uint32(table[4*i:])
+	}
+	return nil
+}
+
+func (sfs *FS) readFragments() error {
+	if sfs.sb.fragmentCount == 0 || sfs.sb.fragmentTableStart == invalidTable {
+		return nil
+	}
+	table, err := sfs.readTable(sfs.sb.fragmentTableStart, int(sfs.sb.fragmentCount), 16)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't read fragment table")
+	}
+	sfs.fragments = make([]fragment, sfs.sb.fragmentCount)
+	for i := range sfs.fragments {
+		sfs.fragments[i] = fragment{
+			start: binary.LittleEndian.Uint64(table[16*i:]),
+			size:  binary.LittleEndian.Uint32(table[16*i+8:]),
+		}
+	}
+	return nil
+}
+
+func (sfs *FS) readXattrIDs() error {
+	if sfs.sb.noXattrs || sfs.sb.xattrTableStart == invalidTable {
+		return nil
+	}
+	hdr := make([]byte, 16)
+	if _, err := sfs.r.ReadAt(hdr, int64(sfs.sb.xattrTableStart)); err != nil {
+		return errors.Wrapf(err, "couldn't read xattr table")
+	}
+	sfs.xattrStart = binary.LittleEndian.Uint64(hdr[0:8])
+	count := int(binary.LittleEndian.Uint32(hdr[8:12]))
+
+	table, err := sfs.readTable(sfs.sb.xattrTableStart+16, count, 16)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't read xattr id table")
+	}
+	sfs.xattrIDs = make([]xattrID, count)
+	for i := range sfs.xattrIDs {
+		sfs.xattrIDs[i] = xattrID{
+			ref:   binary.LittleEndian.Uint64(table[16*i:]),
+			count: binary.LittleEndian.Uint32(table[16*i+8:]),
+		}
+	}
+	return nil
+}
+
+var xattrPrefixes = []string{"user.", "trusted.", "security."}
+
+func (sfs *FS) readXattrs(idx uint32) (map[string][]byte, error) {
+	if idx == noXattr {
+		return nil, nil
+	}
+	if int(idx) >= len(sfs.xattrIDs) {
+		return nil, errors.Errorf("bad xattr index %d", idx)
+	}
+	id := sfs.xattrIDs[idx]
+
+	mr, err := sfs.newMetadataReader(sfs.xattrStart+id.ref>>16, uint16(id.ref))
+	if err != nil {
+		return nil, err
+	}
+
+	xattrs := map[string][]byte{}
+	for i := uint32(0); i < id.count; i++ {
+		typ, err := mr.u16()
+		if err != nil {
+			return nil, err
+		}
+		nameSize, err := mr.u16()
+		if err != nil {
+			return nil, err
+		}
+		name, err := mr.read(int(nameSize))
+		if err != nil {
+			return nil, err
+		}
+		if int(typ&0xff) >= len(xattrPrefixes) {
+			return nil, errors.Errorf("unknown xattr type %d", typ)
+		}
+
+		valueSize, err := mr.u32()
+		if err != nil {
+			return nil, err
+		}
+		value, err := mr.read(int(valueSize))
+		if err != nil {
+			return nil, err
+		}
+
+		// out of line values are stored elsewhere, the inline value is
+		// a reference to them.
+		if typ&0x100 != 0 {
+			if len(value) != 8 {
+				return nil, errors.Errorf("bad out of line xattr reference")
+			}
+			ref := binary.LittleEndian.Uint64(value)
+			vr, err := sfs.newMetadataReader(sfs.xattrStart+ref>>16, uint16(ref))
+			if err != nil {
+				return nil, err
+			}
+			valueSize, err := vr.u32()
+			if err != nil {
+				return nil, err
+			}
+			value, err = vr.read(int(valueSize))
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		xattrs[xattrPrefixes[typ&0xff]+string(name)] = value
+	}
+	return xattrs, nil
+}
+
+func (sfs *FS) id(idx uint16) (uint32, error) {
+	if int(idx) >= len(sfs.ids) {
+		return 0, errors.Errorf("bad id index %d", idx)
+	}
+	return sfs.ids[idx], nil
+}
+
+func (sfs *FS) readInode(ref uint64) (*inode, error) {
+	mr, err := sfs.newMetadataReader(sfs.sb.inodeTableStart+ref>>16, uint16(ref))
+	if err != nil {
+		return nil, err
+	}
+
+	hdr, err := mr.read(16)
+	if err != nil {
+		return nil, err
+	}
+	i := &inode{
+		ref:   ref,
+		typ:   binary.LittleEndian.Uint16(hdr[0:2]),
+		perm:  binary.LittleEndian.Uint16(hdr[2:4]),
+		mtime: binary.LittleEndian.Uint32(hdr[8:12]),
+		ino:   binary.LittleEndian.Uint32(hdr[12:16]),
+		nlink: 1,
+		xattr: noXattr,
+	}
+	if i.uid, err = sfs.id(binary.LittleEndian.Uint16(hdr[4:6])); err != nil {
+		return nil, err
+	}
+	if i.gid, err = sfs.id(binary.LittleEndian.Uint16(hdr[6:8])); err != nil {
+		return nil, err
+	}
+
+	switch i.typ {
+	case inodeDir:
+		b, err := mr.read(16)
+		if err != nil {
+			return nil, err
+		}
+		i.dirBlock = binary.LittleEndian.Uint32(b[0:4])
+		i.nlink = binary.LittleEndian.Uint32(b[4:8])
+		i.dirSize = uint32(binary.LittleEndian.Uint16(b[8:10]))
+		i.dirOffset = binary.LittleEndian.Uint16(b[10:12])
+	case inodeLDir:
+		// the directory index that follows is only an optimization
+		b, err := mr.read(24)
+		if err != nil {
+			return nil, err
+		}
+		i.nlink = binary.LittleEndian.Uint32(b[0:4])
+		i.dirSize = binary.LittleEndian.Uint32(b[4:8])
+		i.dirBlock = binary.LittleEndian.Uint32(b[8:12])
+		i.dirOffset = binary.LittleEndian.Uint16(b[18:20])
+		i.xattr = binary.LittleEndian.Uint32(b[20:24])
+	case inodeFile:
+		b, err := mr.read(16)
+		if err != nil {
+			return nil, err
+		}
+		i.startBlock = uint64(binary.LittleEndian.Uint32(b[0:4]))
+		i.fragment = binary.LittleEndian.Uint32(b[4:8])
+		i.fragOffset = binary.LittleEndian.Uint32(b[8:12])
+		i.fileSize = uint64(binary.LittleEndian.Uint32(b[12:16]))
+		if err := sfs.readBlockList(mr, i); err != nil {
+			return nil, err
+		}
+	case inodeLFile:
+		b, err := mr.read(40)
+		if err != nil {
+			return nil, err
+		}
+		i.startBlock = binary.LittleEndian.Uint64(b[0:8])
+		i.fileSize = binary.LittleEndian.Uint64(b[8:16])
+		i.nlink = binary.LittleEndian.Uint32(b[24:28])
+		i.fragment = binary.LittleEndian.Uint32(b[28:32])
+		i.fragOffset = binary.LittleEndian.Uint32(b[32:36])
+		i.xattr = binary.LittleEndian.Uint32(b[36:40])
+		if err := sfs.readBlockList(mr, i); err != nil {
+			return nil, err
+		}
+	case inodeSymlink, inodeLSymlink:
+		b, err := mr.read(8)
+		if err != nil {
+			return nil, err
+		}
+		i.nlink = binary.LittleEndian.Uint32(b[0:4])
+		size := binary.LittleEndian.Uint32(b[4:8])
+		if size > unix.PathMax {
+			return nil, errors.Errorf("symlink target of %d bytes", size)
+		}
+		target, err := mr.read(int(size))
+		if err != nil {
+			return nil, err
+		}
+		i.target = string(target)
+		if i.typ == inodeLSymlink {
+			if i.xattr, err = mr.u32(); err != nil {
+				return nil, err
+			}
+		}
+	case inodeBlockDev, inodeCharDev, inodeLBlockDev, inodeLCharDev:
+		b, err := mr.read(8)
+		if err != nil {
+			return nil, err
+		}
+		i.nlink = binary.LittleEndian.Uint32(b[0:4])
+		i.rdev = binary.LittleEndian.Uint32(b[4:8])
+		if i.typ == inodeLBlockDev || i.typ == inodeLCharDev {
+			if i.xattr, err = mr.u32(); err != nil {
+				return nil, err
+			}
+		}
+	case inodeFifo, inodeSocket, inodeLFifo, inodeLSocket:
+		if i.nlink, err = mr.u32(); err != nil {
+			return nil, err
+		}
+		if i.typ == inodeLFifo || i.typ == inodeLSocket {
+			if i.xattr, err = mr.u32(); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, errors.Errorf("inode %d has unknown type %d", i.ino, i.typ)
+	}
+
+	return i, nil
+}
+
+func (sfs *FS) readBlockList(mr *metadataReader, i *inode) error {
+	bs := uint64(sfs.sb.blocksize)
+	count := i.fileSize / bs
+	if i.fragment == noFragment && i.fileSize%bs != 0 {
+		count++
+	}
+	if i.fragment != noFragment && int(i.fragment) >= len(sfs.fragments) {
+		return errors.Errorf("inode %d has bad fragment %d", i.ino, i.fragment)
+	}
+	// each block needs a 4 byte entry, so this bounds the allocation
+	// below by what the image could actually hold.
+	if count*4 > sfs.sb.size {
+		return errors.Errorf("inode %d has impossible size %d", i.ino, i.fileSize)
+	}
+	b, err := mr.read(int(count) * 4)
+	if err != nil {
+		return err
+	}
+	i.blocks = make([]uint32, count)
+	for n := range i.blocks {
+		i.blocks[n] = binary.LittleEndian.Uint32(b[4*n:])
+	}
+	return nil
+}
+
+func (i *inode) isDir() bool {
+	return i.typ == inodeDir || i.typ == inodeLDir
+}
+
+func (i *inode) isSymlink() bool {
+	return i.typ == inodeSymlink || i.typ == inodeLSymlink
+}
+
+func (i *inode) isRegular() bool {
+	return i.typ == inodeFile || i.typ == inodeLFile
+}
+
+func typeMode(typ uint16) fs.FileMode {
+	switch typ {
+	case inodeDir, inodeLDir:
+		return fs.ModeDir
+	case inodeSymlink, inodeLSymlink:
+		return fs.ModeSymlink
+	case inodeBlockDev, inodeLBlockDev:
+		return fs.ModeDevice
+	case inodeCharDev, inodeLCharDev:
+		return fs.ModeDevice | fs.ModeCharDevice
+	case inodeFifo, inodeLFifo:
+		return fs.ModeNamedPipe
+	case inodeSocket, inodeLSocket:
+		return fs.ModeSocket
+	}
+	return 0
+}
+
+func (i *inode) mode() fs.FileMode {
+	m := fs.FileMode(i.perm&0777) | typeMode(i.typ)
+	if i.perm&unix.S_ISUID != 0 {
+		m |= fs.ModeSetuid
+	}
+	if i.perm&unix.S_ISGID != 0 {
+		m |= fs.ModeSetgid
+	}
+	if i.perm&unix.S_ISVTX != 0 {
+		m |= fs.ModeSticky
+	}
+	return m
+}
+
+func (i *inode) size() int64 {
+	switch {
+	case i.isRegular():
+		return int64(i.fileSize)
+	case i.isSymlink():
+		return int64(len(i.target))
+	case i.isDir():
+		return int64(i.dirSize)
+	}
+	return 0
+}
+
+// readDir returns the entries of the directory i, in on-disk (sorted) order.
+func (sfs *FS) readDir(i *inode) ([]dirent, error) {
+	if !i.isDir() {
+		return nil, unix.ENOTDIR
+	}
+
+	sfs.mu.Lock()
+	ents, ok := sfs.dirs[i.ref]
+	sfs.mu.Unlock()
+	if ok {
+		return ents, nil
+	}
+
+	// the listing size includes 3 bytes for the "." and ".." entries
+	// that are never stored.
+	if i.dirSize <= 3 {
+		return nil, nil
+	}
+	remaining := int(i.dirSize) - 3
+
+	mr, err := sfs.newMetadataReader(sfs.sb.directoryTableStart+uint64(i.dirBlock), i.dirOffset)
+	if err != nil {
+		return nil, err
+	}
+
+	for remaining > 0 {
+		hdr, err := mr.read(12)
+		if err != nil {
+			return nil, err
+		}
+		remaining -= 12
+		count := int(binary.LittleEndian.Uint32(hdr[0:4])) + 1
+		startBlock := uint64(binary.LittleEndian.Uint32(hdr[4:8]))
+		if count > 256 {
+			return nil, errors.Errorf("directory header with %d entries", count)
+		}
+
+		for n := 0; n < count; n++ {
+			b, err := mr.read(8)
+			if err != nil {
+				return nil, err
+			}
+			nameSize := int(binary.LittleEndian.Uint16(b[6:8])) + 1
+			name, err := mr.read(nameSize)
+			if err != nil {
+				return nil, err
+			}
+			remaining -= 8 + nameSize
+			if !imagefs.ValidName(string(name)) {
+				return nil, errors.Errorf("bad directory entry name %q", name)
+			}
+			ents = append(ents, dirent{
+				name: string(name),
+				ref:  startBlock<<16 | uint64(binary.LittleEndian.Uint16(b[0:2])),
+				typ:  binary.LittleEndian.Uint16(b[4:6]),
+			})
+		}
+	}
+
+	sort.Slice(ents, func(a, b int) bool { return ents[a].name < ents[b].name })
+
+	sfs.mu.Lock()
+	if len(sfs.dirs) >= dirCacheSize {
+		sfs.dirs = map[uint64][]dirent{}
+	}
+	sfs.dirs[i.ref] = ents
+	sfs.mu.Unlock()
+	return ents, nil
+}
+
+func (sfs *FS) lookup(dir *inode, name string) (*inode, error) {
+	ents, err := sfs.readDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	n := sort.Search(len(ents), func(i int) bool { return ents[i].name >= name })
+	if n == len(ents) || ents[n].name != name {
+		return nil, fs.ErrNotExist
+	}
+	return sfs.readInode(ents[n].ref)
+}
+
+func (sfs *FS) resolve(op, name string, follow bool) (*inode, error) {
+	if !fs.ValidPath(name) {
+		return nil, imagefs.PathError(op, name, fs.ErrInvalid)
+	}
+	i, err := sfs.resolver.Resolve(name, follow)
+	if err != nil {
+		return nil, imagefs.PathError(op, name, err)
+	}
+	return i, nil
+}
+
+func (sfs *FS) stat(name string, i *inode) (fs.FileInfo, error) {
+	xattrs, err := sfs.readXattrs(i.xattr)
+	if err != nil {
+		return nil, err
+	}
+	// squashfs stores device numbers in the kernel's old 32 bit encoding
+	major := (i.rdev >> 8) & 0xfff
+	minor := (i.rdev & 0xff) | ((i.rdev >> 12) & 0xfff00)
+	return &fileInfo{
+		name: name,
+		i:    i,
+		stat: &imagefs.Stat{
+			Ino:    uint64(i.ino),
+			Nlink:  i.nlink,
+			Uid:    i.uid,
+			Gid:    i.gid,
+			Rdev:   unix.Mkdev(major, minor),
+			Xattrs: xattrs,
+		},
+	}, nil
+}
+
+func baseName(name string) string {
+	for n := len(name) - 1; n >= 0; n-- {
+		if name[n] == '/' {
+			return name[n+1:]
+		}
+	}
+	return name
+}
+
+// Open implements fs.FS, following symlinks within the image.
+func (sfs *FS) Open(name string) (fs.File, error) {
+	i, err := sfs.resolve("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return &file{sfs: sfs, name: name, i: i}, nil
+}
+
+// Stat implements fs.StatFS.
+func (sfs *FS) Stat(name string) (fs.FileInfo, error) {
+	i, err := sfs.resolve("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := sfs.stat(baseName(name), i)
+	if err != nil {
+		return nil, imagefs.PathError("stat", name, err)
+	}
+	return fi, nil
+}
+
+// Lstat is Stat without following a final symlink.
+func (sfs *FS) Lstat(name string) (fs.FileInfo, error) {
+	i, err := sfs.resolve("lstat", name, false)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := sfs.stat(baseName(name), i)
+	if err != nil {
+		return nil, imagefs.PathError("lstat", name, err)
+	}
+	return fi, nil
+}
+
+// ReadLink returns the target of the symlink name.
+func (sfs *FS) ReadLink(name string) (string, error) {
+	i, err := sfs.resolve("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+	if !i.isSymlink() {
+		return "", imagefs.PathError("readlink", name, fs.ErrInvalid)
+	}
+	return i.target, nil
+}
+
+// ReadDir implements fs.ReadDirFS.
+func (sfs *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	i, err := sfs.resolve("readdir", name, true)
+	if err != nil {
+		return nil, err
+	}
+	ents, err := sfs.dirEntries(i)
+	if err != nil {
+		return nil, imagefs.PathError("readdir", name, err)
+	}
+	return ents, nil
+}
+
+func (sfs *FS) dirEntries(i *inode) ([]fs.DirEntry, error) {
+	ents, err := sfs.readDir(i)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]fs.DirEntry, len(ents))
+	for n, e := range ents {
+		ret[n] = &dirEntry{sfs: sfs, dirent: e}
+	}
+	return ret, nil
+}
+
+type fileInfo struct {
+	name string
+	i    *inode
+	stat *imagefs.Stat
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return fi.i.size() }
+func (fi *fileInfo) Mode() fs.FileMode  { return fi.i.mode() }
+func (fi *fileInfo) ModTime() time.Time { return time.Unix(int64(fi.i.mtime), 0) }
+func (fi *fileInfo) IsDir() bool        { return fi.i.isDir() }
+func (fi *fileInfo) Sys() any           { return fi.stat }
+
+type dirEntry struct {
+	sfs *FS
+	dirent
+}
+
+func (de *dirEntry) Name() string      { return de.name }
+func (de *dirEntry) IsDir() bool       { return typeMode(de.typ).IsDir() }
+func (de *dirEntry) Type() fs.FileMode { return typeMode(de.typ) }
+
+func (de *dirEntry) Info() (fs.FileInfo, error) {
+	i, err := de.sfs.readInode(de.ref)
+	if err != nil {
+		return nil, err
+	}
+	return de.sfs.stat(de.name, i)
+}
+
+// file is an open file or directory. Regular files implement io.ReaderAt
+// and io.Seeker as well.
+type file struct {
+	sfs    *FS
+	name   string
+	i      *inode
+	offset int64
+	// directories
+	ents []fs.DirEntry
+	read bool
+	// the last data block read, and which it was
+	block    []byte
+	blockIdx int
+	// where each data block starts
+	blockPos []uint64
+}
+
+func (f *file) Stat() (fs.FileInfo, error) {
+	return f.sfs.stat(baseName(f.name), f.i)
+}
+
+func (f *file) Close() error {
+	return nil
+}
+
+func (f *file) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !f.i.isDir() {
+		return nil, imagefs.PathError("readdir", f.name, unix.ENOTDIR)
+	}
+	if !f.read {
+		ents, err := f.sfs.dirEntries(f.i)
+		if err != nil {
+			return nil, imagefs.PathError("readdir", f.name, err)
+		}
+		f.ents = ents
+		f.read = true
+	}
+	if n <= 0 {
+		ents := f.ents
+		f.ents = nil
+		return ents, nil
+	}
+	if len(f.ents) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(f.ents) {
+		n = len(f.ents)
+	}
+	ents := f.ents[:n]
+	f.ents = f.ents[n:]
+	return ents, nil
+}
+
+func (f *file) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.offset)
+	f.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.i.size()
+	default:
+		return 0, imagefs.PathError("seek", f.name, fs.ErrInvalid)
+	}
+	if offset < 0 {
+		return 0, imagefs.PathError("seek", f.name, fs.ErrInvalid)
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *file) ReadAt(p []byte, off int64) (int, error) {
+	if !f.i.isRegular() {
+		return 0, imagefs.PathError("read", f.name, fs.ErrInvalid)
+	}
+	if off < 0 {
+		return 0, imagefs.PathError("read", f.name, fs.ErrInvalid)
+	}
+
+	bs := int64(f.sfs.sb.blocksize)
+	size := int64(f.i.fileSize)
+	total := 0
+	for len(p) > 0 && off < size {
+		idx := int(off / bs)
+		block, err := f.dataBlock(idx)
+		if err != nil {
+			return total, imagefs.PathError("read", f.name, err)
+		}
+		within := off - int64(idx)*bs
+		if within >= int64(len(block)) {
+			return total, imagefs.PathError("read", f.name, errors.Errorf("block %d is short", idx))
+		}
+		n := copy(p, block[within:])
+		p = p[n:]
+		off += int64(n)
+		total += n
+	}
+	if len(p) > 0 {
+		return total, io.EOF
+	}
+	return total, nil
+}
+
+// dataBlock returns the decompressed contents of the file's idx'th block,
+// which is the tail end fragment when idx is past the block list.
+func (f *file) dataBlock(idx int) ([]byte, error) {
+	if f.block != nil && f.blockIdx == idx {
+		return f.block, nil
+	}
+
+	bs := int(f.sfs.sb.blocksize)
+	length := bs
+	if rest := int64(f.i.fileSize) - int64(idx)*int64(bs); rest < int64(bs) {
+		length = int(rest)
+	}
+
+	var block []byte
+	var err error
+	if idx < len(f.i.blocks) {
+		if f.blockPos == nil {
+			f.blockPos = make([]uint64, len(f.i.blocks))
+			pos := f.i.startBlock
+			for n, b := range f.i.blocks {
+				f.blockPos[n] = pos
+				pos += uint64(b &^ dataUncompressed)
+			}
+		}
+		block, err = f.sfs.readDataBlock(f.blockPos[idx], f.i.blocks[idx], length)
+	} else {
+		block, err = f.sfs.readFragment(f.i.fragment)
+		if err == nil {
+			start := int(f.i.fragOffset)
+			if start+length > len(block) {
+				return nil, errors.Errorf("fragment %d is too short", f.i.fragment)
+			}
+			block = block[start : start+length]
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(block) < length {
+		return nil, errors.Errorf("block %d is short", idx)
+	}
+
+	f.block = block[:length]
+	f.blockIdx = idx
+	return f.block, nil
+}
+
+func (sfs *FS) readDataBlock(pos uint64, sizeField uint32, length int) ([]byte, error) {
+	size := sizeField &^ dataUncompressed
+	if size == 0 {
+		// sparse
+		return make([]byte, length), nil
+	}
+	if size > sfs.sb.blocksize {
+		return nil, errors.Errorf("data block at %d is %d bytes", pos, size)
+	}
+	raw := make([]byte, size)
+	if _, err := sfs.r.ReadAt(raw, int64(pos)); err != nil {
+		return nil, errors.Wrapf(err, "couldn't read data block at %d", pos)
+	}
+	if sizeField&dataUncompressed != 0 {
+		return raw, nil
+	}
+	data, err := sfs.decompress(raw, int(sfs.sb.blocksize))
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't decompress data block at %d", pos)
+	}
+	return data, nil
+}
+
+func (sfs *FS) readFragment(idx uint32) ([]byte, error) {
+	sfs.mu.Lock()
+	if sfs.lastFrag == idx {
+		data := sfs.fragCache
+		sfs.mu.Unlock()
+		return data, nil
+	}
+	sfs.mu.Unlock()
+
+	if int(idx) >= len(sfs.fragments) {
+		return nil, errors.Errorf("bad fragment %d", idx)
+	}
+	frag := sfs.fragments[idx]
+	data, err := sfs.readDataBlock(frag.start, frag.size, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	sfs.mu.Lock()
+	sfs.lastFrag = idx
+	sfs.fragCache = data
+	sfs.mu.Unlock()
+	return data, nil
+}
+
+var _ imagefs.FS = &FS{}
+var _ fs.ReadDirFS = &FS{}
+var _ fs.StatFS = &FS{}
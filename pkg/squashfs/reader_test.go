@@ -0,0 +1,112 @@
+package squashfs
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"machinerun.io/atomfs/pkg/common"
+	"machinerun.io/atomfs/pkg/imagefs"
+	"machinerun.io/atomfs/pkg/verity"
+)
+
+func TestReader(t *testing.T) {
+	assert := assert.New(t)
+
+	if common.Which("mksquashfs") == "" {
+		t.Skip("mksquashfs not found")
+	}
+
+	rootfs, err := os.MkdirTemp("", "stacker_reader_test_rootfs")
+	require.NoError(t, err)
+	defer os.RemoveAll(rootfs)
+
+	tempdir, err := os.MkdirTemp("", "stacker_reader_test_tempdir")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempdir)
+
+	// bigger than a block, so it's got a block list and a fragment
+	big := make([]byte, 300*1024)
+	for i := range big {
+		big[i] = byte(i % 251)
+	}
+	require.NoError(t, os.MkdirAll(path.Join(rootfs, "dir", "sub"), 0750))
+	require.NoError(t, os.WriteFile(path.Join(rootfs, "dir", "big"), big, 0644))
+	require.NoError(t, os.WriteFile(path.Join(rootfs, "dir", "sub", "small"), []byte("hello"), 0600))
+	require.NoError(t, os.Symlink("dir/sub", path.Join(rootfs, "link")))
+	require.NoError(t, os.Link(path.Join(rootfs, "dir", "big"), path.Join(rootfs, "hardlink")))
+
+	reader, _, _, err := MakeSquashfs(tempdir, rootfs, nil, verity.VerityMetadataPresent)
+	if err == verity.CryptsetupTooOld {
+		t.Skip("libcryptsetup too old")
+	}
+	require.NoError(t, err)
+
+	image := path.Join(tempdir, "foo.squashfs")
+	out, err := os.Create(image)
+	require.NoError(t, err)
+	_, err = io.Copy(out, reader)
+	require.NoError(t, err)
+	reader.Close()
+	out.Close()
+
+	sfs, err := Open(image)
+	require.NoError(t, err)
+	defer sfs.Close()
+
+	content, err := fs.ReadFile(sfs, "dir/big")
+	assert.NoError(err)
+	assert.Equal(big, content)
+
+	// Open follows symlinks, Lstat and ReadLink don't
+	content, err = fs.ReadFile(sfs, "link/small")
+	assert.NoError(err)
+	assert.Equal("hello", string(content))
+
+	fi, err := sfs.Lstat("link")
+	assert.NoError(err)
+	assert.Equal(fs.ModeSymlink, fi.Mode().Type())
+	target, err := sfs.ReadLink("link")
+	assert.NoError(err)
+	assert.Equal("dir/sub", target)
+
+	fi, err = sfs.Stat("dir/sub")
+	assert.NoError(err)
+	assert.True(fi.IsDir())
+	assert.Equal(fs.FileMode(0750), fi.Mode().Perm())
+
+	a, err := sfs.Stat("dir/big")
+	assert.NoError(err)
+	b, err := sfs.Stat("hardlink")
+	assert.NoError(err)
+	assert.Equal(imagefs.StatOf(a).Ino, imagefs.StatOf(b).Ino)
+	assert.Equal(uint32(2), imagefs.StatOf(a).Nlink)
+
+	ents, err := sfs.ReadDir(".")
+	assert.NoError(err)
+	names := []string{}
+	for _, e := range ents {
+		names = append(names, e.Name())
+	}
+	assert.Equal([]string{"dir", "hardlink", "link"}, names)
+
+	_, err = sfs.Open("nope")
+	assert.ErrorIs(err, fs.ErrNotExist)
+
+	// and the extractor built on it
+	extractDir := path.Join(tempdir, "extracted")
+	policy, err := NewExtractPolicy("gosquash")
+	assert.NoError(err)
+	assert.NoError(ExtractSingleSquashPolicy(image, extractDir, policy))
+
+	content, err = os.ReadFile(path.Join(extractDir, "link", "small"))
+	assert.NoError(err)
+	assert.Equal("hello", string(content))
+	content, err = os.ReadFile(path.Join(extractDir, "hardlink"))
+	assert.NoError(err)
+	assert.Equal(big, content)
+}
@@ -18,6 +18,8 @@ import (
 	"github.com/Masterminds/semver/v3"
 	"github.com/pkg/errors"
 	"machinerun.io/atomfs/pkg/common"
+	"machinerun.io/atomfs/pkg/extract"
+	"machinerun.io/atomfs/pkg/imagefs"
 	"machinerun.io/atomfs/pkg/log"
 	types "machinerun.io/atomfs/pkg/types"
 	vrty "machinerun.io/atomfs/pkg/verity"
@@ -33,15 +35,26 @@ var once sync.Once
 var squashFuseInfo = squashFuseInfoStruct{"", "", false}
 
 const PolicyEnvName = "STACKER_SQUASHFS_EXTRACT_POLICY"
-const DefPolicies = "kmount squashfuse unsquashfs"
-const AllPolicies = "kmount squashfuse unsquashfs"
+const DefPolicies = "kmount squashfuse unsquashfs gosquash"
+const AllPolicies = "kmount squashfuse unsquashfs gosquash"
 
 func MakeSquashfs(tempdir string, rootfs string, eps *common.ExcludePaths, verity vrty.VerityMetadata) (io.ReadCloser, string, string, error) {
+	return MakeSquashfsWithOptions(tempdir, rootfs, eps, verity, types.MakeOptions{})
+}
+
+// MakeSquashfsWithOptions is MakeSquashfs with control over compression, block
+// size and parallelism. The returned media type reflects the compressor used.
+func MakeSquashfsWithOptions(tempdir string, rootfs string, eps *common.ExcludePaths, verity vrty.VerityMetadata, opts types.MakeOptions) (io.ReadCloser, string, string, error) {
 	var excludesFile string
 	var err error
 	var toExclude string
 	var rootHash string
 
+	settings, err := resolveMakeOptions(opts, mksquashfsSupportsCompressor)
+	if err != nil {
+		return nil, "", rootHash, err
+	}
+
 	if eps != nil {
 		toExclude, err = eps.String()
 		if err != nil {
@@ -81,24 +94,118 @@ func MakeSquashfs(tempdir string, rootfs string, eps *common.ExcludePaths, verit
 
 	defer os.Remove(tmpSquashfs.Name())
 
-	args := []string{rootfs, tmpSquashfs.Name()}
-	compression := GzipCompression
-	if mksquashfsSupportsZstd() {
-		args = append(args, "-comp", "zstd")
-		compression = ZstdCompression
+	reproArgs, reproducible, err := reproducibleArgs()
+	if err != nil {
+		return nil, "", rootHash, err
 	}
+
+	args := []string{rootfs, tmpSquashfs.Name()}
+	args = append(args, settings.mksquashfsArgs()...)
 	if len(toExclude) != 0 {
 		args = append(args, "-ef", excludesFile)
 	}
+	args = append(args, reproArgs...)
 	cmd := exec.Command("mksquashfs", args...)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
+	if reproducible {
+		// mksquashfs refuses SOURCE_DATE_EPOCH alongside -mkfs-time
+		cmd.Env = common.EnvWithout(common.SourceDateEpochKey)
+	}
 	if err = cmd.Run(); err != nil {
 		return nil, "", rootHash, errors.Wrap(err, "couldn't build squashfs")
 	}
 
 	if verity {
-		rootHash, err = vrty.AppendVerityData(tmpSquashfs.Name())
+		rootHash, err = appendVerityData(tmpSquashfs.Name(), reproducible)
+		if err != nil {
+			return nil, "", rootHash, err
+		}
+	}
+
+	blob, err := os.Open(tmpSquashfs.Name())
+	if err != nil {
+		return nil, "", rootHash, errors.WithStack(err)
+	}
+
+	return blob, GenerateSquashfsMediaType(settings.compression), rootHash, nil
+}
+
+// MakeSquashfsFromTar streams an uncompressed tar layer into sqfstar (from
+// squashfs-tools >= 4.6) or, failing that, tar2sqfs (from squashfs-tools-ng).
+// Ownership, modes and xattrs are taken from the tar headers, so no
+// privileges are needed to produce a correct image. OCI whiteouts in the
+// stream are converted to overlay whiteouts. The return values match those
+// of MakeSquashfs.
+func MakeSquashfsFromTar(tempdir string, tarStream io.Reader, verity vrty.VerityMetadata, opts types.MakeOptions) (io.ReadCloser, string, string, error) {
+	var rootHash string
+
+	tmpSquashfs, err := os.CreateTemp(tempdir, "stacker-squashfs-img-")
+	if err != nil {
+		return nil, "", rootHash, err
+	}
+	// see MakeSquashfs for why we only want the name here.
+	tmpSquashfs.Close()
+	os.Remove(tmpSquashfs.Name())
+
+	defer os.Remove(tmpSquashfs.Name())
+
+	reproArgs, reproducible, err := reproducibleArgs()
+	if err != nil {
+		return nil, "", rootHash, err
+	}
+
+	var settings squashfsSettings
+	var cmd *exec.Cmd
+	if p := common.Which("sqfstar"); p != "" {
+		// sqfstar may come from another squashfs-tools build than
+		// mksquashfs, or without it
+		settings, err = resolveMakeOptions(opts, func(c SquashfsCompression) bool {
+			return tarToolSupportsCompressor(p, c)
+		})
+		if err != nil {
+			return nil, "", rootHash, err
+		}
+		args := settings.mksquashfsArgs()
+		args = append(args, reproArgs...)
+		args = append(args, tmpSquashfs.Name())
+		cmd = exec.Command(p, args...)
+		if reproducible {
+			cmd.Env = common.EnvWithout(common.SourceDateEpochKey)
+		}
+	} else if p := common.Which("tar2sqfs"); p != "" {
+		settings, err = resolveMakeOptions(opts, func(c SquashfsCompression) bool {
+			return tarToolSupportsCompressor(p, c)
+		})
+		if err != nil {
+			return nil, "", rootHash, err
+		}
+		args := []string{"--quiet"}
+		args = append(args, settings.tar2sqfsArgs()...)
+		if reproducible {
+			epoch, _, _ := common.SourceDateEpoch()
+			args = append(args, "--no-keep-time", "--defaults", fmt.Sprintf("mtime=%d", epoch))
+		}
+		args = append(args, tmpSquashfs.Name())
+		cmd = exec.Command(p, args...)
+	} else {
+		return nil, "", rootHash, errors.Errorf("neither sqfstar nor tar2sqfs found in PATH")
+	}
+
+	converted := common.NewOverlayWhiteoutReader(tarStream)
+	cmd.Stdin = converted
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	if convErr := converted.Close(); convErr != nil && err == nil {
+		err = convErr
+	}
+	if err != nil {
+		return nil, "", rootHash, errors.Wrapf(err, "couldn't build squashfs from tar with %s", cmd.Path)
+	}
+
+	if verity {
+		rootHash, err = appendVerityData(tmpSquashfs.Name(), reproducible)
 		if err != nil {
 			return nil, "", rootHash, err
 		}
@@ -109,7 +216,29 @@ func MakeSquashfs(tempdir string, rootfs string, eps *common.ExcludePaths, verit
 		return nil, "", rootHash, errors.WithStack(err)
 	}
 
-	return blob, GenerateSquashfsMediaType(compression), rootHash, nil
+	return blob, GenerateSquashfsMediaType(settings.compression), rootHash, nil
+}
+
+// reproducibleArgs returns the mksquashfs/sqfstar arguments which pin all
+// timestamps to SOURCE_DATE_EPOCH, and whether it was set. mksquashfs already
+// sorts directory entries and its output is independent of the number of
+// processors, so that is all that is needed.
+func reproducibleArgs() ([]string, bool, error) {
+	epoch, ok, err := common.SourceDateEpoch()
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	ts := fmt.Sprintf("%d", epoch)
+	return []string{"-mkfs-time", ts, "-all-time", ts}, true, nil
+}
+
+// appendVerityData appends verity data with a content-derived salt for
+// reproducible builds, or a random one otherwise.
+func appendVerityData(file string, reproducible bool) (string, error) {
+	if reproducible {
+		return vrty.AppendReproducibleVerityData(file)
+	}
+	return vrty.AppendVerityData(file)
 }
 
 func findSquashFuseInfo() {
@@ -289,49 +418,22 @@ func squashFuse(squashFile, extractDir string) (*exec.Cmd, error) {
 	return cmd, nil
 }
 
-type ExtractPolicy struct {
-	Extractors  []types.FsExtractor
-	Extractor   types.FsExtractor
-	Excuses     map[string]error
-	initialized bool
-	mutex       sync.Mutex
-}
-
-var exPolInfo struct {
-	once   sync.Once
-	err    error
-	policy *ExtractPolicy
-}
+// ExtractPolicy is how squashfs images are extracted.
+type ExtractPolicy = extract.Policy
 
-func NewExtractPolicy(args ...string) (*ExtractPolicy, error) {
-	p := &ExtractPolicy{
-		Extractors: []types.FsExtractor{},
-		Excuses:    map[string]error{},
-	}
-
-	allEx := []types.FsExtractor{
+// Extractors returns all the ways of extracting squashfs images.
+func Extractors() []types.FsExtractor {
+	return []types.FsExtractor{
 		&KernelExtractor{},
 		&SquashFuseExtractor{},
 		&UnsquashfsExtractor{},
+		&GoSquashExtractor{},
 	}
-	byName := map[string]types.FsExtractor{}
-	for _, i := range allEx {
-		byName[i.Name()] = i
-	}
+}
 
-	for _, i := range args {
-		extractor, ok := byName[i]
-		if !ok {
-			return nil, errors.Errorf("Unknown extractor: '%s'", i)
-		}
-		excuse := extractor.IsAvailable()
-		if excuse != nil {
-			p.Excuses[i] = excuse
-			continue
-		}
-		p.Extractors = append(p.Extractors, extractor)
-	}
-	return p, nil
+// NewExtractPolicy returns a policy using the named extractors in order.
+func NewExtractPolicy(args ...string) (*ExtractPolicy, error) {
+	return extract.NewPolicy(Extractors(), extract.WithOrder(args...))
 }
 
 type UnsquashfsExtractor struct {
@@ -391,6 +493,60 @@ func (k *UnsquashfsExtractor) Mount(squashFile, extractDir string) error {
 	return nil
 }
 
+// GoSquashExtractor extracts with the built in squashfs reader, so it needs
+// neither privileges nor any tools.
+type GoSquashExtractor struct {
+	mutex sync.Mutex
+}
+
+func (k *GoSquashExtractor) Name() string {
+	return "gosquash"
+}
+
+func (k *GoSquashExtractor) IsAvailable() error {
+	return nil
+}
+
+func (k *GoSquashExtractor) Mount(squashFile, extractDir string) error {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	// check if already extracted
+	empty, err := common.IsEmptyDir(extractDir)
+	if err != nil {
+		return errors.Wrapf(err, "Error checking for empty dir")
+	}
+	if !empty {
+		return nil
+	}
+
+	log.Debugf("gosquash %s -> %s", squashFile, extractDir)
+	sfs, err := Open(squashFile)
+	if err != nil {
+		return err
+	}
+	defer sfs.Close()
+
+	err = imagefs.Extract(sfs, extractDir)
+	if err != nil {
+		if rmErr := os.RemoveAll(extractDir); rmErr != nil {
+			log.Errorf("Failed to remove %s after failed extraction of %s: %v", extractDir, squashFile, rmErr)
+		}
+		return err
+	}
+
+	empty, err = common.IsEmptyDir(extractDir)
+	if err != nil {
+		return errors.Errorf("Failed to read %s after successful extraction of %s: %v",
+			extractDir, squashFile, err)
+	}
+	if empty {
+		return errors.Errorf("%s was an empty fs image", squashFile)
+	}
+
+	return nil
+}
+
 type KernelExtractor struct {
 	mutex sync.Mutex
 }
@@ -416,6 +572,10 @@ func (k *KernelExtractor) Mount(squashFile, extractDir string) error {
 		return nil
 	}
 
+	if err := checkKernelSupport(squashFile); err != nil {
+		return err
+	}
+
 	ecmd := []string{"mount", "-tsquashfs", "-oloop,ro", squashFile, extractDir}
 	var output bytes.Buffer
 	cmd := exec.Command(ecmd[0], ecmd[1:]...)
@@ -482,105 +642,53 @@ func (k *SquashFuseExtractor) Mount(squashFile, extractDir string) error {
 	return nil
 }
 
-// ExtractSingleSquashPolicy - extract squashfile to extractDir
+// ExtractSingleSquashPolicy - extract squashFile to extractDir
 func ExtractSingleSquashPolicy(squashFile, extractDir string, policy *ExtractPolicy) error {
-	const initName = "init"
 	if policy == nil {
 		return errors.Errorf("policy cannot be nil")
 	}
+	return policy.Extract(squashFile, extractDir)
+}
 
-	// avoid taking a lock if already initialized (possibly premature optimization)
-	if !policy.initialized {
-		policy.mutex.Lock()
-		// We may have been waiting on the initializer. If so, then the policy will now be initialized.
-		// if not, then we are the initializer.
-		if !policy.initialized {
-			defer policy.mutex.Unlock()
-			defer func() {
-				policy.initialized = true
-			}()
-		} else {
-			policy.mutex.Unlock()
-		}
+// ExtractSingleSquashVerified - extract squashFile to extractDir as policy
+// says, checking it against rootHash first if the policy requires verity.
+func ExtractSingleSquashVerified(squashFile, extractDir, rootHash string, policy *ExtractPolicy) error {
+	if policy == nil {
+		return errors.Errorf("policy cannot be nil")
 	}
-
-	err := os.MkdirAll(extractDir, 0755)
-	if err != nil {
-		return err
+	if !policy.RequireVerity {
+		return policy.Extract(squashFile, extractDir)
 	}
-
-	fdest, err := filepath.Abs(extractDir)
+	info, err := Inspect(squashFile)
 	if err != nil {
 		return err
 	}
+	return policy.ExtractVerified(squashFile, extractDir, info.VerityOffset, rootHash)
+}
 
-	if policy.initialized {
-		if err, ok := policy.Excuses[initName]; ok {
-			return err
-		}
-		return policy.Extractor.Mount(squashFile, fdest)
-	}
-
-	// At this point we are the initialzer
-	if policy.Excuses == nil {
-		policy.Excuses = map[string]error{}
-	}
-
-	if len(policy.Extractors) == 0 {
-		policy.Excuses[initName] = errors.Errorf("policy had no extractors")
-		return policy.Excuses[initName]
-	}
-
-	var extractor types.FsExtractor
-	allExcuses := []string{}
-	for _, extractor = range policy.Extractors {
-		err = extractor.Mount(squashFile, fdest)
-		if err == nil {
-			policy.Extractor = extractor
-			log.Debugf("Selected squashfs extractor %s", extractor.Name())
-			return nil
-		}
-		policy.Excuses[extractor.Name()] = err
-	}
-
-	for n, exc := range policy.Excuses {
-		allExcuses = append(allExcuses, fmt.Sprintf("%s: %v", n, exc))
-	}
-
-	// nothing worked. populate Excuses[initName]
-	policy.Excuses[initName] = errors.Errorf("No suitable extractor found:\n %s", strings.Join(allExcuses, "\n  "))
-	return policy.Excuses[initName]
+// DefaultExtractPolicy returns the policy ExtractSingleSquash uses, set up
+// by the extract config file and $STACKER_SQUASHFS_EXTRACT_POLICY.
+func DefaultExtractPolicy() (*ExtractPolicy, error) {
+	return extract.Default("squashfs", Extractors(), PolicyEnvName, DefPolicies)
 }
 
-// ExtractSingleSquash - extract the squashFile to extractDir
-// Initialize a extractPolicy struct and then call ExtractSingleSquashPolicy
-// wik()th that.
+// ExtractSingleSquash - extract the squashFile to extractDir with the
+// default policy.
 func ExtractSingleSquash(squashFile string, extractDir string) error {
-	exPolInfo.once.Do(func() {
-		val := os.Getenv(PolicyEnvName)
-		if val == "" {
-			val = DefPolicies
-		}
-		exPolInfo.policy, exPolInfo.err = NewExtractPolicy(strings.Fields(val)...)
-		if exPolInfo.err == nil {
-			for k, v := range exPolInfo.policy.Excuses {
-				log.Debugf(" squashfs extractor %s is not available: %v", k, v)
-			}
-		}
-	})
-
-	if exPolInfo.err != nil {
-		return exPolInfo.err
+	policy, err := DefaultExtractPolicy()
+	if err != nil {
+		return err
 	}
-
-	return ExtractSingleSquashPolicy(squashFile, extractDir, exPolInfo.policy)
+	return ExtractSingleSquashPolicy(squashFile, extractDir, policy)
 }
 
-var checkZstdSupported sync.Once
-var zstdIsSuspported bool
+var checkMksquashfsHelp sync.Once
+var mksquashfsHelpText string
 
-func mksquashfsSupportsZstd() bool {
-	checkZstdSupported.Do(func() {
+// mksquashfsHelp returns the output of `mksquashfs --help`, which lists the
+// compressors it was built with.
+func mksquashfsHelp() string {
+	checkMksquashfsHelp.Do(func() {
 		var stdoutBuffer strings.Builder
 		var stderrBuffer strings.Builder
 
@@ -591,11 +699,19 @@ func mksquashfsSupportsZstd() bool {
 		// Ignore errs here as `mksquashfs --help` exit status code is 1
 		_ = cmd.Run()
 
-		if strings.Contains(stdoutBuffer.String(), "zstd") ||
-			strings.Contains(stderrBuffer.String(), "zstd") {
-			zstdIsSuspported = true
-		}
+		mksquashfsHelpText = stdoutBuffer.String() + stderrBuffer.String()
 	})
 
-	return zstdIsSuspported
+	return mksquashfsHelpText
+}
+
+func mksquashfsSupportsCompressor(comp SquashfsCompression) bool {
+	return strings.Contains(mksquashfsHelp(), string(comp))
+}
+
+// tarToolSupportsCompressor reports whether sqfstar or tar2sqfs, at path
+// tool, was built with comp; each lists its compressors in its --help.
+func tarToolSupportsCompressor(tool string, comp SquashfsCompression) bool {
+	out, _ := exec.Command(tool, "--help").CombinedOutput()
+	return strings.Contains(string(out), string(comp))
 }
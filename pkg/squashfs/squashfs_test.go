@@ -0,0 +1,43 @@
+package squashfs
+
+import (
+	"io"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"machinerun.io/atomfs/pkg/common"
+	"machinerun.io/atomfs/pkg/imagefs/imagefstest"
+	types "machinerun.io/atomfs/pkg/types"
+	"machinerun.io/atomfs/pkg/verity"
+)
+
+func TestMakeSquashfsFromTar(t *testing.T) {
+	assert := assert.New(t)
+
+	if common.Which("sqfstar") == "" && common.Which("tar2sqfs") == "" {
+		t.Skip("neither sqfstar nor tar2sqfs found")
+	}
+
+	tempdir := t.TempDir()
+	reader, mediaType, rootHash, err := MakeSquashfsFromTar(tempdir, imagefstest.WhiteoutLayer(t), verity.VerityMetadataMissing, types.MakeOptions{})
+	require.NoError(t, err)
+	assert.True(IsSquashfsMediaType(mediaType))
+	assert.Empty(rootHash)
+
+	image := path.Join(tempdir, "layer.squashfs")
+	out, err := os.Create(image)
+	require.NoError(t, err)
+	_, err = io.Copy(out, reader)
+	require.NoError(t, err)
+	reader.Close()
+	out.Close()
+
+	sfs, err := Open(image)
+	require.NoError(t, err)
+	defer sfs.Close()
+
+	imagefstest.CheckWhiteoutLayer(t, sfs)
+}
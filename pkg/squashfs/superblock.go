@@ -46,7 +46,6 @@ type inodeRef struct {
 	offset uint16
 }
 
-// nolint:unused // copied from diskfs
 func (i *inodeRef) toUint64() uint64 {
 	var u uint64
 	u |= (uint64(i.block) << 16)
@@ -212,7 +211,7 @@ func parseSuperblock(b []byte) (*superblock, error) {
 	majorVersion := binary.LittleEndian.Uint16(b[28:30])
 	minorVersion := binary.LittleEndian.Uint16(b[30:32])
 	if majorVersion != superblockMajorVersion || minorVersion != superblockMinorVersion {
-		return nil, errors.Errorf("superblock version mismatch, received %d.%d instead of expected %d.%d", majorVersion, minorVersion, superblockMajorVersion, superblockMinorVersion)
+		return nil, errors.Errorf("squashfs version %d.%d is not supported, only %d.%d; unsquashfs can extract older images", majorVersion, minorVersion, superblockMajorVersion, superblockMinorVersion)
 	}
 
 	blocksize := binary.LittleEndian.Uint32(b[12:16])
@@ -0,0 +1,76 @@
+package squashfs
+
+import (
+	"fmt"
+
+	"machinerun.io/atomfs/pkg/common"
+)
+
+// kernelCompression holds the kernel config option for each compressor
+// squashfs images can be mounted with, and the first kernel release that
+// has it. lzma never made it upstream.
+var kernelCompression = map[compression]struct {
+	config string
+	since  common.KernelVersion
+}{
+	compressionGzip: {"CONFIG_SQUASHFS_ZLIB", common.KernelVersion{Major: 2, Minor: 6}},
+	compressionLzo:  {"CONFIG_SQUASHFS_LZO", common.KernelVersion{Major: 2, Minor: 6}},
+	compressionXz:   {"CONFIG_SQUASHFS_XZ", common.KernelVersion{Major: 2, Minor: 6}},
+	compressionLz4:  {"CONFIG_SQUASHFS_LZ4", common.KernelVersion{Major: 3, Minor: 19}},
+	compressionZstd: {"CONFIG_SQUASHFS_ZSTD", common.KernelVersion{Major: 4, Minor: 14}},
+}
+
+// unsupportedByKernel describes what kernel can't handle about the image,
+// or returns "" if it can mount it. What its config, if it's known, says
+// wins; otherwise kernel's version is all there is to go on, and guessed
+// is true.
+func unsupportedByKernel(sb *superblock, kernel common.KernelVersion, config common.KernelConfig) (what string, guessed bool) {
+	comp, ok := kernelCompression[sb.compression]
+	if !ok {
+		return fmt.Sprintf("%s compression", sb.compression), false
+	}
+	if enabled, ok := config.Enabled(comp.config); ok {
+		if !enabled {
+			return fmt.Sprintf("%s compression (%s is not set)", sb.compression, comp.config), false
+		}
+		return "", false
+	}
+	if !kernel.AtLeast(comp.since) {
+		return fmt.Sprintf("%s compression (kernel %s or later)", sb.compression, comp.since), true
+	}
+	return "", true
+}
+
+// checkKernelSupport returns an error naming what the running kernel can't
+// handle about the image at path, so we can fail before mount(2) gives a
+// bare EINVAL.
+func checkKernelSupport(path string) error {
+	sb, err := readSuperblock(path)
+	if err != nil {
+		return err
+	}
+	kernel, err := common.RunningKernelVersion()
+	if err != nil {
+		return err
+	}
+	config, err := common.RunningKernelConfig()
+	if err != nil {
+		return err
+	}
+	what, guessed := unsupportedByKernel(sb, kernel, config)
+	if what == "" {
+		return nil
+	}
+
+	alternatives := []string{"squashfuse", "unsquashfs"}
+	if sb.compression != compressionLzo {
+		alternatives = append(alternatives, "gosquash")
+	}
+	return &common.UnsupportedFeatureError{
+		Image:        path,
+		Feature:      what,
+		By:           "kernel " + kernel.String(),
+		Guessed:      guessed,
+		Alternatives: alternatives,
+	}
+}
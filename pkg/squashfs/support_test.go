@@ -0,0 +1,30 @@
+package squashfs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"machinerun.io/atomfs/pkg/common"
+)
+
+func TestKernelSupport(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	check := func(comp compression, kernel common.KernelVersion, config common.KernelConfig) [2]any {
+		what, guessed := unsupportedByKernel(&superblock{compression: comp}, kernel, config)
+		return [2]any{what, guessed}
+	}
+	v54, v44 := common.KernelVersion{Major: 5, Minor: 4}, common.KernelVersion{Major: 4, Minor: 4}
+
+	// without its config, the kernel's version is all there is to go on
+	assert.Equal([2]any{"", true}, check(compressionZstd, v54, nil))
+	assert.Equal([2]any{"zstd compression (kernel 4.14 or later)", true}, check(compressionZstd, v44, nil))
+	assert.Equal([2]any{"lzma compression", false}, check(compressionLzma, common.KernelVersion{Major: 6, Minor: 10}, nil))
+
+	// with it, what it says wins
+	config := common.KernelConfig{"CONFIG_SQUASHFS_ZSTD": "n", "CONFIG_SQUASHFS_XZ": "m"}
+	assert.Equal([2]any{"zstd compression (CONFIG_SQUASHFS_ZSTD is not set)", false}, check(compressionZstd, v54, config))
+	assert.Equal([2]any{"", false}, check(compressionXz, v54, config))
+	assert.Equal([2]any{"", true}, check(compressionGzip, v54, config))
+}
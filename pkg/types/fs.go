@@ -2,16 +2,61 @@ package fs
 
 import (
 	"io"
+	"time"
 
 	"machinerun.io/atomfs/pkg/common"
+	"machinerun.io/atomfs/pkg/extract"
 	"machinerun.io/atomfs/pkg/verity"
 )
 
+// MakeOptions tunes how a filesystem image is built. The zero value selects
+// each backend's defaults.
+type MakeOptions struct {
+	// Compression is the compressor to use: one of gzip, xz, lz4, lz4hc or
+	// zstd. Not every backend supports every compressor.
+	Compression string
+	// CompressionLevel is passed on to the compressor when non-zero.
+	CompressionLevel int
+	// BlockSize is the squashfs block size, or the erofs maximum physical
+	// cluster size, in bytes, when non-zero.
+	BlockSize int
+	// Workers is the number of compression threads, when non-zero.
+	Workers int
+}
+
+// ImageInfo is what a filesystem image's superblock says about it.
+type ImageInfo struct {
+	Type FilesystemType
+	// Compression names the compressors the image may use, none if it's
+	// uncompressed.
+	Compression []string
+	BlockSize   uint32
+	Inodes      uint64
+	// Features are the optional on-disk features in use.
+	Features  []string
+	BuildTime time.Time
+	// Size is the size of the image file, including any verity data.
+	Size int64
+	// VerityOffset is the filesystem's length padded as for verity, i.e.
+	// where the verity data starts if there is any.
+	VerityOffset uint64
+}
+
 type Filesystem interface {
 	// Make creates a new filesystem image.
-	Make(tempdir string, rootfs string, eps *common.ExcludePaths, verity verity.VerityMetadata) (io.ReadCloser, string, string, error)
+	Make(tempdir string, rootfs string, eps *common.ExcludePaths, verity verity.VerityMetadata, opts MakeOptions) (io.ReadCloser, string, string, error)
+	// MakeFromTar creates a new filesystem image from an uncompressed tar stream.
+	MakeFromTar(tempdir string, tarStream io.Reader, verity verity.VerityMetadata, opts MakeOptions) (io.ReadCloser, string, string, error)
+	// Inspect describes a filesystem image from its superblock.
+	Inspect(fsImgFile string) (*ImageInfo, error)
 	// ExtractSingle extracts a filesystem image.
 	ExtractSingle(fsImgFile string, extractDir string) error
+	// Extractors returns all the ways of extracting the filesystem's
+	// images, to make an extract.Policy from.
+	Extractors() []FsExtractor
+	// ExtractSinglePolicy extracts a filesystem image as policy says. The
+	// rootHash is only needed if the policy requires verity.
+	ExtractSinglePolicy(fsImgFile, extractDir, rootHash string, policy *extract.Policy) error
 	// Mount mounts a filesystem image on a given mountpoint.
 	Mount(fsImgFile, mountpoint, rootHash string) error
 	// Unmount umounts a filesystem image.
@@ -20,11 +65,5 @@ type Filesystem interface {
 
 type FilesystemType string
 
-type FsExtractor interface {
-	Name() string
-	IsAvailable() error
-	// Mount - Mount or extract path to dest.
-	//   Return nil on "already extracted"
-	//   Return error on failure.
-	Mount(path, dest string) error
-}
+// FsExtractor is one way of extracting a filesystem's images.
+type FsExtractor = extract.Extractor
@@ -0,0 +1,238 @@
+// Package userns re-executes the running program in new user and mount
+// namespaces, so an unprivileged user can make the mounts atomfs needs. The
+// caller is mapped to root in the namespace, and the ranges /etc/subuid and
+// /etc/subgid give it to the ids after that, so images with files owned by
+// other users keep their ownership.
+package userns
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"machinerun.io/atomfs/pkg/common"
+	"machinerun.io/atomfs/pkg/log"
+)
+
+// Mapping is one line of a uid_map or gid_map.
+type Mapping struct {
+	ContainerID uint32
+	HostID      uint32
+	Size        uint32
+}
+
+func (m Mapping) String() string {
+	return fmt.Sprintf("%d %d %d", m.ContainerID, m.HostID, m.Size)
+}
+
+// ParseMapping parses a mapping written as container:host:size, the way
+// lxc and podman take them on the command line.
+func ParseMapping(s string) (Mapping, error) {
+	fields := strings.Split(s, ":")
+	if len(fields) != 3 {
+		return Mapping{}, errors.Errorf("bad id mapping %q, want container:host:size", s)
+	}
+	ids := [3]uint32{}
+	for i, f := range fields {
+		n, err := strconv.ParseUint(f, 10, 32)
+		if err != nil {
+			return Mapping{}, errors.Errorf("bad id mapping %q, want container:host:size", s)
+		}
+		ids[i] = uint32(n)
+	}
+	if ids[2] == 0 {
+		return Mapping{}, errors.Errorf("bad id mapping %q: size can't be 0", s)
+	}
+	return Mapping{ContainerID: ids[0], HostID: ids[1], Size: ids[2]}, nil
+}
+
+// ParseSubIDs returns the ranges an /etc/subuid or /etc/subgid style file
+// gives to the user called name or with the given id, mapped one after
+// another starting at id 1 in the namespace.
+func ParseSubIDs(r io.Reader, name string, id int) ([]Mapping, error) {
+	ids := strconv.Itoa(id)
+	mappings := []Mapping{}
+	next := uint32(1)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ":")
+		if len(fields) != 3 || (fields[0] != name && fields[0] != ids) {
+			continue
+		}
+		start, err := strconv.ParseUint(fields[1], 10, 32)
+		if err != nil {
+			return nil, errors.Errorf("bad subordinate id range %q", line)
+		}
+		count, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			return nil, errors.Errorf("bad subordinate id range %q", line)
+		}
+		if count == 0 {
+			continue
+		}
+		mappings = append(mappings, Mapping{ContainerID: next, HostID: uint32(start), Size: uint32(count)})
+		next += uint32(count)
+	}
+	return mappings, errors.WithStack(scanner.Err())
+}
+
+// idMappings maps id to root and then whatever subIDFile gives the user.
+func idMappings(subIDFile, name string, id int) []Mapping {
+	mappings := []Mapping{{ContainerID: 0, HostID: uint32(id), Size: 1}}
+	f, err := os.Open(subIDFile)
+	if err != nil {
+		return mappings
+	}
+	defer f.Close()
+	sub, err := ParseSubIDs(f, name, id)
+	if err != nil {
+		log.Warnf("ignoring %s: %v", subIDFile, err)
+		return mappings
+	}
+	return append(mappings, sub...)
+}
+
+// writeMappings sets up the namespace of pid, with newuidmap and
+// newgidmap if there are subordinate ids to map, or by writing the
+// caller's own ids directly if not.
+func writeMappings(pid int, uids, gids []Mapping) error {
+	newuidmap, newgidmap := common.Which("newuidmap"), common.Which("newgidmap")
+	if len(uids) > 1 && len(gids) > 1 && newuidmap != "" && newgidmap != "" {
+		for _, m := range []struct {
+			helper   string
+			mappings []Mapping
+		}{{newuidmap, uids}, {newgidmap, gids}} {
+			args := []string{strconv.Itoa(pid)}
+			for _, mapping := range m.mappings {
+				args = append(args, strings.Fields(mapping.String())...)
+			}
+			if out, err := exec.Command(m.helper, args...).CombinedOutput(); err != nil {
+				return errors.Wrapf(err, "%s failed: %s", m.helper, strings.TrimSpace(string(out)))
+			}
+		}
+		return nil
+	}
+
+	log.Debugf("no subordinate ids or new[ug]idmap, mapping only uid %d and gid %d", uids[0].HostID, gids[0].HostID)
+	proc := fmt.Sprintf("/proc/%d/", pid)
+	if err := os.WriteFile(proc+"uid_map", []byte(uids[0].String()), 0); err != nil {
+		return errors.Wrapf(err, "couldn't write uid_map")
+	}
+	// an unprivileged gid_map needs setgroups disabled
+	if err := os.WriteFile(proc+"setgroups", []byte("deny"), 0); err != nil {
+		return errors.Wrapf(err, "couldn't write setgroups")
+	}
+	if err := os.WriteFile(proc+"gid_map", []byte(gids[0].String()), 0); err != nil {
+		return errors.Wrapf(err, "couldn't write gid_map")
+	}
+	return nil
+}
+
+// syncFdEnv tells the re-executed program which descriptor to wait on for
+// its id mappings.
+const syncFdEnv = "_ATOMFS_USERNS_SYNC_FD"
+
+// Cmd is the running program re-executed in new user and mount namespaces.
+type Cmd struct {
+	*exec.Cmd
+	sync *os.File
+}
+
+// Command returns the running program with args, to be run in new user and
+// mount namespaces. Further ExtraFiles may be appended, but they start at
+// descriptor 4.
+func Command(args ...string) (*Cmd, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't find the running program")
+	}
+
+	syncR, syncW, err := os.Pipe()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	cmd := exec.Command(self, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(common.EnvWithout(syncFdEnv), syncFdEnv+"=3")
+	cmd.ExtraFiles = []*os.File{syncR}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Cloneflags: syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS}
+	return &Cmd{Cmd: cmd, sync: syncW}, nil
+}
+
+// Start starts c and maps its ids.
+func (c *Cmd) Start() error {
+	defer c.sync.Close()
+	err := c.Cmd.Start()
+	c.ExtraFiles[0].Close()
+	if err != nil {
+		return errors.Wrapf(err, "couldn't start %s in a user namespace", c.Path)
+	}
+
+	u, err := user.Current()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	uids := idMappings("/etc/subuid", u.Username, os.Getuid())
+	gids := idMappings("/etc/subgid", u.Username, os.Getgid())
+	if err := writeMappings(c.Process.Pid, uids, gids); err != nil {
+		_ = c.Process.Kill()
+		_ = c.Wait()
+		return err
+	}
+
+	if _, err := c.sync.Write([]byte{0}); err != nil {
+		return errors.Wrapf(err, "couldn't start %s in a user namespace", c.Path)
+	}
+	return nil
+}
+
+// Run starts c and waits for it to finish.
+func (c *Cmd) Run() error {
+	if err := c.Start(); err != nil {
+		return err
+	}
+	return c.Wait()
+}
+
+// Enter must be called first thing by programs that use Command. In the
+// re-executed program, it waits for the id mappings and then executes the
+// program again: the capabilities a process has in a new user namespace
+// are lost when it execs as an unmapped user, which it was at first.
+func Enter() error {
+	fd := os.Getenv(syncFdEnv)
+	if fd == "" {
+		return nil
+	}
+	n, err := strconv.Atoi(fd)
+	if err != nil {
+		return errors.Errorf("bad %s %q", syncFdEnv, fd)
+	}
+
+	sync := os.NewFile(uintptr(n), "userns-sync")
+	b := make([]byte, 1)
+	_, err = sync.Read(b)
+	sync.Close()
+	if err != nil {
+		return errors.Wrapf(err, "parent failed to set up the user namespace")
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(syscall.Exec(self, os.Args, common.EnvWithout(syncFdEnv)))
+}
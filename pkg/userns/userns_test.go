@@ -0,0 +1,55 @@
+package userns
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSubIDs(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	subuid := `# comment
+other:100000:65536
+me:200000:1000
+
+1000:300000:500
+me:400000:0
+`
+	mappings, err := ParseSubIDs(strings.NewReader(subuid), "me", 1000)
+	assert.NoError(err)
+	assert.Equal([]Mapping{
+		{ContainerID: 1, HostID: 200000, Size: 1000},
+		{ContainerID: 1001, HostID: 300000, Size: 500},
+	}, mappings)
+
+	mappings, err = ParseSubIDs(strings.NewReader(subuid), "nobody", 65534)
+	assert.NoError(err)
+	assert.Empty(mappings)
+
+	_, err = ParseSubIDs(strings.NewReader("me:lots:10\n"), "me", 1000)
+	assert.Error(err)
+}
+
+func TestParseMapping(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	m, err := ParseMapping("0:100000:65536")
+	assert.NoError(err)
+	assert.Equal(Mapping{ContainerID: 0, HostID: 100000, Size: 65536}, m)
+
+	for _, bad := range []string{"", "0:100000", "0:100000:0", "0:-1:10", "a:b:c", "0:1:2:3"} {
+		_, err := ParseMapping(bad)
+		assert.Error(err, bad)
+	}
+}
+
+func TestMappingString(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	assert.Equal("0 1000 1", Mapping{ContainerID: 0, HostID: 1000, Size: 1}.String())
+}
@@ -0,0 +1,178 @@
+package verity
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// VerifiedReader reads the data protected by an image's verity data,
+// checking every block against the hash tree and a trusted root hash the
+// way dm-verity does, so images can be verified without device mapper.
+// Reads of blocks that don't match fail with an error wrapping unix.EIO.
+type VerifiedReader struct {
+	r    io.ReaderAt
+	t    *tree
+	root []byte
+
+	mu sync.Mutex
+	// hash blocks that have been checked, by their position in the image
+	verified map[uint64][]byte
+}
+
+// NewVerifiedReader checks the verity data at sb against rootHash (in hex,
+// as in the root hash annotation) and returns a reader for the data it
+// protects.
+func NewVerifiedReader(r io.ReaderAt, sb *Superblock, rootHash string) (*VerifiedReader, error) {
+	root, err := hex.DecodeString(rootHash)
+	if err != nil {
+		return nil, errors.Wrapf(err, "bad root hash %q", rootHash)
+	}
+	t := newTree(sb)
+	if len(root) != t.digestSize {
+		return nil, errors.Errorf("root hash %q is the wrong size for %s", rootHash, sb.Algorithm)
+	}
+
+	v := &VerifiedReader{r: r, t: t, root: root, verified: map[uint64][]byte{}}
+	if len(t.levelBlock) == 0 {
+		// check the single data block now, so a wrong root hash is
+		// noticed before anything is read
+		if err := v.readDataBlock(0, make([]byte, sb.DataBlockSize)); err != nil {
+			return nil, err
+		}
+		return v, nil
+	}
+
+	top := t.levelBlock[len(t.levelBlock)-1]
+	hb, err := v.readHashBlock(top)
+	if err != nil {
+		return nil, err
+	}
+	if stored := t.digest(hb); !bytes.Equal(stored, root) {
+		return nil, errors.Wrapf(unix.EIO, "verity root hash is %x, expected %s", stored, rootHash)
+	}
+	v.verified[top] = hb
+	return v, nil
+}
+
+// OpenVerified opens the image at path, whose verity data starts at offset,
+// checking everything read against rootHash.
+func OpenVerified(path string, offset uint64, rootHash string) (*VerifiedReader, io.Closer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	sb, err := ReadSuperblock(f, offset)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	v, err := NewVerifiedReader(f, sb, rootHash)
+	if err != nil {
+		f.Close()
+		return nil, nil, errors.Wrapf(err, "couldn't verify %s", path)
+	}
+	return v, f, nil
+}
+
+// Size is the size of the protected data.
+func (v *VerifiedReader) Size() int64 {
+	return int64(v.t.sb.DataBlocks) * int64(v.t.sb.DataBlockSize)
+}
+
+func (v *VerifiedReader) readHashBlock(pos uint64) ([]byte, error) {
+	b := make([]byte, v.t.sb.HashBlockSize)
+	if _, err := v.r.ReadAt(b, int64(pos*uint64(v.t.sb.HashBlockSize))); err != nil {
+		return nil, errors.Wrapf(err, "couldn't read hash block %d", pos)
+	}
+	return b, nil
+}
+
+// expected returns the digest that block index of level should have, level
+// -1 being the data; the caller holds mu.
+func (v *VerifiedReader) expected(level int, index uint64) ([]byte, error) {
+	if len(v.t.levelBlock) == 0 {
+		// a single data block's digest is the root hash
+		return v.root, nil
+	}
+	level++
+	bits := v.t.perBlockBits
+	pos := v.t.levelBlock[level] + index>>bits
+	hb, ok := v.verified[pos]
+	if !ok {
+		parent, err := v.expected(level, index>>bits)
+		if err != nil {
+			return nil, err
+		}
+		hb, err = v.readHashBlock(pos)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(v.t.digest(hb), parent) {
+			return nil, errors.Wrapf(unix.EIO, "verity hash block %d is corrupt", pos)
+		}
+		v.verified[pos] = hb
+	}
+	within := int(index&(1<<bits-1)) * v.t.digestSizeFull
+	return hb[within : within+v.t.digestSize], nil
+}
+
+func (v *VerifiedReader) readDataBlock(index uint64, b []byte) error {
+	if _, err := v.r.ReadAt(b, int64(index*uint64(v.t.sb.DataBlockSize))); err != nil {
+		return errors.Wrapf(err, "couldn't read data block %d", index)
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	want, err := v.expected(-1, index)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(v.t.digest(b), want) {
+		return errors.Wrapf(unix.EIO, "verity data block %d is corrupt", index)
+	}
+	return nil
+}
+
+// ReadAt implements io.ReaderAt.
+func (v *VerifiedReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.Errorf("negative offset %d", off)
+	}
+	bs := int64(v.t.sb.DataBlockSize)
+	block := make([]byte, bs)
+	total := 0
+	for len(p) > 0 && off < v.Size() {
+		index := off / bs
+		if err := v.readDataBlock(uint64(index), block); err != nil {
+			return total, err
+		}
+		n := copy(p, block[off-index*bs:])
+		p = p[n:]
+		off += int64(n)
+		total += n
+	}
+	if len(p) > 0 {
+		return total, io.EOF
+	}
+	return total, nil
+}
+
+// VerifyImage checks all of the image at path, whose verity data starts at
+// offset, against rootHash.
+func VerifyImage(path string, offset uint64, rootHash string) error {
+	v, closer, err := OpenVerified(path, offset, rootHash)
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+
+	if _, err := io.Copy(io.Discard, io.NewSectionReader(v, 0, v.Size())); err != nil {
+		return errors.Wrapf(err, "%s doesn't match its root hash", path)
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package verity
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+// buildVerity appends verity data to data the way veritysetup format does,
+// building each level from the one below and storing them top level first.
+func buildVerity(data, salt []byte) ([]byte, string) {
+	nblocks := uint64(len(data) / 4096)
+	levels := [][]byte{}
+	digests := [][]byte{}
+	for i := uint64(0); i < nblocks; i++ {
+		digests = append(digests, saltedSum(salt, data[i*4096:(i+1)*4096]))
+	}
+	for len(digests) > 1 {
+		level := []byte{}
+		for i := 0; i < len(digests); i += 128 {
+			hb := make([]byte, 4096)
+			for j := 0; j < 128 && i+j < len(digests); j++ {
+				copy(hb[j*32:], digests[i+j])
+			}
+			level = append(level, hb...)
+		}
+		levels = append(levels, level)
+		digests = [][]byte{}
+		for i := 0; i < len(level); i += 4096 {
+			digests = append(digests, saltedSum(salt, level[i:i+4096]))
+		}
+	}
+
+	img := append([]byte{}, data...)
+	img = append(img, testSuperblock(nblocks, salt)...)
+	img = append(img, make([]byte, 4096-superblockSize)...)
+	for i := len(levels) - 1; i >= 0; i-- {
+		img = append(img, levels[i]...)
+	}
+	return img, hex.EncodeToString(digests[0])
+}
+
+func TestVerifiedReader(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	salt := []byte("pepper")
+	data := make([]byte, 300*4096)
+	rand.New(rand.NewSource(1)).Read(data)
+	img, root := buildVerity(data, salt)
+
+	sb, err := ReadSuperblock(bytes.NewReader(img), uint64(len(data)))
+	assert.NoError(err)
+	computed, err := sb.RootHash(bytes.NewReader(img))
+	assert.NoError(err)
+	assert.Equal(root, computed)
+	assert.Equal(uint64(len(img)), sb.HashTreeEnd())
+
+	v, err := NewVerifiedReader(bytes.NewReader(img), sb, root)
+	assert.NoError(err)
+	assert.Equal(int64(len(data)), v.Size())
+	read, err := io.ReadAll(io.NewSectionReader(v, 0, v.Size()))
+	assert.NoError(err)
+	assert.Equal(data, read)
+
+	buf := make([]byte, 10000)
+	n, err := v.ReadAt(buf, int64(len(data))-5000)
+	assert.Equal(5000, n)
+	assert.Equal(io.EOF, err)
+
+	// a corrupt data block fails, its neighbours don't
+	corrupt := append([]byte{}, img...)
+	corrupt[200*4096+7] ^= 1
+	v, err = NewVerifiedReader(bytes.NewReader(corrupt), sb, root)
+	assert.NoError(err)
+	_, err = v.ReadAt(buf[:100], 200*4096)
+	assert.ErrorIs(err, unix.EIO)
+	_, err = v.ReadAt(buf[:100], 199*4096)
+	assert.NoError(err)
+	_, err = v.ReadAt(buf[:100], 201*4096)
+	assert.NoError(err)
+
+	// as does everything under a corrupt hash block; there are three
+	// level 0 blocks after the superblock's and level 1's
+	corrupt = append([]byte{}, img...)
+	corrupt[len(data)+2*4096+5] ^= 1
+	v, err = NewVerifiedReader(bytes.NewReader(corrupt), sb, root)
+	assert.NoError(err)
+	_, err = v.ReadAt(buf[:100], 0)
+	assert.ErrorIs(err, unix.EIO)
+	_, err = v.ReadAt(buf[:100], 127*4096)
+	assert.ErrorIs(err, unix.EIO)
+	_, err = v.ReadAt(buf[:100], 128*4096)
+	assert.NoError(err)
+
+	// the wrong root hash is noticed up front
+	_, err = NewVerifiedReader(bytes.NewReader(img), sb, computed[:10]+"0000000000"+computed[20:])
+	assert.ErrorIs(err, unix.EIO)
+	_, err = NewVerifiedReader(bytes.NewReader(img), sb, "abcd")
+	assert.Error(err)
+
+	// a single block is checked against the root hash directly
+	img, root = buildVerity(data[:4096], salt)
+	sb, err = ReadSuperblock(bytes.NewReader(img), 4096)
+	assert.NoError(err)
+	v, err = NewVerifiedReader(bytes.NewReader(img), sb, root)
+	assert.NoError(err)
+	n, err = v.ReadAt(buf[:4096], 0)
+	assert.NoError(err)
+	assert.Equal(4096, n)
+	assert.Equal(data[:4096], buf[:4096])
+	img[0] ^= 1
+	_, err = NewVerifiedReader(bytes.NewReader(img), sb, root)
+	assert.ErrorIs(err, unix.EIO)
+}
+
+func TestVerifyImage(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	data := make([]byte, 10*4096)
+	rand.New(rand.NewSource(2)).Read(data)
+	img, root := buildVerity(data, []byte("salt"))
+
+	path := filepath.Join(t.TempDir(), "img")
+	assert.NoError(os.WriteFile(path, img, 0644))
+	assert.NoError(VerifyImage(path, uint64(len(data)), root))
+
+	img[5*4096+7] ^= 1
+	assert.NoError(os.WriteFile(path, img, 0644))
+	assert.Error(VerifyImage(path, uint64(len(data)), root))
+}
@@ -0,0 +1,50 @@
+package verity
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// ContentSalt derives a verity salt from the contents of file, for use with
+// AppendVerityDataWithSalt when builds need to be reproducible. Identical
+// images get identical salts, and thus identical root hashes.
+func ContentSalt(file string) ([]byte, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	// domain-separate from the image's plain sha256
+	h.Write([]byte("atomfs verity salt\x00"))
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, errors.Wrapf(err, "failed hashing %s", file)
+	}
+	return h.Sum(nil), nil
+}
+
+// saltUUID derives the UUID of a verity superblock from its salt, so that,
+// like the hash tree, it's the same each time an image is built; a random
+// one would change the blob's digest.
+func saltUUID(salt []byte) string {
+	u := sha256.Sum256(append([]byte("atomfs verity uuid\x00"), salt...))
+	// version 4 and the RFC 4122 variant, as libcryptsetup's own are
+	u[6] = u[6]&0x0f | 0x40
+	u[8] = u[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16])
+}
+
+// AppendReproducibleVerityData is AppendVerityData with a salt derived from
+// the file's contents.
+func AppendReproducibleVerityData(file string) (string, error) {
+	salt, err := ContentSalt(file)
+	if err != nil {
+		return "", err
+	}
+	return AppendVerityDataWithSalt(file, salt)
+}
@@ -0,0 +1,17 @@
+package verity
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSaltUUID(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	uuid := saltUUID([]byte("salt"))
+	assert.Equal(uuid, saltUUID([]byte("salt")))
+	assert.NotEqual(uuid, saltUUID([]byte("pepper")))
+	assert.Regexp(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`, uuid)
+}
@@ -0,0 +1,264 @@
+package verity
+
+import (
+	"bytes"
+	"crypto"
+	_ "crypto/sha1"   // register hashes veritysetup may have used
+	_ "crypto/sha256" // ...
+	_ "crypto/sha512" // ...
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// The verity data libcryptsetup appends to an image starts with a
+// superblock, followed by the hash tree from its top level down, see
+// https://gitlab.com/cryptsetup/cryptsetup/-/wikis/DMVerity. Everything
+// here is plain Go, so images can be checked without privileges or
+// libcryptsetup.
+
+const (
+	superblockSignature = "verity\x00\x00"
+	superblockSize      = 512
+	maxSaltSize         = 256
+)
+
+var hashAlgorithms = map[string]crypto.Hash{
+	"sha1":   crypto.SHA1,
+	"sha256": crypto.SHA256,
+	"sha512": crypto.SHA512,
+}
+
+// Superblock is the header of the verity data appended to an image.
+type Superblock struct {
+	// Offset is where the verity data starts in the image.
+	Offset uint64
+
+	Version uint32
+	// HashType is 1 for normal verity, 0 for the chrome os format.
+	HashType      uint32
+	UUID          [16]byte
+	Algorithm     string
+	DataBlockSize uint32
+	HashBlockSize uint32
+	DataBlocks    uint64
+	Salt          []byte
+}
+
+// ReadSuperblock reads the verity superblock at offset in r.
+func ReadSuperblock(r io.ReaderAt, offset uint64) (*Superblock, error) {
+	b := make([]byte, superblockSize)
+	if _, err := r.ReadAt(b, int64(offset)); err != nil {
+		return nil, errors.Wrapf(err, "couldn't read verity superblock at %d", offset)
+	}
+	return parseSuperblock(b, offset)
+}
+
+func parseSuperblock(b []byte, offset uint64) (*Superblock, error) {
+	if string(b[0:8]) != superblockSignature {
+		return nil, errors.Errorf("no verity superblock at %d", offset)
+	}
+
+	sb := &Superblock{
+		Offset:        offset,
+		Version:       binary.LittleEndian.Uint32(b[8:12]),
+		HashType:      binary.LittleEndian.Uint32(b[12:16]),
+		UUID:          [16]byte(b[16:32]),
+		Algorithm:     string(bytes.TrimRight(b[32:64], "\x00")),
+		DataBlockSize: binary.LittleEndian.Uint32(b[64:68]),
+		HashBlockSize: binary.LittleEndian.Uint32(b[68:72]),
+		DataBlocks:    binary.LittleEndian.Uint64(b[72:80]),
+	}
+	saltSize := binary.LittleEndian.Uint16(b[80:82])
+	if saltSize > maxSaltSize {
+		return nil, errors.Errorf("verity salt size %d is too large", saltSize)
+	}
+	sb.Salt = append([]byte{}, b[88:88+saltSize]...)
+
+	if sb.Version != 1 {
+		return nil, errors.Errorf("unsupported verity superblock version %d", sb.Version)
+	}
+	if sb.HashType > 1 {
+		return nil, errors.Errorf("unsupported verity hash type %d", sb.HashType)
+	}
+	if _, ok := hashAlgorithms[sb.Algorithm]; !ok {
+		return nil, errors.Errorf("unsupported verity hash algorithm %q", sb.Algorithm)
+	}
+	for _, bs := range []uint32{sb.DataBlockSize, sb.HashBlockSize} {
+		if bs < 512 || bs > 1<<19 || bs&(bs-1) != 0 {
+			return nil, errors.Errorf("invalid verity block size %d", bs)
+		}
+	}
+	if sb.DataBlocks == 0 {
+		return nil, errors.Errorf("verity superblock has no data blocks")
+	}
+	if sb.DataBlocks > offset/uint64(sb.DataBlockSize) {
+		return nil, errors.Errorf("verity data blocks (%d of %d bytes) overlap the verity data at %d", sb.DataBlocks, sb.DataBlockSize, offset)
+	}
+	return sb, nil
+}
+
+// tree is the layout of the hash tree that follows a superblock.
+type tree struct {
+	sb   *Superblock
+	hash crypto.Hash
+	// each digest takes up digestSizeFull bytes in a hash block
+	digestSize     int
+	digestSizeFull int
+	perBlockBits   uint
+	// levelBlock[i] is the hash block where level i starts, counting hash
+	// blocks from the start of the image; level 0 holds the digests of the
+	// data blocks, and the top level is a single block.
+	levelBlock []uint64
+	levelSize  []uint64
+}
+
+func bitsUp(n int) uint {
+	bits := uint(0)
+	for 1<<bits < n {
+		bits++
+	}
+	return bits
+}
+
+func bitsDown(n int) uint {
+	bits := uint(0)
+	for n>>(bits+1) != 0 {
+		bits++
+	}
+	return bits
+}
+
+// newTree works out the layout as libcryptsetup's VERITY_create_or_verify_hash
+// does.
+func newTree(sb *Superblock) *tree {
+	t := &tree{sb: sb, hash: hashAlgorithms[sb.Algorithm]}
+	t.digestSize = t.hash.Size()
+	t.digestSizeFull = t.digestSize
+	if sb.HashType == 1 {
+		t.digestSizeFull = 1 << bitsUp(t.digestSize)
+	}
+	t.perBlockBits = bitsDown(int(sb.HashBlockSize) / t.digestSizeFull)
+
+	levels := 0
+	for t.perBlockBits*uint(levels) < 64 && (sb.DataBlocks-1)>>(t.perBlockBits*uint(levels)) != 0 {
+		levels++
+	}
+
+	// the tree starts in the first hash block after the superblock
+	position := (sb.Offset + superblockSize + uint64(sb.HashBlockSize) - 1) / uint64(sb.HashBlockSize)
+	t.levelBlock = make([]uint64, levels)
+	t.levelSize = make([]uint64, levels)
+	for i := levels - 1; i >= 0; i-- {
+		t.levelBlock[i] = position
+		shift := uint(i+1) * t.perBlockBits
+		size := sb.DataBlocks >> shift
+		if size<<shift != sb.DataBlocks {
+			size++
+		}
+		t.levelSize[i] = size
+		position += size
+	}
+	return t
+}
+
+// end is where the hash tree ends.
+func (t *tree) end() uint64 {
+	if len(t.levelBlock) == 0 {
+		return (t.sb.Offset + superblockSize + uint64(t.sb.HashBlockSize) - 1) / uint64(t.sb.HashBlockSize) * uint64(t.sb.HashBlockSize)
+	}
+	return (t.levelBlock[0] + t.levelSize[0]) * uint64(t.sb.HashBlockSize)
+}
+
+func (t *tree) digest(block []byte) []byte {
+	h := t.hash.New()
+	if t.sb.HashType == 1 {
+		h.Write(t.sb.Salt)
+	}
+	h.Write(block)
+	if t.sb.HashType == 0 {
+		h.Write(t.sb.Salt)
+	}
+	return h.Sum(nil)
+}
+
+// rootHash computes the root hash from the data blocks alone, so it doesn't
+// matter whether the stored tree is intact.
+func (t *tree) rootHash(r io.ReaderAt) ([]byte, error) {
+	block := make([]byte, t.sb.DataBlockSize)
+	digests := make([][]byte, 0, t.sb.DataBlocks)
+	for i := uint64(0); i < t.sb.DataBlocks; i++ {
+		if _, err := r.ReadAt(block, int64(i*uint64(t.sb.DataBlockSize))); err != nil {
+			return nil, errors.Wrapf(err, "couldn't read data block %d", i)
+		}
+		digests = append(digests, t.digest(block))
+	}
+	if len(digests) == 1 {
+		return digests[0], nil
+	}
+
+	perBlock := 1 << t.perBlockBits
+	for {
+		blocks := [][]byte{}
+		for len(digests) > 0 {
+			n := min(perBlock, len(digests))
+			hb := make([]byte, t.sb.HashBlockSize)
+			for j, d := range digests[:n] {
+				copy(hb[j*t.digestSizeFull:], d)
+			}
+			blocks = append(blocks, hb)
+			digests = digests[n:]
+		}
+		for _, hb := range blocks {
+			digests = append(digests, t.digest(hb))
+		}
+		if len(blocks) == 1 {
+			return digests[0], nil
+		}
+	}
+}
+
+// storedRootHash is the digest of the top level of the stored tree, which
+// is what the kernel checks the root hash against.
+func (t *tree) storedRootHash(r io.ReaderAt) ([]byte, error) {
+	if len(t.levelBlock) == 0 {
+		block := make([]byte, t.sb.DataBlockSize)
+		if _, err := r.ReadAt(block, 0); err != nil {
+			return nil, errors.Wrapf(err, "couldn't read data block 0")
+		}
+		return t.digest(block), nil
+	}
+	top := len(t.levelBlock) - 1
+	block := make([]byte, t.sb.HashBlockSize)
+	if _, err := r.ReadAt(block, int64(t.levelBlock[top]*uint64(t.sb.HashBlockSize))); err != nil {
+		return nil, errors.Wrapf(err, "couldn't read top hash block")
+	}
+	return t.digest(block), nil
+}
+
+// RootHash computes the root hash of the image's data, as hex like the
+// root hash annotation.
+func (sb *Superblock) RootHash(r io.ReaderAt) (string, error) {
+	h, err := newTree(sb).rootHash(r)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h), nil
+}
+
+// StoredRootHash returns the root hash of the hash tree stored in the
+// image, which only matches RootHash if the tree is intact.
+func (sb *Superblock) StoredRootHash(r io.ReaderAt) (string, error) {
+	h, err := newTree(sb).storedRootHash(r)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h), nil
+}
+
+// HashTreeEnd returns where the verity data ends in the image.
+func (sb *Superblock) HashTreeEnd() uint64 {
+	return newTree(sb).end()
+}
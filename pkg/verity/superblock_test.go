@@ -0,0 +1,103 @@
+package verity
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testSuperblock(dataBlocks uint64, salt []byte) []byte {
+	b := make([]byte, superblockSize)
+	copy(b, superblockSignature)
+	binary.LittleEndian.PutUint32(b[8:], 1)
+	binary.LittleEndian.PutUint32(b[12:], 1)
+	copy(b[32:], "sha256")
+	binary.LittleEndian.PutUint32(b[64:], 4096)
+	binary.LittleEndian.PutUint32(b[68:], 4096)
+	binary.LittleEndian.PutUint64(b[72:], dataBlocks)
+	binary.LittleEndian.PutUint16(b[80:], uint16(len(salt)))
+	copy(b[88:], salt)
+	return b
+}
+
+func saltedSum(salt, b []byte) []byte {
+	h := sha256.New()
+	h.Write(salt)
+	h.Write(b)
+	return h.Sum(nil)
+}
+
+func TestSuperblock(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	salt := []byte("salty")
+	data := bytes.Repeat([]byte{'a'}, 4096)
+	data = append(data, bytes.Repeat([]byte{'b'}, 4096)...)
+	data = append(data, bytes.Repeat([]byte{'c'}, 4096)...)
+
+	// three data blocks need one level, stored in the hash block after
+	// the superblock
+	hashBlock := make([]byte, 4096)
+	for i := 0; i < 3; i++ {
+		copy(hashBlock[i*32:], saltedSum(salt, data[i*4096:(i+1)*4096]))
+	}
+	img := append([]byte{}, data...)
+	img = append(img, testSuperblock(3, salt)...)
+	img = append(img, make([]byte, 4096-superblockSize)...)
+	img = append(img, hashBlock...)
+	expected := hex.EncodeToString(saltedSum(salt, hashBlock))
+
+	sb, err := ReadSuperblock(bytes.NewReader(img), uint64(len(data)))
+	assert.NoError(err)
+	assert.Equal("sha256", sb.Algorithm)
+	assert.Equal(uint64(3), sb.DataBlocks)
+	assert.Equal(salt, sb.Salt)
+	assert.Equal(uint64(len(img)), sb.HashTreeEnd())
+
+	root, err := sb.RootHash(bytes.NewReader(img))
+	assert.NoError(err)
+	assert.Equal(expected, root)
+	stored, err := sb.StoredRootHash(bytes.NewReader(img))
+	assert.NoError(err)
+	assert.Equal(expected, stored)
+
+	// corrupting data changes the computed hash but not the stored one
+	img[0] = 'x'
+	root, err = sb.RootHash(bytes.NewReader(img))
+	assert.NoError(err)
+	assert.NotEqual(expected, root)
+	stored, err = sb.StoredRootHash(bytes.NewReader(img))
+	assert.NoError(err)
+	assert.Equal(expected, stored)
+
+	// a single data block is its own root
+	img = append([]byte{}, data[:4096]...)
+	img = append(img, testSuperblock(1, salt)...)
+	sb, err = ReadSuperblock(bytes.NewReader(img), 4096)
+	assert.NoError(err)
+	root, err = sb.RootHash(bytes.NewReader(img))
+	assert.NoError(err)
+	assert.Equal(hex.EncodeToString(saltedSum(salt, data[:4096])), root)
+
+	_, err = ReadSuperblock(bytes.NewReader(img), 0)
+	assert.Error(err)
+	_, err = ReadSuperblock(bytes.NewReader(append(make([]byte, 4096), testSuperblock(2, salt)...)), 4096)
+	assert.Error(err)
+}
+
+func TestTreeLayout(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	// 128 sha256 digests fit in a hash block, so 129 data blocks need a
+	// second level, which is stored first
+	tr := newTree(&Superblock{Offset: 129 * 4096, Algorithm: "sha256", HashType: 1, DataBlockSize: 4096, HashBlockSize: 4096, DataBlocks: 129})
+	assert.Equal([]uint64{131, 130}, tr.levelBlock)
+	assert.Equal([]uint64{2, 1}, tr.levelSize)
+	assert.Equal(uint64(133*4096), tr.end())
+}
@@ -97,6 +97,8 @@ type verityDeviceType struct {
 	Flags      uint
 	DataDevice string
 	HashOffset uint64
+	// Salt to use when formatting; nil means a random one.
+	Salt []byte
 }
 
 func (verity verityDeviceType) Name() string {
@@ -113,6 +115,10 @@ func (verity verityDeviceType) Unmanaged() (unsafe.Pointer, func()) {
 
 	cParams.salt_size = 32 // DEFAULT_VERITY_SALT_SIZE
 	cParams.salt = nil
+	if len(verity.Salt) != 0 {
+		cParams.salt_size = C.uint32_t(len(verity.Salt))
+		cParams.salt = (*C.char)(C.CBytes(verity.Salt))
+	}
 
 	// these can't be larger than a page size, but we want them to be as
 	// big as possible so the hash data is small, so let's set them to a
@@ -129,6 +135,9 @@ func (verity verityDeviceType) Unmanaged() (unsafe.Pointer, func()) {
 	deallocate := func() {
 		C.free(unsafe.Pointer(cParams.hash_name))
 		C.free(unsafe.Pointer(cParams.data_device))
+		if cParams.salt != nil {
+			C.free(unsafe.Pointer(cParams.salt))
+		}
 	}
 
 	return unsafe.Pointer(&cParams), deallocate
@@ -142,6 +151,14 @@ func isCryptsetupEINVAL(err error) bool {
 var CryptsetupTooOld = errors.Errorf("libcryptsetup not new enough, need >= 2.3.0")
 
 func AppendVerityData(file string) (string, error) {
+	return AppendVerityDataWithSalt(file, nil)
+}
+
+// AppendVerityDataWithSalt is like AppendVerityData, but uses the given salt
+// instead of a random one, so that the hash tree (and root hash) is a pure
+// function of the file's contents. See ContentSalt(). The superblock's UUID
+// is derived from the salt too, so the whole file is.
+func AppendVerityDataWithSalt(file string, salt []byte) (string, error) {
 	fi, err := os.Lstat(file)
 	if err != nil {
 		return "", errors.WithStack(err)
@@ -165,8 +182,13 @@ func AppendVerityData(file string) (string, error) {
 		Flags:      cryptsetup.CRYPT_VERITY_CREATE_HASH,
 		DataDevice: file,
 		HashOffset: uint64(verityOffset),
+		Salt:       salt,
+	}
+	params := cryptsetup.GenericParams{}
+	if salt != nil {
+		params.UUID = saltUUID(salt)
 	}
-	err = verityDevice.Format(verityType, cryptsetup.GenericParams{})
+	err = verityDevice.Format(verityType, params)
 	if err != nil {
 		return "", errors.WithStack(err)
 	}
@@ -0,0 +1,255 @@
+package verityfuse
+
+import (
+	"context"
+	"io"
+	iofs "io/fs"
+	"path"
+	"sort"
+	"syscall"
+
+	gofs "github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/pkg/errors"
+	"machinerun.io/atomfs/pkg/imagefs"
+	"machinerun.io/atomfs/pkg/log"
+)
+
+// node is a file or directory of the image; the go-fuse Inode holds the
+// kernel's view of it.
+type node struct {
+	gofs.Inode
+	img  imagefs.FS
+	name string
+}
+
+var _ = (gofs.NodeLookuper)((*node)(nil))
+var _ = (gofs.NodeReaddirer)((*node)(nil))
+var _ = (gofs.NodeGetattrer)((*node)(nil))
+var _ = (gofs.NodeOpener)((*node)(nil))
+var _ = (gofs.NodeReader)((*node)(nil))
+var _ = (gofs.NodeReadlinker)((*node)(nil))
+var _ = (gofs.NodeGetxattrer)((*node)(nil))
+var _ = (gofs.NodeListxattrer)((*node)(nil))
+var _ = (gofs.NodeStatfser)((*node)(nil))
+
+// errno maps a reader error to what the kernel should see. Anything that
+// isn't a plain lookup failure, in particular a verity mismatch, is EIO.
+func errno(op, name string, err error) syscall.Errno {
+	var e syscall.Errno
+	switch {
+	case errors.Is(err, iofs.ErrNotExist):
+		return syscall.ENOENT
+	case errors.As(err, &e) && e != syscall.EIO:
+		return e
+	}
+	log.Warnf("verityfuse: %s %s: %v", op, name, err)
+	return syscall.EIO
+}
+
+// unixMode is m as a stat(2) st_mode.
+func unixMode(m iofs.FileMode) uint32 {
+	mode := uint32(m.Perm())
+	switch m.Type() {
+	case iofs.ModeDir:
+		mode |= syscall.S_IFDIR
+	case iofs.ModeSymlink:
+		mode |= syscall.S_IFLNK
+	case iofs.ModeDevice:
+		mode |= syscall.S_IFBLK
+	case iofs.ModeDevice | iofs.ModeCharDevice:
+		mode |= syscall.S_IFCHR
+	case iofs.ModeNamedPipe:
+		mode |= syscall.S_IFIFO
+	case iofs.ModeSocket:
+		mode |= syscall.S_IFSOCK
+	default:
+		mode |= syscall.S_IFREG
+	}
+	if m&iofs.ModeSetuid != 0 {
+		mode |= syscall.S_ISUID
+	}
+	if m&iofs.ModeSetgid != 0 {
+		mode |= syscall.S_ISGID
+	}
+	if m&iofs.ModeSticky != 0 {
+		mode |= syscall.S_ISVTX
+	}
+	return mode
+}
+
+func fillAttr(fi iofs.FileInfo, out *fuse.Attr) {
+	out.Mode = unixMode(fi.Mode())
+	out.Size = uint64(fi.Size())
+	if fi.IsDir() {
+		out.Size = 4096
+	}
+	out.Blocks = (out.Size + 511) / 512
+	out.Blksize = 4096
+	mtime := fi.ModTime()
+	out.SetTimes(&mtime, &mtime, &mtime)
+	out.Nlink = 1
+	if st := imagefs.StatOf(fi); st != nil {
+		out.Ino = st.Ino
+		out.Owner = fuse.Owner{Uid: st.Uid, Gid: st.Gid}
+		out.Rdev = uint32(st.Rdev)
+		if st.Nlink != 0 {
+			out.Nlink = st.Nlink
+		}
+	}
+}
+
+func (n *node) lstat() (iofs.FileInfo, syscall.Errno) {
+	fi, err := n.img.Lstat(n.name)
+	if err != nil {
+		return nil, errno("lstat", n.name, err)
+	}
+	return fi, 0
+}
+
+func (n *node) Getattr(ctx context.Context, f gofs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	fi, e := n.lstat()
+	if e != 0 {
+		return e
+	}
+	fillAttr(fi, &out.Attr)
+	return 0
+}
+
+func (n *node) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*gofs.Inode, syscall.Errno) {
+	child := path.Join(n.name, name)
+	fi, err := n.img.Lstat(child)
+	if err != nil {
+		return nil, errno("lookup", child, err)
+	}
+	fillAttr(fi, &out.Attr)
+	stable := gofs.StableAttr{Mode: out.Attr.Mode & syscall.S_IFMT, Ino: out.Attr.Ino}
+	return n.NewInode(ctx, &node{img: n.img, name: child}, stable), 0
+}
+
+func (n *node) Readdir(ctx context.Context) (gofs.DirStream, syscall.Errno) {
+	ents, err := iofs.ReadDir(n.img, n.name)
+	if err != nil {
+		return nil, errno("readdir", n.name, err)
+	}
+	sort.Slice(ents, func(i, j int) bool { return ents[i].Name() < ents[j].Name() })
+
+	list := make([]fuse.DirEntry, 0, len(ents))
+	for _, e := range ents {
+		de := fuse.DirEntry{Name: e.Name(), Mode: unixMode(e.Type())}
+		if fi, err := e.Info(); err == nil {
+			if st := imagefs.StatOf(fi); st != nil {
+				de.Ino = st.Ino
+			}
+		}
+		list = append(list, de)
+	}
+	return gofs.NewListDirStream(list), 0
+}
+
+func (n *node) Open(ctx context.Context, flags uint32) (gofs.FileHandle, uint32, syscall.Errno) {
+	if flags&(syscall.O_WRONLY|syscall.O_RDWR|syscall.O_TRUNC|syscall.O_APPEND) != 0 {
+		return nil, 0, syscall.EROFS
+	}
+	f, err := n.img.Open(n.name)
+	if err != nil {
+		return nil, 0, errno("open", n.name, err)
+	}
+	r, ok := f.(io.ReaderAt)
+	if !ok {
+		f.Close()
+		return nil, 0, syscall.EISDIR
+	}
+	// the image never changes, so the kernel may cache what it reads
+	return &handle{f: f, r: r}, fuse.FOPEN_KEEP_CACHE, 0
+}
+
+func (n *node) Read(ctx context.Context, fh gofs.FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	h, ok := fh.(*handle)
+	if !ok {
+		return nil, syscall.EBADF
+	}
+	read, err := h.r.ReadAt(dest, off)
+	if err != nil && err != io.EOF {
+		return nil, errno("read", n.name, err)
+	}
+	return fuse.ReadResultData(dest[:read]), 0
+}
+
+func (n *node) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	target, err := n.img.ReadLink(n.name)
+	if err != nil {
+		return nil, errno("readlink", n.name, err)
+	}
+	return []byte(target), 0
+}
+
+func (n *node) xattrs() (map[string][]byte, syscall.Errno) {
+	fi, e := n.lstat()
+	if e != 0 {
+		return nil, e
+	}
+	if st := imagefs.StatOf(fi); st != nil {
+		return st.Xattrs, 0
+	}
+	return nil, 0
+}
+
+func (n *node) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+	xattrs, e := n.xattrs()
+	if e != 0 {
+		return 0, e
+	}
+	v, ok := xattrs[attr]
+	if !ok {
+		return 0, syscall.ENODATA
+	}
+	if len(dest) < len(v) {
+		return uint32(len(v)), syscall.ERANGE
+	}
+	return uint32(copy(dest, v)), 0
+}
+
+func (n *node) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
+	xattrs, e := n.xattrs()
+	if e != 0 {
+		return 0, e
+	}
+	names := make([]string, 0, len(xattrs))
+	for k := range xattrs {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	list := []byte{}
+	for _, k := range names {
+		list = append(list, k...)
+		list = append(list, 0)
+	}
+	if len(dest) < len(list) {
+		return uint32(len(list)), syscall.ERANGE
+	}
+	return uint32(copy(dest, list)), 0
+}
+
+// Statfs reports a filesystem with no free space; overlayfs needs NameLen
+// to be set or it refuses every name.
+func (n *node) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
+	out.Bsize = 4096
+	out.Frsize = 4096
+	out.NameLen = 255
+	return 0
+}
+
+// handle is an open regular file.
+type handle struct {
+	f iofs.File
+	r io.ReaderAt
+}
+
+var _ = (gofs.FileReleaser)((*handle)(nil))
+
+func (h *handle) Release(ctx context.Context) syscall.Errno {
+	h.f.Close()
+	return 0
+}
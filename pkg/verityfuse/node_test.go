@@ -0,0 +1,36 @@
+package verityfuse
+
+import (
+	iofs "io/fs"
+	"syscall"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestUnixMode(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	assert.Equal(uint32(syscall.S_IFREG|0644), unixMode(0644))
+	assert.Equal(uint32(syscall.S_IFDIR|0755), unixMode(iofs.ModeDir|0755))
+	assert.Equal(uint32(syscall.S_IFLNK|0777), unixMode(iofs.ModeSymlink|0777))
+	assert.Equal(uint32(syscall.S_IFCHR), unixMode(iofs.ModeDevice|iofs.ModeCharDevice))
+	assert.Equal(uint32(syscall.S_IFBLK|0600), unixMode(iofs.ModeDevice|0600))
+	assert.Equal(uint32(syscall.S_IFIFO|0600), unixMode(iofs.ModeNamedPipe|0600))
+	assert.Equal(uint32(syscall.S_IFREG|syscall.S_ISUID|syscall.S_ISGID|0755), unixMode(iofs.ModeSetuid|iofs.ModeSetgid|0755))
+	assert.Equal(uint32(syscall.S_IFDIR|syscall.S_ISVTX|0777), unixMode(iofs.ModeDir|iofs.ModeSticky|0777))
+}
+
+func TestErrno(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	assert.Equal(syscall.ENOENT, errno("lookup", "a", errors.Wrap(iofs.ErrNotExist, "a")))
+	assert.Equal(syscall.ENOTDIR, errno("lookup", "a", &iofs.PathError{Op: "open", Path: "a", Err: syscall.ENOTDIR}))
+	// a verity mismatch, or anything unexpected, is an I/O error
+	assert.Equal(syscall.EIO, errno("read", "a", errors.Wrap(unix.EIO, "verity data block 1 is corrupt")))
+	assert.Equal(syscall.EIO, errno("read", "a", errors.New("bad inode")))
+}
@@ -0,0 +1,168 @@
+// Package verityfuse serves squashfs and erofs atoms over FUSE from the
+// pure-Go readers, checking every block read against the image's verity
+// data the way dm-verity does. It gives unprivileged mounts the same
+// guarantee as verity.VerityHostMount. Since nothing goes unchecked, it
+// can also serve atoms that are fetched from a registry as they're read.
+//
+// common.VerityFuse starts the server by running common.VerityFuseHelper
+// with common.VerityFuseArg as its first argument. Programs other than
+// atomfs that mount verity-protected atoms as non-root must set it, to
+// themselves with UseSelf if they pass the arguments that follow it to
+// Serve, or to an atomfs binary.
+package verityfuse
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	gofs "github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"machinerun.io/atomfs/pkg/common"
+	"machinerun.io/atomfs/pkg/fs"
+	"machinerun.io/atomfs/pkg/imagefs"
+	"machinerun.io/atomfs/pkg/registry"
+	types "machinerun.io/atomfs/pkg/types"
+	"machinerun.io/atomfs/pkg/verity"
+)
+
+// Mount mounts the fsType image at mountpoint, verifying reads against
+// rootHash, and returns the running server.
+func Mount(fsType types.FilesystemType, image, mountpoint, rootHash string) (*fuse.Server, error) {
+	f, err := os.Open(image)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return mount(fsType, image, f, f, mountpoint, rootHash)
+}
+
+// MountLazy is Mount for an image that's fetched from repo as it's read,
+// into a cache beside image, its path in the local OCI layout; see
+// registry.LazyBlob. Its digest is taken from its name. The registry is
+// logged in to with the credentials docker login saved for it, if any.
+func MountLazy(fsType types.FilesystemType, image, repo, mountpoint, rootHash string) (*fuse.Server, error) {
+	r, err := registry.ParseRepository(repo)
+	if err != nil {
+		return nil, err
+	}
+	if r.Credentials, err = registry.DockerCredentials(r.Host()); err != nil {
+		return nil, err
+	}
+	d := digest.NewDigestFromEncoded(digest.Canonical, filepath.Base(image))
+	blob, err := registry.OpenLazy(r, d, image)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't open %s from %s", d, repo)
+	}
+	return mount(fsType, blob.Path(), blob, blob, mountpoint, rootHash)
+}
+
+// mount serves the fsType image read from r, which is described by the
+// superblock of the file at image, checking reads against rootHash. closer
+// is closed once it's unmounted.
+func mount(fsType types.FilesystemType, image string, r io.ReaderAt, closer io.Closer, mountpoint, rootHash string) (*fuse.Server, error) {
+	filesystem := fs.New(fsType)
+	if filesystem == nil {
+		closer.Close()
+		return nil, errors.Errorf("unknown filesystem type %s", fsType)
+	}
+	info, err := filesystem.Inspect(image)
+	if err != nil {
+		closer.Close()
+		return nil, err
+	}
+	if uint64(info.Size) <= info.VerityOffset {
+		closer.Close()
+		return nil, errors.Errorf("%s has no verity data", image)
+	}
+
+	sb, err := verity.ReadSuperblock(r, info.VerityOffset)
+	if err != nil {
+		closer.Close()
+		return nil, err
+	}
+	v, err := verity.NewVerifiedReader(r, sb, rootHash)
+	if err != nil {
+		closer.Close()
+		return nil, errors.Wrapf(err, "couldn't verify %s", image)
+	}
+	img, err := fs.NewReader(fsType, v, v.Size())
+	if err != nil {
+		closer.Close()
+		return nil, errors.Wrapf(err, "couldn't read %s", image)
+	}
+
+	// the image is immutable, so let the kernel cache as much as it likes
+	timeout := time.Hour
+	root := &node{img: img, name: "."}
+	server, err := gofs.Mount(mountpoint, root, &gofs.Options{
+		EntryTimeout:    &timeout,
+		AttrTimeout:     &timeout,
+		NegativeTimeout: &timeout,
+		NullPermissions: true,
+		MountOptions: fuse.MountOptions{
+			Name:       "atomfs-verity",
+			FsName:     common.VerityFuseSource(rootHash),
+			AllowOther: common.AmHostRoot(),
+			// mount(2) works in a user namespace we own, and go-fuse
+			// falls back to fusermount when it doesn't
+			DirectMount: true,
+			// ReadAt isn't safe to run concurrently in the readers
+			SingleThreaded: true,
+			Options:        []string{"ro", "default_permissions"},
+		},
+	})
+	if err != nil {
+		closeImage(img, closer)
+		return nil, errors.Wrapf(err, "couldn't mount %s on %s", image, mountpoint)
+	}
+	go func() {
+		server.Wait()
+		closeImage(img, closer)
+	}()
+	return server, nil
+}
+
+func closeImage(img imagefs.Image, closer io.Closer) {
+	img.Close()
+	closer.Close()
+}
+
+// UseSelf makes common.VerityFuse run the current program to serve mounts,
+// which must then pass the arguments after common.VerityFuseArg to Serve.
+func UseSelf() error {
+	self, err := os.Executable()
+	if err != nil {
+		return errors.Wrapf(err, "couldn't find the running program")
+	}
+	common.VerityFuseHelper = self
+	return nil
+}
+
+// Serve runs the server for a mount made by common.VerityFuse, with the
+// arguments it passed after common.VerityFuseArg, until it is unmounted.
+func Serve(args []string) error {
+	var server *fuse.Server
+	var err error
+	switch len(args) {
+	case 4:
+		server, err = Mount(types.FilesystemType(args[0]), args[1], args[2], args[3])
+	case 5:
+		server, err = MountLazy(types.FilesystemType(args[0]), args[1], args[4], args[2], args[3])
+	default:
+		return errors.Errorf("usage: %s fstype image mountpoint roothash [repository]", common.VerityFuseArg)
+	}
+	if err != nil {
+		return err
+	}
+
+	ready := os.NewFile(common.VerityFuseReadyFd, "ready")
+	if ready != nil {
+		_, _ = ready.Write([]byte("ready\n"))
+		ready.Close()
+	}
+	server.Wait()
+	return nil
+}
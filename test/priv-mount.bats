@@ -72,6 +72,33 @@ function require_x86() {
 
 }
 
+@test "mount without verity data checks atoms' digests" {
+    cp -a ${BATS_SUITE_TMPDIR}/oci-no-verity ${BATS_TEST_TMPDIR}/oci
+    run atomfs-cover --debug mount --allow-missing-verity ${BATS_TEST_TMPDIR}/oci:test-squashfs $MP
+    assert_success
+    assert_output --partial "against its digest"
+    assert_dir_exists $ATOMFS_TEST_RUN_DIR/verified-digests
+    run atomfs-cover --debug umount $MP
+    assert_success
+
+    # the second time, they're known to be fine
+    run atomfs-cover --debug mount --allow-missing-verity ${BATS_TEST_TMPDIR}/oci:test-squashfs $MP
+    assert_success
+    assert_output --partial "checked against"
+    run atomfs-cover --debug umount $MP
+    assert_success
+
+    blob=$(ls -S ${BATS_TEST_TMPDIR}/oci/blobs/sha256/* | head -1)
+    printf X | dd of=$blob bs=1 seek=100 conv=notrunc
+    run atomfs-cover --debug mount --allow-missing-verity ${BATS_TEST_TMPDIR}/oci:test-squashfs $MP
+    assert_failure
+    assert_line --partial "doesn't match its digest"
+
+    run atomfs-cover --debug mount --allow-missing-verity --verify-digests=never ${BATS_TEST_TMPDIR}/oci:test-squashfs $MP
+    refute_line --partial "doesn't match its digest"
+    atomfs-cover umount $MP || true
+}
+
 @test "mount/umount with writeable overlay" {
     run atomfs-cover --debug mount --writeable ${BATS_SUITE_TMPDIR}/oci:test-squashfs $MP
     assert_success
@@ -0,0 +1,29 @@
+load helpers
+load test_helper/bats-support/load
+load test_helper/bats-assert/load
+load test_helper/bats-file/load
+
+function setup_file() {
+    build_image_at $BATS_SUITE_TMPDIR
+}
+
+@test "diff-images shows what a layer added" {
+    run atomfs-cover --debug diff-images ${BATS_SUITE_TMPDIR}/oci:test_base-squashfs ${BATS_SUITE_TMPDIR}/oci:test-squashfs
+    assert_success
+    assert_output --partial "A /random.txt"
+    refute_output --partial "1.README.md"
+
+    run atomfs-cover --debug diff-images ${BATS_SUITE_TMPDIR}/oci:test-squashfs ${BATS_SUITE_TMPDIR}/oci:test_base-squashfs
+    assert_success
+    assert_output --partial "D /random.txt"
+}
+
+@test "diff-images --json" {
+    run atomfs-cover diff-images --json ${BATS_SUITE_TMPDIR}/oci:test_base-squashfs ${BATS_SUITE_TMPDIR}/oci:test-squashfs
+    assert_success
+    [ "$(echo "$output" | jq -r '.[] | select(.path == "/random.txt") | .change')" = "added" ]
+
+    run atomfs-cover diff-images --json ${BATS_SUITE_TMPDIR}/oci:test-squashfs ${BATS_SUITE_TMPDIR}/oci:test-squashfs
+    assert_success
+    assert_output "[]"
+}
@@ -15,44 +15,28 @@ function setup() {
     mkdir -p $MP
 }
 
-@test "guestmount works ignoring verity" {
+@test "guestmount checks verity in userspace" {
 
     lxc-usernsexec -s <<EOF
-    set -x
+    set -ex
     export ATOMFS_TEST_RUN_DIR=$ATOMFS_TEST_RUN_DIR
     export PERSIST_DIR=${BATS_TEST_TMPDIR}/persist-dir
     mkdir -p \$PERSIST_DIR
 
     export INNER_MNTNSNAME=\$(readlink /proc/self/ns/mnt | cut -c 6-15)
 
-    set +e
     atomfs-cover --debug mount --persist=\$PERSIST_DIR ${BATS_SUITE_TMPDIR}/oci:test-squashfs $MP
-    [ \$? -eq 0 ] && {
-      echo guestmount without allow-missing should fail, because we do not have verity
-      exit 1
-    }
-    echo "XFAIL: guestmount without allow-missing did fail"
-    set -e
-
-    atomfs-cover --debug mount --allow-missing-verity --persist=\$PERSIST_DIR ${BATS_SUITE_TMPDIR}/oci:test-squashfs $MP
     [ -f $MP/1.README.md ]
     [ -f $MP/random.txt ]
+    cat $MP/random.txt > /dev/null
     touch $MP/let-me-write
 
-    set +e
+    grep -q fuse.atomfs-verity /proc/self/mountinfo
     atomfs-cover --debug verify $MP
-    [ \$? -eq 0 ] && {
-       echo mount with squashfuse ignores verity, so verify should have failed, output should include warning
-       exit 1
-    }
-    echo "XFAIL: verify did fail on squashfuse mounted molecule"
-    set -e
-
-    find $ATOMFS_TEST_RUN_DIR/meta/\$INNER_MNTNSNAME/ -name config.json|xargs cat
-    find $ATOMFS_TEST_RUN_DIR/meta/\$INNER_MNTNSNAME/
 
     atomfs-cover --debug umount $MP
     [ -f \$PERSIST_DIR/persist/let-me-write ]
+    [ \$(grep -c fuse.atomfs-verity /proc/self/mountinfo) -eq 0 ]
 
     # mount point and meta dir should be empty
     [ -d $MP ]
@@ -65,6 +49,31 @@ EOF
 
 }
 
+@test "guestmount refuses to read a corrupt atom" {
+    cp -r ${BATS_SUITE_TMPDIR}/oci ${BATS_TEST_TMPDIR}/oci
+    manifest=$(jq -r '.manifests[] | select(.annotations."org.opencontainers.image.ref.name" == "test-squashfs") | .digest' ${BATS_TEST_TMPDIR}/oci/index.json | cut -d: -f2)
+    # flip a byte a quarter of the way into each atom's filesystem
+    for blob in $(jq -r '.layers[].digest' ${BATS_TEST_TMPDIR}/oci/blobs/sha256/$manifest | cut -d: -f2); do
+        f=${BATS_TEST_TMPDIR}/oci/blobs/sha256/$blob
+        chmod u+w $f
+        printf 'X' | dd of=$f bs=1 seek=$(( $(stat -c %s $f) / 4 )) conv=notrunc
+    done
+
+    lxc-usernsexec -s <<EOF
+    set -ex
+    export ATOMFS_TEST_RUN_DIR=$ATOMFS_TEST_RUN_DIR
+
+    # either the mount notices the corruption, or reading does
+    if atomfs-cover --debug mount ${BATS_TEST_TMPDIR}/oci:test-squashfs $MP; then
+        if find $MP -type f -exec cat {} + > /dev/null; then
+            echo reading a corrupt atom should have failed
+            exit 1
+        fi
+        atomfs-cover --debug umount $MP
+    fi
+EOF
+    rm -rf $ATOMFS_TEST_RUN_DIR/meta
+}
 
 @test "guestmount works on images without verity" {
 
@@ -130,3 +139,30 @@ EOF
 
 EOF
 }
+
+@test "verify notices dead fuse daemons and can restart them" {
+
+    lxc-usernsexec -s <<EOF
+    set -ex
+    export ATOMFS_TEST_RUN_DIR=$ATOMFS_TEST_RUN_DIR
+
+    atomfs-cover --debug mount ${BATS_SUITE_TMPDIR}/oci:test-squashfs $MP
+    atomfs-cover --debug list | grep "$MP.*ok"
+
+    # kill the daemon serving one of the atoms
+    pid=\$(atomfs-cover list | awk -F '\t' '\$1 == "" { print \$2; exit }')
+    kill -9 \$pid
+    ! cat $MP/random.txt > /dev/null
+
+    atomfs-cover --debug list | grep "$MP.*1 dead"
+    ! atomfs-cover --debug verify $MP
+    atomfs-cover --debug verify --restart-dead $MP
+    cat $MP/random.txt > /dev/null
+    atomfs-cover --debug verify $MP | grep "OK (verified on read)"
+    atomfs-cover --debug list | grep "$MP.*ok"
+
+    atomfs-cover --debug umount $MP
+    [ -z "\$(atomfs-cover list)" ]
+    rm -rf $ATOMFS_TEST_RUN_DIR/meta
+EOF
+}
@@ -0,0 +1,42 @@
+load helpers
+load test_helper/bats-support/load
+load test_helper/bats-assert/load
+load test_helper/bats-file/load
+
+function setup_file() {
+    build_image_at $BATS_SUITE_TMPDIR
+}
+
+@test "inspect checks every atom of an image" {
+    run atomfs-cover --debug inspect ${BATS_SUITE_TMPDIR}/oci:test-squashfs
+    assert_success
+    assert_output --partial "type:          squashfs"
+    assert_output --partial "hash algorithm:  sha256"
+    assert_output --partial "annotation:      matches"
+    refute_output --partial "problem:"
+}
+
+@test "inspect a single blob" {
+    manifest=$(cat ${BATS_SUITE_TMPDIR}/oci/index.json | jq -r .manifests[0].digest | cut -f2 -d:)
+    layer=$(cat ${BATS_SUITE_TMPDIR}/oci/blobs/sha256/$manifest | jq -r .layers[0].digest | cut -f2 -d:)
+    run atomfs-cover --debug inspect ${BATS_SUITE_TMPDIR}/oci/blobs/sha256/$layer
+    assert_success
+    assert_output --partial "verity offset:"
+}
+
+@test "inspect notices a corrupted atom" {
+    cp -r ${BATS_SUITE_TMPDIR}/oci ${BATS_SUITE_TMPDIR}/oci-corrupt
+    manifest=$(cat ${BATS_SUITE_TMPDIR}/oci-corrupt/index.json | jq -r .manifests[0].digest | cut -f2 -d:)
+    layer=$(cat ${BATS_SUITE_TMPDIR}/oci-corrupt/blobs/sha256/$manifest | jq -r .layers[0].digest | cut -f2 -d:)
+    printf 'x' | dd of=${BATS_SUITE_TMPDIR}/oci-corrupt/blobs/sha256/$layer bs=1 seek=100 conv=notrunc
+    run atomfs-cover inspect ${BATS_SUITE_TMPDIR}/oci-corrupt:test-squashfs
+    assert_failure
+    assert_output --partial "problem:"
+}
+
+@test "backends lists the built-in filesystems" {
+    run atomfs-cover backends
+    assert_success
+    assert_line --regexp "^erofs	pure-go reader: yes	extractors: .*goerofs"
+    assert_line --regexp "^squashfs	pure-go reader: yes	extractors: .*gosquash"
+}
@@ -0,0 +1,54 @@
+load helpers
+load test_helper/bats-support/load
+load test_helper/bats-assert/load
+load test_helper/bats-file/load
+
+function setup_file() {
+    build_image_at $BATS_SUITE_TMPDIR
+}
+
+function setup() {
+    cp -a ${BATS_SUITE_TMPDIR}/oci ${BATS_TEST_TMPDIR}/oci
+    echo orphan > ${BATS_TEST_TMPDIR}/orphan
+    ORPHAN=${BATS_TEST_TMPDIR}/oci/blobs/sha256/$(sha256sum ${BATS_TEST_TMPDIR}/orphan | cut -d' ' -f1)
+    mv ${BATS_TEST_TMPDIR}/orphan $ORPHAN
+}
+
+@test "layout gc removes only unreferenced blobs" {
+    run atomfs-cover --debug layout gc --dry-run ${BATS_TEST_TMPDIR}/oci
+    assert_success
+    assert_output --partial "would remove $ORPHAN"
+    assert_file_exists $ORPHAN
+
+    run atomfs-cover --debug layout gc ${BATS_TEST_TMPDIR}/oci
+    assert_success
+    assert_output --partial "removed $ORPHAN"
+    assert_file_not_exists $ORPHAN
+
+    run atomfs-cover --debug ls ${BATS_TEST_TMPDIR}/oci:test-squashfs
+    assert_success
+    assert_output --partial "random.txt"
+}
+
+@test "layout gc --keep-tag untags the other images" {
+    run atomfs-cover --debug layout gc --keep-tag 'test_base-*' ${BATS_TEST_TMPDIR}/oci
+    assert_success
+    assert_output --partial "untagged test-squashfs"
+
+    run atomfs-cover --debug ls ${BATS_TEST_TMPDIR}/oci:test_base-squashfs
+    assert_success
+    run atomfs-cover --debug ls ${BATS_TEST_TMPDIR}/oci:test-squashfs
+    assert_failure
+}
+
+@test "layout dedupe links identical blobs to the store" {
+    cp -a ${BATS_SUITE_TMPDIR}/oci ${BATS_TEST_TMPDIR}/oci2
+    run atomfs-cover --debug layout dedupe --store ${BATS_TEST_TMPDIR}/store ${BATS_TEST_TMPDIR}/oci ${BATS_TEST_TMPDIR}/oci2
+    assert_success
+    assert_output --partial "stored ${BATS_TEST_TMPDIR}/store/sha256/"
+    assert_output --partial "linked ${BATS_TEST_TMPDIR}/oci2/blobs/sha256/"
+
+    run atomfs-cover --debug ls ${BATS_TEST_TMPDIR}/oci2:test-squashfs
+    assert_success
+    assert_output --partial "random.txt"
+}
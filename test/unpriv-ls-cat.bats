@@ -0,0 +1,33 @@
+load helpers
+load test_helper/bats-support/load
+load test_helper/bats-assert/load
+load test_helper/bats-file/load
+
+function setup_file() {
+    build_image_at $BATS_SUITE_TMPDIR
+}
+
+@test "ls lists the merged image without mounting" {
+    run atomfs-cover --debug ls ${BATS_SUITE_TMPDIR}/oci:test-squashfs
+    assert_success
+    assert_output --partial "1.README.md"
+    assert_output --partial "random.txt"
+}
+
+@test "ls --per-layer shows which atom provides each entry" {
+    run atomfs-cover --debug ls --per-layer ${BATS_SUITE_TMPDIR}/oci:test-squashfs:/
+    assert_success
+    readme_atom=$(echo "$output" | grep 1.README.md | cut -d' ' -f1)
+    random_atom=$(echo "$output" | grep random.txt | cut -d' ' -f1)
+    [ -n "$readme_atom" ]
+    [ "$readme_atom" != "$random_atom" ]
+}
+
+@test "cat prints a file without mounting" {
+    run atomfs-cover --debug cat ${BATS_SUITE_TMPDIR}/oci:test-squashfs:/1.README.md
+    assert_success
+    assert_output "$(cat "$(dirname "$BATS_TEST_FILENAME")/1.README.md")"
+
+    run atomfs-cover --debug cat ${BATS_SUITE_TMPDIR}/oci:test-squashfs:/nope
+    assert_failure
+}
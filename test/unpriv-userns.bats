@@ -0,0 +1,48 @@
+load helpers
+load test_helper/bats-support/load
+load test_helper/bats-assert/load
+load test_helper/bats-file/load
+
+function setup_file() {
+    build_image_at $BATS_SUITE_TMPDIR
+}
+
+function setup() {
+    export MP=${BATS_TEST_TMPDIR}/testmountpoint
+    export META_DIR=${BATS_TEST_TMPDIR}/metadir
+    mkdir -p $MP $META_DIR
+}
+
+@test "run mounts the image in a user namespace for the command" {
+    run atomfs-cover --debug run --metadir=$META_DIR ${BATS_SUITE_TMPDIR}/oci:test-squashfs $MP cat $MP/1.README.md
+    assert_success
+    assert_output --partial "$(cat "$(dirname "$BATS_TEST_FILENAME")/1.README.md")"
+
+    # nothing is left mounted or recorded
+    [ -z "$(ls -A $MP)" ]
+    [ -z "$(find $META_DIR -mindepth 3)" ]
+}
+
+@test "run passes on the command's exit status" {
+    run atomfs-cover --debug run --metadir=$META_DIR ${BATS_SUITE_TMPDIR}/oci:test-squashfs $MP sh -c "exit 7"
+    assert_failure 7
+}
+
+@test "mount --userns keeps the mount until umount" {
+    run atomfs-cover --debug mount --userns --metadir=$META_DIR ${BATS_SUITE_TMPDIR}/oci:test-squashfs $MP
+    assert_success
+    assert_output --partial "nsenter"
+
+    # only visible in the holder's namespaces
+    [ -z "$(ls -A $MP)" ]
+    pid=$(cat $META_DIR/meta/*/*testmountpoint/userns.pid)
+    [ -f /proc/$pid/root/$MP/1.README.md ]
+
+    run atomfs-cover --debug mount --userns --metadir=$META_DIR ${BATS_SUITE_TMPDIR}/oci:test-squashfs $MP
+    assert_failure
+    assert_output --partial "already mounted"
+
+    atomfs-cover --debug umount --metadir=$META_DIR $MP
+    ! grep -q userns-hold /proc/$pid/cmdline
+    [ -z "$(find $META_DIR -mindepth 3)" ]
+}